@@ -0,0 +1,156 @@
+// Package asl models Amazon States Language (ASL) state machine definitions
+// so that the Step Functions workflows driving the cwl handlers can be
+// built, validated and versioned alongside the handlers themselves.
+package asl
+
+import "encoding/json"
+
+// state types
+const (
+	TypeTask     = "Task"
+	TypePass     = "Pass"
+	TypeWait     = "Wait"
+	TypeChoice   = "Choice"
+	TypeParallel = "Parallel"
+	TypeSucceed  = "Succeed"
+	TypeFail     = "Fail"
+)
+
+// predefined error names
+const (
+	ErrorAll             = "States.ALL"
+	ErrorTimeout         = "States.Timeout"
+	ErrorTaskFailed      = "States.TaskFailed"
+	ErrorRuntime         = "States.Runtime"
+	ErrorNoChoice        = "States.NoChoiceMatched"
+	ErrorBranchFailed    = "States.BranchFailed"
+	ErrorParameterPath   = "States.ParameterPathFailure"
+	ErrorResultPathMatch = "States.ResultPathMatchFailure"
+)
+
+// StateMachine is a state machine definition, or a branch of a Parallel
+// state.
+type StateMachine struct {
+	Comment        string            `json:"Comment,omitempty"`
+	StartAt        string            `json:"StartAt"`
+	TimeoutSeconds int               `json:"TimeoutSeconds,omitempty"`
+	States         map[string]*State `json:"States"`
+}
+
+// State is a single state.  The fields that apply depend upon Type.
+type State struct {
+	Type    string `json:"Type"`
+	Comment string `json:"Comment,omitempty"`
+
+	// transitions
+	Next string `json:"Next,omitempty"`
+	End  bool   `json:"End,omitempty"`
+
+	// input and output processing
+	InputPath  string                 `json:"InputPath,omitempty"`
+	Parameters map[string]interface{} `json:"Parameters,omitempty"`
+	ResultPath string                 `json:"ResultPath,omitempty"`
+	OutputPath string                 `json:"OutputPath,omitempty"`
+
+	// Task
+	Resource         string     `json:"Resource,omitempty"`
+	TimeoutSeconds   int        `json:"TimeoutSeconds,omitempty"`
+	HeartbeatSeconds int        `json:"HeartbeatSeconds,omitempty"`
+	Retry            []*Retrier `json:"Retry,omitempty"`
+	Catch            []*Catcher `json:"Catch,omitempty"`
+
+	// Pass
+	Result interface{} `json:"Result,omitempty"`
+
+	// Wait
+	Seconds       int    `json:"Seconds,omitempty"`
+	SecondsPath   string `json:"SecondsPath,omitempty"`
+	Timestamp     string `json:"Timestamp,omitempty"`
+	TimestampPath string `json:"TimestampPath,omitempty"`
+
+	// Choice
+	Choices []*ChoiceRule `json:"Choices,omitempty"`
+	Default string        `json:"Default,omitempty"`
+
+	// Parallel
+	Branches []*StateMachine `json:"Branches,omitempty"`
+
+	// Fail
+	Error string `json:"Error,omitempty"`
+	Cause string `json:"Cause,omitempty"`
+}
+
+// Retrier describes the retry policy applied to a Task or Parallel state
+// for the errors named in ErrorEquals.
+type Retrier struct {
+	ErrorEquals     []string `json:"ErrorEquals"`
+	IntervalSeconds int      `json:"IntervalSeconds,omitempty"`
+	MaxAttempts     *int     `json:"MaxAttempts,omitempty"`
+	BackoffRate     float64  `json:"BackoffRate,omitempty"`
+}
+
+// Catcher transitions to a fallback state when a Task or Parallel state
+// fails with one of the errors named in ErrorEquals.
+type Catcher struct {
+	ErrorEquals []string `json:"ErrorEquals"`
+	ResultPath  string   `json:"ResultPath,omitempty"`
+	Next        string   `json:"Next"`
+}
+
+// ChoiceRule is a rule of a Choice state.  A top-level rule has a Next
+// state; nested rules within And, Or and Not do not.
+type ChoiceRule struct {
+	Variable string `json:"Variable,omitempty"`
+
+	StringEquals             *string  `json:"StringEquals,omitempty"`
+	StringLessThan           *string  `json:"StringLessThan,omitempty"`
+	StringGreaterThan        *string  `json:"StringGreaterThan,omitempty"`
+	StringMatches            *string  `json:"StringMatches,omitempty"`
+	NumericEquals            *float64 `json:"NumericEquals,omitempty"`
+	NumericLessThan          *float64 `json:"NumericLessThan,omitempty"`
+	NumericGreaterThan       *float64 `json:"NumericGreaterThan,omitempty"`
+	NumericLessThanEquals    *float64 `json:"NumericLessThanEquals,omitempty"`
+	NumericGreaterThanEquals *float64 `json:"NumericGreaterThanEquals,omitempty"`
+	BooleanEquals            *bool    `json:"BooleanEquals,omitempty"`
+	IsPresent                *bool    `json:"IsPresent,omitempty"`
+	IsNull                   *bool    `json:"IsNull,omitempty"`
+
+	And []*ChoiceRule `json:"And,omitempty"`
+	Or  []*ChoiceRule `json:"Or,omitempty"`
+	Not *ChoiceRule   `json:"Not,omitempty"`
+
+	Next string `json:"Next,omitempty"`
+}
+
+// JSON returns the indented JSON encoding of the state machine definition.
+func (sm *StateMachine) JSON() ([]byte, error) {
+	b, err := json.MarshalIndent(sm, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// Parse decodes and validates a JSON state machine definition.
+func Parse(b []byte) (*StateMachine, error) {
+	sm := &StateMachine{}
+	if err := json.Unmarshal(b, sm); err != nil {
+		return nil, err
+	}
+	if err := sm.Validate(); err != nil {
+		return nil, err
+	}
+	return sm, nil
+}
+
+// String returns a pointer to s, for use in ChoiceRule comparisons.
+func String(s string) *string { return &s }
+
+// Number returns a pointer to n, for use in ChoiceRule comparisons.
+func Number(n float64) *float64 { return &n }
+
+// Bool returns a pointer to b, for use in ChoiceRule comparisons.
+func Bool(b bool) *bool { return &b }
+
+// Int returns a pointer to i, for use in Retrier.MaxAttempts.
+func Int(i int) *int { return &i }
@@ -0,0 +1,68 @@
+package asl
+
+//go:generate go run ../cmd/cwl asl -o ../statemachine/batchjob.asl.json
+
+// state names of the Batch job workflow
+const (
+	BatchSubmitJob      = "Submit Job"
+	BatchWait           = "Wait X Seconds"
+	BatchGetJobStatus   = "Get Job Status"
+	BatchJobComplete    = "Job Complete?"
+	BatchJobFailed      = "Job Failed"
+	BatchGetFinalStatus = "Get Final Job Status"
+)
+
+// BatchJob returns the definition of the workflow that submits an AWS Batch
+// job with SubmitJobFunc3 and polls its status with CheckJobFunc3 until the
+// job succeeds or fails.  submitArn and checkArn are the ARNs (or template
+// substitution variables) of the two functions.
+//
+// The execution input is a cwl.JobEvent.  SubmitJobFunc3 returns the job-id
+// as a cwl.JobGuid, which is mapped to "ResultPath": "$.guid".  The workflow
+// then waits for "wait_time" seconds and passes $.guid to CheckJobFunc3,
+// whose job status result is mapped to "ResultPath": "$.status".
+func BatchJob(submitArn, checkArn string) *StateMachine {
+	return &StateMachine{
+		Comment: "Submit an AWS Batch job and poll for its completion",
+		StartAt: BatchSubmitJob,
+		States: map[string]*State{
+			BatchSubmitJob: {
+				Type:       TypeTask,
+				Resource:   submitArn,
+				ResultPath: "$.guid",
+				Next:       BatchWait,
+			},
+			BatchWait: {
+				Type:        TypeWait,
+				SecondsPath: "$.wait_time",
+				Next:        BatchGetJobStatus,
+			},
+			BatchGetJobStatus: {
+				Type:       TypeTask,
+				Resource:   checkArn,
+				InputPath:  "$.guid",
+				ResultPath: "$.status",
+				Next:       BatchJobComplete,
+			},
+			BatchJobComplete: {
+				Type: TypeChoice,
+				Choices: []*ChoiceRule{
+					{Variable: "$.status", StringEquals: String("FAILED"), Next: BatchJobFailed},
+					{Variable: "$.status", StringEquals: String("SUCCEEDED"), Next: BatchGetFinalStatus},
+				},
+				Default: BatchWait,
+			},
+			BatchJobFailed: {
+				Type:  TypeFail,
+				Cause: "AWS Batch Job Failed",
+				Error: "DescribeJob returned FAILED",
+			},
+			BatchGetFinalStatus: {
+				Type:      TypeTask,
+				Resource:  checkArn,
+				InputPath: "$.guid",
+				End:       true,
+			},
+		},
+	}
+}
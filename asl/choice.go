@@ -0,0 +1,93 @@
+package asl
+
+import "strings"
+
+// matches reports whether the choice rule r matches input.
+func (r *ChoiceRule) matches(input interface{}) (bool, error) {
+	switch {
+	case len(r.And) > 0:
+		for _, sub := range r.And {
+			ok, err := sub.matches(input)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case len(r.Or) > 0:
+		for _, sub := range r.Or {
+			ok, err := sub.matches(input)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case r.Not != nil:
+		ok, err := r.Not.matches(input)
+		return !ok, err
+	}
+
+	v, err := selectPath(input, r.Variable)
+	if r.IsPresent != nil {
+		return (err == nil) == *r.IsPresent, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if r.IsNull != nil {
+		return (v == nil) == *r.IsNull, nil
+	}
+
+	// comparisons of mismatched types do not match, rather than failing
+	if s, ok := v.(string); ok {
+		switch {
+		case r.StringEquals != nil:
+			return s == *r.StringEquals, nil
+		case r.StringLessThan != nil:
+			return s < *r.StringLessThan, nil
+		case r.StringGreaterThan != nil:
+			return s > *r.StringGreaterThan, nil
+		case r.StringMatches != nil:
+			return wildcardMatch(*r.StringMatches, s), nil
+		}
+	}
+	if n, ok := v.(float64); ok {
+		switch {
+		case r.NumericEquals != nil:
+			return n == *r.NumericEquals, nil
+		case r.NumericLessThan != nil:
+			return n < *r.NumericLessThan, nil
+		case r.NumericGreaterThan != nil:
+			return n > *r.NumericGreaterThan, nil
+		case r.NumericLessThanEquals != nil:
+			return n <= *r.NumericLessThanEquals, nil
+		case r.NumericGreaterThanEquals != nil:
+			return n >= *r.NumericGreaterThanEquals, nil
+		}
+	}
+	if b, ok := v.(bool); ok && r.BooleanEquals != nil {
+		return b == *r.BooleanEquals, nil
+	}
+	return false, nil
+}
+
+// wildcardMatch matches s against a StringMatches pattern in which "*"
+// matches any sequence of characters and "\*" a literal asterisk.
+func wildcardMatch(pattern, s string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+	if strings.HasPrefix(pattern, "*") {
+		for i := 0; i <= len(s); i++ {
+			if wildcardMatch(pattern[1:], s[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	c := pattern[:1]
+	rest := pattern[1:]
+	if strings.HasPrefix(pattern, `\*`) || strings.HasPrefix(pattern, `\\`) {
+		c, rest = pattern[1:2], pattern[2:]
+	}
+	return strings.HasPrefix(s, c) && wildcardMatch(rest, s[1:])
+}
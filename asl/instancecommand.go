@@ -0,0 +1,63 @@
+package asl
+
+//go:generate go run ../cmd/cwl asl -workflow instance-command -o ../statemachine/instancecommand.asl.json
+
+// state names of the instance command workflow
+const (
+	InstanceStart = "Start Instances"
+	InstanceRun   = "Run Command"
+)
+
+// lambdaCallback is the Resource of Task states that invoke a Lambda
+// function and wait for the task token to be returned.
+const lambdaCallback = "arn:aws:states:::lambda:invoke.waitForTaskToken"
+
+// InstanceCommand returns the definition of the workflow that starts EC2
+// instances with EC2InstancesStartCallback and then runs a command on them
+// with EC2IssueCmdCallback.  startArn and issueArn are the ARNs (or template
+// substitution variables) of the two functions.
+//
+// Rather than polling with Wait states, each Task passes its task token to
+// the function and waits for CallbackCompletion to return the token when
+// EventBridge reports that the instances are running, or that the command
+// has finished.  The execution input is {"instances": [...], "cmd": "..."}.
+// The execution ARN is passed to the functions for their audit records.
+func InstanceCommand(startArn, issueArn string) *StateMachine {
+	return &StateMachine{
+		Comment: "Start EC2 instances and run a command on them, waiting for completion events",
+		StartAt: InstanceStart,
+		States: map[string]*State{
+			InstanceStart: {
+				Type:     TypeTask,
+				Resource: lambdaCallback,
+				Parameters: map[string]interface{}{
+					"FunctionName": startArn,
+					"Payload": map[string]interface{}{
+						"instances.$":    "$.instances",
+						"taskToken.$":    "$$.Task.Token",
+						"executionArn.$": "$$.Execution.Id",
+					},
+				},
+				ResultPath:     "$.started",
+				TimeoutSeconds: 600,
+				Next:           InstanceRun,
+			},
+			InstanceRun: {
+				Type:     TypeTask,
+				Resource: lambdaCallback,
+				Parameters: map[string]interface{}{
+					"FunctionName": issueArn,
+					"Payload": map[string]interface{}{
+						"instances.$":    "$.instances",
+						"cmd.$":          "$.cmd",
+						"taskToken.$":    "$$.Task.Token",
+						"executionArn.$": "$$.Execution.Id",
+					},
+				},
+				ResultPath:     "$.command",
+				TimeoutSeconds: 900,
+				End:            true,
+			},
+		},
+	}
+}
@@ -0,0 +1,593 @@
+package asl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// execution statuses
+const (
+	StatusSucceeded = "SUCCEEDED"
+	StatusFailed    = "FAILED"
+)
+
+// history event types
+const (
+	EventStateEntered  = "StateEntered"
+	EventStateExited   = "StateExited"
+	EventTaskSucceeded = "TaskSucceeded"
+	EventTaskFailed    = "TaskFailed"
+	EventRetry         = "Retry"
+	EventCaught        = "Caught"
+	EventWait          = "Wait"
+)
+
+// defaultMaxTransitions bounds the number of state transitions of an
+// execution, so that a definition that loops forever fails rather than
+// hanging a test.  It matches the Step Functions execution history limit.
+const defaultMaxTransitions = 25000
+
+// TaskFunc performs the work of a Task state.  resource is the Resource of
+// the state and input its effective input; the result must be JSON.  A
+// *TaskError may be returned to fail the state with a named error; any
+// other error fails it with States.TaskFailed.
+type TaskFunc func(ctx context.Context, resource string, input []byte) ([]byte, error)
+
+// TaskError is the error returned by a TaskFunc to fail a Task state with
+// the given error name and cause.
+type TaskError struct {
+	Name  string
+	Cause string
+}
+
+func (e *TaskError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Cause)
+}
+
+// Interpreter runs state machine definitions locally.  It supports the
+// Task, Pass, Wait, Choice, Parallel, Succeed and Fail states, Retry and
+// Catch, and the InputPath, Parameters, ResultPath and OutputPath fields.
+type Interpreter struct {
+	// Task performs the work of Task states.
+	Task TaskFunc
+
+	// Clock is used for Wait states and retry intervals; the default is
+	// the system clock.  Use a VirtualClock to run workflows instantly.
+	Clock Clock
+
+	// MaxTransitions limits the number of state transitions in an
+	// execution; the default is 25000.
+	MaxTransitions int
+}
+
+// Event is an entry in the history of an execution.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	State  string    `json:"state"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Execution is the result of running a state machine.  ID is a local
+// execution ARN, available to the definition as $$.Execution.Id.
+type Execution struct {
+	ID        string          `json:"id"`
+	Status    string          `json:"status"`
+	Output    json.RawMessage `json:"output,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Cause     string          `json:"cause,omitempty"`
+	StartTime time.Time       `json:"startTime"`
+	StopTime  time.Time       `json:"stopTime"`
+	History   []Event         `json:"history"`
+
+	mu sync.Mutex
+}
+
+// Visits returns the number of times the named state was entered.
+func (e *Execution) Visits(state string) int {
+	n := 0
+	for _, ev := range e.History {
+		if ev.Type == EventStateEntered && ev.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// stateError is a named error raised while running a state, which may be
+// handled by a Retry or Catch field.
+type stateError struct {
+	name  string
+	cause string
+}
+
+func (e *stateError) Error() string {
+	return fmt.Sprintf("%s: %s", e.name, e.cause)
+}
+
+func runtimeErr(format string, args ...interface{}) *stateError {
+	return &stateError{name: ErrorRuntime, cause: fmt.Sprintf(format, args...)}
+}
+
+// runner holds the state of a single execution.
+type runner struct {
+	in          *Interpreter
+	clock       Clock
+	exec        *Execution
+	input       interface{}
+	mu          sync.Mutex
+	transitions int
+}
+
+// Run validates sm and executes it with the given JSON input.  A failed
+// execution is reported through the Status, Error and Cause of the returned
+// Execution; an error is returned only if the definition or input is
+// invalid or ctx is cancelled.
+func (in *Interpreter) Run(ctx context.Context, sm *StateMachine, input []byte) (*Execution, error) {
+	if err := sm.Validate(); err != nil {
+		return nil, err
+	}
+	if len(input) == 0 {
+		input = []byte("{}")
+	}
+	var v interface{}
+	if err := json.Unmarshal(input, &v); err != nil {
+		return nil, fmt.Errorf("invalid execution input: %v", err)
+	}
+
+	r := &runner{in: in, clock: in.Clock, input: v}
+	if r.clock == nil {
+		r.clock = RealClock{}
+	}
+	r.exec = &Execution{StartTime: r.clock.Now()}
+	r.exec.ID = fmt.Sprintf("arn:aws:states:local:000000000000:execution:local:%d", r.exec.StartTime.UnixNano())
+
+	if sm.TimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(sm.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+
+	out, err := r.machine(ctx, sm, v)
+	r.exec.StopTime = r.clock.Now()
+	var serr *stateError
+	switch {
+	case errors.As(err, &serr):
+		r.exec.Status = StatusFailed
+		r.exec.Error = serr.name
+		r.exec.Cause = serr.cause
+	case err != nil:
+		return r.exec, err
+	default:
+		r.exec.Status = StatusSucceeded
+		if r.exec.Output, err = json.Marshal(out); err != nil {
+			return r.exec, err
+		}
+	}
+	return r.exec, nil
+}
+
+// record appends an event to the execution history.
+func (r *runner) record(typ, state, detail string) {
+	r.exec.mu.Lock()
+	defer r.exec.mu.Unlock()
+	r.exec.History = append(r.exec.History, Event{Time: r.clock.Now(), Type: typ, State: state, Detail: detail})
+}
+
+// machine runs a state machine or Parallel branch from StartAt until a
+// terminal state is reached.
+func (r *runner) machine(ctx context.Context, sm *StateMachine, input interface{}) (interface{}, error) {
+	max := r.in.MaxTransitions
+	if max <= 0 {
+		max = defaultMaxTransitions
+	}
+	name := sm.StartAt
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		r.transitions++
+		n := r.transitions
+		r.mu.Unlock()
+		if n > max {
+			return nil, runtimeErr("execution exceeded %d state transitions", max)
+		}
+
+		st := sm.States[name]
+		r.record(EventStateEntered, name, "")
+		out, next, err := r.state(ctx, name, st, input)
+		if err != nil {
+			return nil, err
+		}
+		r.record(EventStateExited, name, "")
+		if next == "" {
+			return out, nil
+		}
+		name, input = next, out
+	}
+}
+
+// state runs a single state, returning its output and the name of the next
+// state, which is empty if the state is terminal.
+func (r *runner) state(ctx context.Context, name string, st *State, input interface{}) (interface{}, string, error) {
+	next := st.Next
+	if st.End {
+		next = ""
+	}
+
+	switch st.Type {
+	case TypeSucceed:
+		out, err := r.filter(st, input)
+		return out, "", err
+
+	case TypeFail:
+		return nil, "", &stateError{name: st.Error, cause: st.Cause}
+
+	case TypeChoice:
+		effective, err := r.selectInput(st, input)
+		if err != nil {
+			return nil, "", err
+		}
+		target := st.Default
+		for _, rule := range st.Choices {
+			ok, err := rule.matches(effective)
+			if err != nil {
+				return nil, "", runtimeErr("%s: %v", name, err)
+			}
+			if ok {
+				target = rule.Next
+				break
+			}
+		}
+		if target == "" {
+			return nil, "", &stateError{name: ErrorNoChoice, cause: fmt.Sprintf("no choice rule of state %q matched the input", name)}
+		}
+		out, err := r.outputPath(st, effective)
+		return out, target, err
+
+	case TypeWait:
+		d, err := r.waitDuration(st, input)
+		if err != nil {
+			return nil, "", err
+		}
+		r.record(EventWait, name, d.String())
+		if err := r.clock.Sleep(ctx, d); err != nil {
+			return nil, "", err
+		}
+		out, err := r.filter(st, input)
+		return out, next, err
+
+	case TypePass:
+		effective, err := r.effectiveInput(st, name, input)
+		if err != nil {
+			return nil, "", err
+		}
+		result := effective
+		if st.Result != nil {
+			result = st.Result
+		}
+		out, err := r.output(st, input, result)
+		return out, next, err
+
+	case TypeTask, TypeParallel:
+		effective, err := r.effectiveInput(st, name, input)
+		if err != nil {
+			return nil, "", err
+		}
+		return r.withErrorHandling(ctx, name, st, input, func() (interface{}, error) {
+			if st.Type == TypeTask {
+				return r.task(ctx, name, st, effective)
+			}
+			return r.parallel(ctx, st, effective)
+		})
+	}
+	return nil, "", runtimeErr("%s: unsupported state type %q", name, st.Type)
+}
+
+// withErrorHandling runs do, applying the Retry and Catch fields of st to
+// any error it raises.
+func (r *runner) withErrorHandling(ctx context.Context, name string, st *State, input interface{}, do func() (interface{}, error)) (interface{}, string, error) {
+	attempts := make([]int, len(st.Retry))
+	for {
+		result, err := do()
+		if err == nil {
+			out, err := r.output(st, input, result)
+			return out, st.Next, err
+		}
+		var serr *stateError
+		if !errors.As(err, &serr) {
+			return nil, "", err
+		}
+
+		if i := matchRetrier(st.Retry, serr.name); i >= 0 {
+			rt := st.Retry[i]
+			max := 3
+			if rt.MaxAttempts != nil {
+				max = *rt.MaxAttempts
+			}
+			if attempts[i] < max {
+				interval := float64(rt.IntervalSeconds)
+				if interval == 0 {
+					interval = 1
+				}
+				backoff := rt.BackoffRate
+				if backoff == 0 {
+					backoff = 2
+				}
+				d := time.Duration(interval * math.Pow(backoff, float64(attempts[i])) * float64(time.Second))
+				attempts[i]++
+				r.record(EventRetry, name, fmt.Sprintf("%s; attempt %d after %v", serr.name, attempts[i], d))
+				if err := r.clock.Sleep(ctx, d); err != nil {
+					return nil, "", err
+				}
+				continue
+			}
+		}
+
+		for _, c := range st.Catch {
+			if !errorMatches(c.ErrorEquals, serr.name) {
+				continue
+			}
+			r.record(EventCaught, name, serr.name)
+			rp := c.ResultPath
+			if rp == "" {
+				rp = "$"
+			}
+			out, err := setPath(input, rp, map[string]interface{}{"Error": serr.name, "Cause": serr.cause})
+			if err != nil {
+				return nil, "", &stateError{name: ErrorResultPathMatch, cause: err.Error()}
+			}
+			return out, c.Next, nil
+		}
+		return nil, "", serr
+	}
+}
+
+// matchRetrier returns the index of the first retrier matching the error,
+// or -1.
+func matchRetrier(retry []*Retrier, name string) int {
+	for i, rt := range retry {
+		if errorMatches(rt.ErrorEquals, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// errorMatches reports whether an ErrorEquals list matches the error name.
+// States.ALL matches any error other than States.Runtime, and
+// States.TaskFailed any error other than States.Timeout.
+func errorMatches(errs []string, name string) bool {
+	for _, e := range errs {
+		switch {
+		case e == name:
+			return true
+		case e == ErrorAll && name != ErrorRuntime:
+			return true
+		case e == ErrorTaskFailed && name != ErrorTimeout && name != ErrorRuntime:
+			return true
+		}
+	}
+	return false
+}
+
+// task invokes the TaskFunc of the interpreter for a Task state.
+func (r *runner) task(ctx context.Context, name string, st *State, input interface{}) (interface{}, error) {
+	if r.in.Task == nil {
+		return nil, runtimeErr("%s: no TaskFunc configured for resource %s", name, st.Resource)
+	}
+	b, err := json.Marshal(input)
+	if err != nil {
+		return nil, runtimeErr("%s: %v", name, err)
+	}
+
+	tctx := ctx
+	if st.TimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		tctx, cancel = context.WithTimeout(ctx, time.Duration(st.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	res, err := r.in.Task(tctx, st.Resource, b)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var terr *TaskError
+		switch {
+		case errors.As(err, &terr):
+			r.record(EventTaskFailed, name, terr.Name)
+			return nil, &stateError{name: terr.Name, cause: terr.Cause}
+		case tctx.Err() != nil:
+			r.record(EventTaskFailed, name, ErrorTimeout)
+			return nil, &stateError{name: ErrorTimeout, cause: fmt.Sprintf("task did not complete within %d seconds", st.TimeoutSeconds)}
+		}
+		r.record(EventTaskFailed, name, ErrorTaskFailed)
+		return nil, &stateError{name: ErrorTaskFailed, cause: err.Error()}
+	}
+	r.record(EventTaskSucceeded, name, "")
+
+	var out interface{}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(res, &out); err != nil {
+		return nil, runtimeErr("%s: task result is not valid JSON: %v", name, err)
+	}
+	return out, nil
+}
+
+// parallel runs the branches of a Parallel state and returns an array of
+// their outputs.  With a VirtualClock the branches run one after another,
+// each from the time the state was entered, and the state completes at the
+// time the longest branch completed; otherwise they run concurrently.
+func (r *runner) parallel(ctx context.Context, st *State, input interface{}) (interface{}, error) {
+	results := make([]interface{}, len(st.Branches))
+	errs := make([]error, len(st.Branches))
+
+	if vc, ok := r.clock.(*VirtualClock); ok {
+		start, end := vc.Now(), vc.Now()
+		for i, b := range st.Branches {
+			vc.set(start)
+			results[i], errs[i] = r.machine(ctx, b, input)
+			if vc.Now().After(end) {
+				end = vc.Now()
+			}
+			if errs[i] != nil {
+				break
+			}
+		}
+		vc.set(end)
+	} else {
+		bctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var wg sync.WaitGroup
+		for i, b := range st.Branches {
+			wg.Add(1)
+			go func(i int, b *StateMachine) {
+				defer wg.Done()
+				results[i], errs[i] = r.machine(bctx, b, input)
+				if errs[i] != nil {
+					cancel() // a failed branch stops the others
+				}
+			}(i, b)
+		}
+		wg.Wait()
+	}
+
+	// report the first branch error other than the cancellation of the
+	// remaining branches
+	var first error
+	for _, err := range errs {
+		var serr *stateError
+		if errors.As(err, &serr) {
+			return nil, serr
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		return nil, first
+	}
+	return results, nil
+}
+
+// waitDuration returns the time a Wait state should wait.
+func (r *runner) waitDuration(st *State, input interface{}) (time.Duration, error) {
+	var until time.Time
+	switch {
+	case st.Seconds > 0:
+		return time.Duration(st.Seconds) * time.Second, nil
+	case st.SecondsPath != "":
+		v, err := selectPath(input, st.SecondsPath)
+		if err != nil {
+			return 0, &stateError{name: ErrorRuntime, cause: err.Error()}
+		}
+		n, ok := v.(float64)
+		if !ok || n < 0 {
+			return 0, runtimeErr("SecondsPath %s must select a non-negative number", st.SecondsPath)
+		}
+		return time.Duration(n * float64(time.Second)), nil
+	case st.Timestamp != "":
+		t, err := time.Parse(time.RFC3339, st.Timestamp)
+		if err != nil {
+			return 0, runtimeErr("invalid Timestamp: %v", err)
+		}
+		until = t
+	case st.TimestampPath != "":
+		v, err := selectPath(input, st.TimestampPath)
+		if err != nil {
+			return 0, &stateError{name: ErrorRuntime, cause: err.Error()}
+		}
+		s, _ := v.(string)
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return 0, runtimeErr("TimestampPath %s must select an RFC3339 timestamp", st.TimestampPath)
+		}
+		until = t
+	}
+	if d := until.Sub(r.clock.Now()); d > 0 {
+		return d, nil
+	}
+	return 0, nil
+}
+
+// selectInput applies InputPath to the raw input of a state.
+func (r *runner) selectInput(st *State, input interface{}) (interface{}, error) {
+	if st.InputPath == "" {
+		return input, nil
+	}
+	v, err := selectPath(input, st.InputPath)
+	if err != nil {
+		return nil, runtimeErr("InputPath: %v", err)
+	}
+	return v, nil
+}
+
+// effectiveInput applies InputPath and then Parameters to the raw input of
+// a state.
+func (r *runner) effectiveInput(st *State, name string, input interface{}) (interface{}, error) {
+	v, err := r.selectInput(st, input)
+	if err != nil {
+		return nil, err
+	}
+	if st.Parameters == nil {
+		return v, nil
+	}
+	context := map[string]interface{}{
+		"Execution": map[string]interface{}{
+			"Id":        r.exec.ID,
+			"Input":     r.input,
+			"StartTime": r.exec.StartTime.UTC().Format(time.RFC3339),
+		},
+		"State": map[string]interface{}{
+			"Name":        name,
+			"EnteredTime": r.clock.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	p, err := applyParameters(map[string]interface{}(st.Parameters), v, context)
+	if err != nil {
+		return nil, &stateError{name: ErrorParameterPath, cause: err.Error()}
+	}
+	return p, nil
+}
+
+// output applies ResultPath and then OutputPath to produce the output of a
+// state from its raw input and result.
+func (r *runner) output(st *State, input, result interface{}) (interface{}, error) {
+	out := result
+	if st.ResultPath != "" {
+		var err error
+		if out, err = setPath(input, st.ResultPath, result); err != nil {
+			return nil, &stateError{name: ErrorResultPathMatch, cause: err.Error()}
+		}
+	}
+	return r.outputPath(st, out)
+}
+
+// outputPath applies OutputPath to the output of a state.
+func (r *runner) outputPath(st *State, out interface{}) (interface{}, error) {
+	if st.OutputPath == "" {
+		return out, nil
+	}
+	v, err := selectPath(out, st.OutputPath)
+	if err != nil {
+		return nil, runtimeErr("OutputPath: %v", err)
+	}
+	return v, nil
+}
+
+// filter applies InputPath and OutputPath for states without a result.
+func (r *runner) filter(st *State, input interface{}) (interface{}, error) {
+	v, err := r.selectInput(st, input)
+	if err != nil {
+		return nil, err
+	}
+	return r.outputPath(st, v)
+}
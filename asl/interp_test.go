@@ -0,0 +1,276 @@
+package asl_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/1414C/cwl/asl"
+	"github.com/1414C/cwl/awsfake"
+	cwl "github.com/1414C/cwl/handler"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// batchEnv returns an interpreter running the cwl handlers in-process
+// against fake AWS clients that share its virtual clock.
+func batchEnv(t *testing.T) (*asl.Interpreter, *awsfake.State, context.Context) {
+	t.Helper()
+	clock := asl.NewVirtualClock(epoch)
+	st := awsfake.NewState()
+	st.Now = clock.Now
+	st.JobDuration = 5 * time.Minute
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{
+		EC2:   awsfake.NewEC2(st),
+		SSM:   awsfake.NewSSM(st),
+		Batch: awsfake.NewBatch(st),
+	})
+	in := &asl.Interpreter{
+		Task:  asl.LambdaTasks(cwl.NewRouter().InvokeHandler),
+		Clock: clock,
+	}
+	return in, st, ctx
+}
+
+const jobInput = `{"jobName": "my-test-job", "jobDefinition": "def:1", "jobQueue": "queue", "wait_time": 60}`
+
+func TestBatchJobSucceeds(t *testing.T) {
+	in, st, ctx := batchEnv(t)
+	exec, err := in.Run(ctx, asl.BatchJob("${SubmitJobFunc3Arn}", "${CheckJobFunc3Arn}"), []byte(jobInput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exec.Status != asl.StatusSucceeded {
+		t.Fatalf("status %s: %s %s", exec.Status, exec.Error, exec.Cause)
+	}
+	if string(exec.Output) != `"SUCCEEDED"` {
+		t.Errorf("output %s, want \"SUCCEEDED\"", exec.Output)
+	}
+	// the job runs for 5 minutes and is polled every 60 seconds
+	if n := exec.Visits(asl.BatchGetJobStatus); n != 5 {
+		t.Errorf("job status checked %d times, want 5", n)
+	}
+	if d := exec.StopTime.Sub(exec.StartTime); d != 5*time.Minute {
+		t.Errorf("execution took %v of virtual time, want 5m", d)
+	}
+	if jobs := st.Jobs(); len(jobs) != 1 || jobs[0].Name != "my-test-job" {
+		t.Errorf("jobs submitted: %+v", jobs)
+	}
+}
+
+func TestBatchJobFails(t *testing.T) {
+	in, st, ctx := batchEnv(t)
+	st.FailJob("my-test-job", "Essential container in task exited")
+	exec, err := in.Run(ctx, asl.BatchJob("${SubmitJobFunc3Arn}", "${CheckJobFunc3Arn}"), []byte(jobInput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exec.Status != asl.StatusFailed || exec.Error != "DescribeJob returned FAILED" {
+		t.Fatalf("got %s %q, want FAILED with the Fail state error", exec.Status, exec.Error)
+	}
+	if exec.Visits(asl.BatchGetFinalStatus) != 0 {
+		t.Error("final job status retrieved for a failed job")
+	}
+}
+
+func TestBatchJobSubmitError(t *testing.T) {
+	in, _, ctx := batchEnv(t)
+	exec, err := in.Run(ctx, asl.BatchJob("${SubmitJobFunc3Arn}", "${CheckJobFunc3Arn}"), []byte(`{"wait_time": 60}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the event lacks the job's name, queue and definition
+	if exec.Status != asl.StatusFailed || exec.Error != "ValidationError" {
+		t.Fatalf("got %s %q, want FAILED with the Lambda error type", exec.Status, exec.Error)
+	}
+}
+
+// scripted returns a TaskFunc that fails the first n calls with the named
+// error and then returns result.
+func scripted(n int, name, result string) (asl.TaskFunc, *int) {
+	calls := 0
+	return func(ctx context.Context, resource string, input []byte) ([]byte, error) {
+		calls++
+		if calls <= n {
+			return nil, &asl.TaskError{Name: name, Cause: "scripted failure"}
+		}
+		return []byte(result), nil
+	}, &calls
+}
+
+func TestRetry(t *testing.T) {
+	task, calls := scripted(2, "Lambda.ServiceException", `{"ok": true}`)
+	in := &asl.Interpreter{Task: task, Clock: asl.NewVirtualClock(epoch)}
+	sm := &asl.StateMachine{
+		StartAt: "Call",
+		States: map[string]*asl.State{
+			"Call": {
+				Type:     asl.TypeTask,
+				Resource: "fn",
+				Retry: []*asl.Retrier{
+					{ErrorEquals: []string{"Lambda.ServiceException"}, IntervalSeconds: 2, MaxAttempts: asl.Int(3), BackoffRate: 3},
+				},
+				ResultPath: "$.result",
+				End:        true,
+			},
+		},
+	}
+	exec, err := in.Run(context.Background(), sm, []byte(`{"id": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exec.Status != asl.StatusSucceeded || *calls != 3 {
+		t.Fatalf("status %s after %d calls", exec.Status, *calls)
+	}
+	if got := string(exec.Output); got != `{"id":1,"result":{"ok":true}}` {
+		t.Errorf("output %s", got)
+	}
+	// retries after 2s and then 6s
+	if d := exec.StopTime.Sub(exec.StartTime); d != 8*time.Second {
+		t.Errorf("retries took %v, want 8s", d)
+	}
+}
+
+func TestCatch(t *testing.T) {
+	task, _ := scripted(10, "CustomError", `{}`)
+	in := &asl.Interpreter{Task: task, Clock: asl.NewVirtualClock(epoch)}
+	sm := &asl.StateMachine{
+		StartAt: "Call",
+		States: map[string]*asl.State{
+			"Call": {
+				Type:     asl.TypeTask,
+				Resource: "fn",
+				Retry:    []*asl.Retrier{{ErrorEquals: []string{asl.ErrorTimeout}}},
+				Catch:    []*asl.Catcher{{ErrorEquals: []string{asl.ErrorAll}, ResultPath: "$.error", Next: "Handled"}},
+				End:      true,
+			},
+			"Handled": {Type: asl.TypePass, OutputPath: "$.error", End: true},
+		},
+	}
+	exec, err := in.Run(context.Background(), sm, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]string
+	if err := json.Unmarshal(exec.Output, &out); err != nil {
+		t.Fatal(err)
+	}
+	if exec.Status != asl.StatusSucceeded || out["Error"] != "CustomError" || out["Cause"] != "scripted failure" {
+		t.Errorf("got %s %s", exec.Status, exec.Output)
+	}
+}
+
+func TestParallelAndPaths(t *testing.T) {
+	in := &asl.Interpreter{Clock: asl.NewVirtualClock(epoch)}
+	branch := func(seconds int, result string) *asl.StateMachine {
+		return &asl.StateMachine{
+			StartAt: "Wait",
+			States: map[string]*asl.State{
+				"Wait": {Type: asl.TypeWait, Seconds: seconds, Next: "Set"},
+				"Set":  {Type: asl.TypePass, Result: result, End: true},
+			},
+		}
+	}
+	sm := &asl.StateMachine{
+		StartAt: "Prepare",
+		States: map[string]*asl.State{
+			"Prepare": {
+				Type:       asl.TypePass,
+				InputPath:  "$.detail",
+				Parameters: map[string]interface{}{"name.$": "$.items[1]", "fixed": "x"},
+				ResultPath: "$.prepared",
+				Next:       "Both",
+			},
+			"Both": {
+				Type:       asl.TypeParallel,
+				Branches:   []*asl.StateMachine{branch(30, "a"), branch(90, "b")},
+				ResultPath: "$.branches",
+				Next:       "Check",
+			},
+			"Check": {
+				Type: asl.TypeChoice,
+				Choices: []*asl.ChoiceRule{
+					{And: []*asl.ChoiceRule{
+						{Variable: "$.prepared.name", StringMatches: asl.String("sec*")},
+						{Variable: "$.branches[1]", StringEquals: asl.String("b")},
+					}, Next: "Done"},
+				},
+			},
+			"Done": {Type: asl.TypeSucceed, OutputPath: "$.prepared"},
+		},
+	}
+	exec, err := in.Run(context.Background(), sm, []byte(`{"detail": {"items": ["first", "second"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exec.Status != asl.StatusSucceeded {
+		t.Fatalf("status %s: %s %s", exec.Status, exec.Error, exec.Cause)
+	}
+	if got := string(exec.Output); got != `{"fixed":"x","name":"second"}` {
+		t.Errorf("output %s", got)
+	}
+	// the branches run concurrently in virtual time
+	if d := exec.StopTime.Sub(exec.StartTime); d != 90*time.Second {
+		t.Errorf("parallel state took %v, want 90s", d)
+	}
+}
+
+func TestNoChoiceMatched(t *testing.T) {
+	in := &asl.Interpreter{}
+	sm := &asl.StateMachine{
+		StartAt: "Check",
+		States: map[string]*asl.State{
+			"Check": {
+				Type:    asl.TypeChoice,
+				Choices: []*asl.ChoiceRule{{Variable: "$.n", NumericGreaterThan: asl.Number(10), Next: "Big"}},
+			},
+			"Big": {Type: asl.TypeSucceed},
+		},
+	}
+	exec, err := in.Run(context.Background(), sm, []byte(`{"n": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exec.Status != asl.StatusFailed || exec.Error != asl.ErrorNoChoice {
+		t.Errorf("got %s %q, want %s", exec.Status, exec.Error, asl.ErrorNoChoice)
+	}
+}
+
+func TestMaxTransitions(t *testing.T) {
+	in := &asl.Interpreter{Clock: asl.NewVirtualClock(epoch), MaxTransitions: 50}
+	sm := &asl.StateMachine{
+		StartAt: "Loop",
+		States:  map[string]*asl.State{"Loop": {Type: asl.TypeWait, Seconds: 1, Next: "Loop"}},
+	}
+	exec, err := in.Run(context.Background(), sm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exec.Status != asl.StatusFailed || exec.Error != asl.ErrorRuntime {
+		t.Errorf("got %s %q, want %s", exec.Status, exec.Error, asl.ErrorRuntime)
+	}
+}
+
+func TestInvalidDefinition(t *testing.T) {
+	in := &asl.Interpreter{}
+	_, err := in.Run(context.Background(), &asl.StateMachine{StartAt: "Missing"}, nil)
+	var verr *asl.ValidationError
+	if !errors.As(err, &verr) {
+		t.Errorf("got %v, want a *asl.ValidationError", err)
+	}
+}
+
+func TestFunctionName(t *testing.T) {
+	for resource, want := range map[string]string{
+		"${SubmitJobFunc3Arn}": "SubmitJobFunc3",
+		"arn:aws:lambda:us-west-2:123456789012:function:CheckJobFunc3":      "CheckJobFunc3",
+		"arn:aws:lambda:us-west-2:123456789012:function:CheckJobFunc3:live": "CheckJobFunc3",
+		"GetEC2Statuses": "GetEC2Statuses",
+	} {
+		if got := asl.FunctionName(resource); got != want {
+			t.Errorf("FunctionName(%q) = %q, want %q", resource, got, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package asl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// InvokeFunc invokes the Lambda function name with payload, returning the
+// JSON response.  (*cwl.Router).InvokeHandler is an InvokeFunc.
+type InvokeFunc func(ctx context.Context, name string, payload []byte) ([]byte, error)
+
+// LambdaTasks returns a TaskFunc that runs the Lambda functions named by
+// Task resources in-process with invoke.  As with AWS Step Functions, an
+// error returned by a function fails the Task with the error type as the
+// error name, and a Cause holding the Lambda error response.
+func LambdaTasks(invoke InvokeFunc) TaskFunc {
+	return func(ctx context.Context, resource string, input []byte) (out []byte, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = lambdaError(fmt.Errorf("%v", p), "Runtime.Panic")
+			}
+		}()
+		out, err = invoke(ctx, FunctionName(resource), input)
+		if err != nil {
+			return nil, lambdaError(err, "")
+		}
+		return out, nil
+	}
+}
+
+// lambdaError converts an error returned by a function to a *TaskError in
+// the form reported by AWS Step Functions for the Lambda error response.
+func lambdaError(err error, name string) *TaskError {
+	if name == "" {
+		t := reflect.TypeOf(err)
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		name = t.Name()
+	}
+	cause, _ := json.Marshal(struct {
+		ErrorMessage string `json:"errorMessage"`
+		ErrorType    string `json:"errorType"`
+	}{err.Error(), name})
+	return &TaskError{Name: name, Cause: string(cause)}
+}
+
+// FunctionName returns the Lambda function name referred to by a Task
+// resource, which may be a function ARN (optionally qualified by a version
+// or alias), a bare function name, or a definition substitution variable of
+// the form "${<name>Arn}" as used in the cwl SAM template.
+func FunctionName(resource string) string {
+	if strings.HasPrefix(resource, "${") && strings.HasSuffix(resource, "}") {
+		return strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(resource, "${"), "}"), "Arn")
+	}
+	if strings.HasPrefix(resource, "arn:") {
+		// arn:aws:lambda:<region>:<account>:function:<name>[:<qualifier>]
+		parts := strings.Split(resource, ":")
+		if len(parts) >= 7 && parts[5] == "function" {
+			return parts[6]
+		}
+	}
+	return resource
+}
@@ -0,0 +1,172 @@
+package asl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pathStep is a single field name or array index of a reference path.
+type pathStep struct {
+	field string
+	index int
+	isIdx bool
+}
+
+// parsePath parses a reference path of the form $.a.b[0]['c d'].  The
+// leading "$" may be "$$" when selecting from the context object.
+func parsePath(p string) ([]pathStep, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("path %q must begin with \"$\"", p)
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(p, "$"), "$")
+	var steps []pathStep
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			n := strings.IndexAny(rest, ".[")
+			if n < 0 {
+				n = len(rest)
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("path %q has an empty field name", p)
+			}
+			steps = append(steps, pathStep{field: rest[:n]})
+			rest = rest[n:]
+		case strings.HasPrefix(rest, "['"):
+			n := strings.Index(rest, "']")
+			if n < 0 {
+				return nil, fmt.Errorf("path %q has an unterminated field name", p)
+			}
+			steps = append(steps, pathStep{field: rest[2:n]})
+			rest = rest[n+2:]
+		case strings.HasPrefix(rest, "["):
+			n := strings.Index(rest, "]")
+			if n < 0 {
+				return nil, fmt.Errorf("path %q has an unterminated index", p)
+			}
+			i, err := strconv.Atoi(rest[1:n])
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("path %q has an invalid index %q", p, rest[1:n])
+			}
+			steps = append(steps, pathStep{index: i, isIdx: true})
+			rest = rest[n+1:]
+		default:
+			return nil, fmt.Errorf("path %q is not a reference path", p)
+		}
+	}
+	return steps, nil
+}
+
+// selectPath returns the value at path p within v.
+func selectPath(v interface{}, p string) (interface{}, error) {
+	steps, err := parsePath(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range steps {
+		if s.isIdx {
+			a, ok := v.([]interface{})
+			if !ok || s.index >= len(a) {
+				return nil, fmt.Errorf("path %q does not match the input", p)
+			}
+			v = a[s.index]
+			continue
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("path %q does not match the input", p)
+		}
+		if v, ok = m[s.field]; !ok {
+			return nil, fmt.Errorf("path %q does not match the input", p)
+		}
+	}
+	return v, nil
+}
+
+// setPath returns a copy of root with val placed at path p, creating any
+// missing objects along the way.  The path "$" replaces root entirely.
+func setPath(root interface{}, p string, val interface{}) (interface{}, error) {
+	steps, err := parsePath(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range steps {
+		if s.isIdx {
+			return nil, fmt.Errorf("result path %q may not contain array indexes", p)
+		}
+	}
+	return setSteps(root, steps, val, p)
+}
+
+func setSteps(v interface{}, steps []pathStep, val interface{}, p string) (interface{}, error) {
+	if len(steps) == 0 {
+		return val, nil
+	}
+	var m map[string]interface{}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m = make(map[string]interface{}, len(t)+1)
+		for k, x := range t {
+			m[k] = x
+		}
+	case nil:
+		m = make(map[string]interface{})
+	default:
+		return nil, fmt.Errorf("result path %q cannot be applied to a non-object input", p)
+	}
+	child, err := setSteps(m[steps[0].field], steps[1:], val, p)
+	if err != nil {
+		return nil, err
+	}
+	m[steps[0].field] = child
+	return m, nil
+}
+
+// applyParameters builds the value described by a Parameters (or
+// ResultSelector) template.  Fields whose names end in ".$" are replaced
+// by the value selected by their path from input, or from the context
+// object if the path begins with "$$".
+func applyParameters(tmpl interface{}, input, context interface{}) (interface{}, error) {
+	switch t := tmpl.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			if strings.HasSuffix(k, ".$") {
+				p, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("the value of field %q must be a path", k)
+				}
+				src := input
+				if strings.HasPrefix(p, "$$") {
+					src = context
+				}
+				x, err := selectPath(src, p)
+				if err != nil {
+					return nil, err
+				}
+				out[strings.TrimSuffix(k, ".$")] = x
+				continue
+			}
+			x, err := applyParameters(v, input, context)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = x
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, v := range t {
+			x, err := applyParameters(v, input, context)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = x
+		}
+		return out, nil
+	default:
+		return tmpl, nil
+	}
+}
@@ -0,0 +1,298 @@
+package asl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidationError lists every problem found in a state machine definition.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid state machine definition: %s", strings.Join(e.Problems, "; "))
+}
+
+// validator accumulates the problems found while validating a definition.
+type validator struct {
+	problems []string
+}
+
+func (v *validator) addf(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+// Validate checks the definition for structural errors: a missing or
+// unknown StartAt, transitions to unknown states, states that neither
+// transition nor end, missing or conflicting fields for the state type,
+// malformed paths and unreachable states.  All problems are reported at
+// once in a *ValidationError.
+func (sm *StateMachine) Validate() error {
+	v := &validator{}
+	v.machine(sm, "")
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+// machine validates a state machine or Parallel branch.  prefix identifies
+// the branch in problem descriptions.
+func (v *validator) machine(sm *StateMachine, prefix string) {
+	if len(sm.States) == 0 {
+		v.addf("%sno states defined", prefix)
+		return
+	}
+	if sm.StartAt == "" {
+		v.addf("%sStartAt is required", prefix)
+	} else if _, ok := sm.States[sm.StartAt]; !ok {
+		v.addf("%sStartAt names unknown state %q", prefix, sm.StartAt)
+	}
+
+	var names []string
+	for name := range sm.States {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		v.state(sm, prefix+name, sm.States[name], prefix)
+	}
+
+	// every state must be reachable from StartAt
+	reached := make(map[string]bool)
+	var walk func(string)
+	walk = func(name string) {
+		st, ok := sm.States[name]
+		if !ok || reached[name] {
+			return
+		}
+		reached[name] = true
+		for _, n := range st.transitions() {
+			walk(n)
+		}
+	}
+	walk(sm.StartAt)
+	for _, name := range names {
+		if !reached[name] {
+			v.addf("%s%s: state is unreachable from %q", prefix, name, sm.StartAt)
+		}
+	}
+}
+
+// state validates a single state.
+func (v *validator) state(sm *StateMachine, name string, st *State, prefix string) {
+	if len(strings.TrimPrefix(name, prefix)) > 80 {
+		v.addf("%s: state names are limited to 80 characters", name)
+	}
+	target := func(field, next string) {
+		if _, ok := sm.States[next]; !ok {
+			v.addf("%s: %s names unknown state %q", name, field, next)
+		}
+	}
+	v.path(name, "InputPath", st.InputPath)
+	v.path(name, "OutputPath", st.OutputPath)
+	v.path(name, "ResultPath", st.ResultPath)
+
+	switch st.Type {
+	case TypeTask, TypePass, TypeWait, TypeParallel:
+		switch {
+		case st.Next != "" && st.End:
+			v.addf("%s: Next and End are mutually exclusive", name)
+		case st.Next == "" && !st.End:
+			v.addf("%s: one of Next or End is required", name)
+		case st.Next != "":
+			target("Next", st.Next)
+		}
+	case TypeChoice, TypeSucceed, TypeFail:
+		if st.Next != "" || st.End {
+			v.addf("%s: %s states may not specify Next or End", name, st.Type)
+		}
+	case "":
+		v.addf("%s: Type is required", name)
+		return
+	default:
+		v.addf("%s: unknown state type %q", name, st.Type)
+		return
+	}
+
+	switch st.Type {
+	case TypeTask:
+		if st.Resource == "" {
+			v.addf("%s: Task states require a Resource", name)
+		}
+		if st.TimeoutSeconds < 0 || st.HeartbeatSeconds < 0 {
+			v.addf("%s: TimeoutSeconds and HeartbeatSeconds must be positive", name)
+		}
+		if st.HeartbeatSeconds > 0 && st.TimeoutSeconds > 0 && st.HeartbeatSeconds >= st.TimeoutSeconds {
+			v.addf("%s: HeartbeatSeconds must be less than TimeoutSeconds", name)
+		}
+		v.errorHandling(name, st, target)
+	case TypeParallel:
+		if len(st.Branches) == 0 {
+			v.addf("%s: Parallel states require at least one branch", name)
+		}
+		for i, b := range st.Branches {
+			v.machine(b, fmt.Sprintf("%s.Branches[%d].", name, i))
+		}
+		v.errorHandling(name, st, target)
+	case TypeWait:
+		n := 0
+		for _, set := range []bool{st.Seconds > 0, st.SecondsPath != "", st.Timestamp != "", st.TimestampPath != ""} {
+			if set {
+				n++
+			}
+		}
+		if n != 1 {
+			v.addf("%s: Wait states require exactly one of Seconds, SecondsPath, Timestamp or TimestampPath", name)
+		}
+		v.path(name, "SecondsPath", st.SecondsPath)
+		v.path(name, "TimestampPath", st.TimestampPath)
+	case TypeChoice:
+		if len(st.Choices) == 0 {
+			v.addf("%s: Choice states require at least one choice rule", name)
+		}
+		for i, r := range st.Choices {
+			rn := fmt.Sprintf("%s.Choices[%d]", name, i)
+			if r.Next == "" {
+				v.addf("%s: Next is required", rn)
+			} else {
+				target(rn+".Next", r.Next)
+			}
+			v.rule(rn, r)
+		}
+		if st.Default != "" {
+			target("Default", st.Default)
+		}
+	}
+}
+
+// errorHandling validates the Retry and Catch fields of a Task or Parallel
+// state.
+func (v *validator) errorHandling(name string, st *State, target func(field, next string)) {
+	for i, r := range st.Retry {
+		rn := fmt.Sprintf("%s.Retry[%d]", name, i)
+		v.errorEquals(rn, r.ErrorEquals, i == len(st.Retry)-1)
+		if r.MaxAttempts != nil && *r.MaxAttempts < 0 {
+			v.addf("%s: MaxAttempts must not be negative", rn)
+		}
+		if r.BackoffRate != 0 && r.BackoffRate < 1 {
+			v.addf("%s: BackoffRate must be at least 1.0", rn)
+		}
+	}
+	for i, c := range st.Catch {
+		cn := fmt.Sprintf("%s.Catch[%d]", name, i)
+		v.errorEquals(cn, c.ErrorEquals, i == len(st.Catch)-1)
+		v.path(cn, "ResultPath", c.ResultPath)
+		if c.Next == "" {
+			v.addf("%s: Next is required", cn)
+		} else {
+			target(cn+".Next", c.Next)
+		}
+	}
+}
+
+// errorEquals validates an ErrorEquals list; States.ALL must appear alone
+// and in the last retrier or catcher.
+func (v *validator) errorEquals(name string, errs []string, last bool) {
+	if len(errs) == 0 {
+		v.addf("%s: ErrorEquals must name at least one error", name)
+	}
+	for _, e := range errs {
+		if e == ErrorAll && (len(errs) > 1 || !last) {
+			v.addf("%s: %s must appear alone in the last retrier or catcher", name, ErrorAll)
+		}
+	}
+}
+
+// rule validates a choice rule; exactly one comparison or boolean operator
+// is expected, and comparisons require a Variable.
+func (v *validator) rule(name string, r *ChoiceRule) {
+	n := len(r.comparisons())
+	if len(r.And) > 0 {
+		n++
+	}
+	if len(r.Or) > 0 {
+		n++
+	}
+	if r.Not != nil {
+		n++
+	}
+	if n != 1 {
+		v.addf("%s: exactly one comparison, And, Or or Not is required", name)
+	}
+	if len(r.comparisons()) > 0 {
+		if r.Variable == "" {
+			v.addf("%s: Variable is required", name)
+		}
+		v.path(name, "Variable", r.Variable)
+	}
+	for i, sub := range r.And {
+		v.nested(fmt.Sprintf("%s.And[%d]", name, i), sub)
+	}
+	for i, sub := range r.Or {
+		v.nested(fmt.Sprintf("%s.Or[%d]", name, i), sub)
+	}
+	if r.Not != nil {
+		v.nested(name+".Not", r.Not)
+	}
+}
+
+// nested validates a rule within an And, Or or Not, which must not specify
+// a Next state.
+func (v *validator) nested(name string, r *ChoiceRule) {
+	if r.Next != "" {
+		v.addf("%s: nested rules may not specify Next", name)
+	}
+	v.rule(name, r)
+}
+
+// path checks that a non-empty path is a reference path starting with "$".
+func (v *validator) path(name, field, p string) {
+	if p != "" && !strings.HasPrefix(p, "$") {
+		v.addf("%s: %s %q must begin with \"$\"", name, field, p)
+	}
+}
+
+// transitions returns every state that st may transition to.
+func (st *State) transitions() []string {
+	var next []string
+	if st.Next != "" {
+		next = append(next, st.Next)
+	}
+	if st.Default != "" {
+		next = append(next, st.Default)
+	}
+	for _, r := range st.Choices {
+		next = append(next, r.Next)
+	}
+	for _, c := range st.Catch {
+		next = append(next, c.Next)
+	}
+	return next
+}
+
+// comparisons returns the names of the comparison operators set in r.
+func (r *ChoiceRule) comparisons() []string {
+	var ops []string
+	add := func(set bool, op string) {
+		if set {
+			ops = append(ops, op)
+		}
+	}
+	add(r.StringEquals != nil, "StringEquals")
+	add(r.StringLessThan != nil, "StringLessThan")
+	add(r.StringGreaterThan != nil, "StringGreaterThan")
+	add(r.StringMatches != nil, "StringMatches")
+	add(r.NumericEquals != nil, "NumericEquals")
+	add(r.NumericLessThan != nil, "NumericLessThan")
+	add(r.NumericGreaterThan != nil, "NumericGreaterThan")
+	add(r.NumericLessThanEquals != nil, "NumericLessThanEquals")
+	add(r.NumericGreaterThanEquals != nil, "NumericGreaterThanEquals")
+	add(r.BooleanEquals != nil, "BooleanEquals")
+	add(r.IsPresent != nil, "IsPresent")
+	add(r.IsNull != nil, "IsNull")
+	return ops
+}
@@ -0,0 +1,91 @@
+package awsfake
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/batch/batchiface"
+)
+
+// Batch is a fake AWS Batch client.  Submitted jobs are queued for the
+// JobQueueTime of the State, RUNNING for its JobDuration, and then SUCCEEDED, or FAILED if the job name
+// was passed to State.FailJob.  Only the methods called by the cwl handlers
+// are implemented; calling any other method panics.
+type Batch struct {
+	batchiface.BatchAPI
+	state *State
+}
+
+// NewBatch returns a fake Batch client backed by st.
+func NewBatch(st *State) *Batch {
+	return &Batch{state: st}
+}
+
+// clientException returns the error Batch reports for invalid requests.
+func clientException(msg string) error {
+	return awserr.NewRequestFailure(awserr.New(batch.ErrCodeClientException, msg, nil), 400, "")
+}
+
+// SubmitJobWithContext records a new job.
+func (f *Batch) SubmitJobWithContext(ctx aws.Context, input *batch.SubmitJobInput, opts ...request.Option) (*batch.SubmitJobOutput, error) {
+	switch {
+	case aws.StringValue(input.JobName) == "":
+		return nil, clientException("jobName is required")
+	case aws.StringValue(input.JobQueue) == "":
+		return nil, clientException("jobQueue is required")
+	case aws.StringValue(input.JobDefinition) == "":
+		return nil, clientException("jobDefinition is required")
+	}
+	f.state.mu.Lock()
+	j := &Job{
+		ID:         f.state.newID(),
+		Name:       aws.StringValue(input.JobName),
+		Queue:      aws.StringValue(input.JobQueue),
+		Definition: aws.StringValue(input.JobDefinition),
+		CreatedAt:  f.state.Now().UTC(),
+	}
+	f.state.jobs[j.ID] = j
+	f.state.mu.Unlock()
+
+	return &batch.SubmitJobOutput{
+		JobId:   aws.String(j.ID),
+		JobName: aws.String(j.Name),
+		JobArn:  aws.String(fmt.Sprintf("arn:aws:batch:us-west-2:123456789012:job/%s", j.ID)),
+	}, nil
+}
+
+// DescribeJobsWithContext returns the details of the named jobs.  As with
+// AWS Batch, unknown job-ids are omitted from the result.
+func (f *Batch) DescribeJobsWithContext(ctx aws.Context, input *batch.DescribeJobsInput, opts ...request.Option) (*batch.DescribeJobsOutput, error) {
+	out := &batch.DescribeJobsOutput{}
+	for _, id := range aws.StringValueSlice(input.Jobs) {
+		j, ok := f.state.Job(id)
+		if !ok {
+			continue
+		}
+		status, reason := f.state.JobStatus(j)
+		d := &batch.JobDetail{
+			JobId:         aws.String(j.ID),
+			JobName:       aws.String(j.Name),
+			JobQueue:      aws.String(j.Queue),
+			JobDefinition: aws.String(j.Definition),
+			Status:        aws.String(status),
+			CreatedAt:     aws.Int64(j.CreatedAt.UnixNano() / 1e6),
+		}
+		started := j.CreatedAt.Add(f.state.JobQueueTime)
+		if !f.state.Now().Before(started) {
+			d.StartedAt = aws.Int64(started.UnixNano() / 1e6)
+		}
+		if status == "SUCCEEDED" || status == "FAILED" {
+			d.StoppedAt = aws.Int64(started.Add(f.state.JobDuration).UnixNano() / 1e6)
+		}
+		if reason != "" {
+			d.StatusReason = aws.String(reason)
+		}
+		out.Jobs = append(out.Jobs, d)
+	}
+	return out, nil
+}
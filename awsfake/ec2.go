@@ -0,0 +1,312 @@
+package awsfake
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// EC2 is a fake EC2 client.  Only the methods called by the cwl handlers are
+// implemented; calling any other method panics.
+type EC2 struct {
+	ec2iface.EC2API
+	state *State
+}
+
+// NewEC2 returns a fake EC2 client backed by st.
+func NewEC2(st *State) *EC2 {
+	return &EC2{state: st}
+}
+
+// instanceNotFound returns the error EC2 reports for unknown instance-ids.
+func instanceNotFound(ids []string) error {
+	return awserr.NewRequestFailure(awserr.New("InvalidInstanceID.NotFound",
+		fmt.Sprintf("The instance IDs '%v' do not exist", ids), nil), 400, "")
+}
+
+// lookup returns the named instances, or every instance if ids is empty,
+// completing any state transitions that are due.  The caller must hold the
+// state lock.
+func (f *EC2) lookup(ids []*string) ([]*Instance, error) {
+	if len(ids) == 0 {
+		var ins []*Instance
+		for _, in := range f.state.instances {
+			f.state.settle(in)
+			ins = append(ins, in)
+		}
+		sort.Slice(ins, func(i, j int) bool { return ins[i].ID < ins[j].ID })
+		return ins, nil
+	}
+	var ins []*Instance
+	var missing []string
+	for _, id := range aws.StringValueSlice(ids) {
+		in, ok := f.state.instances[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		f.state.settle(in)
+		ins = append(ins, in)
+	}
+	if len(missing) > 0 {
+		return nil, instanceNotFound(missing)
+	}
+	return ins, nil
+}
+
+// instanceState returns the EC2 representation of a state name.
+func instanceState(name string) *ec2.InstanceState {
+	return &ec2.InstanceState{Code: aws.Int64(instanceStateCodes[name]), Name: aws.String(name)}
+}
+
+// DescribeInstancesWithContext returns a reservation for each instance.
+func (f *EC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	if input == nil {
+		input = &ec2.DescribeInstancesInput{}
+	}
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	ins, err := f.lookup(input.InstanceIds)
+	if err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeInstancesOutput{}
+	for _, in := range ins {
+		i := &ec2.Instance{
+			InstanceId:   aws.String(in.ID),
+			InstanceType: aws.String(in.Type),
+			LaunchTime:   aws.Time(in.LaunchTime),
+			State:        instanceState(in.State),
+		}
+		if in.Hibernation {
+			i.HibernationOptions = &ec2.HibernationOptions{Configured: aws.Bool(true)}
+		}
+		if in.PublicIP != "" {
+			i.PublicIpAddress = aws.String(in.PublicIP)
+		}
+		if in.PrivateIP != "" {
+			i.PrivateIpAddress = aws.String(in.PrivateIP)
+		}
+		var keys []string
+		for k := range in.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			i.Tags = append(i.Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(in.Tags[k])})
+		}
+		out.Reservations = append(out.Reservations, &ec2.Reservation{
+			ReservationId: aws.String("r-" + strings.TrimPrefix(in.ID, "i-")),
+			Instances:     []*ec2.Instance{i},
+		})
+	}
+	return out, nil
+}
+
+// DescribeInstanceStatusWithContext returns a page of instance statuses.
+// Only running instances are included unless IncludeAllInstances is set.
+func (f *EC2) DescribeInstanceStatusWithContext(ctx aws.Context, input *ec2.DescribeInstanceStatusInput, opts ...request.Option) (*ec2.DescribeInstanceStatusOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	ins, err := f.lookup(input.InstanceIds)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []*ec2.InstanceStatus
+	for _, in := range ins {
+		if in.State != InstanceRunning && !aws.BoolValue(input.IncludeAllInstances) {
+			continue
+		}
+		status := "ok"
+		if in.State != InstanceRunning {
+			status = "not-applicable"
+		}
+		statuses = append(statuses, &ec2.InstanceStatus{
+			InstanceId:     aws.String(in.ID),
+			InstanceState:  instanceState(in.State),
+			InstanceStatus: &ec2.InstanceStatusSummary{Status: aws.String(status)},
+			SystemStatus:   &ec2.InstanceStatusSummary{Status: aws.String(status)},
+		})
+	}
+
+	start := 0
+	if input.NextToken != nil {
+		if start, err = strconv.Atoi(*input.NextToken); err != nil || start > len(statuses) {
+			return nil, awserr.NewRequestFailure(awserr.New("InvalidParameterValue", "invalid NextToken", nil), 400, "")
+		}
+	}
+	end := len(statuses)
+	size := f.state.PageSize
+	if n := int(aws.Int64Value(input.MaxResults)); n > 0 && (size == 0 || n < size) {
+		size = n
+	}
+	if size > 0 && start+size < end {
+		end = start + size
+	}
+	out := &ec2.DescribeInstanceStatusOutput{InstanceStatuses: statuses[start:end]}
+	if end < len(statuses) {
+		out.NextToken = aws.String(strconv.Itoa(end))
+	}
+	return out, nil
+}
+
+// DescribeInstanceStatusPagesWithContext calls fn for each page of instance
+// statuses until fn returns false or the last page has been read.
+func (f *EC2) DescribeInstanceStatusPagesWithContext(ctx aws.Context, input *ec2.DescribeInstanceStatusInput, fn func(*ec2.DescribeInstanceStatusOutput, bool) bool, opts ...request.Option) error {
+	in := *input
+	for {
+		out, err := f.DescribeInstanceStatusWithContext(ctx, &in, opts...)
+		if err != nil {
+			return err
+		}
+		last := out.NextToken == nil
+		if !fn(out, last) || last {
+			return nil
+		}
+		in.NextToken = out.NextToken
+	}
+}
+
+// transition moves the named instances from one of the from states to the
+// to state, returning the state changes.  reported is the transitional
+// state EC2 reports, in which the instances remain for the
+// InstanceTransition of the State.  If check is not nil, it is called with
+// each instance before any is changed, and may refuse the transition.
+func (f *EC2) transition(ids []*string, from []string, to, reported string, check func(*Instance) error) ([]*ec2.InstanceStateChange, error) {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	ins, err := f.lookup(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, in := range ins {
+		if in.State != to && !contains(from, in.State) {
+			return nil, awserr.NewRequestFailure(awserr.New("IncorrectInstanceState",
+				fmt.Sprintf("The instance '%s' is not in a state from which it can be %s.", in.ID, to), nil), 400, "")
+		}
+		if check != nil {
+			if err := check(in); err != nil {
+				return nil, err
+			}
+		}
+	}
+	now := f.state.Now().UTC()
+	var changes []*ec2.InstanceStateChange
+	for _, in := range ins {
+		change := &ec2.InstanceStateChange{
+			InstanceId:    aws.String(in.ID),
+			PreviousState: instanceState(in.State),
+			CurrentState:  instanceState(reported),
+		}
+		switch {
+		case in.State == to:
+			change.CurrentState = instanceState(to)
+		case f.state.InstanceTransition > 0 && reported != to:
+			if in.State != reported {
+				in.State = reported
+				in.StateChangedAt = now
+			}
+		default:
+			in.State = to
+			in.StateChangedAt = now
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// StartInstancesWithContext starts stopped instances.  The instances are
+// pending for the InstanceTransition of the State, and then running.
+func (f *EC2) StartInstancesWithContext(ctx aws.Context, input *ec2.StartInstancesInput, opts ...request.Option) (*ec2.StartInstancesOutput, error) {
+	changes, err := f.transition(input.InstanceIds, []string{InstanceStopped, InstancePending}, InstanceRunning, InstancePending, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StartInstancesOutput{StartingInstances: changes}, nil
+}
+
+// StopInstancesWithContext stops running instances.  The instances are
+// stopping for the InstanceTransition of the State, and then stopped.
+// Only instances configured for hibernation may be stopped with Hibernate.
+func (f *EC2) StopInstancesWithContext(ctx aws.Context, input *ec2.StopInstancesInput, opts ...request.Option) (*ec2.StopInstancesOutput, error) {
+	var check func(*Instance) error
+	if aws.BoolValue(input.Hibernate) {
+		check = func(in *Instance) error {
+			if !in.Hibernation {
+				return awserr.NewRequestFailure(awserr.New("UnsupportedHibernationConfiguration",
+					fmt.Sprintf("The instance '%s' is not enabled for hibernation.", in.ID), nil), 400, "")
+			}
+			return nil
+		}
+	}
+	changes, err := f.transition(input.InstanceIds, []string{InstanceRunning, InstancePending, InstanceStopping}, InstanceStopped, InstanceStopping, check)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StopInstancesOutput{StoppingInstances: changes}, nil
+}
+
+// RebootInstancesWithContext reboots running instances.
+func (f *EC2) RebootInstancesWithContext(ctx aws.Context, input *ec2.RebootInstancesInput, opts ...request.Option) (*ec2.RebootInstancesOutput, error) {
+	if _, err := f.transition(input.InstanceIds, []string{InstanceRunning}, InstanceRunning, InstanceRunning, nil); err != nil {
+		return nil, err
+	}
+	return &ec2.RebootInstancesOutput{}, nil
+}
+
+// TerminateInstancesWithContext terminates instances that are not
+// protected by DisableAPITermination.  The instances are shutting-down for
+// the InstanceTransition of the State, and then terminated.
+func (f *EC2) TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	from := []string{InstancePending, InstanceRunning, InstanceStopping, InstanceStopped, InstanceShuttingDown}
+	changes, err := f.transition(input.InstanceIds, from, InstanceTerminated, InstanceShuttingDown, func(in *Instance) error {
+		if in.DisableAPITermination && in.State != InstanceTerminated {
+			return awserr.NewRequestFailure(awserr.New("OperationNotPermitted",
+				fmt.Sprintf("The instance '%s' may not be terminated. Modify its 'disableApiTermination' instance attribute and try again.", in.ID), nil), 400, "")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.TerminateInstancesOutput{TerminatingInstances: changes}, nil
+}
+
+// DescribeInstanceAttributeWithContext returns an attribute of an
+// instance.  Only the disableApiTermination attribute is supported.
+func (f *EC2) DescribeInstanceAttributeWithContext(ctx aws.Context, input *ec2.DescribeInstanceAttributeInput, opts ...request.Option) (*ec2.DescribeInstanceAttributeOutput, error) {
+	if aws.StringValue(input.Attribute) != ec2.InstanceAttributeNameDisableApiTermination {
+		return nil, awserr.NewRequestFailure(awserr.New("InvalidParameterValue",
+			fmt.Sprintf("the attribute %q is not supported by awsfake", aws.StringValue(input.Attribute)), nil), 400, "")
+	}
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	ins, err := f.lookup([]*string{input.InstanceId})
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.DescribeInstanceAttributeOutput{
+		InstanceId:            input.InstanceId,
+		DisableApiTermination: &ec2.AttributeBooleanValue{Value: aws.Bool(ins[0].DisableAPITermination)},
+	}, nil
+}
@@ -0,0 +1,405 @@
+package awsfake
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+)
+
+// the operations served by Server, which are those implemented by the
+// fake clients
+var (
+	serverEC2Ops   = []string{"DescribeInstances", "DescribeInstanceStatus", "StartInstances", "StopInstances", "RebootInstances", "TerminateInstances", "DescribeInstanceAttribute"}
+	serverSSMOps   = []string{"SendCommand", "ListCommands", "GetCommandInvocation"}
+	serverBatchOps = []string{"SubmitJob", "DescribeJobs"}
+)
+
+// ec2Namespace is the XML namespace of EC2 API responses.
+const ec2Namespace = "http://ec2.amazonaws.com/doc/2016-11-15/"
+
+// Server is an HTTP server backed by a State that speaks enough of the EC2
+// Query, SSM JSON and AWS Batch REST-JSON protocols to serve the calls made
+// by the cwl handlers.  Unlike the fake clients, which are called directly,
+// requests to the Server pass through the request serialization, response
+// parsing, error handling and pagination of the AWS SDK, so that handlers
+// can be tested end-to-end without AWS:
+//
+//	srv := awsfake.NewServer(awsfake.NewState())
+//	defer srv.Close()
+//	sess := srv.Session()
+//	ctx = cwl.WithClients(ctx, &cwl.Clients{EC2: ec2.New(sess), SSM: ssm.New(sess), Batch: batch.New(sess)})
+//
+// The operations served are DescribeInstances, DescribeInstanceStatus,
+// StartInstances, StopInstances, RebootInstances, SendCommand, ListCommands,
+// GetCommandInvocation, SubmitJob and DescribeJobs; any other operation
+// fails with a 400 response.
+type Server struct {
+	*httptest.Server
+
+	// State is the model of the resources served, which tests may script
+	// while the server is running.
+	State *State
+
+	ec2   *EC2
+	ssm   *SSM
+	batch *Batch
+
+	mu  sync.Mutex
+	seq int
+}
+
+// NewServer starts a Server backed by st.  The caller should call Close
+// when finished, to shut it down.
+func NewServer(st *State) *Server {
+	s := &Server{State: st, ec2: NewEC2(st), ssm: NewSSM(st), batch: NewBatch(st)}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Config returns the configuration of AWS SDK clients calling the Server.
+func (s *Server) Config() *aws.Config {
+	return &aws.Config{
+		Endpoint:    aws.String(s.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("AKIDFAKE", "fake", ""),
+		DisableSSL:  aws.Bool(true),
+		MaxRetries:  aws.Int(0),
+	}
+}
+
+// Session returns a session for AWS SDK clients calling the Server.
+func (s *Server) Session() *session.Session {
+	return session.Must(session.NewSession(s.Config()))
+}
+
+// ServeHTTP dispatches a request by protocol: SSM requests are identified by
+// their X-Amz-Target header, Batch requests by their /v1/ path, and all
+// other requests are taken to be EC2 Query requests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM."):
+		s.serveSSM(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/"):
+		s.serveBatch(w, r)
+	default:
+		s.serveEC2(w, r)
+	}
+}
+
+// requestID returns a new request-id for a response.
+func (s *Server) requestID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return fmt.Sprintf("%08x-0000-4000-9000-%012x", s.seq, s.seq)
+}
+
+// serveEC2 serves an EC2 Query request, replying with an XML document.
+func (s *Server) serveEC2(w http.ResponseWriter, r *http.Request) {
+	id := s.requestID()
+	if err := r.ParseForm(); err != nil {
+		writeEC2Error(w, id, awserr.New("MalformedQueryString", err.Error(), nil))
+		return
+	}
+	op := r.Form.Get("Action")
+	out, err := call(r.Context(), s.ec2, op, serverEC2Ops, func(in interface{}) error {
+		return decodeQuery(r.Form, "", reflect.ValueOf(in).Elem())
+	})
+	if err != nil {
+		writeEC2Error(w, id, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	e := xml.NewEncoder(&buf)
+	start := xml.StartElement{
+		Name: xml.Name{Local: op + "Response"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: ec2Namespace}},
+	}
+	e.EncodeToken(start)
+	e.EncodeElement(id, xml.StartElement{Name: xml.Name{Local: "requestId"}})
+	if err := encodeXMLFields(e, reflect.ValueOf(out).Elem()); err != nil {
+		writeEC2Error(w, id, err)
+		return
+	}
+	e.EncodeToken(start.End())
+	e.Flush()
+	w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+	w.Write([]byte(xml.Header))
+	w.Write(buf.Bytes())
+}
+
+// writeEC2Error writes an EC2 error response.
+func writeEC2Error(w http.ResponseWriter, id string, err error) {
+	code, msg, status := errorInfo(err)
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString("<Response><Errors><Error><Code>")
+	xml.EscapeText(&buf, []byte(code))
+	buf.WriteString("</Code><Message>")
+	xml.EscapeText(&buf, []byte(msg))
+	buf.WriteString("</Message></Error></Errors><RequestID>" + id + "</RequestID></Response>")
+	w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// serveSSM serves an SSM JSON request, naming the operation in its
+// X-Amz-Target header.
+func (s *Server) serveSSM(w http.ResponseWriter, r *http.Request) {
+	op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM.")
+	out, err := call(r.Context(), s.ssm, op, serverSSMOps, func(in interface{}) error {
+		return jsonutil.UnmarshalJSON(in, r.Body)
+	})
+	writeJSON(w, s.requestID(), "application/x-amz-json-1.1", out, err)
+}
+
+// serveBatch serves a Batch REST-JSON request, naming the operation in its
+// path; for example /v1/submitjob.
+func (s *Server) serveBatch(w http.ResponseWriter, r *http.Request) {
+	op := strings.TrimPrefix(r.URL.Path, "/v1/")
+	for _, name := range serverBatchOps {
+		if strings.ToLower(name) == op {
+			op = name
+		}
+	}
+	out, err := call(r.Context(), s.batch, op, serverBatchOps, func(in interface{}) error {
+		return jsonutil.UnmarshalJSON(in, r.Body)
+	})
+	writeJSON(w, s.requestID(), "application/json", out, err)
+}
+
+// writeJSON writes the output of a JSON protocol request or, if err is set,
+// the error response.
+func writeJSON(w http.ResponseWriter, id, contentType string, out interface{}, err error) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Amzn-Requestid", id)
+	var b []byte
+	if err == nil {
+		b, err = jsonutil.BuildJSON(out)
+	}
+	if err != nil {
+		code, msg, status := errorInfo(err)
+		w.Header().Set("X-Amzn-Errortype", code)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"__type": code, "message": msg})
+		return
+	}
+	w.Write(b)
+}
+
+// errorInfo returns the error code, message and HTTP status code of the
+// response for err.
+func errorInfo(err error) (string, string, int) {
+	code, msg, status := "InternalFailure", err.Error(), http.StatusInternalServerError
+	if aerr, ok := err.(awserr.Error); ok {
+		code, msg, status = aerr.Code(), aerr.Message(), http.StatusBadRequest
+	}
+	if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() != 0 {
+		status = rf.StatusCode()
+	}
+	return code, msg, status
+}
+
+// call decodes the input of op and calls the corresponding WithContext
+// method of client, which must be one of the supported ops.
+func call(ctx context.Context, client interface{}, op string, ops []string, decode func(interface{}) error) (interface{}, error) {
+	if !contains(ops, op) {
+		return nil, awserr.New("InvalidAction", fmt.Sprintf("the operation %q is not supported by awsfake.Server", op), nil)
+	}
+	m := reflect.ValueOf(client).MethodByName(op + "WithContext")
+	in := reflect.New(m.Type().In(1).Elem())
+	if err := decode(in.Interface()); err != nil && err != io.EOF {
+		return nil, awserr.New("SerializationException", err.Error(), nil)
+	}
+	res := m.Call([]reflect.Value{reflect.ValueOf(ctx), in})
+	if err, _ := res[1].Interface().(error); err != nil {
+		return nil, err
+	}
+	return res[0].Interface(), nil
+}
+
+// decodeQuery sets the fields of the struct v from the EC2 Query parameters
+// in form, using the names given to them by the AWS SDK: the queryName or
+// capitalized locationName of the field, with list members numbered from 1
+// and structure members separated by dots; for example
+// Filter.1.Value.2=running.
+func decodeQuery(form url.Values, prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Name == "_" {
+			continue
+		}
+		name := f.Tag.Get("queryName")
+		if name == "" {
+			name = f.Tag.Get("locationName")
+			if name != "" {
+				name = strings.ToUpper(name[:1]) + name[1:]
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if err := decodeQueryValue(form, prefix+name, v.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeQueryValue sets v from the query parameter, list or structure
+// named name.
+func decodeQueryValue(form url.Values, name string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		for n := 1; hasQueryParam(form, fmt.Sprintf("%s.%d", name, n)); n++ {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeQueryValue(form, fmt.Sprintf("%s.%d", name, n), elem); err != nil {
+				return err
+			}
+			v.Set(reflect.Append(v, elem))
+		}
+		return nil
+	case reflect.Ptr:
+		if !hasQueryParam(form, name) {
+			return nil
+		}
+		elem := reflect.New(v.Type().Elem())
+		if err := decodeQueryValue(form, name, elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			tm, err := time.Parse(protocol.ISO8601TimeFormat, form.Get(name))
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			v.Set(reflect.ValueOf(tm))
+			return nil
+		}
+		return decodeQuery(form, name+".", v)
+	case reflect.String:
+		v.SetString(form.Get(name))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(form.Get(name))
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		v.SetBool(b)
+	case reflect.Int64:
+		n, err := strconv.ParseInt(form.Get(name), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(form.Get(name), 64)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		v.SetFloat(n)
+	}
+	return nil
+}
+
+// hasQueryParam reports whether form holds the parameter name, or members
+// of the list or structure name.
+func hasQueryParam(form url.Values, name string) bool {
+	if _, ok := form[name]; ok {
+		return true
+	}
+	for k := range form {
+		if strings.HasPrefix(k, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeXMLFields writes the fields of the struct v as EC2 response
+// elements, named by their locationName.
+func encodeXMLFields(e *xml.Encoder, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Name == "_" {
+			continue
+		}
+		name := f.Tag.Get("locationName")
+		if name == "" {
+			name = f.Name
+		}
+		if err := encodeXMLValue(e, name, v.Field(i), f.Tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeXMLValue writes v as the element name.  Lists are written as a
+// sequence of item elements, and nil values are omitted.
+func encodeXMLValue(e *xml.Encoder, name string, v reflect.Value, tag reflect.StructTag) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	switch v.Kind() {
+	case reflect.Struct:
+		if tm, ok := v.Interface().(time.Time); ok {
+			return e.EncodeElement(tm.UTC().Format(protocol.ISO8601TimeFormat), start)
+		}
+		if err := e.EncodeToken(start); err != nil {
+			return err
+		}
+		if err := encodeXMLFields(e, v); err != nil {
+			return err
+		}
+		return e.EncodeToken(start.End())
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		item := tag.Get("locationNameList")
+		if item == "" {
+			item = "item"
+		}
+		if err := e.EncodeToken(start); err != nil {
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeXMLValue(e, item, v.Index(i), ""); err != nil {
+				return err
+			}
+		}
+		return e.EncodeToken(start.End())
+	case reflect.Map:
+		// maps do not occur in the outputs of the EC2 operations served
+		return nil
+	default:
+		return e.EncodeElement(fmt.Sprint(v.Interface()), start)
+	}
+}
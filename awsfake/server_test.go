@@ -0,0 +1,256 @@
+package awsfake_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/1414C/cwl/awsfake"
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// clock is a manually advanced clock for the State.
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time          { return c.now }
+func (c *clock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// newServer returns a Server on a manual clock, and a context supplying
+// AWS SDK clients that call it.
+func newServer(t *testing.T) (*awsfake.Server, *clock, context.Context) {
+	t.Helper()
+	clk := &clock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	st := awsfake.NewState()
+	st.Now = clk.Now
+	srv := awsfake.NewServer(st)
+	t.Cleanup(srv.Close)
+	sess := srv.Session()
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{
+		EC2:   ec2.New(sess),
+		SSM:   ssm.New(sess),
+		Batch: batch.New(sess),
+	})
+	return srv, clk, ctx
+}
+
+func errCode(err error) string {
+	for err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			return aerr.Code()
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			break
+		}
+		err = u.Unwrap()
+	}
+	return ""
+}
+
+func statuses(t *testing.T, ctx context.Context, ids ...string) map[string]string {
+	t.Helper()
+	res, err := cwl.GetEC2Statuses(ctx, cwl.GetEC2StatusesEvent{Instances: ids})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string)
+	for _, s := range res.InstanceStatuses {
+		m[aws.StringValue(s.InstanceId)] = aws.StringValue(s.InstanceState.Name)
+	}
+	return m
+}
+
+func TestServerInstanceLifecycle(t *testing.T) {
+	srv, clk, ctx := newServer(t)
+	srv.State.InstanceTransition = 30 * time.Second
+	srv.State.AddInstance(awsfake.Instance{ID: "i-0000000000000001a", State: awsfake.InstanceStopped, Tags: map[string]string{"Name": "web"}})
+
+	out, err := cwl.EC2InstancesStart(ctx, cwl.EC2InstancesStartEvent{Instances: []string{"i-0000000000000001a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.StartingInstances) != 1 || aws.StringValue(out.StartingInstances[0].CurrentState.Name) != "pending" {
+		t.Fatalf("start returned %v", out)
+	}
+	if got := statuses(t, ctx, "i-0000000000000001a"); got["i-0000000000000001a"] != "pending" {
+		t.Fatalf("started instance is %v", got)
+	}
+
+	// commands can only be sent to running instances
+	if _, err := cwl.EC2IssueCmd(ctx, cwl.EC2IssueCmdEvent{Instances: []string{"i-0000000000000001a"}, Cmd: "uptime"}); errCode(err) != ssm.ErrCodeInvalidInstanceId {
+		t.Fatalf("command sent to pending instance returned %v", err)
+	}
+
+	clk.Advance(30 * time.Second)
+	if got := statuses(t, ctx, "i-0000000000000001a"); got["i-0000000000000001a"] != "running" {
+		t.Fatalf("instance is %v after the transition", got)
+	}
+
+	cmd, err := cwl.EC2IssueCmd(ctx, cwl.EC2IssueCmdEvent{Instances: []string{"i-0000000000000001a"}, Cmd: "uptime"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := aws.StringValue(cmd.CommandId)
+	if err := srv.State.SetCommandResult(id, "Failed", "load average: 9.99"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := cwl.EC2ListCmd(ctx, cwl.EC2ListCmdEvent{Cmd: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Commands) != 1 || aws.StringValue(list.Commands[0].Status) != "Failed" {
+		t.Fatalf("list returned %v", list)
+	}
+	inv, err := ssm.New(srv.Session()).GetCommandInvocation(&ssm.GetCommandInvocationInput{
+		CommandId:  aws.String(id),
+		InstanceId: aws.String("i-0000000000000001a"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.Int64Value(inv.ResponseCode) != 1 || aws.StringValue(inv.StandardOutputContent) != "load average: 9.99" {
+		t.Fatalf("invocation %v", inv)
+	}
+
+	if _, err := cwl.EC2InstancesStop(ctx, cwl.EC2InstancesStopEvent{Instances: []string{"i-0000000000000001a"}}); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(30 * time.Second)
+	if in, _ := srv.State.Instance("i-0000000000000001a"); in.State != awsfake.InstanceStopped {
+		t.Fatalf("instance is %s after stopping", in.State)
+	}
+}
+
+func TestServerDescribeInstances(t *testing.T) {
+	srv, _, _ := newServer(t)
+	launch := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv.State.AddInstance(awsfake.Instance{ID: "i-0000000000000002a", PrivateIP: "10.0.0.1", LaunchTime: launch, Tags: map[string]string{"Environment": "dev"}})
+
+	out, err := ec2.New(srv.Session()).DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice([]string{"i-0000000000000002a"})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Reservations) != 1 || len(out.Reservations[0].Instances) != 1 {
+		t.Fatalf("got %v", out)
+	}
+	in := out.Reservations[0].Instances[0]
+	if aws.StringValue(in.PrivateIpAddress) != "10.0.0.1" || !aws.TimeValue(in.LaunchTime).Equal(launch) ||
+		aws.Int64Value(in.State.Code) != 16 || len(in.Tags) != 1 || aws.StringValue(in.Tags[0].Value) != "dev" {
+		t.Fatalf("got %v", in)
+	}
+}
+
+func TestServerSafeguards(t *testing.T) {
+	srv, _, _ := newServer(t)
+	srv.State.AddInstance(awsfake.Instance{ID: "i-0000000000000005a", Hibernation: true})
+	srv.State.AddInstance(awsfake.Instance{ID: "i-0000000000000005b", DisableAPITermination: true})
+	svc := ec2.New(srv.Session())
+
+	// EC2 refuses the whole call for one instance that cannot hibernate
+	ids := aws.StringSlice([]string{"i-0000000000000005a", "i-0000000000000005b"})
+	if _, err := svc.StopInstances(&ec2.StopInstancesInput{InstanceIds: ids, Hibernate: aws.Bool(true)}); errCode(err) != "UnsupportedHibernationConfiguration" {
+		t.Errorf("hibernate of unconfigured instance returned %v", err)
+	}
+	if in, _ := srv.State.Instance("i-0000000000000005a"); in.State != awsfake.InstanceRunning {
+		t.Errorf("instance is %s after a refused hibernate", in.State)
+	}
+
+	attr, err := svc.DescribeInstanceAttribute(&ec2.DescribeInstanceAttributeInput{
+		InstanceId: aws.String("i-0000000000000005b"),
+		Attribute:  aws.String(ec2.InstanceAttributeNameDisableApiTermination),
+	})
+	if err != nil || !aws.BoolValue(attr.DisableApiTermination.Value) {
+		t.Errorf("got %v, %v; want termination protection", attr, err)
+	}
+	if _, err := svc.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: ids}); errCode(err) != "OperationNotPermitted" {
+		t.Errorf("terminate of protected instance returned %v", err)
+	}
+	out, err := svc.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: ids[:1]})
+	if err != nil || aws.StringValue(out.TerminatingInstances[0].CurrentState.Name) != awsfake.InstanceShuttingDown {
+		t.Fatalf("terminate returned %v, %v", out, err)
+	}
+	if in, _ := srv.State.Instance("i-0000000000000005a"); in.State != awsfake.InstanceTerminated {
+		t.Errorf("instance is %s after terminating", in.State)
+	}
+}
+
+func TestServerPagination(t *testing.T) {
+	srv, _, ctx := newServer(t)
+	srv.State.PageSize = 2
+	for _, id := range []string{"i-0000000000000003a", "i-0000000000000003b", "i-0000000000000003c", "i-0000000000000003d", "i-0000000000000003e"} {
+		srv.State.AddInstance(awsfake.Instance{ID: id})
+	}
+	if got := statuses(t, ctx); len(got) != 5 {
+		t.Fatalf("got %d statuses over 3 pages, want 5", len(got))
+	}
+}
+
+func TestServerBatchJob(t *testing.T) {
+	srv, clk, ctx := newServer(t)
+	srv.State.JobQueueTime = 4 * time.Minute
+	srv.State.JobDuration = 10 * time.Minute
+	srv.State.FailJob("nightly", "Essential container in task exited")
+
+	for _, name := range []string{"hourly", "nightly"} {
+		job, err := cwl.SubmitJobFunc3(ctx, cwl.JobEvent{JobName: name, JobQueue: "queue", JobDefinition: "def:1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		final := "SUCCEEDED"
+		if name == "nightly" {
+			final = "FAILED"
+		}
+		start := clk.now
+		for _, step := range []struct {
+			at     time.Duration
+			status string
+		}{
+			{0, "SUBMITTED"},
+			{time.Minute, "PENDING"},
+			{2 * time.Minute, "RUNNABLE"},
+			{3 * time.Minute, "STARTING"},
+			{4 * time.Minute, "RUNNING"},
+			{14 * time.Minute, final},
+		} {
+			clk.now = start.Add(step.at)
+			status, err := cwl.CheckJobFunc3(ctx, job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != step.status {
+				t.Errorf("%s at %v: status %s, want %s", name, step.at, status, step.status)
+			}
+		}
+	}
+
+	out, err := batch.New(srv.Session()).DescribeJobs(&batch.DescribeJobsInput{Jobs: aws.StringSlice([]string{srv.State.Jobs()[1].ID})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Jobs) != 1 || aws.StringValue(out.Jobs[0].StatusReason) != "Essential container in task exited" || out.Jobs[0].StoppedAt == nil {
+		t.Fatalf("got %v", out)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	srv, _, ctx := newServer(t)
+	srv.State.AddInstance(awsfake.Instance{ID: "i-0000000000000004a", State: awsfake.InstanceTerminated})
+
+	if _, err := cwl.EC2InstancesStart(ctx, cwl.EC2InstancesStartEvent{Instances: []string{"i-000000000000000ff"}}); errCode(err) != "InvalidInstanceID.NotFound" {
+		t.Errorf("start of unknown instance returned %v", err)
+	}
+	if _, err := cwl.EC2InstancesStart(ctx, cwl.EC2InstancesStartEvent{Instances: []string{"i-0000000000000004a"}}); errCode(err) != "IncorrectInstanceState" {
+		t.Errorf("start of terminated instance returned %v", err)
+	}
+	if _, err := batch.New(srv.Session()).SubmitJob(&batch.SubmitJobInput{JobName: aws.String("j"), JobQueue: aws.String(""), JobDefinition: aws.String("d")}); errCode(err) != batch.ErrCodeClientException {
+		t.Errorf("submit without a queue returned %v", err)
+	}
+	if _, err := ec2.New(srv.Session()).DescribeVpcs(&ec2.DescribeVpcsInput{}); errCode(err) != "InvalidAction" {
+		t.Errorf("unsupported operation returned %v", err)
+	}
+}
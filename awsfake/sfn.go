@@ -0,0 +1,69 @@
+package awsfake
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sfn/sfniface"
+)
+
+// TaskResult is a task token returned to the fake Step Functions client.
+type TaskResult struct {
+	Token   string `json:"token"`
+	Success bool   `json:"success"`
+	Output  string `json:"output,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Cause   string `json:"cause,omitempty"`
+}
+
+// SFN is a fake Step Functions client recording the task tokens returned
+// by the callback handlers.  As with Step Functions, a token may only be
+// returned once.  Only the methods called by the cwl handlers are
+// implemented; calling any other method panics.
+type SFN struct {
+	sfniface.SFNAPI
+	state *State
+}
+
+// NewSFN returns a fake Step Functions client backed by st.
+func NewSFN(st *State) *SFN {
+	return &SFN{state: st}
+}
+
+// TaskResult returns the result sent for token.
+func (s *State) TaskResult(token string) (TaskResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.taskResults[token]
+	return r, ok
+}
+
+// record stores the result for a token, failing if it has been used.
+func (f *SFN) record(r TaskResult) error {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	if _, ok := f.state.taskResults[r.Token]; ok {
+		return awserr.New(sfn.ErrCodeTaskTimedOut, "Task Timed Out: 'Provided task does not exist anymore'", nil)
+	}
+	f.state.taskResults[r.Token] = r
+	return nil
+}
+
+// SendTaskSuccessWithContext records a successful task result.
+func (f *SFN) SendTaskSuccessWithContext(ctx aws.Context, input *sfn.SendTaskSuccessInput, opts ...request.Option) (*sfn.SendTaskSuccessOutput, error) {
+	err := f.record(TaskResult{Token: aws.StringValue(input.TaskToken), Success: true, Output: aws.StringValue(input.Output)})
+	if err != nil {
+		return nil, err
+	}
+	return &sfn.SendTaskSuccessOutput{}, nil
+}
+
+// SendTaskFailureWithContext records a failed task result.
+func (f *SFN) SendTaskFailureWithContext(ctx aws.Context, input *sfn.SendTaskFailureInput, opts ...request.Option) (*sfn.SendTaskFailureOutput, error) {
+	err := f.record(TaskResult{Token: aws.StringValue(input.TaskToken), Error: aws.StringValue(input.Error), Cause: aws.StringValue(input.Cause)})
+	if err != nil {
+		return nil, err
+	}
+	return &sfn.SendTaskFailureOutput{}, nil
+}
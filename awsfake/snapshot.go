@@ -0,0 +1,149 @@
+package awsfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Snapshot is the JSON form of a State, used to seed the fakes from a file
+// and to carry the state of the simulated resources from one local
+// invocation to the next:
+//
+//	{
+//	  "instances": [{"id": "i-0123456789abcdef0", "state": "stopped", "tags": {"Environment": "dev"}}],
+//	  "instanceTransition": "30s",
+//	  "jobDuration": "2m",
+//	  "failJobs": {"nightly-report": "Essential container in task exited"}
+//	}
+type Snapshot struct {
+	Instances          []Instance        `json:"instances,omitempty"`
+	Commands           []Command         `json:"commands,omitempty"`
+	Jobs               []Job             `json:"jobs,omitempty"`
+	TaskResults        []TaskResult      `json:"taskResults,omitempty"`
+	FailJobs           map[string]string `json:"failJobs,omitempty"`
+	InstanceTransition string            `json:"instanceTransition,omitempty"`
+	JobQueueTime       string            `json:"jobQueueTime,omitempty"`
+	JobDuration        string            `json:"jobDuration,omitempty"`
+	CommandStatus      string            `json:"commandStatus,omitempty"`
+	PageSize           int               `json:"pageSize,omitempty"`
+	Seq                int               `json:"seq,omitempty"`
+}
+
+// Snapshot returns the current contents of the State.
+func (s *State) Snapshot() *Snapshot {
+	snap := &Snapshot{
+		Instances:     s.Instances(),
+		Jobs:          s.Jobs(),
+		JobDuration:   s.JobDuration.String(),
+		CommandStatus: s.CommandStatus,
+		PageSize:      s.PageSize,
+	}
+	if s.InstanceTransition > 0 {
+		snap.InstanceTransition = s.InstanceTransition.String()
+	}
+	if s.JobQueueTime > 0 {
+		snap.JobQueueTime = s.JobQueueTime.String()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.commands {
+		snap.Commands = append(snap.Commands, *c)
+	}
+	sort.Slice(snap.Commands, func(i, j int) bool { return snap.Commands[i].ID < snap.Commands[j].ID })
+	for _, r := range s.taskResults {
+		snap.TaskResults = append(snap.TaskResults, r)
+	}
+	sort.Slice(snap.TaskResults, func(i, j int) bool { return snap.TaskResults[i].Token < snap.TaskResults[j].Token })
+	if len(s.failJobs) > 0 {
+		snap.FailJobs = make(map[string]string)
+		for k, v := range s.failJobs {
+			snap.FailJobs[k] = v
+		}
+	}
+	snap.Seq = s.seq
+	return snap
+}
+
+// Restore adds the contents of snap to the State, and applies its settings.
+func (s *State) Restore(snap *Snapshot) error {
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"instanceTransition", snap.InstanceTransition, &s.InstanceTransition},
+		{"jobQueueTime", snap.JobQueueTime, &s.JobQueueTime},
+		{"jobDuration", snap.JobDuration, &s.JobDuration},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", d.name, err)
+		}
+		*d.dst = v
+	}
+	if snap.CommandStatus != "" {
+		s.CommandStatus = snap.CommandStatus
+	}
+	if snap.PageSize > 0 {
+		s.PageSize = snap.PageSize
+	}
+	for _, in := range snap.Instances {
+		if in.ID == "" {
+			return fmt.Errorf("instances require an id")
+		}
+		s.AddInstance(in)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range snap.Commands {
+		c := snap.Commands[i]
+		s.commands[c.ID] = &c
+	}
+	for i := range snap.Jobs {
+		j := snap.Jobs[i]
+		s.jobs[j.ID] = &j
+	}
+	for _, r := range snap.TaskResults {
+		s.taskResults[r.Token] = r
+	}
+	for k, v := range snap.FailJobs {
+		s.failJobs[k] = v
+	}
+	if snap.Seq > s.seq {
+		s.seq = snap.Seq
+	}
+	return nil
+}
+
+// LoadState returns a new State restored from the snapshot file at path.
+func LoadState(path string) (*State, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{}
+	if err := json.Unmarshal(b, snap); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	st := NewState()
+	if err := st.Restore(snap); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return st, nil
+}
+
+// SaveState writes a snapshot of the State to the file at path.
+func (s *State) SaveState(path string) error {
+	b, err := json.MarshalIndent(s.Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,138 @@
+package awsfake
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// SSM is a fake SSM client.  Commands complete as soon as they are sent,
+// with the CommandStatus of the State.  Only the methods called by the cwl
+// handlers are implemented; calling any other method panics.
+type SSM struct {
+	ssmiface.SSMAPI
+	state *State
+}
+
+// NewSSM returns a fake SSM client backed by st.
+func NewSSM(st *State) *SSM {
+	return &SSM{state: st}
+}
+
+// command returns the SSM representation of c.
+func command(c *Command, in *ssm.SendCommandInput) *ssm.Command {
+	params := make(map[string][]*string)
+	for k, v := range c.Parameters {
+		params[k] = aws.StringSlice(v)
+	}
+	cmd := &ssm.Command{
+		CommandId:         aws.String(c.ID),
+		DocumentName:      aws.String(c.DocumentName),
+		InstanceIds:       aws.StringSlice(c.InstanceIDs),
+		Parameters:        params,
+		RequestedDateTime: aws.Time(c.RequestedAt),
+		Status:            aws.String(c.Status),
+		StatusDetails:     aws.String(c.Status),
+		TargetCount:       aws.Int64(int64(len(c.InstanceIDs))),
+		CompletedCount:    aws.Int64(int64(len(c.InstanceIDs))),
+		ErrorCount:        aws.Int64(0),
+	}
+	if c.Comment != "" {
+		cmd.Comment = aws.String(c.Comment)
+	}
+	if c.Status != "Success" {
+		cmd.ErrorCount = cmd.CompletedCount
+	}
+	if in != nil {
+		cmd.MaxConcurrency = in.MaxConcurrency
+		cmd.MaxErrors = in.MaxErrors
+		cmd.TimeoutSeconds = in.TimeoutSeconds
+	}
+	return cmd
+}
+
+// SendCommandWithContext records a command sent to running instances.
+func (f *SSM) SendCommandWithContext(ctx aws.Context, input *ssm.SendCommandInput, opts ...request.Option) (*ssm.SendCommandOutput, error) {
+	if aws.StringValue(input.DocumentName) == "" {
+		return nil, awserr.New("ValidationException", "DocumentName is required", nil)
+	}
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	for _, id := range aws.StringValueSlice(input.InstanceIds) {
+		in, ok := f.state.instances[id]
+		if ok {
+			f.state.settle(in)
+		}
+		if !ok || in.State != InstanceRunning {
+			return nil, awserr.New(ssm.ErrCodeInvalidInstanceId, fmt.Sprintf("instance %s is not in a valid state for the command", id), nil)
+		}
+	}
+	c := &Command{
+		ID:           f.state.newID(),
+		DocumentName: aws.StringValue(input.DocumentName),
+		Comment:      aws.StringValue(input.Comment),
+		InstanceIDs:  aws.StringValueSlice(input.InstanceIds),
+		Parameters:   make(map[string][]string),
+		Status:       f.state.CommandStatus,
+		RequestedAt:  f.state.Now().UTC(),
+	}
+	for k, v := range input.Parameters {
+		c.Parameters[k] = aws.StringValueSlice(v)
+	}
+	f.state.commands[c.ID] = c
+	return &ssm.SendCommandOutput{Command: command(c, input)}, nil
+}
+
+// ListCommandsWithContext returns the command named by CommandId, or every
+// command sent through the fake.
+func (f *SSM) ListCommandsWithContext(ctx aws.Context, input *ssm.ListCommandsInput, opts ...request.Option) (*ssm.ListCommandsOutput, error) {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	out := &ssm.ListCommandsOutput{}
+	if id := aws.StringValue(input.CommandId); id != "" {
+		c, ok := f.state.commands[id]
+		if !ok {
+			return nil, awserr.New(ssm.ErrCodeInvalidCommandId, "", nil)
+		}
+		out.Commands = append(out.Commands, command(c, nil))
+		return out, nil
+	}
+	for _, c := range f.state.commands {
+		out.Commands = append(out.Commands, command(c, nil))
+	}
+	return out, nil
+}
+
+// GetCommandInvocationWithContext returns the result of a command on one of
+// the instances it was sent to.  A failed command has response code 1.
+func (f *SSM) GetCommandInvocationWithContext(ctx aws.Context, input *ssm.GetCommandInvocationInput, opts ...request.Option) (*ssm.GetCommandInvocationOutput, error) {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	c, ok := f.state.commands[aws.StringValue(input.CommandId)]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeInvalidCommandId, "", nil)
+	}
+	id := aws.StringValue(input.InstanceId)
+	if !contains(c.InstanceIDs, id) {
+		return nil, awserr.New(ssm.ErrCodeInvocationDoesNotExist, "", nil)
+	}
+	code := int64(0)
+	if c.Status != "Success" {
+		code = 1
+	}
+	return &ssm.GetCommandInvocationOutput{
+		CommandId:             aws.String(c.ID),
+		InstanceId:            aws.String(id),
+		DocumentName:          aws.String(c.DocumentName),
+		Comment:               aws.String(c.Comment),
+		Status:                aws.String(c.Status),
+		StatusDetails:         aws.String(c.Status),
+		ResponseCode:          aws.Int64(code),
+		StandardOutputContent: aws.String(c.Output),
+		StandardErrorContent:  aws.String(""),
+	}, nil
+}
@@ -0,0 +1,307 @@
+// Package awsfake provides in-memory fakes of the EC2, SSM, AWS Batch and
+// Step Functions clients used by the cwl handlers.  The fakes share a
+// State, so that a command sent to an instance by one handler refers to the
+// instance started by another, and can be supplied to the handlers with
+// cwl.WithClients:
+//
+//	st := awsfake.NewState()
+//	st.AddInstance(awsfake.Instance{ID: "i-0123456789abcdef0", State: "stopped"})
+//	ctx = cwl.WithClients(ctx, &cwl.Clients{
+//		EC2:   awsfake.NewEC2(st),
+//		SSM:   awsfake.NewSSM(st),
+//		Batch: awsfake.NewBatch(st),
+//	})
+//
+// Server serves the same State over HTTP, for tests that should exercise
+// the AWS SDK serialization as well as the handlers.
+package awsfake
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EC2 instance state names
+const (
+	InstancePending      = "pending"
+	InstanceRunning      = "running"
+	InstanceShuttingDown = "shutting-down"
+	InstanceTerminated   = "terminated"
+	InstanceStopping     = "stopping"
+	InstanceStopped      = "stopped"
+)
+
+// instanceStateCodes maps the EC2 instance state names to their codes.
+var instanceStateCodes = map[string]int64{
+	InstancePending:      0,
+	InstanceRunning:      16,
+	InstanceShuttingDown: 32,
+	InstanceTerminated:   48,
+	InstanceStopping:     64,
+	InstanceStopped:      80,
+}
+
+// Instance is an EC2 instance known to the fake.
+type Instance struct {
+	ID         string            `json:"id"`
+	Type       string            `json:"type,omitempty"`
+	State      string            `json:"state,omitempty"`
+	PublicIP   string            `json:"publicIp,omitempty"`
+	PrivateIP  string            `json:"privateIp,omitempty"`
+	LaunchTime time.Time         `json:"launchTime,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+
+	// Hibernation is set if the instance is configured for hibernation,
+	// so that it may be stopped with hibernate.
+	Hibernation bool `json:"hibernation,omitempty"`
+
+	// DisableAPITermination is set if the instance is protected from
+	// termination through the API.
+	DisableAPITermination bool `json:"disableApiTermination,omitempty"`
+
+	// StateChangedAt is the time the instance entered its State.
+	StateChangedAt time.Time `json:"stateChangedAt,omitempty"`
+}
+
+// Command is an SSM command sent through the fake.
+type Command struct {
+	ID           string              `json:"id"`
+	DocumentName string              `json:"documentName"`
+	Comment      string              `json:"comment,omitempty"`
+	InstanceIDs  []string            `json:"instanceIds"`
+	Parameters   map[string][]string `json:"parameters,omitempty"`
+	Status       string              `json:"status"`
+	Output       string              `json:"output,omitempty"`
+	RequestedAt  time.Time           `json:"requestedAt"`
+}
+
+// Job is an AWS Batch job submitted through the fake.
+type Job struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Queue      string    `json:"queue"`
+	Definition string    `json:"definition"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// State is the model of the AWS resources shared by the fakes.  It is safe
+// for concurrent use.
+type State struct {
+	// Now returns the current time; it may be replaced by a virtual clock
+	// so that Batch jobs progress with the simulated passage of time.
+	Now func() time.Time
+
+	// InstanceTransition is the time an instance spends in the pending,
+	// stopping and shutting-down states before becoming running, stopped
+	// or terminated.  With the default of zero, instances change state as
+	// soon as they are started or stopped.
+	InstanceTransition time.Duration
+
+	// JobQueueTime is the time a Batch job spends passing through the
+	// SUBMITTED, PENDING, RUNNABLE and STARTING statuses, in equal parts,
+	// before it is RUNNING.  The default of zero starts jobs immediately.
+	JobQueueTime time.Duration
+
+	// JobDuration is the time a Batch job spends RUNNING before reaching
+	// its final status.
+	JobDuration time.Duration
+
+	// CommandStatus is the status given to SSM commands when sent.
+	CommandStatus string
+
+	// PageSize limits the number of results returned by a paginated call.
+	// A smaller MaxResults in the request limits it further.
+	PageSize int
+
+	mu        sync.Mutex
+	seq       int
+	instances map[string]*Instance
+	commands  map[string]*Command
+	jobs      map[string]*Job
+	failJobs  map[string]string
+
+	taskResults map[string]TaskResult
+}
+
+// NewState returns an empty State using the system clock.
+func NewState() *State {
+	return &State{
+		Now:           time.Now,
+		JobDuration:   2 * time.Minute,
+		CommandStatus: "Success",
+		PageSize:      1000,
+		instances:     make(map[string]*Instance),
+		commands:      make(map[string]*Command),
+		jobs:          make(map[string]*Job),
+		failJobs:      make(map[string]string),
+		taskResults:   make(map[string]TaskResult),
+	}
+}
+
+// AddInstance adds an instance to the model, replacing any instance with
+// the same ID.  An instance with no State is running, and one with no Type
+// is a t2.micro.
+func (s *State) AddInstance(in Instance) {
+	if in.State == "" {
+		in.State = InstanceRunning
+	}
+	if in.Type == "" {
+		in.Type = "t2.micro"
+	}
+	if in.LaunchTime.IsZero() {
+		in.LaunchTime = s.Now().UTC()
+	}
+	if in.StateChangedAt.IsZero() {
+		in.StateChangedAt = in.LaunchTime
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instances[in.ID] = &in
+}
+
+// Instance returns the instance with the given ID.
+func (s *State) Instance(id string) (Instance, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, ok := s.instances[id]
+	if !ok {
+		return Instance{}, false
+	}
+	s.settle(in)
+	return *in, true
+}
+
+// Instances returns every instance in the model sorted by ID.
+func (s *State) Instances() []Instance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ins []Instance
+	for _, in := range s.instances {
+		s.settle(in)
+		ins = append(ins, *in)
+	}
+	sort.Slice(ins, func(i, j int) bool { return ins[i].ID < ins[j].ID })
+	return ins
+}
+
+// settledStates maps the transitional instance states to the states in
+// which they end.
+var settledStates = map[string]string{
+	InstancePending:      InstanceRunning,
+	InstanceStopping:     InstanceStopped,
+	InstanceShuttingDown: InstanceTerminated,
+}
+
+// settle completes the state transition of an instance once the
+// InstanceTransition has elapsed.  The caller must hold the state lock.
+func (s *State) settle(in *Instance) {
+	to, ok := settledStates[in.State]
+	if ok && s.Now().Sub(in.StateChangedAt) >= s.InstanceTransition {
+		in.State = to
+		in.StateChangedAt = in.StateChangedAt.Add(s.InstanceTransition)
+	}
+}
+
+// SetInstanceState places an instance in the given state, as though it had
+// been changed outside of the handlers; for example, terminated by an Auto
+// Scaling group.  A transitional state settles after InstanceTransition.
+func (s *State) SetInstanceState(id, state string) error {
+	if _, ok := instanceStateCodes[state]; !ok {
+		return fmt.Errorf("unknown instance state %q", state)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, ok := s.instances[id]
+	if !ok {
+		return fmt.Errorf("unknown instance %s", id)
+	}
+	in.State = state
+	in.StateChangedAt = s.Now().UTC()
+	return nil
+}
+
+// SetCommandResult sets the status and standard output of an SSM command
+// on every instance it was sent to.
+func (s *State) SetCommandResult(id, status, output string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.commands[id]
+	if !ok {
+		return fmt.Errorf("unknown command %s", id)
+	}
+	c.Status = status
+	c.Output = output
+	return nil
+}
+
+// Command returns the SSM command with the given ID.
+func (s *State) Command(id string) (Command, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.commands[id]
+	if !ok {
+		return Command{}, false
+	}
+	return *c, true
+}
+
+// Job returns the Batch job with the given ID.
+func (s *State) Job(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+// Jobs returns every Batch job submitted to the model in submission order.
+func (s *State) Jobs() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []Job
+	for _, j := range s.jobs {
+		jobs = append(jobs, *j)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+// FailJob causes Batch jobs named name to end with status FAILED and the
+// given reason rather than SUCCEEDED.
+func (s *State) FailJob(name, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failJobs[name] = reason
+}
+
+// jobQueueStatuses are the statuses of a Batch job before it runs.
+var jobQueueStatuses = []string{"SUBMITTED", "PENDING", "RUNNABLE", "STARTING"}
+
+// JobStatus returns the status of job at the current time, and the reason
+// for a failure.
+func (s *State) JobStatus(job Job) (string, string) {
+	elapsed := s.Now().Sub(job.CreatedAt)
+	if elapsed < s.JobQueueTime {
+		return jobQueueStatuses[int(elapsed*time.Duration(len(jobQueueStatuses))/s.JobQueueTime)], ""
+	}
+	if elapsed < s.JobQueueTime+s.JobDuration {
+		return "RUNNING", ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reason, ok := s.failJobs[job.Name]; ok {
+		return "FAILED", reason
+	}
+	return "SUCCEEDED", ""
+}
+
+// newID returns a deterministic UUID-style identifier.  Deterministic IDs
+// keep the output of tests stable.
+func (s *State) newID() string {
+	s.seq++
+	return fmt.Sprintf("%08x-0000-4000-8000-%012x", s.seq, s.seq)
+}
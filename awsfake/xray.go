@@ -0,0 +1,150 @@
+package awsfake
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TraceSegment is an X-Ray segment or subsegment document received by an
+// XRayDaemon.
+type TraceSegment struct {
+	Name        string                 `json:"name"`
+	ID          string                 `json:"id"`
+	TraceID     string                 `json:"trace_id"`
+	ParentID    string                 `json:"parent_id,omitempty"`
+	Type        string                 `json:"type,omitempty"`
+	Namespace   string                 `json:"namespace,omitempty"`
+	StartTime   float64                `json:"start_time"`
+	EndTime     float64                `json:"end_time"`
+	Error       bool                   `json:"error,omitempty"`
+	Fault       bool                   `json:"fault,omitempty"`
+	Throttle    bool                   `json:"throttle,omitempty"`
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+	AWS         map[string]interface{} `json:"aws,omitempty"`
+	Cause       json.RawMessage        `json:"cause,omitempty"`
+}
+
+// Duration returns the time covered by the segment.
+func (s TraceSegment) Duration() time.Duration {
+	return time.Duration((s.EndTime - s.StartTime) * float64(time.Second))
+}
+
+// XRayDaemon is a stand-in for the AWS X-Ray daemon.  It receives segment
+// documents on a local UDP port, as the daemon does, and keeps them for
+// inspection rather than forwarding them to X-Ray.  Set the
+// AWS_XRAY_DAEMON_ADDRESS environment variable of the traced code to Addr.
+type XRayDaemon struct {
+	conn *net.UDPConn
+
+	mu       sync.Mutex
+	segments []TraceSegment
+	invalid  int
+	received chan struct{}
+}
+
+// NewXRayDaemon returns an XRayDaemon listening on a free local port.
+func NewXRayDaemon() (*XRayDaemon, error) {
+	return ListenXRayDaemon("127.0.0.1:0")
+}
+
+// ListenXRayDaemon returns an XRayDaemon listening on addr, for example
+// "127.0.0.1:2000", the default address of the X-Ray daemon.
+func ListenXRayDaemon(addr string) (*XRayDaemon, error) {
+	ua, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", ua)
+	if err != nil {
+		return nil, err
+	}
+	d := &XRayDaemon{conn: conn, received: make(chan struct{}, 1)}
+	go d.serve()
+	return d, nil
+}
+
+// Addr returns the UDP address of the daemon.
+func (d *XRayDaemon) Addr() string {
+	return d.conn.LocalAddr().String()
+}
+
+// Close stops the daemon.
+func (d *XRayDaemon) Close() error {
+	return d.conn.Close()
+}
+
+// serve receives datagrams of the form {"format": "json", "version": 1}
+// followed by a newline and a segment document.
+func (d *XRayDaemon) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := d.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		var seg TraceSegment
+		header, doc, ok := bytes.Cut(buf[:n], []byte("\n"))
+		var h struct {
+			Format  string `json:"format"`
+			Version int    `json:"version"`
+		}
+		ok = ok && json.Unmarshal(header, &h) == nil && h.Format == "json" && h.Version == 1
+		d.mu.Lock()
+		if ok && json.Unmarshal(doc, &seg) == nil && seg.ID != "" && seg.TraceID != "" {
+			d.segments = append(d.segments, seg)
+		} else {
+			d.invalid++
+		}
+		d.mu.Unlock()
+		select {
+		case d.received <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Segments returns the segments received so far, ordered by start time.
+func (d *XRayDaemon) Segments() []TraceSegment {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	segs := append([]TraceSegment(nil), d.segments...)
+	sort.SliceStable(segs, func(i, j int) bool { return segs[i].StartTime < segs[j].StartTime })
+	return segs
+}
+
+// Invalid returns the number of datagrams received that were not valid
+// segment documents.
+func (d *XRayDaemon) Invalid() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.invalid
+}
+
+// WaitFor waits up to timeout for at least n segments to be received, and
+// returns the segments received.  Segments are sent over UDP without
+// acknowledgement, so they may arrive after the traced call returns.
+func (d *XRayDaemon) WaitFor(n int, timeout time.Duration) []TraceSegment {
+	deadline := time.After(timeout)
+	for {
+		if segs := d.Segments(); len(segs) >= n {
+			return segs
+		}
+		select {
+		case <-d.received:
+		case <-deadline:
+			return d.Segments()
+		}
+	}
+}
+
+// Reset discards the segments received so far.
+func (d *XRayDaemon) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.segments = nil
+	d.invalid = 0
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/1414C/cwl/deploy"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// aliasOp is an operation applied to an alias of a deployed function.
+type aliasOp func(ctx context.Context, svc lambdaiface.LambdaAPI, function, alias string) (*deploy.AliasState, error)
+
+// promoteCmd moves an alias to its canary version for each manifest.
+func promoteCmd(args []string) error {
+	return aliasCmd("promote", args, deploy.Promote)
+}
+
+// rollbackCmd re-points an alias at the previous version for each manifest.
+func rollbackCmd(args []string) error {
+	return aliasCmd("rollback", args, deploy.Rollback)
+}
+
+// aliasCmd parses the common alias command flags and applies op to the
+// alias of every function named by the manifests.
+func aliasCmd(name string, args []string, op aliasOp) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	profile := fs.String("profile", "", "AWS shared-config profile (default $AWS_PROFILE)")
+	alias := fs.String("alias", "", "alias to "+name+" (required)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: cwl %s -alias name [flags] manifest.json|dir ...\n", name)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *alias == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("an alias and at least one manifest are required")
+	}
+
+	manifests, err := loadManifests(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for _, m := range manifests {
+		sess, err := newSession(*profile, m.Region)
+		if err != nil {
+			return err
+		}
+		state, err := op(ctx, lambda.New(sess), m.Name, *alias)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", m.Name, state)
+	}
+	return nil
+}
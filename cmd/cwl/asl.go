@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/1414C/cwl/asl"
+)
+
+// aslCmd builds, validates and writes the Amazon States Language definition
+// of a cwl workflow, or validates existing definition files.
+func aslCmd(args []string) error {
+	fs := flag.NewFlagSet("asl", flag.ExitOnError)
+	out := fs.String("o", "", "write the definition to file rather than stdout")
+	workflow := fs.String("workflow", "batch", "workflow to write: batch or instance-command")
+	submit := fs.String("submit", "${SubmitJobFunc3Arn}", "ARN of the SubmitJobFunc3 function")
+	check := fs.String("check", "${CheckJobFunc3Arn}", "ARN of the CheckJobFunc3 function")
+	start := fs.String("start", "${EC2InstancesStartCallbackArn}", "ARN of the EC2InstancesStartCallback function")
+	issue := fs.String("issue", "${EC2IssueCmdCallbackArn}", "ARN of the EC2IssueCmdCallback function")
+	validate := fs.Bool("validate", false, "validate the definition files named as arguments")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cwl asl [-o file] [-workflow batch] [-submit arn] [-check arn]")
+		fmt.Fprintln(os.Stderr, "       cwl asl [-o file] -workflow instance-command [-start arn] [-issue arn]")
+		fmt.Fprintln(os.Stderr, "       cwl asl -validate definition.json ...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *validate {
+		for _, f := range fs.Args() {
+			b, err := os.ReadFile(f)
+			if err != nil {
+				return err
+			}
+			if _, err := asl.Parse(b); err != nil {
+				return fmt.Errorf("%s: %v", f, err)
+			}
+			fmt.Printf("%s: ok\n", f)
+		}
+		return nil
+	}
+
+	var sm *asl.StateMachine
+	switch *workflow {
+	case "batch":
+		sm = asl.BatchJob(*submit, *check)
+	case "instance-command":
+		sm = asl.InstanceCommand(*start, *issue)
+	default:
+		return fmt.Errorf("unknown workflow %q; use batch or instance-command", *workflow)
+	}
+	if err := sm.Validate(); err != nil {
+		return err
+	}
+	b, err := sm.JSON()
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(*out, b, 0644)
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// newSession creates an AWS session for region using the named profile from
+// the shared configuration files.  An empty profile selects $AWS_PROFILE or
+// the default profile.
+func newSession(profile, region string) (*session.Session, error) {
+	return session.NewSessionWithOptions(session.Options{
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+		Config:            aws.Config{Region: aws.String(region)},
+	})
+}
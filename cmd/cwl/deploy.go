@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/1414C/cwl/deploy"
+	"github.com/aws/aws-sdk-go/service/apigatewayv2"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// deployCmd builds and deploys the functions described by the manifests
+// named on the command line.  Directories are expanded to the *.json
+// manifests they contain.
+func deployCmd(args []string) error {
+	fs := flag.NewFlagSet("deploy", flag.ExitOnError)
+	profile := fs.String("profile", "", "AWS shared-config profile (default $AWS_PROFILE)")
+	buildOnly := fs.Bool("build-only", false, "build and package the functions without deploying them")
+	alias := fs.String("alias", "", "alias (e.g. dev, staging, prod) to point at the published version")
+	canary := fs.Float64("canary", 0, "percentage of alias traffic routed to the new version; the remainder stays on the current version")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cwl deploy [flags] manifest.json|dir ...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no manifests specified")
+	}
+
+	if *canary < 0 || *canary >= 100 {
+		return fmt.Errorf("canary percentage %v must be in the range 0-100 (exclusive)", *canary)
+	}
+	if *canary > 0 && *alias == "" {
+		return fmt.Errorf("-canary requires -alias")
+	}
+
+	manifests, err := loadManifests(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	// functions served by the same binary share one build per architecture
+	ctx := context.Background()
+	built := make(map[string]*deploy.Artifact)
+	for _, m := range manifests {
+		key := m.PackageDir() + "/" + m.Architecture
+		a, ok := built[key]
+		if !ok {
+			a, err = deploy.Build(ctx, m)
+			if err != nil {
+				return err
+			}
+			built[key] = a
+		}
+		fmt.Printf("%s: built %s deployment package, %d bytes, sha256 %s\n", m.Name, m.Architecture, len(a.Zip), a.CodeSha256)
+		if *buildOnly {
+			continue
+		}
+
+		sess, err := newSession(*profile, m.Region)
+		if err != nil {
+			return err
+		}
+		svc := lambda.New(sess)
+		res, err := deploy.Deploy(ctx, svc, m, a)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s (created: %t, config updated: %t, code updated: %t)\n", m.Name, res.FunctionArn, res.Created, res.ConfigUpdated, res.CodeUpdated)
+
+		// every deploy publishes a version so that aliases can be moved
+		// forward and rolled back.
+		version, err := deploy.Publish(ctx, svc, m, res)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: version %s\n", m.Name, version)
+		if *alias != "" {
+			state, err := deploy.PointAlias(ctx, svc, m.Name, *alias, version, *canary/100)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: %s\n", m.Name, state)
+		}
+
+		// bring the schedules, queues, topics and routes that invoke the
+		// function into line with the manifest.
+		err = deploy.SyncTriggers(ctx, &deploy.TriggerClients{
+			Lambda:      svc,
+			EventBridge: eventbridge.New(sess),
+			SNS:         sns.New(sess),
+			APIGateway:  apigatewayv2.New(sess),
+		}, m, res.FunctionArn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadManifests reads the manifests named by paths, expanding directories
+// to the *.json files they contain.
+func loadManifests(paths []string) ([]*deploy.Manifest, error) {
+	var files []string
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(p, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	var manifests []*deploy.Manifest
+	for _, f := range files {
+		m, err := deploy.LoadManifest(f)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests, nil
+}
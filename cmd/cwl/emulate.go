@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/1414C/cwl/deploy"
+	"github.com/1414C/cwl/runtimeapi"
+)
+
+// envFlags collects repeated -env KEY=VALUE flags.
+type envFlags map[string]string
+
+func (e envFlags) String() string { return "" }
+
+func (e envFlags) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("%q is not of the form KEY=VALUE", s)
+	}
+	e[k] = v
+	return nil
+}
+
+// emulateCmd runs a built function binary under the local Runtime API
+// emulator, invoking it once per event file.
+func emulateCmd(args []string) error {
+	fs := flag.NewFlagSet("emulate", flag.ExitOnError)
+	manifest := fs.String("manifest", "", "function manifest providing the handler, memory, timeout, Region and environment")
+	binary := fs.String("binary", "", "function binary built for this machine (default: build the manifest's package)")
+	memory := fs.Int("memory", 0, "memory size in MB (default from the manifest, or 128)")
+	timeout := fs.Duration("timeout", 0, "function timeout (default from the manifest, or 3s)")
+	trace := fs.Bool("trace", false, "enable X-Ray tracing, and write the segments to stderr once the events are done")
+	env := envFlags{}
+	fs.Var(env, "env", "additional environment variable KEY=VALUE; may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cwl emulate [flags] [event.json|- ...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *manifest == "" && *binary == "" {
+		fs.Usage()
+		return fmt.Errorf("a manifest or a binary is required")
+	}
+
+	var cfg runtimeapi.Config
+	if *manifest != "" {
+		m, err := deploy.LoadManifest(*manifest)
+		if err != nil {
+			return err
+		}
+		if *binary == "" {
+			dir, err := os.MkdirTemp("", "cwl-emulate-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+			*binary = filepath.Join(dir, "bootstrap")
+			log.Printf("building %s", m.PackageDir())
+			if err := deploy.BuildBinary(context.Background(), m.PackageDir(), runtime.GOOS, runtime.GOARCH, *binary); err != nil {
+				return err
+			}
+		}
+		cfg = runtimeapi.ConfigFromManifest(m, *binary)
+	} else {
+		cfg = runtimeapi.Config{Name: filepath.Base(*binary), Binary: *binary, Env: map[string]string{}}
+	}
+	if *memory != 0 {
+		cfg.Memory = *memory
+	}
+	if *timeout != 0 {
+		cfg.Timeout = *timeout
+	}
+	if *trace {
+		d, tenv, err := startTrace()
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		for k, v := range tenv {
+			cfg.Env[k] = v
+		}
+		cfg.Tracing = true
+		defer printTrace(os.Stderr, d)
+	}
+	for k, v := range env {
+		cfg.Env[k] = v
+	}
+
+	events := fs.Args()
+	if len(events) == 0 {
+		events = []string{"-"}
+	}
+
+	em, err := runtimeapi.New(cfg)
+	if err != nil {
+		return err
+	}
+	defer em.Close()
+
+	// each event is written to stdout as a response or error, one per
+	// line, in the order given
+	failed := false
+	for _, name := range events {
+		payload, err := readEvent(name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		res, err := em.Invoke(context.Background(), payload)
+		if err != nil {
+			return err
+		}
+		if res.Error != nil {
+			failed = true
+			b, _ := json.Marshal(res.Error)
+			fmt.Println(string(b))
+			continue
+		}
+		fmt.Println(string(res.Payload))
+	}
+	if failed {
+		return errHandlerFailed
+	}
+	return nil
+}
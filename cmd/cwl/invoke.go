@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/1414C/cwl/awsfake"
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// errHandlerFailed is returned by invokeCmd when the handler returned an
+// error, which has already been written as a Lambda error response.
+var errHandlerFailed = errors.New("handler returned an error")
+
+// invokeCmd runs a handler locally with the JSON event read from a file or
+// stdin, and writes the response to stdout as Lambda would return it.
+func invokeCmd(args []string) error {
+	fs := flag.NewFlagSet("invoke", flag.ExitOnError)
+	profile := fs.String("profile", "", "AWS shared-config profile (default $AWS_PROFILE)")
+	region := fs.String("region", "us-west-2", "AWS Region of the clients used by the handler")
+	fake := fs.Bool("fake", false, "call fake AWS clients rather than AWS")
+	state := fs.String("state", "", "seed the fake AWS clients from a snapshot file, and save the updated state to it (implies -fake)")
+	timeout := fs.Duration("timeout", 10*time.Second, "function timeout")
+	trace := fs.Bool("trace", false, "trace the handler with X-Ray, and write the segments to stderr")
+	correlationID := fs.String("correlation-id", "", "correlation ID of the handler's log records, passed in the client context (default the request ID)")
+	caller := fs.String("caller", localUser(), "caller recorded in the audit trail, passed in the client context")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cwl invoke [flags] handler [event.json|-]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return fmt.Errorf("a handler name and optional event file are required")
+	}
+
+	name := fs.Arg(0)
+	def, ok := cwl.LookupHandler(name)
+	if !ok {
+		var names []string
+		for _, d := range cwl.Handlers() {
+			names = append(names, d.Name)
+		}
+		return fmt.Errorf("unknown handler %q. known handlers: %s", name, strings.Join(names, ", "))
+	}
+
+	payload, err := readEvent(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	checkEvent(def, payload)
+
+	// the clients used by the handler
+	var clients *cwl.Clients
+	var st *awsfake.State
+	if *fake || *state != "" {
+		st = awsfake.NewState()
+		if *state != "" {
+			if st, err = loadOrCreateState(*state); err != nil {
+				return err
+			}
+		}
+		clients = &cwl.Clients{
+			EC2:         awsfake.NewEC2(st),
+			SSM:         awsfake.NewSSM(st),
+			Batch:       awsfake.NewBatch(st),
+			SFN:         awsfake.NewSFN(st),
+			Callbacks:   cwl.NewMemoryCallbackStore(),
+			Idempotency: cwl.NewMemoryIdempotencyStore(),
+		}
+	} else {
+		sess, err := newSession(*profile, *region)
+		if err != nil {
+			return err
+		}
+		clients = &cwl.Clients{
+			EC2:      ec2.New(sess),
+			SSM:      ssm.New(sess),
+			Batch:    batch.New(sess),
+			SFN:      sfn.New(sess),
+			DynamoDB: dynamodb.New(sess),
+			S3:       s3.New(sess),
+			SNS:      sns.New(sess),
+		}
+	}
+
+	// an invocation context resembling the one provided by Lambda
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	lambdacontext.FunctionName = name
+	ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{
+		AwsRequestID:       requestID(),
+		InvokedFunctionArn: fmt.Sprintf("arn:aws:lambda:%s:000000000000:function:%s", *region, name),
+		ClientContext:      lambdacontext.ClientContext{Custom: map[string]string{"correlationId": *correlationID, "caller": *caller}},
+	})
+	ctx = cwl.WithClients(ctx, clients)
+
+	if *trace {
+		d, env, err := startTrace()
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		defer setEnv(env)()
+		defer printTrace(os.Stderr, d)
+	}
+
+	// handler logging goes to stderr, as it would to CloudWatch Logs
+	log.SetPrefix("")
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	resp, err := invoke(ctx, name, payload)
+	log.SetPrefix("cwl: ")
+	log.SetFlags(0)
+
+	if st != nil && *state != "" {
+		if serr := st.SaveState(*state); serr != nil {
+			return serr
+		}
+	}
+	if err != nil {
+		b, _ := json.Marshal(errorResponse(err))
+		fmt.Println(string(b))
+		return errHandlerFailed
+	}
+	fmt.Println(string(resp))
+	return nil
+}
+
+// invoke runs the handler, converting a panic into an error as the Lambda
+// runtime does.
+func invoke(ctx context.Context, name string, payload []byte) (resp []byte, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			if perr, ok := p.(error); ok {
+				err = perr
+			} else {
+				err = &messages.InvokeResponse_Error{Message: fmt.Sprintf("%v", p), Type: errorType(p)}
+			}
+		}
+	}()
+	return cwl.NewRouter().InvokeHandler(ctx, name, payload)
+}
+
+// errorResponse returns the error response Lambda reports for err.
+func errorResponse(err error) *messages.InvokeResponse_Error {
+	var ierr *messages.InvokeResponse_Error
+	if errors.As(err, &ierr) {
+		return ierr
+	}
+	return &messages.InvokeResponse_Error{Message: err.Error(), Type: errorType(err)}
+}
+
+// errorType returns the name of the type of v, which Lambda reports as the
+// errorType of a failed invocation.
+func errorType(v interface{}) string {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		return t.Elem().Name()
+	}
+	return t.Name()
+}
+
+// readEvent reads the event from the named file, or from stdin if name is
+// empty or "-".
+func readEvent(name string) ([]byte, error) {
+	var b []byte
+	var err error
+	if name == "" || name == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		b = []byte("{}")
+	}
+	if !json.Valid(b) {
+		return nil, fmt.Errorf("event is not valid JSON")
+	}
+	return b, nil
+}
+
+// checkEvent decodes the payload strictly into the event type of the handler
+// and warns of fields that the handler will ignore, which are usually
+// misspellings.  Lambda itself ignores unknown fields.
+func checkEvent(def cwl.HandlerDef, payload []byte) {
+	et := def.EventType()
+	if et == nil {
+		return
+	}
+
+	// the invocation fields accepted with any event are not reported
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(payload, &fields) == nil {
+		meta := reflect.TypeOf(cwl.InvocationMeta{})
+		for i := 0; i < meta.NumField(); i++ {
+			name, _, _ := strings.Cut(meta.Field(i).Tag.Get("json"), ",")
+			delete(fields, name)
+		}
+		payload, _ = json.Marshal(fields)
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(reflect.New(et).Interface()); err != nil {
+		fmt.Fprintf(os.Stderr, "cwl: warning: event does not match %s: %v\n", et, err)
+	}
+}
+
+// loadOrCreateState loads the fake state snapshot at path, or returns an
+// empty state if the file does not yet exist.
+func loadOrCreateState(path string) (*awsfake.State, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return awsfake.NewState(), nil
+	}
+	return awsfake.LoadState(path)
+}
+
+// requestID returns a random UUID in the form used for Lambda request-ids.
+func requestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// localUser returns the name of the user running cwl, the default caller of
+// the handlers it invokes.
+func localUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,71 @@
+// Command cwl is the build, deployment and local test tool for the cwl
+// Lambda functions.  It replaces the per-folder cwbldlambda.sh scripts.
+//
+// usage:
+//
+//	cwl <command> [flags] [arguments]
+//
+// Run cwl help for the list of commands.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// command is a cwl sub-command.
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{
+	"asl":      {"write or validate the Step Functions state machine definitions", aslCmd},
+	"deploy":   {"build and create-or-update functions from their manifests", deployCmd},
+	"emulate":  {"run a built function binary under a local Lambda Runtime API", emulateCmd},
+	"invoke":   {"run a handler locally against a JSON event", invokeCmd},
+	"policy":   {"generate a least-privilege IAM policy for handlers", policyCmd},
+	"promote":  {"complete a canary release by moving an alias to the canary version", promoteCmd},
+	"rollback": {"re-point an alias at the previous version of its functions", rollbackCmd},
+	"schema":   {"write the JSON Schemas of the handler events", schemaCmd},
+	"template": {"write a SAM template for every registered handler", templateCmd},
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("cwl: ")
+
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" {
+		usage()
+		return
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "cwl: unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		if err == errHandlerFailed {
+			os.Exit(1)
+		}
+		log.Fatal(err)
+	}
+}
+
+// usage writes the list of commands to stderr.
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: cwl <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", n, commands[n].summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nrun cwl <command> -h for help on a command")
+}
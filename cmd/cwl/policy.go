@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/1414C/cwl/handler"
+)
+
+// tagFlags collects repeated -tag key=value flags.
+type tagFlags map[string]string
+
+func (t tagFlags) String() string {
+	var s []string
+	for k, v := range t {
+		s = append(s, k+"="+v)
+	}
+	return strings.Join(s, ",")
+}
+
+func (t tagFlags) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("tag %q must be of the form key=value", v)
+	}
+	t[kv[0]] = kv[1]
+	return nil
+}
+
+// policyCmd writes a least-privilege IAM policy document for the handlers
+// named on the command line, or for the handlers of the given manifests.
+func policyCmd(args []string) error {
+	fs := flag.NewFlagSet("policy", flag.ExitOnError)
+	region := fs.String("region", "", "restrict resources to an AWS Region (default any)")
+	account := fs.String("account", "", "restrict resources to an AWS account-id (default any)")
+	manifests := fs.Bool("manifest", false, "arguments are function manifests rather than handler names")
+	tracing := fs.Bool("tracing", false, "grant the X-Ray access needed for active tracing")
+	audit := fs.String("audit", "", "grant access to the audit trail `sink`, e.g. dynamodb://cwl-audit")
+	protection := fs.String("protection", "", "grant access to the protection `policy`, e.g. ssm:///cwl/policy")
+	approvals := fs.String("approvals", "", "grant access to send approval requests to `notify`, e.g. sns://<topic-arn>")
+	holidays := fs.String("holidays", "", "grant access to the scheduler's holiday `calendars`, e.g. ssm:///cwl/holidays")
+	tags := tagFlags{}
+	fs.Var(tags, "tag", "restrict tag-aware actions to resources with tag key=value (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cwl policy [flags] handler ...")
+		fmt.Fprintln(os.Stderr, "       cwl policy -manifest [flags] manifest.json|dir ...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no handlers specified")
+	}
+
+	names := fs.Args()
+	var queues []string
+	if *manifests {
+		ms, err := loadManifests(fs.Args())
+		if err != nil {
+			return err
+		}
+		names = nil
+		for _, m := range ms {
+			names = append(names, m.Handler)
+			if *region == "" {
+				*region = m.Region
+			}
+			if m.Tracing {
+				*tracing = true
+			}
+			if *audit == "" {
+				*audit = m.Audit
+			}
+			if *protection == "" {
+				*protection = m.Policy
+			}
+			if *approvals == "" {
+				*approvals = m.Approvals
+			}
+			if *holidays == "" {
+				*holidays = m.Holidays
+			}
+			queues = append(queues, m.Queues()...)
+		}
+	}
+
+	doc, err := cwl.HandlerPolicy(names, cwl.PolicyOptions{
+		Region:           *region,
+		Account:          *account,
+		Tags:             tags,
+		Tracing:          *tracing,
+		AuditSink:        *audit,
+		ProtectionPolicy: *protection,
+		Approvals:        *approvals,
+		Holidays:         *holidays,
+		Queues:           queues,
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/1414C/cwl/handler"
+)
+
+// schemaCmd writes the JSON Schemas of the handler events, either to stdout
+// for a single handler or to <Handler>.schema.json files in a directory.
+func schemaCmd(args []string) error {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	out := fs.String("o", "", "directory to write a <Handler>.schema.json file per handler to (default: stdout, for a single handler)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cwl schema [-o dir] [handler...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var defs []cwl.HandlerDef
+	if fs.NArg() == 0 {
+		defs = cwl.Handlers()
+	}
+	for _, name := range fs.Args() {
+		def, ok := cwl.LookupHandler(name)
+		if !ok {
+			return fmt.Errorf("unknown handler %q", name)
+		}
+		defs = append(defs, def)
+	}
+	if *out == "" && len(defs) != 1 {
+		fs.Usage()
+		return fmt.Errorf("name a single handler, or use -o to write the schemas of several")
+	}
+
+	for _, def := range defs {
+		s := def.EventSchema()
+		if s == nil {
+			continue
+		}
+		b, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if *out == "" {
+			os.Stdout.Write(b)
+			continue
+		}
+		if err := os.MkdirAll(*out, 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(*out, def.Name+".schema.json"), b, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/1414C/cwl/deploy"
+	"github.com/1414C/cwl/sam"
+)
+
+// templateCmd writes a SAM template covering every registered handler,
+// using the settings of any function manifests named on the command line.
+func templateCmd(args []string) error {
+	fs := flag.NewFlagSet("template", flag.ExitOnError)
+	out := fs.String("o", "", "write the template to file rather than stdout")
+	codeURI := fs.String("code-uri", "mrouter/", "location of the router main package relative to the template")
+	tags := tagFlags{}
+	fs.Var(tags, "tag", "restrict tag-aware IAM actions to resources with tag key=value (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cwl template [flags] [manifest.json|dir ...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var manifests []*deploy.Manifest
+	if fs.NArg() > 0 {
+		var err error
+		if manifests, err = loadManifests(fs.Args()); err != nil {
+			return err
+		}
+	}
+
+	t, err := sam.Generate(manifests, sam.Options{CodeURI: *codeURI, Tags: tags})
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(t); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "template contains %d resources\n", len(t.ResourceIDs()))
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/1414C/cwl/awsfake"
+)
+
+// traceWait is how long to wait for the segments of an invocation to reach
+// the X-Ray daemon stand-in after the invocation returns.
+const traceWait = 200 * time.Millisecond
+
+// startTrace starts an X-Ray daemon stand-in and returns the environment
+// variables that enable tracing to it.
+func startTrace() (*awsfake.XRayDaemon, map[string]string, error) {
+	d, err := awsfake.NewXRayDaemon()
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, map[string]string{
+		"CWL_TRACING":             "active",
+		"AWS_XRAY_DAEMON_ADDRESS": d.Addr(),
+	}, nil
+}
+
+// printTrace writes the segments received by d as an indented tree, one
+// trace at a time, with the duration and annotations of each segment.
+func printTrace(w io.Writer, d *awsfake.XRayDaemon) {
+	d.WaitFor(1, traceWait)
+	time.Sleep(traceWait / 4) // let trailing segments arrive
+	segs := d.Segments()
+
+	ids := make(map[string]bool)
+	children := make(map[string][]awsfake.TraceSegment)
+	for _, s := range segs {
+		ids[s.ID] = true
+	}
+	var roots []awsfake.TraceSegment
+	for _, s := range segs {
+		if ids[s.ParentID] {
+			children[s.ParentID] = append(children[s.ParentID], s)
+		} else {
+			roots = append(roots, s)
+		}
+	}
+	sort.SliceStable(roots, func(i, j int) bool { return roots[i].TraceID < roots[j].TraceID })
+
+	var walk func(s awsfake.TraceSegment, depth int)
+	walk = func(s awsfake.TraceSegment, depth int) {
+		fmt.Fprintf(w, "%s%s", strings.Repeat("  ", depth), s.Name)
+		if op, ok := s.AWS["operation"]; ok {
+			fmt.Fprintf(w, " %v", op)
+		}
+		fmt.Fprintf(w, " %v", s.Duration().Round(time.Microsecond))
+		switch {
+		case s.Fault:
+			fmt.Fprint(w, " fault")
+		case s.Throttle:
+			fmt.Fprint(w, " throttle")
+		case s.Error:
+			fmt.Fprint(w, " error")
+		}
+		var keys []string
+		for k := range s.Annotations {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, " %s=%v", k, s.Annotations[k])
+		}
+		fmt.Fprintln(w)
+		for _, c := range children[s.ID] {
+			walk(c, depth+1)
+		}
+	}
+	trace := ""
+	for _, r := range roots {
+		if r.TraceID != trace {
+			trace = r.TraceID
+			fmt.Fprintf(w, "trace %s\n", trace)
+		}
+		walk(r, 1)
+	}
+}
+
+// setEnv sets the environment variables in env and returns a function
+// restoring their previous values.
+func setEnv(env map[string]string) func() {
+	prev := make(map[string]*string)
+	for k, v := range env {
+		if old, ok := os.LookupEnv(k); ok {
+			prev[k] = &old
+		} else {
+			prev[k] = nil
+		}
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range prev {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// AliasState describes where a function alias points.  During a canary
+// release CanaryVersion receives CanaryWeight (0.0-1.0) of the invocations
+// and Version receives the remainder.  Previous is the version the alias
+// pointed at before Version, to which Rollback returns it; it is empty if
+// the alias has not moved since it was created.
+type AliasState struct {
+	Alias         string
+	Version       string
+	CanaryVersion string
+	CanaryWeight  float64
+	Previous      string
+}
+
+// previousPrefix starts the alias description recording the version the
+// alias pointed at before its current one.
+const previousPrefix = "cwl previous version "
+
+// String returns a readable description of the alias routing.
+func (s *AliasState) String() string {
+	if s.CanaryVersion == "" {
+		return fmt.Sprintf("%s -> version %s", s.Alias, s.Version)
+	}
+	return fmt.Sprintf("%s -> version %s (%.0f%%), version %s (%.0f%%)", s.Alias, s.Version, (1-s.CanaryWeight)*100, s.CanaryVersion, s.CanaryWeight*100)
+}
+
+// Publish publishes a new version of the function from the code and
+// configuration deployed by Deploy.  If neither has changed since the last
+// published version, AWS Lambda returns that version instead of creating
+// a new one.
+func Publish(ctx context.Context, svc lambdaiface.LambdaAPI, m *Manifest, res *Result) (string, error) {
+	out, err := svc.PublishVersionWithContext(ctx, &lambda.PublishVersionInput{
+		FunctionName: aws.String(m.Name),
+		CodeSha256:   aws.String(res.CodeSha256),
+		Description:  aws.String(fmt.Sprintf("cwl deploy sha256 %s", res.CodeSha256)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to publish a version of %s: %v", m.Name, err)
+	}
+	version := aws.StringValue(out.Version)
+	log.Printf("%s: published version %s\n", m.Name, version)
+	return version, nil
+}
+
+// GetAlias returns the current routing of the named alias, or nil if the
+// alias does not exist.
+func GetAlias(ctx context.Context, svc lambdaiface.LambdaAPI, function, alias string) (*AliasState, error) {
+	out, err := svc.GetAliasWithContext(ctx, &lambda.GetAliasInput{
+		FunctionName: aws.String(function),
+		Name:         aws.String(alias),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == lambda.ErrCodeResourceNotFoundException {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to read alias %s of %s: %v", alias, function, err)
+	}
+	return aliasState(out), nil
+}
+
+// PointAlias moves the alias to version, creating the alias if required.
+// If canaryWeight is greater than zero and the alias already exists, the
+// alias continues to point at its current version and version receives
+// canaryWeight (0.0-1.0) of the invocations instead.
+func PointAlias(ctx context.Context, svc lambdaiface.LambdaAPI, function, alias, version string, canaryWeight float64) (*AliasState, error) {
+	if canaryWeight < 0 || canaryWeight >= 1 {
+		return nil, fmt.Errorf("canary weight %v must be in the range 0.0-1.0 (exclusive)", canaryWeight)
+	}
+
+	current, err := GetAlias(ctx, svc, function, alias)
+	if err != nil {
+		return nil, err
+	}
+
+	if current == nil {
+		if canaryWeight > 0 {
+			log.Printf("%s: alias %s does not exist; creating it without a canary\n", function, alias)
+		}
+		out, err := svc.CreateAliasWithContext(ctx, &lambda.CreateAliasInput{
+			FunctionName:    aws.String(function),
+			Name:            aws.String(alias),
+			FunctionVersion: aws.String(version),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to create alias %s of %s: %v", alias, function, err)
+		}
+		return aliasState(out), nil
+	}
+
+	primary, weights := version, map[string]*float64{}
+	if canaryWeight > 0 && current.Version != version {
+		primary = current.Version
+		weights[version] = aws.Float64(canaryWeight)
+	}
+	return updateAlias(ctx, svc, function, current, primary, weights)
+}
+
+// Promote completes a canary release by pointing the alias at the canary
+// version and removing the weighted routing.
+func Promote(ctx context.Context, svc lambdaiface.LambdaAPI, function, alias string) (*AliasState, error) {
+	current, err := GetAlias(ctx, svc, function, alias)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, fmt.Errorf("alias %s of %s does not exist", alias, function)
+	}
+	if current.CanaryVersion == "" {
+		return nil, fmt.Errorf("alias %s of %s has no canary version to promote", alias, function)
+	}
+	return updateAlias(ctx, svc, function, current, current.CanaryVersion, map[string]*float64{})
+}
+
+// Rollback re-points the alias at the version it pointed at before its
+// current one.  If a canary release is in progress, the canary routing is
+// removed and the alias is left on its current (stable) version.  Rolling
+// back twice returns the alias to the version rolled back from.
+func Rollback(ctx context.Context, svc lambdaiface.LambdaAPI, function, alias string) (*AliasState, error) {
+	current, err := GetAlias(ctx, svc, function, alias)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, fmt.Errorf("alias %s of %s does not exist", alias, function)
+	}
+	if current.CanaryVersion != "" {
+		log.Printf("%s: abandoning canary version %s of alias %s\n", function, current.CanaryVersion, alias)
+		return updateAlias(ctx, svc, function, current, current.Version, map[string]*float64{})
+	}
+	if current.Previous == "" {
+		return nil, fmt.Errorf("alias %s of %s records no previous version to roll back to", alias, function)
+	}
+	return updateAlias(ctx, svc, function, current, current.Previous, map[string]*float64{})
+}
+
+// updateAlias points the alias, currently routed as described by current,
+// at version with the given additional version weights.  An empty weights
+// map removes any existing weighted routing.  If the alias moves to another
+// version, the version it leaves is recorded in its description.
+func updateAlias(ctx context.Context, svc lambdaiface.LambdaAPI, function string, current *AliasState, version string, weights map[string]*float64) (*AliasState, error) {
+	input := &lambda.UpdateAliasInput{
+		FunctionName:    aws.String(function),
+		Name:            aws.String(current.Alias),
+		FunctionVersion: aws.String(version),
+		RoutingConfig:   &lambda.AliasRoutingConfiguration{AdditionalVersionWeights: weights},
+	}
+	if version != current.Version {
+		input.Description = aws.String(previousPrefix + current.Version)
+	}
+	out, err := svc.UpdateAliasWithContext(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("unable to update alias %s of %s: %v", current.Alias, function, err)
+	}
+	return aliasState(out), nil
+}
+
+// aliasState converts an AWS Lambda alias configuration to an AliasState.
+func aliasState(cfg *lambda.AliasConfiguration) *AliasState {
+	s := &AliasState{
+		Alias:   aws.StringValue(cfg.Name),
+		Version: aws.StringValue(cfg.FunctionVersion),
+	}
+	if v, ok := strings.CutPrefix(aws.StringValue(cfg.Description), previousPrefix); ok {
+		s.Previous = v
+	}
+	if cfg.RoutingConfig != nil {
+		for v, w := range cfg.RoutingConfig.AdditionalVersionWeights {
+			s.CanaryVersion = v
+			s.CanaryWeight = aws.Float64Value(w)
+		}
+	}
+	return s
+}
@@ -0,0 +1,82 @@
+package deploy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/1414C/cwl/deploy"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// fakeAliases holds the aliases of one function.  As in AWS Lambda, an
+// update without a description keeps the alias's description.
+type fakeAliases struct {
+	lambdaiface.LambdaAPI
+	aliases map[string]*lambda.AliasConfiguration
+}
+
+func (f *fakeAliases) GetAliasWithContext(ctx aws.Context, in *lambda.GetAliasInput, _ ...request.Option) (*lambda.AliasConfiguration, error) {
+	a, ok := f.aliases[aws.StringValue(in.Name)]
+	if !ok {
+		return nil, awserr.New(lambda.ErrCodeResourceNotFoundException, "alias not found", nil)
+	}
+	return a, nil
+}
+
+func (f *fakeAliases) CreateAliasWithContext(ctx aws.Context, in *lambda.CreateAliasInput, _ ...request.Option) (*lambda.AliasConfiguration, error) {
+	a := &lambda.AliasConfiguration{Name: in.Name, FunctionVersion: in.FunctionVersion, Description: in.Description}
+	f.aliases[aws.StringValue(in.Name)] = a
+	return a, nil
+}
+
+func (f *fakeAliases) UpdateAliasWithContext(ctx aws.Context, in *lambda.UpdateAliasInput, _ ...request.Option) (*lambda.AliasConfiguration, error) {
+	prev := f.aliases[aws.StringValue(in.Name)]
+	a := &lambda.AliasConfiguration{Name: in.Name, FunctionVersion: in.FunctionVersion, Description: prev.Description, RoutingConfig: in.RoutingConfig}
+	if in.Description != nil {
+		a.Description = in.Description
+	}
+	f.aliases[aws.StringValue(in.Name)] = a
+	return a, nil
+}
+
+func TestRollback(t *testing.T) {
+	ctx := context.Background()
+	svc := &fakeAliases{aliases: make(map[string]*lambda.AliasConfiguration)}
+	check := func(step string, s *deploy.AliasState, err error, version, canary, previous string) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if s.Version != version || s.CanaryVersion != canary || s.Previous != previous {
+			t.Fatalf("%s: alias %+v, want version %s, canary %q, previous %q", step, s, version, canary, previous)
+		}
+	}
+
+	s, err := deploy.PointAlias(ctx, svc, "fn", "prod", "3", 0)
+	check("create", s, err, "3", "", "")
+	if _, err := deploy.Rollback(ctx, svc, "fn", "prod"); err == nil {
+		t.Fatal("new alias rolled back")
+	}
+
+	// versions 4 to 6 went only to dev and staging, so prod returns to 3
+	s, err = deploy.PointAlias(ctx, svc, "fn", "prod", "7", 0)
+	check("deploy 7", s, err, "7", "", "3")
+	s, err = deploy.Rollback(ctx, svc, "fn", "prod")
+	check("rollback", s, err, "3", "", "7")
+	s, err = deploy.Rollback(ctx, svc, "fn", "prod")
+	check("second rollback", s, err, "7", "", "3")
+
+	// a canary does not move the alias until it is promoted
+	s, err = deploy.PointAlias(ctx, svc, "fn", "prod", "8", 0.1)
+	check("canary", s, err, "7", "8", "3")
+	s, err = deploy.Promote(ctx, svc, "fn", "prod")
+	check("promote", s, err, "8", "", "7")
+	s, err = deploy.PointAlias(ctx, svc, "fn", "prod", "9", 0.1)
+	check("second canary", s, err, "8", "9", "7")
+	s, err = deploy.Rollback(ctx, svc, "fn", "prod")
+	check("abandon canary", s, err, "8", "", "7")
+}
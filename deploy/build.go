@@ -0,0 +1,133 @@
+package deploy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// Artifact is a zipped deployment package ready for upload to AWS Lambda.
+type Artifact struct {
+	// Zip holds the deployment package contents.
+	Zip []byte
+
+	// CodeSha256 is the base64 encoded SHA-256 of Zip, in the same form as
+	// the CodeSha256 reported by AWS Lambda.
+	CodeSha256 string
+}
+
+// bootstrapName is the executable name expected by the provided.al2023
+// runtime.
+const bootstrapName = "bootstrap"
+
+// zipEpoch is the modification time recorded for every file in the zip so
+// that unchanged code produces an identical CodeSha256.
+var zipEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Build compiles the manifest's main package as a provided.al2023
+// bootstrap binary and packages it in a zip archive.  The build is
+// reproducible (-trimpath, no VCS stamping) so that the SHA-256 of the
+// archive can be compared with the code already deployed.
+func Build(ctx context.Context, m *Manifest) (*Artifact, error) {
+	arch, err := goArch(m.Architecture)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "cwl-build-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, bootstrapName)
+
+	if err := BuildBinary(ctx, m.PackageDir(), "linux", arch, bin); err != nil {
+		return nil, fmt.Errorf("%s: %v", m.Name, err)
+	}
+
+	if err := CheckBinary(bin, arch); err != nil {
+		return nil, fmt.Errorf("%s: %v", m.Name, err)
+	}
+	return Package(bin)
+}
+
+// BuildBinary compiles the main package in dir for goos/goarch, writing the
+// executable to out.  The flags match those of the deployment build, so a
+// binary built for the local platform behaves as the deployed one does.
+func BuildBinary(ctx context.Context, dir, goos, goarch, out string) error {
+	cmd := exec.CommandContext(ctx, "go", "build", "-tags", "lambda.norpc", "-trimpath", "-buildvcs=false", "-ldflags", "-s -w", "-o", out, ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH="+goarch, "CGO_ENABLED=0")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("build of %s failed: %v", dir, err)
+	}
+	return nil
+}
+
+// CheckBinary verifies that the Go binary at path was built for linux and
+// the given GOARCH, refusing binaries that would not run on the target
+// function.
+func CheckBinary(path, goarch string) error {
+	info, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read build information from %s: %v", path, err)
+	}
+	var goos, arch string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "GOOS":
+			goos = s.Value
+		case "GOARCH":
+			arch = s.Value
+		}
+	}
+	if goos != "linux" || arch != goarch {
+		return fmt.Errorf("%s was built for %s/%s but the target function requires linux/%s", path, goos, arch, goarch)
+	}
+	return nil
+}
+
+// Package zips the binary at path as an executable named bootstrap.
+func Package(path string) (*Artifact, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	hdr := &zip.FileHeader{
+		Name:     bootstrapName,
+		Method:   zip.Deflate,
+		Modified: zipEpoch,
+	}
+	hdr.SetMode(0555)
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	return &Artifact{
+		Zip:        buf.Bytes(),
+		CodeSha256: base64.StdEncoding.EncodeToString(sum[:]),
+	}, nil
+}
@@ -0,0 +1,185 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// runtime and handler used by every function deployed by cwl
+const (
+	functionRuntime = lambda.RuntimeProvidedAl2023
+	functionHandler = bootstrapName
+)
+
+// Result describes the changes made to a function by Deploy.
+type Result struct {
+	FunctionArn   string
+	CodeSha256    string
+	Created       bool
+	CodeUpdated   bool
+	ConfigUpdated bool
+}
+
+// Deploy creates the function described by m if it does not exist, or
+// updates it in place if it does.  The function code is only uploaded when
+// the SHA-256 of the artifact differs from the deployed code (or the
+// architecture changes), and the configuration is only updated when it
+// differs from the manifest.  Unlike the original delete/create scripts,
+// the function, its triggers and its permissions are never removed.
+func Deploy(ctx context.Context, svc lambdaiface.LambdaAPI, m *Manifest, a *Artifact) (*Result, error) {
+
+	current, err := svc.GetFunctionWithContext(ctx, &lambda.GetFunctionInput{
+		FunctionName: aws.String(m.Name),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == lambda.ErrCodeResourceNotFoundException {
+			return create(ctx, svc, m, a)
+		}
+		return nil, fmt.Errorf("unable to read function %s: %v", m.Name, err)
+	}
+
+	cfg := current.Configuration
+	res := &Result{
+		FunctionArn: aws.StringValue(cfg.FunctionArn),
+		CodeSha256:  aws.StringValue(cfg.CodeSha256),
+	}
+
+	// update the configuration first; the code update below will then
+	// wait for the configuration change to complete.
+	if !configMatches(cfg, m) {
+		log.Printf("%s: updating function configuration\n", m.Name)
+		_, err := svc.UpdateFunctionConfigurationWithContext(ctx, &lambda.UpdateFunctionConfigurationInput{
+			FunctionName:  aws.String(m.Name),
+			Description:   aws.String(m.Description),
+			Environment:   &lambda.Environment{Variables: aws.StringMap(m.Env())},
+			Handler:       aws.String(functionHandler),
+			MemorySize:    aws.Int64(m.Memory),
+			Role:          aws.String(m.Role),
+			Runtime:       aws.String(functionRuntime),
+			Timeout:       aws.Int64(m.Timeout),
+			TracingConfig: &lambda.TracingConfig{Mode: aws.String(m.tracingMode())},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to update configuration of %s: %v", m.Name, err)
+		}
+		if err := waitUpdated(ctx, svc, m.Name); err != nil {
+			return nil, err
+		}
+		res.ConfigUpdated = true
+	}
+
+	if res.CodeSha256 != a.CodeSha256 || architecture(cfg) != m.Architecture {
+		log.Printf("%s: updating function code; deployed sha256 %s, new sha256 %s\n", m.Name, res.CodeSha256, a.CodeSha256)
+		out, err := svc.UpdateFunctionCodeWithContext(ctx, &lambda.UpdateFunctionCodeInput{
+			FunctionName:  aws.String(m.Name),
+			Architectures: aws.StringSlice([]string{m.Architecture}),
+			ZipFile:       a.Zip,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to update code of %s: %v", m.Name, err)
+		}
+		if err := waitUpdated(ctx, svc, m.Name); err != nil {
+			return nil, err
+		}
+		res.CodeSha256 = aws.StringValue(out.CodeSha256)
+		res.CodeUpdated = true
+	} else {
+		log.Printf("%s: function code is unchanged (sha256 %s)\n", m.Name, a.CodeSha256)
+	}
+	return res, nil
+}
+
+// create creates a new function from the manifest and artifact, and waits
+// for it to become active.
+func create(ctx context.Context, svc lambdaiface.LambdaAPI, m *Manifest, a *Artifact) (*Result, error) {
+	log.Printf("%s: creating function\n", m.Name)
+	out, err := svc.CreateFunctionWithContext(ctx, &lambda.CreateFunctionInput{
+		FunctionName:  aws.String(m.Name),
+		Architectures: aws.StringSlice([]string{m.Architecture}),
+		Code:          &lambda.FunctionCode{ZipFile: a.Zip},
+		Description:   aws.String(m.Description),
+		Environment:   &lambda.Environment{Variables: aws.StringMap(m.Env())},
+		Handler:       aws.String(functionHandler),
+		MemorySize:    aws.Int64(m.Memory),
+		Role:          aws.String(m.Role),
+		Runtime:       aws.String(functionRuntime),
+		Timeout:       aws.Int64(m.Timeout),
+		TracingConfig: &lambda.TracingConfig{Mode: aws.String(m.tracingMode())},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create function %s: %v", m.Name, err)
+	}
+	err = svc.WaitUntilFunctionActiveV2WithContext(ctx, &lambda.GetFunctionInput{
+		FunctionName: aws.String(m.Name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("function %s did not become active: %v", m.Name, err)
+	}
+	return &Result{
+		FunctionArn: aws.StringValue(out.FunctionArn),
+		CodeSha256:  aws.StringValue(out.CodeSha256),
+		Created:     true,
+	}, nil
+}
+
+// waitUpdated waits for an in-progress function update to complete.
+func waitUpdated(ctx context.Context, svc lambdaiface.LambdaAPI, name string) error {
+	err := svc.WaitUntilFunctionUpdatedV2WithContext(ctx, &lambda.GetFunctionInput{
+		FunctionName: aws.String(name),
+	})
+	if err != nil {
+		return fmt.Errorf("update of function %s did not complete: %v", name, err)
+	}
+	return nil
+}
+
+// configMatches reports whether the deployed function configuration matches
+// the manifest.
+func configMatches(cfg *lambda.FunctionConfiguration, m *Manifest) bool {
+	if aws.StringValue(cfg.Runtime) != functionRuntime ||
+		aws.StringValue(cfg.Handler) != functionHandler ||
+		aws.StringValue(cfg.Role) != m.Role ||
+		aws.StringValue(cfg.Description) != m.Description ||
+		aws.Int64Value(cfg.MemorySize) != m.Memory ||
+		aws.Int64Value(cfg.Timeout) != m.Timeout ||
+		tracingMode(cfg) != m.tracingMode() {
+		return false
+	}
+
+	var deployed map[string]*string
+	if cfg.Environment != nil {
+		deployed = cfg.Environment.Variables
+	}
+	want := m.Env()
+	if len(deployed) != len(want) {
+		return false
+	}
+	for k, v := range want {
+		if dv, ok := deployed[k]; !ok || aws.StringValue(dv) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// tracingMode returns the X-Ray tracing mode of the deployed function.
+func tracingMode(cfg *lambda.FunctionConfiguration) string {
+	if cfg.TracingConfig == nil || cfg.TracingConfig.Mode == nil {
+		return lambda.TracingModePassThrough
+	}
+	return aws.StringValue(cfg.TracingConfig.Mode)
+}
+
+// architecture returns the architecture of the deployed function.
+func architecture(cfg *lambda.FunctionConfiguration) string {
+	if len(cfg.Architectures) == 0 {
+		return lambda.ArchitectureX8664
+	}
+	return aws.StringValue(cfg.Architectures[0])
+}
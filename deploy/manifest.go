@@ -0,0 +1,276 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// Manifest describes a single AWS Lambda function served by a cwl binary.
+// Manifests are stored as JSON, one file per function, for example:
+//
+//	{
+//	  "name": "GetEC2Statuses",
+//	  "handler": "GetEC2Statuses",
+//	  "package": "../mrouter",
+//	  "role": "arn:aws:iam::907538708243:role/LambdaEC2Access",
+//	  "memory": 128,
+//	  "timeout": 10,
+//	  "architecture": "arm64",
+//	  "environment": {"CWL_LOG_LEVEL": "info"},
+//	  "tracing": true,
+//	  "audit": "dynamodb://cwl-audit",
+//	  "policy": "ssm:///cwl/protection-policy",
+//	  "triggers": [
+//	    {"type": "schedule", "name": "every-5m", "schedule": "rate(5 minutes)"}
+//	  ]
+//	}
+type Manifest struct {
+	// Name is the AWS Lambda function-name.
+	Name string `json:"name"`
+
+	// Handler is the registered cwl handler served by the function.  It is
+	// passed to the router binary via the CWL_HANDLER environment variable.
+	Handler string `json:"handler"`
+
+	// Package is the main package to build, relative to the manifest file.
+	// It defaults to the multi-function router binary.
+	Package string `json:"package,omitempty"`
+
+	// Description is an optional description of the function.
+	Description string `json:"description,omitempty"`
+
+	// Region is the AWS Region the function is deployed to.
+	Region string `json:"region,omitempty"`
+
+	// Role is the ARN of the IAM role assumed by the function.
+	Role string `json:"role"`
+
+	// Memory is the memory allocated to the function in MB.
+	Memory int64 `json:"memory,omitempty"`
+
+	// Timeout is the maximum execution time of the function in seconds.
+	Timeout int64 `json:"timeout,omitempty"`
+
+	// Architecture is the Lambda instruction set architecture; arm64 or
+	// x86_64.
+	Architecture string `json:"architecture,omitempty"`
+
+	// Environment holds additional environment variables for the function.
+	Environment map[string]string `json:"environment,omitempty"`
+
+	// Tracing enables active AWS X-Ray tracing of the function and of the
+	// handler's AWS API calls.
+	Tracing bool `json:"tracing,omitempty"`
+
+	// Audit locates the audit trail of the function's actions, in the form
+	// dynamodb://<table>, s3://<bucket>/<prefix> or file://<path>.  It is
+	// passed to the function via the CWL_AUDIT_SINK environment variable.
+	// By default audit records are written to the function log only.
+	Audit string `json:"audit,omitempty"`
+
+	// Policy locates the protection policy checked before the function
+	// changes the state of AWS resources, in the form ssm://<parameter-name>
+	// or file://<path>.  It is passed to the function via the CWL_POLICY
+	// environment variable.  By default the policy bundled with the
+	// function is used.
+	Policy string `json:"policy,omitempty"`
+
+	// Approvals is where the protection policy sends approval requests:
+	// sns://<topic-arn> or a webhook URL, as in its approval notify field.
+	// It is used only to grant the function access to send the requests.
+	Approvals string `json:"approvals,omitempty"`
+
+	// Holidays locates the holiday calendars of the EC2InstancesSchedule
+	// handler, in the form ssm://<parameter-name> or file://<path>.  It is
+	// passed to the function via the CWL_HOLIDAYS environment variable.
+	Holidays string `json:"holidays,omitempty"`
+
+	// Triggers lists the event sources that invoke the function.  The
+	// deploy tool creates, updates and removes the corresponding mappings,
+	// rules, subscriptions, routes and permissions to match this list.
+	Triggers []Trigger `json:"triggers,omitempty"`
+
+	// TriggerAlias optionally names the alias invoked by the triggers.  By
+	// default triggers invoke the unqualified function ($LATEST).
+	TriggerAlias string `json:"triggerAlias,omitempty"`
+
+	// path is the location the manifest was read from.
+	path string
+}
+
+// manifest defaults
+const (
+	defaultPackage      = "../mrouter"
+	defaultRegion       = "us-west-2"
+	defaultMemory       = 128
+	defaultTimeout      = 10
+	defaultArchitecture = lambda.ArchitectureArm64
+)
+
+// handlerEnvVar, tracingEnvVar, auditEnvVar, policyEnvVar and
+// holidaysEnvVar mirror cwl.HandlerEnvVar, cwl.TracingEnvVar,
+// cwl.AuditSinkEnvVar, cwl.PolicyEnvVar and cwl.HolidaysEnvVar; the deploy
+// package does not import the handler package in order to keep the tool
+// light-weight.
+const (
+	handlerEnvVar  = "CWL_HANDLER"
+	tracingEnvVar  = "CWL_TRACING"
+	auditEnvVar    = "CWL_AUDIT_SINK"
+	policyEnvVar   = "CWL_POLICY"
+	holidaysEnvVar = "CWL_HOLIDAYS"
+)
+
+// LoadManifest reads, defaults and validates the function manifest at path.
+func LoadManifest(path string) (*Manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("manifest %s: %v", path, err)
+	}
+	m.path = path
+	m.setDefaults()
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("manifest %s: %v", path, err)
+	}
+	return m, nil
+}
+
+// setDefaults fills in the optional manifest values.
+func (m *Manifest) setDefaults() {
+	if m.Package == "" {
+		m.Package = defaultPackage
+	}
+	if m.Region == "" {
+		m.Region = defaultRegion
+	}
+	if m.Memory == 0 {
+		m.Memory = defaultMemory
+	}
+	if m.Timeout == 0 {
+		m.Timeout = defaultTimeout
+	}
+	if m.Architecture == "" {
+		m.Architecture = defaultArchitecture
+	}
+	if m.Architecture == "amd64" {
+		m.Architecture = lambda.ArchitectureX8664
+	}
+}
+
+// Validate checks that the manifest contains everything needed to deploy
+// the function.
+func (m *Manifest) Validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if m.Handler == "" {
+		return fmt.Errorf("handler is required")
+	}
+	if m.Role == "" {
+		return fmt.Errorf("role is required")
+	}
+	if m.Memory < 128 || m.Memory > 10240 {
+		return fmt.Errorf("memory %d is outside of the range 128-10240 MB", m.Memory)
+	}
+	if m.Timeout < 1 || m.Timeout > 900 {
+		return fmt.Errorf("timeout %d is outside of the range 1-900 seconds", m.Timeout)
+	}
+	if _, err := goArch(m.Architecture); err != nil {
+		return err
+	}
+	if m.Audit != "" && !strings.HasPrefix(m.Audit, "dynamodb://") && !strings.HasPrefix(m.Audit, "s3://") && !strings.HasPrefix(m.Audit, "file://") {
+		return fmt.Errorf("audit %q must be of the form dynamodb://<table>, s3://<bucket>/<prefix> or file://<path>", m.Audit)
+	}
+	if m.Policy != "" && !strings.HasPrefix(m.Policy, "ssm://") && !strings.HasPrefix(m.Policy, "file://") {
+		return fmt.Errorf("policy %q must be of the form ssm://<parameter-name> or file://<path>", m.Policy)
+	}
+	if m.Approvals != "" && !strings.HasPrefix(m.Approvals, "sns://") && !strings.HasPrefix(m.Approvals, "https://") && !strings.HasPrefix(m.Approvals, "http://") {
+		return fmt.Errorf("approvals %q must be of the form sns://<topic-arn> or a webhook URL", m.Approvals)
+	}
+	if m.Holidays != "" && !strings.HasPrefix(m.Holidays, "ssm://") && !strings.HasPrefix(m.Holidays, "file://") {
+		return fmt.Errorf("holidays %q must be of the form ssm://<parameter-name> or file://<path>", m.Holidays)
+	}
+	names := make(map[string]bool)
+	for i, t := range m.Triggers {
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("trigger %d: %v", i, err)
+		}
+		if t.Type == TriggerSchedule || t.Type == TriggerEvent {
+			if names[t.Name] {
+				return fmt.Errorf("trigger %d: duplicate rule name %q", i, t.Name)
+			}
+			names[t.Name] = true
+		}
+	}
+	return nil
+}
+
+// PackageDir returns the directory of the main package to be built.
+func (m *Manifest) PackageDir() string {
+	if filepath.IsAbs(m.Package) {
+		return m.Package
+	}
+	return filepath.Join(filepath.Dir(m.path), m.Package)
+}
+
+// Env returns the complete set of environment variables for the function,
+// including the CWL_HANDLER, CWL_TRACING, CWL_AUDIT_SINK, CWL_POLICY and
+// CWL_HOLIDAYS settings.
+func (m *Manifest) Env() map[string]string {
+	env := map[string]string{handlerEnvVar: m.Handler}
+	if m.Tracing {
+		env[tracingEnvVar] = "active"
+	}
+	if m.Audit != "" {
+		env[auditEnvVar] = m.Audit
+	}
+	if m.Policy != "" {
+		env[policyEnvVar] = m.Policy
+	}
+	if m.Holidays != "" {
+		env[holidaysEnvVar] = m.Holidays
+	}
+	for k, v := range m.Environment {
+		env[k] = v
+	}
+	return env
+}
+
+// Queues returns the ARNs of the SQS queues declared as triggers of the
+// function.
+func (m *Manifest) Queues() []string {
+	var queues []string
+	for _, t := range m.Triggers {
+		if t.Type == TriggerSQS {
+			queues = append(queues, t.QueueArn)
+		}
+	}
+	return queues
+}
+
+// tracingMode returns the Lambda X-Ray tracing mode of the function.
+func (m *Manifest) tracingMode() string {
+	if m.Tracing {
+		return lambda.TracingModeActive
+	}
+	return lambda.TracingModePassThrough
+}
+
+// goArch maps a Lambda architecture to the corresponding GOARCH.
+func goArch(arch string) (string, error) {
+	switch arch {
+	case lambda.ArchitectureArm64:
+		return "arm64", nil
+	case lambda.ArchitectureX8664:
+		return "amd64", nil
+	}
+	return "", fmt.Errorf("unsupported architecture %q; use arm64 or x86_64", arch)
+}
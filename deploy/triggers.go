@@ -0,0 +1,684 @@
+package deploy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/apigatewayv2"
+	"github.com/aws/aws-sdk-go/service/apigatewayv2/apigatewayv2iface"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+// trigger types supported in function manifests
+const (
+	TriggerSchedule = "schedule"
+	TriggerEvent    = "event"
+	TriggerSQS      = "sqs"
+	TriggerSNS      = "sns"
+	TriggerAPI      = "api"
+)
+
+// Trigger declares an event source that invokes a function.  The fields
+// that apply depend upon Type:
+//
+//	{"type": "schedule", "name": "office-hours", "schedule": "cron(0 8 ? * MON-FRI *)", "input": {...}}
+//	{"type": "event", "name": "ec2-state", "pattern": {"source": ["aws.ec2"], ...}}
+//	{"type": "sqs", "queueArn": "arn:aws:sqs:us-west-2:907538708243:cwl-work", "batchSize": 10}
+//	{"type": "sns", "topicArn": "arn:aws:sns:us-west-2:907538708243:cwl-events"}
+//	{"type": "api", "apiId": "a1b2c3d4e5", "route": "GET /statuses"}
+type Trigger struct {
+	Type string `json:"type"`
+
+	// EventBridge schedule or event rule; Name is unique per function,
+	// Schedule is a rate(...) or cron(...) expression, Pattern is an event
+	// pattern matched against the default event bus and Input is an
+	// optional constant event passed to the function.
+	Name     string          `json:"name,omitempty"`
+	Schedule string          `json:"schedule,omitempty"`
+	Pattern  json.RawMessage `json:"pattern,omitempty"`
+	Input    json.RawMessage `json:"input,omitempty"`
+
+	// SQS event source mapping
+	QueueArn  string `json:"queueArn,omitempty"`
+	BatchSize int64  `json:"batchSize,omitempty"`
+
+	// SNS subscription
+	TopicArn string `json:"topicArn,omitempty"`
+
+	// API Gateway HTTP API route, e.g. "GET /statuses" or "$default"
+	APIID string `json:"apiId,omitempty"`
+	Route string `json:"route,omitempty"`
+}
+
+// statement-ids of the permissions managed by cwl start with this prefix
+const sidPrefix = "cwl-"
+
+// eventbridge target-id used for cwl schedule and event rules
+const scheduleTargetID = "cwl"
+
+// validate checks that the fields required by the trigger type are set.
+func (t Trigger) validate() error {
+	switch t.Type {
+	case TriggerSchedule:
+		if t.Name == "" || t.Schedule == "" {
+			return fmt.Errorf("schedule triggers require a name and a schedule expression")
+		}
+		if len(t.Input) > 0 && !json.Valid(t.Input) {
+			return fmt.Errorf("schedule %s input is not valid JSON", t.Name)
+		}
+	case TriggerEvent:
+		if t.Name == "" || len(t.Pattern) == 0 {
+			return fmt.Errorf("event triggers require a name and an event pattern")
+		}
+		if !json.Valid(t.Pattern) {
+			return fmt.Errorf("event %s pattern is not valid JSON", t.Name)
+		}
+		if len(t.Input) > 0 && !json.Valid(t.Input) {
+			return fmt.Errorf("event %s input is not valid JSON", t.Name)
+		}
+	case TriggerSQS:
+		if !strings.HasPrefix(t.QueueArn, "arn:aws:sqs:") {
+			return fmt.Errorf("sqs triggers require a queueArn")
+		}
+		if t.BatchSize < 0 || t.BatchSize > 10000 {
+			return fmt.Errorf("sqs batchSize %d is outside of the range 1-10000", t.BatchSize)
+		}
+	case TriggerSNS:
+		if !strings.HasPrefix(t.TopicArn, "arn:aws:sns:") {
+			return fmt.Errorf("sns triggers require a topicArn")
+		}
+	case TriggerAPI:
+		if t.APIID == "" || t.Route == "" {
+			return fmt.Errorf("api triggers require an apiId and a route")
+		}
+		if _, _, err := splitRoute(t.Route); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown trigger type %q; use schedule, event, sqs, sns or api", t.Type)
+	}
+	return nil
+}
+
+// TriggerClients holds the AWS service clients used to manage triggers.
+type TriggerClients struct {
+	Lambda      lambdaiface.LambdaAPI
+	EventBridge eventbridgeiface.EventBridgeAPI
+	SNS         snsiface.SNSAPI
+	APIGateway  apigatewayv2iface.ApiGatewayV2API
+}
+
+// triggerSync holds the state of a single SyncTriggers call.
+type triggerSync struct {
+	*TriggerClients
+	m         *Manifest
+	target    string // ARN invoked by the triggers
+	qualifier *string
+	region    string
+	account   string
+}
+
+// permission is a statement in the function's resource-based policy.
+type permission struct {
+	sid       string
+	principal string
+	sourceArn string
+}
+
+// SyncTriggers makes the triggers of the deployed function match those
+// declared in the manifest.  Schedules, SQS mappings, SNS subscriptions and
+// API routes are created or updated as required, along with the resource
+// policy statements that permit them to invoke the function.  Triggers that
+// were previously created by cwl but are no longer declared are removed.
+// SyncTriggers is idempotent and may be run on every deploy.
+func SyncTriggers(ctx context.Context, c *TriggerClients, m *Manifest, functionArn string) error {
+	fa, err := arn.Parse(functionArn)
+	if err != nil {
+		return fmt.Errorf("unable to parse function arn %s: %v", functionArn, err)
+	}
+	// drop any version qualifier from the arn
+	parts := strings.Split(functionArn, ":")
+	if fa.Service != "lambda" || len(parts) < 7 {
+		return fmt.Errorf("%s is not a lambda function arn", functionArn)
+	}
+	fnArn := strings.Join(parts[:7], ":")
+
+	s := &triggerSync{
+		TriggerClients: c,
+		m:              m,
+		target:         fnArn,
+		region:         fa.Region,
+		account:        fa.AccountID,
+	}
+	if m.TriggerAlias != "" {
+		s.target = fnArn + ":" + m.TriggerAlias
+		s.qualifier = aws.String(m.TriggerAlias)
+	}
+
+	existing, err := s.permissions(ctx)
+	if err != nil {
+		return err
+	}
+
+	// create or update the declared triggers
+	desired := make(map[string]bool)
+	var queues []Trigger
+	for _, t := range m.Triggers {
+		var p *permission
+		switch t.Type {
+		case TriggerSchedule, TriggerEvent:
+			p, err = s.syncRule(ctx, t)
+		case TriggerSNS:
+			p, err = s.syncTopic(ctx, t)
+		case TriggerAPI:
+			p, err = s.syncRoute(ctx, t)
+		case TriggerSQS:
+			queues = append(queues, t)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		desired[p.sid] = true
+		if _, ok := existing[p.sid]; ok {
+			continue
+		}
+		if err := s.addPermission(ctx, p); err != nil {
+			return err
+		}
+	}
+	if err := s.syncQueues(ctx, queues); err != nil {
+		return err
+	}
+
+	// remove triggers that cwl created but which are no longer declared
+	for sid, sourceArn := range existing {
+		if desired[sid] {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(sid, sidPrefix+TriggerSchedule+"-"),
+			strings.HasPrefix(sid, sidPrefix+TriggerEvent+"-"):
+			err = s.removeRule(ctx, sourceArn)
+		case strings.HasPrefix(sid, sidPrefix+TriggerSNS+"-"):
+			err = s.removeTopic(ctx, sourceArn)
+		case strings.HasPrefix(sid, sidPrefix+TriggerAPI+"-"):
+			err = s.removeRoutes(ctx, sourceArn)
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.removePermission(ctx, sid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncRule creates or updates the EventBridge rule and target for a
+// schedule or event trigger.
+func (s *triggerSync) syncRule(ctx context.Context, t Trigger) (*permission, error) {
+	name := ruleName(s.m.Name, t.Name)
+	input := &eventbridge.PutRuleInput{
+		Name:        aws.String(name),
+		Description: aws.String(fmt.Sprintf("cwl %s %s for %s", t.Type, t.Name, s.m.Name)),
+		State:       aws.String(eventbridge.RuleStateEnabled),
+	}
+	if t.Type == TriggerEvent {
+		input.EventPattern = aws.String(string(t.Pattern))
+	} else {
+		input.ScheduleExpression = aws.String(t.Schedule)
+	}
+	rule, err := s.EventBridge.PutRuleWithContext(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("unable to put %s rule %s: %v", t.Type, name, err)
+	}
+
+	target := &eventbridge.Target{
+		Id:  aws.String(scheduleTargetID),
+		Arn: aws.String(s.target),
+	}
+	if len(t.Input) > 0 {
+		target.Input = aws.String(string(t.Input))
+	}
+	out, err := s.EventBridge.PutTargetsWithContext(ctx, &eventbridge.PutTargetsInput{
+		Rule:    aws.String(name),
+		Targets: []*eventbridge.Target{target},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to put target of %s rule %s: %v", t.Type, name, err)
+	}
+	if aws.Int64Value(out.FailedEntryCount) > 0 {
+		return nil, fmt.Errorf("unable to put target of %s rule %s: %s", t.Type, name, aws.StringValue(out.FailedEntries[0].ErrorMessage))
+	}
+	if t.Type == TriggerEvent {
+		log.Printf("%s: event rule %s -> %s\n", s.m.Name, name, s.target)
+	} else {
+		log.Printf("%s: schedule %s (%s) -> %s\n", s.m.Name, name, t.Schedule, s.target)
+	}
+	return newPermission(t.Type, "events.amazonaws.com", aws.StringValue(rule.RuleArn)), nil
+}
+
+// removeRule deletes the EventBridge rule identified by ruleArn.
+func (s *triggerSync) removeRule(ctx context.Context, ruleArn string) error {
+	name := ruleArn[strings.LastIndex(ruleArn, "/")+1:]
+	_, err := s.EventBridge.RemoveTargetsWithContext(ctx, &eventbridge.RemoveTargetsInput{
+		Rule: aws.String(name),
+		Ids:  aws.StringSlice([]string{scheduleTargetID}),
+	})
+	if err != nil && !notFound(err) {
+		return fmt.Errorf("unable to remove target of rule %s: %v", name, err)
+	}
+	_, err = s.EventBridge.DeleteRuleWithContext(ctx, &eventbridge.DeleteRuleInput{Name: aws.String(name)})
+	if err != nil && !notFound(err) {
+		return fmt.Errorf("unable to delete rule %s: %v", name, err)
+	}
+	log.Printf("%s: removed rule %s\n", s.m.Name, name)
+	return nil
+}
+
+// syncTopic subscribes the function to an SNS topic.  Subscribe is
+// idempotent, returning the existing subscription if there is one.
+func (s *triggerSync) syncTopic(ctx context.Context, t Trigger) (*permission, error) {
+	_, err := s.SNS.SubscribeWithContext(ctx, &sns.SubscribeInput{
+		TopicArn:              aws.String(t.TopicArn),
+		Protocol:              aws.String("lambda"),
+		Endpoint:              aws.String(s.target),
+		ReturnSubscriptionArn: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to subscribe %s to topic %s: %v", s.target, t.TopicArn, err)
+	}
+	log.Printf("%s: subscribed to topic %s\n", s.m.Name, t.TopicArn)
+	return newPermission(TriggerSNS, "sns.amazonaws.com", t.TopicArn), nil
+}
+
+// removeTopic removes the function's subscriptions to an SNS topic.
+func (s *triggerSync) removeTopic(ctx context.Context, topicArn string) error {
+	var subs []string
+	err := s.SNS.ListSubscriptionsByTopicPagesWithContext(ctx, &sns.ListSubscriptionsByTopicInput{
+		TopicArn: aws.String(topicArn),
+	}, func(page *sns.ListSubscriptionsByTopicOutput, lastPage bool) bool {
+		for _, sub := range page.Subscriptions {
+			if aws.StringValue(sub.Endpoint) == s.target {
+				subs = append(subs, aws.StringValue(sub.SubscriptionArn))
+			}
+		}
+		return true
+	})
+	if err != nil && !notFound(err) {
+		return fmt.Errorf("unable to list subscriptions of topic %s: %v", topicArn, err)
+	}
+	for _, sub := range subs {
+		if _, err := s.SNS.UnsubscribeWithContext(ctx, &sns.UnsubscribeInput{SubscriptionArn: aws.String(sub)}); err != nil {
+			return fmt.Errorf("unable to unsubscribe %s: %v", sub, err)
+		}
+	}
+	log.Printf("%s: unsubscribed from topic %s\n", s.m.Name, topicArn)
+	return nil
+}
+
+// syncRoute creates or updates an API Gateway HTTP API route that proxies
+// to the function.
+func (s *triggerSync) syncRoute(ctx context.Context, t Trigger) (*permission, error) {
+	integrationID, err := s.integration(ctx, t.APIID, true)
+	if err != nil {
+		return nil, err
+	}
+	target := "integrations/" + integrationID
+
+	routes, err := s.routes(ctx, t.APIID)
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := routes[t.Route]; ok {
+		if aws.StringValue(r.Target) != target {
+			_, err = s.APIGateway.UpdateRouteWithContext(ctx, &apigatewayv2.UpdateRouteInput{
+				ApiId:   aws.String(t.APIID),
+				RouteId: r.RouteId,
+				Target:  aws.String(target),
+			})
+		}
+	} else {
+		_, err = s.APIGateway.CreateRouteWithContext(ctx, &apigatewayv2.CreateRouteInput{
+			ApiId:    aws.String(t.APIID),
+			RouteKey: aws.String(t.Route),
+			Target:   aws.String(target),
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to put route %q of api %s: %v", t.Route, t.APIID, err)
+	}
+	log.Printf("%s: api %s route %q\n", s.m.Name, t.APIID, t.Route)
+
+	method, path, _ := splitRoute(t.Route)
+	sourceArn := fmt.Sprintf("arn:aws:execute-api:%s:%s:%s/*/%s%s", s.region, s.account, t.APIID, method, path)
+	return newPermission(TriggerAPI, "apigateway.amazonaws.com", sourceArn), nil
+}
+
+// removeRoutes deletes the routes of an API that target the function and
+// are no longer declared in the manifest, and then the integration itself
+// if it is no longer used.
+func (s *triggerSync) removeRoutes(ctx context.Context, sourceArn string) error {
+	sa, err := arn.Parse(sourceArn)
+	if err != nil {
+		return fmt.Errorf("unable to parse api source arn %s: %v", sourceArn, err)
+	}
+	apiID := strings.SplitN(sa.Resource, "/", 2)[0]
+
+	integrationID, err := s.integration(ctx, apiID, false)
+	if err != nil || integrationID == "" {
+		return err
+	}
+	declared := make(map[string]bool)
+	for _, t := range s.m.Triggers {
+		if t.Type == TriggerAPI && t.APIID == apiID {
+			declared[t.Route] = true
+		}
+	}
+
+	routes, err := s.routes(ctx, apiID)
+	if err != nil {
+		return err
+	}
+	inUse := false
+	for key, r := range routes {
+		if aws.StringValue(r.Target) != "integrations/"+integrationID {
+			continue
+		}
+		if declared[key] {
+			inUse = true
+			continue
+		}
+		_, err := s.APIGateway.DeleteRouteWithContext(ctx, &apigatewayv2.DeleteRouteInput{
+			ApiId:   aws.String(apiID),
+			RouteId: r.RouteId,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to delete route %q of api %s: %v", key, apiID, err)
+		}
+		log.Printf("%s: removed api %s route %q\n", s.m.Name, apiID, key)
+	}
+	if inUse {
+		return nil
+	}
+	_, err = s.APIGateway.DeleteIntegrationWithContext(ctx, &apigatewayv2.DeleteIntegrationInput{
+		ApiId:         aws.String(apiID),
+		IntegrationId: aws.String(integrationID),
+	})
+	if err != nil && !notFound(err) {
+		return fmt.Errorf("unable to delete integration %s of api %s: %v", integrationID, apiID, err)
+	}
+	return nil
+}
+
+// integration returns the id of the Lambda proxy integration of the api
+// that targets the function, optionally creating it.
+func (s *triggerSync) integration(ctx context.Context, apiID string, create bool) (string, error) {
+	input := &apigatewayv2.GetIntegrationsInput{ApiId: aws.String(apiID)}
+	for {
+		out, err := s.APIGateway.GetIntegrationsWithContext(ctx, input)
+		if err != nil {
+			return "", fmt.Errorf("unable to read integrations of api %s: %v", apiID, err)
+		}
+		for _, i := range out.Items {
+			if aws.StringValue(i.IntegrationUri) == s.target {
+				return aws.StringValue(i.IntegrationId), nil
+			}
+		}
+		if out.NextToken == nil {
+			break
+		}
+		input.NextToken = out.NextToken
+	}
+	if !create {
+		return "", nil
+	}
+
+	out, err := s.APIGateway.CreateIntegrationWithContext(ctx, &apigatewayv2.CreateIntegrationInput{
+		ApiId:                aws.String(apiID),
+		IntegrationType:      aws.String(apigatewayv2.IntegrationTypeAwsProxy),
+		IntegrationUri:       aws.String(s.target),
+		PayloadFormatVersion: aws.String("2.0"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to create integration of api %s for %s: %v", apiID, s.target, err)
+	}
+	return aws.StringValue(out.IntegrationId), nil
+}
+
+// routes returns the routes of the api keyed by route-key.
+func (s *triggerSync) routes(ctx context.Context, apiID string) (map[string]*apigatewayv2.Route, error) {
+	routes := make(map[string]*apigatewayv2.Route)
+	input := &apigatewayv2.GetRoutesInput{ApiId: aws.String(apiID)}
+	for {
+		out, err := s.APIGateway.GetRoutesWithContext(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read routes of api %s: %v", apiID, err)
+		}
+		for _, r := range out.Items {
+			routes[aws.StringValue(r.RouteKey)] = r
+		}
+		if out.NextToken == nil {
+			return routes, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// syncQueues makes the function's SQS event source mappings match the
+// declared sqs triggers.  SQS mappings are not managed through the resource
+// policy, so the manifest is treated as the complete list of queues for the
+// function; undeclared SQS mappings are deleted.  Mappings report batch item
+// failures, so that the router's response redelivers only the messages
+// that failed.
+func (s *triggerSync) syncQueues(ctx context.Context, queues []Trigger) error {
+	existing := make(map[string]*lambda.EventSourceMappingConfiguration)
+	err := s.Lambda.ListEventSourceMappingsPagesWithContext(ctx, &lambda.ListEventSourceMappingsInput{
+		FunctionName: aws.String(s.target),
+	}, func(page *lambda.ListEventSourceMappingsOutput, lastPage bool) bool {
+		for _, esm := range page.EventSourceMappings {
+			if strings.HasPrefix(aws.StringValue(esm.EventSourceArn), "arn:aws:sqs:") {
+				existing[aws.StringValue(esm.EventSourceArn)] = esm
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("unable to list event source mappings of %s: %v", s.target, err)
+	}
+
+	for _, t := range queues {
+		batchSize := t.BatchSize
+		if batchSize == 0 {
+			batchSize = 10
+		}
+		esm, ok := existing[t.QueueArn]
+		delete(existing, t.QueueArn)
+		switch {
+		case !ok:
+			_, err = s.Lambda.CreateEventSourceMappingWithContext(ctx, &lambda.CreateEventSourceMappingInput{
+				FunctionName:          aws.String(s.target),
+				EventSourceArn:        aws.String(t.QueueArn),
+				BatchSize:             aws.Int64(batchSize),
+				Enabled:               aws.Bool(true),
+				FunctionResponseTypes: aws.StringSlice(responseTypes),
+			})
+		case aws.Int64Value(esm.BatchSize) != batchSize || aws.StringValue(esm.State) == "Disabled" ||
+			!reportsFailures(esm):
+			_, err = s.Lambda.UpdateEventSourceMappingWithContext(ctx, &lambda.UpdateEventSourceMappingInput{
+				UUID:                  esm.UUID,
+				BatchSize:             aws.Int64(batchSize),
+				Enabled:               aws.Bool(true),
+				FunctionResponseTypes: aws.StringSlice(responseTypes),
+			})
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to map queue %s to %s: %v", t.QueueArn, s.target, err)
+		}
+		log.Printf("%s: queue %s (batch size %d)\n", s.m.Name, t.QueueArn, batchSize)
+	}
+
+	for queueArn, esm := range existing {
+		if _, err := s.Lambda.DeleteEventSourceMappingWithContext(ctx, &lambda.DeleteEventSourceMappingInput{UUID: esm.UUID}); err != nil {
+			return fmt.Errorf("unable to delete mapping of queue %s: %v", queueArn, err)
+		}
+		log.Printf("%s: removed queue %s\n", s.m.Name, queueArn)
+	}
+	return nil
+}
+
+// responseTypes are the function response types of SQS mappings.
+var responseTypes = []string{lambda.FunctionResponseTypeReportBatchItemFailures}
+
+// reportsFailures reports whether esm reports batch item failures.
+func reportsFailures(esm *lambda.EventSourceMappingConfiguration) bool {
+	for _, t := range esm.FunctionResponseTypes {
+		if aws.StringValue(t) == lambda.FunctionResponseTypeReportBatchItemFailures {
+			return true
+		}
+	}
+	return false
+}
+
+// policyDocument is the subset of a Lambda resource policy read by cwl.
+type policyDocument struct {
+	Statement []struct {
+		Sid       string
+		Condition struct {
+			ArnLike map[string]string
+		}
+	}
+}
+
+// permissions returns the source ARNs of the cwl managed statements in the
+// function's resource policy, keyed by statement-id.
+func (s *triggerSync) permissions(ctx context.Context) (map[string]string, error) {
+	perms := make(map[string]string)
+	out, err := s.Lambda.GetPolicyWithContext(ctx, &lambda.GetPolicyInput{
+		FunctionName: aws.String(s.m.Name),
+		Qualifier:    s.qualifier,
+	})
+	if err != nil {
+		if notFound(err) {
+			return perms, nil
+		}
+		return nil, fmt.Errorf("unable to read the resource policy of %s: %v", s.target, err)
+	}
+
+	var doc policyDocument
+	if err := json.Unmarshal([]byte(aws.StringValue(out.Policy)), &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse the resource policy of %s: %v", s.target, err)
+	}
+	for _, st := range doc.Statement {
+		if strings.HasPrefix(st.Sid, sidPrefix) {
+			perms[st.Sid] = st.Condition.ArnLike["AWS:SourceArn"]
+		}
+	}
+	return perms, nil
+}
+
+// addPermission allows the trigger's service principal to invoke the
+// function.
+func (s *triggerSync) addPermission(ctx context.Context, p *permission) error {
+	_, err := s.Lambda.AddPermissionWithContext(ctx, &lambda.AddPermissionInput{
+		FunctionName: aws.String(s.m.Name),
+		Qualifier:    s.qualifier,
+		StatementId:  aws.String(p.sid),
+		Action:       aws.String("lambda:InvokeFunction"),
+		Principal:    aws.String(p.principal),
+		SourceArn:    aws.String(p.sourceArn),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == lambda.ErrCodeResourceConflictException {
+			return nil // statement already present
+		}
+		return fmt.Errorf("unable to permit %s to invoke %s: %v", p.sourceArn, s.target, err)
+	}
+	return nil
+}
+
+// removePermission removes a cwl managed statement from the resource policy.
+func (s *triggerSync) removePermission(ctx context.Context, sid string) error {
+	_, err := s.Lambda.RemovePermissionWithContext(ctx, &lambda.RemovePermissionInput{
+		FunctionName: aws.String(s.m.Name),
+		Qualifier:    s.qualifier,
+		StatementId:  aws.String(sid),
+	})
+	if err != nil && !notFound(err) {
+		return fmt.Errorf("unable to remove permission %s from %s: %v", sid, s.target, err)
+	}
+	return nil
+}
+
+// newPermission returns the resource policy statement for a trigger.  The
+// statement-id is derived from the source ARN so that it is stable across
+// deploys.
+func newPermission(kind, principal, sourceArn string) *permission {
+	sum := sha256.Sum256([]byte(sourceArn))
+	return &permission{
+		sid:       sidPrefix + kind + "-" + hex.EncodeToString(sum[:8]),
+		principal: principal,
+		sourceArn: sourceArn,
+	}
+}
+
+// ruleName returns the EventBridge rule name for a function schedule or
+// event trigger, truncated to the 64 character limit.
+func ruleName(function, schedule string) string {
+	name := sidPrefix + function + "-" + schedule
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// routePathParam matches {param} and {param+} path segments
+var routePathParam = regexp.MustCompile(`\{[^}]+\}`)
+
+// splitRoute splits an HTTP API route-key into the method and path used in
+// an execute-api source ARN.
+func splitRoute(route string) (method, path string, err error) {
+	if route == "$default" {
+		return "$default", "", nil
+	}
+	parts := strings.SplitN(route, " ", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[1], "/") {
+		return "", "", fmt.Errorf("route %q must be \"$default\" or of the form \"METHOD /path\"", route)
+	}
+	method = parts[0]
+	if method == "ANY" {
+		method = "*"
+	}
+	return method, routePathParam.ReplaceAllString(parts[1], "*"), nil
+}
+
+// notFound reports whether err is an AWS resource-not-found error.  The
+// lambda and eventbridge services share the ResourceNotFoundException code.
+func notFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case lambda.ErrCodeResourceNotFoundException, sns.ErrCodeNotFoundException, apigatewayv2.ErrCodeNotFoundException:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package deploy_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/1414C/cwl/awsfake"
+	"github.com/1414C/cwl/deploy"
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// fakeMappings holds the event source mappings of a function without a
+// resource policy.
+type fakeMappings struct {
+	lambdaiface.LambdaAPI
+	mappings []*lambda.EventSourceMappingConfiguration
+}
+
+func (f *fakeMappings) GetPolicyWithContext(ctx aws.Context, in *lambda.GetPolicyInput, _ ...request.Option) (*lambda.GetPolicyOutput, error) {
+	return nil, awserr.New(lambda.ErrCodeResourceNotFoundException, "no policy", nil)
+}
+
+func (f *fakeMappings) ListEventSourceMappingsPagesWithContext(ctx aws.Context, in *lambda.ListEventSourceMappingsInput, fn func(*lambda.ListEventSourceMappingsOutput, bool) bool, _ ...request.Option) error {
+	fn(&lambda.ListEventSourceMappingsOutput{EventSourceMappings: f.mappings}, true)
+	return nil
+}
+
+func (f *fakeMappings) CreateEventSourceMappingWithContext(ctx aws.Context, in *lambda.CreateEventSourceMappingInput, _ ...request.Option) (*lambda.EventSourceMappingConfiguration, error) {
+	esm := &lambda.EventSourceMappingConfiguration{
+		UUID:                  aws.String("esm-1"),
+		EventSourceArn:        in.EventSourceArn,
+		FunctionArn:           in.FunctionName,
+		BatchSize:             in.BatchSize,
+		FunctionResponseTypes: in.FunctionResponseTypes,
+	}
+	f.mappings = append(f.mappings, esm)
+	return esm, nil
+}
+
+// TestSQSTrigger deploys a function with an sqs trigger, and delivers a
+// batch of messages to its handler through the router, as Lambda would.
+func TestSQSTrigger(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "EC2InstancesStart.json")
+	err := os.WriteFile(path, []byte(`{
+		"name": "EC2InstancesStart",
+		"handler": "EC2InstancesStart",
+		"role": "arn:aws:iam::123456789012:role/cwl",
+		"triggers": [{"type": "sqs", "queueArn": "arn:aws:sqs:us-west-2:123456789012:cwl-work"}]
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := deploy.LoadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &fakeMappings{}
+	if err := deploy.SyncTriggers(ctx, &deploy.TriggerClients{Lambda: svc}, m, "arn:aws:lambda:us-west-2:123456789012:function:EC2InstancesStart"); err != nil {
+		t.Fatal(err)
+	}
+	if len(svc.mappings) != 1 || len(svc.mappings[0].FunctionResponseTypes) != 1 ||
+		aws.StringValue(svc.mappings[0].FunctionResponseTypes[0]) != lambda.FunctionResponseTypeReportBatchItemFailures {
+		t.Fatalf("mappings %v, want one reporting batch item failures", svc.mappings)
+	}
+
+	// the second message is invalid, and the third is a redelivery of the
+	// first, which must not start the instance again
+	for k, v := range m.Env() {
+		t.Setenv(k, v)
+	}
+	st := awsfake.NewState()
+	st.AddInstance(awsfake.Instance{ID: "i-0000000000000001a", State: awsfake.InstanceStopped})
+	store := cwl.NewMemoryIdempotencyStore()
+	ctx = cwl.WithClients(ctx, &cwl.Clients{EC2: awsfake.NewEC2(st), Idempotency: store})
+	ev := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "m-1", EventSource: "aws:sqs", EventSourceARN: aws.StringValue(svc.mappings[0].EventSourceArn), Body: `{"instances": ["i-0000000000000001a"]}`},
+		{MessageId: "m-2", EventSource: "aws:sqs", EventSourceARN: aws.StringValue(svc.mappings[0].EventSourceArn), Body: `{"instances": ["web-1"]}`},
+		{MessageId: "m-1", EventSource: "aws:sqs", EventSourceARN: aws.StringValue(svc.mappings[0].EventSourceArn), Body: `{"instances": ["i-0000000000000001a"]}`},
+	}}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := cwl.NewRouter().Invoke(ctx, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp events.SQSEventResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.BatchItemFailures) != 1 || resp.BatchItemFailures[0].ItemIdentifier != "m-2" {
+		t.Errorf("batch item failures %v, want m-2 alone", resp.BatchItemFailures)
+	}
+	if in, _ := st.Instance("i-0000000000000001a"); in.State == awsfake.InstanceStopped {
+		t.Error("instance was not started")
+	}
+	if recs := store.Records(); len(recs) != 1 || recs[0].Key != "sqs-m-1" || recs[0].Status != cwl.IdempotencyCompleted {
+		t.Errorf("idempotency records %+v, want m-1 completed", recs)
+	}
+}
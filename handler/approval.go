@@ -0,0 +1,430 @@
+package cwl
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// opApproval is the operation of a callback holding a pending approval
+// request.
+const opApproval = "approval"
+
+// defaultApprovalExpiry is the time for which an approval request may be
+// approved, unless the policy sets another.
+const defaultApprovalExpiry = time.Hour
+
+// webhookTimeout limits the time taken to notify approvers by webhook.
+const webhookTimeout = 10 * time.Second
+
+// ApprovalPolicy names the actions that may only be taken once approved
+// with a token sent to the approvers, and how approvers are notified.  An action
+// needs approval if any of the rules match it:
+//
+//	{
+//	  "handlers": ["EC2InstancesReboot"],
+//	  "commands": ["\\bsystemctl\\s+restart\\b"],
+//	  "tags": {"Tier": "database"},
+//	  "notify": "sns://arn:aws:sns:us-west-2:123456789012:cwl-approvals",
+//	  "expiresIn": "1h"
+//	}
+type ApprovalPolicy struct {
+	// Handlers lists the handlers every action of which needs approval;
+	// "*" names every handler.
+	Handlers []string `json:"handlers,omitempty"`
+
+	// Commands holds regular expressions matching the EC2IssueCmd
+	// commands that need approval.
+	Commands []string `json:"commands,omitempty"`
+
+	// Tags marks the instances on which any action needs approval.  The
+	// value "*" matches any value of the tag.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Notify is where approval requests are sent: an SNS topic, as
+	// sns://<topic-arn>, or a webhook URL.
+	Notify string `json:"notify"`
+
+	// ExpiresIn is the time for which a request may be approved, as a Go
+	// duration; by default an hour, and at most a day.
+	ExpiresIn string `json:"expiresIn,omitempty"`
+}
+
+// check reports an invalid approval policy.
+func (a *ApprovalPolicy) check() error {
+	if _, err := ParseApprovalNotify(a.Notify); err != nil {
+		return fmt.Errorf("invalid protection policy: approval: %v", err)
+	}
+	if _, err := a.commandPatterns(); err != nil {
+		return err
+	}
+	if a.ExpiresIn != "" {
+		d, err := time.ParseDuration(a.ExpiresIn)
+		if err != nil || d <= 0 || d > callbackTTL {
+			return fmt.Errorf("invalid protection policy: approval expiresIn %q must be a duration of up to %v", a.ExpiresIn, callbackTTL)
+		}
+	}
+	return nil
+}
+
+// commandPatterns compiles the patterns of the commands needing approval.
+func (a *ApprovalPolicy) commandPatterns() ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, s := range a.Commands {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protection policy: approval command %q: %v", s, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// expiry returns the time for which a request may be approved.
+func (a *ApprovalPolicy) expiry() time.Duration {
+	if d, err := time.ParseDuration(a.ExpiresIn); err == nil && d > 0 {
+		return d
+	}
+	return defaultApprovalExpiry
+}
+
+// reasons returns the reasons the action described by req, taken by
+// handler on instances with tags, needs approval.  It returns nil if the
+// action needs no approval, or a is nil.
+func (a *ApprovalPolicy) reasons(handler string, req policyRequest, tags map[string]map[string]string) []string {
+	if a == nil {
+		return nil
+	}
+	var reasons []string
+	if containsString(a.Handlers, handler) || containsString(a.Handlers, "*") {
+		reasons = append(reasons, handler+" requires approval")
+	}
+	if req.Cmd != "" {
+		patterns, _ := a.commandPatterns()
+		for _, re := range patterns {
+			if re.MatchString(req.Cmd) {
+				reasons = append(reasons, fmt.Sprintf("command matches %q", re.String()))
+			}
+		}
+	}
+	var keys []string
+	for k := range a.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, id := range req.Instances {
+		for _, k := range keys {
+			if v, ok := tags[id][k]; ok && (a.Tags[k] == "*" || a.Tags[k] == v) {
+				reasons = append(reasons, fmt.Sprintf("%s: instance is tagged %s=%s", id, k, v))
+			}
+		}
+	}
+	return reasons
+}
+
+// ParseApprovalNotify checks the notification target of an approval
+// policy, returning its kind: "sns" or "webhook".
+func ParseApprovalNotify(target string) (string, error) {
+	switch {
+	case strings.HasPrefix(target, "sns://arn:aws:sns:"):
+		return "sns", nil
+	case strings.HasPrefix(target, "https://"), strings.HasPrefix(target, "http://"):
+		return "webhook", nil
+	}
+	return "", fmt.Errorf("notify %q must be of the form sns://<topic-arn> or a webhook URL", target)
+}
+
+// ApprovalRequest is an action awaiting approval.  Event is the event of
+// the handler that was refused, which is invoked again with it once the
+// request is approved.  Only a hash of the approval token is kept; the
+// token itself is sent to the approvers.  If TaskToken is set, a Step
+// Functions task is waiting on the request; it is sent the output of the
+// action if CompleteTask is set, and the failure of the action or the
+// rejection of the request in any case.  Requester is the caller declared
+// by the refused invocation; like the approver, it is not verified.
+type ApprovalRequest struct {
+	ID           string          `json:"id"`
+	Handler      string          `json:"handler"`
+	Event        json.RawMessage `json:"event"`
+	Targets      []string        `json:"targets"`
+	Cmd          string          `json:"cmd,omitempty"`
+	Reasons      []string        `json:"reasons"`
+	Requester    string          `json:"requester,omitempty"`
+	ExecutionArn string          `json:"executionArn,omitempty"`
+	TokenHash    string          `json:"tokenHash"`
+	CompleteTask bool            `json:"completeTask,omitempty"`
+	Requested    time.Time       `json:"requested"`
+	Expires      time.Time       `json:"expires"`
+}
+
+// ApprovalNotification is sent to the approvers of a request.  Approve is
+// the event with which to invoke ApproveAction.
+type ApprovalNotification struct {
+	Request      string             `json:"request"`
+	Handler      string             `json:"handler"`
+	Targets      []string           `json:"targets"`
+	Cmd          string             `json:"cmd,omitempty"`
+	Reasons      []string           `json:"reasons"`
+	Requester    string             `json:"requester,omitempty"`
+	ExecutionArn string             `json:"executionArn,omitempty"`
+	Expires      time.Time          `json:"expires"`
+	Approve      ApproveActionEvent `json:"approve"`
+}
+
+// ApprovalRequiredError is returned, in place of taking an action, when
+// the protection policy requires the action to be approved.  The request
+// has been stored and the approvers notified; the action is taken when
+// ApproveAction is invoked with the request and token.  It is reported by
+// Lambda with errorType ApprovalRequiredError.
+type ApprovalRequiredError struct {
+	Request string    `json:"request"`
+	Handler string    `json:"handler"`
+	Reasons []string  `json:"reasons"`
+	Expires time.Time `json:"expires"`
+}
+
+func (e *ApprovalRequiredError) Error() string {
+	return fmt.Sprintf("%s requires approval: request %s is pending until %s (%s)",
+		e.Handler, e.Request, e.Expires.Format(time.RFC3339), strings.Join(e.Reasons, "; "))
+}
+
+// approvalTask is the Step Functions task waiting on any approval request
+// made by an invocation.  complete is set if the task is to be sent the
+// output of the approved action.
+type approvalTask struct {
+	token    string
+	complete bool
+}
+
+// approval is an approved request, carried by the context of the
+// invocation taking the approved action.
+type approval struct {
+	request  string
+	handler  string
+	approver string
+}
+
+// context keys for approvalTask and approval
+type (
+	approvalTaskKey struct{}
+	approvedKey     struct{}
+)
+
+// withApprovalTask returns a copy of ctx in which approval requests are
+// made on behalf of the Step Functions task with token.
+func withApprovalTask(ctx context.Context, token string, complete bool) context.Context {
+	return context.WithValue(ctx, approvalTaskKey{}, approvalTask{token: token, complete: complete})
+}
+
+// withApproval returns a copy of ctx in which the action of ar has been
+// approved by approver.
+func withApproval(ctx context.Context, ar *ApprovalRequest, approver string) context.Context {
+	return context.WithValue(ctx, approvedKey{}, approval{request: ar.ID, handler: ar.Handler, approver: approver})
+}
+
+// approvalFrom returns the approval carried by ctx.
+func approvalFrom(ctx context.Context) (approval, bool) {
+	a, ok := ctx.Value(approvedKey{}).(approval)
+	return a, ok
+}
+
+// requestApproval stores a request for approval of the action described by
+// req, notifies the approvers, and returns the *ApprovalRequiredError to be
+// returned in place of taking the action.
+func requestApproval(ctx context.Context, a *ApprovalPolicy, handler string, req policyRequest, reasons []string) error {
+	inv, _ := invocationFrom(ctx)
+	task, _ := ctx.Value(approvalTaskKey{}).(approvalTask)
+	store, err := callbackStore(ctx)
+	if err != nil {
+		return err
+	}
+	id := approvalID(handler, req, inv.executionArn)
+	now := time.Now().UTC()
+
+	// an action already awaiting approval is not requested again, so that
+	// retries and scheduler runs do not notify the approvers each time.  A
+	// retried task waits on the pending request in place of the earlier
+	// attempt.
+	prev, err := store.Get(ctx, approvalKey(id))
+	if err != nil {
+		return err
+	}
+	if prev != nil && prev.Approval != nil && prev.Expires.After(now) {
+		if task.token != "" && task.token != prev.TaskToken {
+			prev.TaskToken = task.token
+			prev.Approval.CompleteTask = task.complete
+			if err := store.Put(ctx, prev); err != nil {
+				return err
+			}
+		}
+		logger(ctx).Info("approval already requested", "request", id, logKeyInstances, req.Instances)
+		return &ApprovalRequiredError{Request: id, Handler: handler, Reasons: prev.Approval.Reasons, Expires: prev.Expires}
+	}
+
+	token, err := newApprovalToken()
+	if err != nil {
+		return err
+	}
+	ar := &ApprovalRequest{
+		ID:           id,
+		Handler:      handler,
+		Event:        withInvocationMeta(inv.payload, inv),
+		Targets:      req.Instances,
+		Cmd:          req.Cmd,
+		Reasons:      reasons,
+		Requester:    inv.caller,
+		ExecutionArn: inv.executionArn,
+		TokenHash:    hashApprovalToken(token),
+		CompleteTask: task.complete,
+		Requested:    now,
+		Expires:      now.Add(a.expiry()),
+	}
+	cb := &Callback{
+		Key:       approvalKey(id),
+		TaskToken: task.token,
+		Operation: opApproval,
+		Instances: req.Instances,
+		Expires:   ar.Expires,
+		Approval:  ar,
+	}
+	if err := store.Put(ctx, cb); err != nil {
+		return err
+	}
+
+	n := ApprovalNotification{
+		Request:      id,
+		Handler:      handler,
+		Targets:      ar.Targets,
+		Cmd:          ar.Cmd,
+		Reasons:      reasons,
+		Requester:    ar.Requester,
+		ExecutionArn: ar.ExecutionArn,
+		Expires:      ar.Expires,
+		Approve:      ApproveActionEvent{Request: id, Token: token},
+	}
+	if err := notifyApprovers(ctx, a.Notify, n); err != nil {
+		// a request no approver knows of cannot be approved
+		if derr := store.Delete(ctx, cb.Key); derr != nil {
+			logger(ctx).Warn("unable to delete approval request", "request", id, logKeyError, derr)
+		}
+		logger(ctx).Error("unable to notify approvers", "request", id, logKeyError, err)
+		return err
+	}
+	logger(ctx).Info("approval requested", "request", id, logKeyInstances, req.Instances, "reasons", reasons)
+	metrics(ctx).count(metricApprovalRequests, 1)
+	return &ApprovalRequiredError{Request: id, Handler: handler, Reasons: reasons, Expires: ar.Expires}
+}
+
+// approvalID returns the ID of the request for approval of the action of
+// handler on req, made within the Step Functions execution executionArn if
+// any.  Every action has its own request, even when one invocation asks
+// for several, and asking again for an action finds its request.
+func approvalID(handler string, req policyRequest, executionArn string) string {
+	targets := append([]string{}, req.Instances...)
+	sort.Strings(targets)
+	h := sha256.New()
+	for _, s := range append([]string{handler, req.Cmd, executionArn}, targets...) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// notifyApprovers sends n to target, the notify field of an approval
+// policy.
+func notifyApprovers(ctx context.Context, target string, n ApprovalNotification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	kind, err := ParseApprovalNotify(target)
+	if err != nil {
+		return err
+	}
+	if kind == "sns" {
+		svc, err := snsClient(ctx)
+		if err != nil {
+			return err
+		}
+		topic := strings.TrimPrefix(target, "sns://")
+		_, err = svc.PublishWithContext(ctx, &sns.PublishInput{
+			TopicArn: aws.String(topic),
+			Subject:  aws.String("cwl approval required: " + n.Handler),
+			Message:  aws.String(string(b)),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to notify approvers on topic %s: %v", topic, err)
+		}
+		return nil
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(wctx, http.MethodPost, target, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to notify approvers: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unable to notify approvers: webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// withInvocationMeta returns payload with the caller, execution ARN and
+// correlation ID of inv added, unless already present, so that an action
+// taken on approval is recorded as made by its requester.
+func withInvocationMeta(payload []byte, inv invocation) json.RawMessage {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &m); err != nil || m == nil {
+		return payload
+	}
+	for k, v := range map[string]string{"caller": inv.caller, "executionArn": inv.executionArn, "correlationId": inv.correlationID} {
+		if _, ok := m[k]; !ok && v != "" {
+			m[k], _ = json.Marshal(v)
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return payload
+	}
+	return b
+}
+
+// newApprovalToken returns a new random approval token.
+func newApprovalToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate approval token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashApprovalToken returns the hash of token kept with its request.
+func hashApprovalToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// validApprovalToken reports whether token is the token of ar.
+func validApprovalToken(ar *ApprovalRequest, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashApprovalToken(token)), []byte(ar.TokenHash)) == 1
+}
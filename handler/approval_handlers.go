@@ -0,0 +1,187 @@
+package cwl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// error names reported to Step Functions for actions awaiting approval
+const (
+	ErrApprovalRejected = "cwl.ApprovalRejected"
+	ErrActionFailed     = "cwl.ActionFailed"
+)
+
+// statuses of actions awaiting approval
+const (
+	ApprovalPending  = "pending"
+	ApprovalExecuted = "executed"
+	ApprovalRejected = "rejected"
+)
+
+// ApprovalStatus is the result of AwaitApproval and ApproveAction.  Output
+// is the response of the handler, once the action has been taken.
+type ApprovalStatus struct {
+	Request  string          `json:"request,omitempty"`
+	Handler  string          `json:"handler"`
+	Status   string          `json:"status"`
+	Approver string          `json:"approver,omitempty"`
+	Expires  *time.Time      `json:"expires,omitempty"`
+	Output   json.RawMessage `json:"output,omitempty"`
+}
+
+// AwaitApprovalEvent triggers function cwl.AwaitApproval.  Event is the
+// event of Handler, and TaskToken the token of the Step Functions Task
+// state waiting for the action to be taken.
+type AwaitApprovalEvent struct {
+	Handler   string          `json:"handler" validate:"required,max=64"`
+	Event     json.RawMessage `json:"event" validate:"required"`
+	TaskToken string          `json:"taskToken" validate:"required,max=1024"`
+}
+
+// AwaitApproval invokes a handler that changes the state of AWS resources
+// on behalf of a Step Functions Task state, using the
+// "arn:aws:states:::lambda:invoke.waitForTaskToken" integration.  If the
+// protection policy lets the action be taken at once, its output is sent
+// back with SendTaskSuccess.  If the action needs approval, the task waits
+// until ApproveAction takes the action, or the request is rejected, so no
+// Wait/poll loop is needed in the state machine.
+func AwaitApproval(ctx context.Context, event AwaitApprovalEvent) (*ApprovalStatus, error) {
+
+	logInvocation(ctx)
+	logger(ctx).Info("received event", logKeyHandler, event.Handler)
+
+	r, ok := routerFrom(ctx)
+	if !ok {
+		return nil, fmt.Errorf("AwaitApproval must be invoked through the router")
+	}
+	if !mutatingHandlers[event.Handler] || event.Handler == "AwaitApproval" || event.Handler == "ApproveAction" {
+		return nil, fmt.Errorf("%q is not a handler that changes the state of AWS resources", event.Handler)
+	}
+
+	inv, _ := invocationFrom(ctx)
+	out, err := r.InvokeHandler(withApprovalTask(ctx, event.TaskToken, true), event.Handler, withInvocationMeta(event.Event, inv))
+	var areq *ApprovalRequiredError
+	if errors.As(err, &areq) {
+		return &ApprovalStatus{Request: areq.Request, Handler: event.Handler, Status: ApprovalPending, Expires: &areq.Expires}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := sendTaskSuccess(ctx, event.TaskToken, json.RawMessage(out)); err != nil {
+		return nil, err
+	}
+	return &ApprovalStatus{Handler: event.Handler, Status: ApprovalExecuted, Output: out}, nil
+}
+
+// ApproveActionEvent triggers function cwl.ApproveAction.  Request and
+// Token are sent to the approvers of the request.  If Reject is set the
+// request is rejected, for the given Reason, rather than approved.
+type ApproveActionEvent struct {
+	Request string `json:"request" validate:"required,max=64"`
+	Token   string `json:"token" validate:"required,max=128"`
+	Reject  bool   `json:"reject,omitempty"`
+	Reason  string `json:"reason,omitempty" validate:"max=1024"`
+}
+
+// ApproveAction approves, or rejects, a pending approval request, and
+// takes the approved action by invoking its handler with the stored event.
+// Possession of the token, which is sent only to the approvers, is the
+// only safeguard: the approver is the caller declared to ApproveAction,
+// which, like the requester, the invoker may set as it likes.  An approver
+// declaring the requester's name is refused, which catches a slip but not
+// a requester holding the token.  A request may be decided only once,
+// before it expires.  If a
+// Step Functions task is waiting on the request, it is sent the outcome.
+func ApproveAction(ctx context.Context, event ApproveActionEvent) (*ApprovalStatus, error) {
+
+	logInvocation(ctx)
+	logger(ctx).Info("received event", "request", event.Request, "reject", event.Reject)
+
+	r, ok := routerFrom(ctx)
+	if !ok {
+		return nil, fmt.Errorf("ApproveAction must be invoked through the router")
+	}
+	store, err := callbackStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cb, err := store.Get(ctx, approvalKey(event.Request))
+	if err != nil {
+		return nil, err
+	}
+	if cb == nil || cb.Approval == nil {
+		return nil, fmt.Errorf("no approval request %s is pending; it may have expired or already been decided", event.Request)
+	}
+	ar := cb.Approval
+	if !validApprovalToken(ar, event.Token) {
+		logger(ctx).Warn("invalid approval token", "request", ar.ID)
+		return nil, fmt.Errorf("invalid token for approval request %s", ar.ID)
+	}
+	inv, _ := invocationFrom(ctx)
+	approver := inv.caller
+	if approver == "" {
+		return nil, fmt.Errorf("the approver of request %s is not identified; pass the caller in the event or client context", ar.ID)
+	}
+	// declared names guard against slips, not forgery
+	if approver == ar.Requester {
+		return nil, fmt.Errorf("approval request %s was made by %s, and must be decided by someone else", ar.ID, approver)
+	}
+
+	// a request is decided once, however many approvers respond: the
+	// approver who takes the request from the store decides it, and is
+	// answered from the request taken
+	taken, err := store.Take(ctx, cb.Key)
+	if err != nil {
+		return nil, err
+	}
+	if taken == nil || taken.Approval == nil || taken.Approval.ID != ar.ID {
+		return nil, fmt.Errorf("approval request %s has already been decided", ar.ID)
+	}
+	cb, ar = taken, taken.Approval
+	status := &ApprovalStatus{Request: ar.ID, Handler: ar.Handler, Approver: approver}
+	params := map[string]interface{}{"request": ar.ID, "handler": ar.Handler}
+
+	if event.Reject {
+		params["reason"] = event.Reason
+		audit(ctx, "cwl:RejectAction", ar.Targets, params, nil, nil)
+		logger(ctx).Info("approval request rejected", "request", ar.ID, "approver", approver, "reason", event.Reason)
+		if cb.TaskToken != "" {
+			cause := fmt.Sprintf("approval request %s was rejected by %s", ar.ID, approver)
+			if event.Reason != "" {
+				cause += ": " + event.Reason
+			}
+			if err := sendTaskFailure(ctx, cb.TaskToken, ErrApprovalRejected, cause); err != nil {
+				return nil, err
+			}
+		}
+		status.Status = ApprovalRejected
+		return status, nil
+	}
+
+	audit(ctx, "cwl:ApproveAction", ar.Targets, params, nil, nil)
+	logger(ctx).Info("approval request approved", "request", ar.ID, "approver", approver)
+	actx := withApproval(ctx, ar, approver)
+	if cb.TaskToken != "" {
+		actx = withApprovalTask(actx, cb.TaskToken, ar.CompleteTask)
+	}
+	out, err := r.InvokeHandler(actx, ar.Handler, ar.Event)
+	if err != nil {
+		if cb.TaskToken != "" {
+			if ferr := sendTaskFailure(ctx, cb.TaskToken, ErrActionFailed, err.Error()); ferr != nil {
+				logger(ctx).Error("unable to report failed action", "request", ar.ID, logKeyError, ferr)
+			}
+		}
+		return nil, err
+	}
+	if cb.TaskToken != "" && ar.CompleteTask {
+		if err := sendTaskSuccess(ctx, cb.TaskToken, json.RawMessage(out)); err != nil {
+			return nil, err
+		}
+	}
+	status.Status = ApprovalExecuted
+	status.Output = out
+	return status, nil
+}
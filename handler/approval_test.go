@@ -0,0 +1,338 @@
+package cwl_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/1414C/cwl/awsfake"
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+// approvers receives approval requests by webhook.
+type approvers struct {
+	mu       sync.Mutex
+	received []cwl.ApprovalNotification
+	status   int
+}
+
+func (a *approvers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var n cwl.ApprovalNotification
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.status != 0 {
+		w.WriteHeader(a.status)
+		return
+	}
+	a.received = append(a.received, n)
+}
+
+// last returns the last request received.
+func (a *approvers) last(t *testing.T) cwl.ApprovalNotification {
+	t.Helper()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.received) == 0 {
+		t.Fatal("approvers were not notified")
+	}
+	return a.received[len(a.received)-1]
+}
+
+// fakeTopic is an SNS topic recording the messages published to it.
+type fakeTopic struct {
+	snsiface.SNSAPI
+	messages []string
+}
+
+func (f *fakeTopic) PublishWithContext(ctx aws.Context, in *sns.PublishInput, _ ...request.Option) (*sns.PublishOutput, error) {
+	f.messages = append(f.messages, aws.StringValue(in.Message))
+	return &sns.PublishOutput{MessageId: aws.String("m-1")}, nil
+}
+
+// approvalEnv returns a router and invoke function running handlers
+// against fakes, under a policy requiring approval to stop any instance, or
+// to act on instances tagged Tier=database.  Requests sent by SNS are
+// published to topic.
+func approvalEnv(t *testing.T, notify string, topic *fakeTopic) (*awsfake.State, *cwl.MemoryCallbackStore, func(caller, handler, event string) ([]byte, error)) {
+	policy, err := cwl.ParseProtectionPolicy([]byte(`{"approval": {
+		"handlers": ["EC2InstancesStop"],
+		"tags": {"Tier": "database"},
+		"notify": "` + notify + `",
+		"expiresIn": "30m"
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := awsfake.NewState()
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000d1"})
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000d2"})
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000d3", State: awsfake.InstanceStopped, Tags: map[string]string{"Tier": "database"}})
+	store := cwl.NewMemoryCallbackStore()
+	clients := &cwl.Clients{EC2: awsfake.NewEC2(st), SFN: awsfake.NewSFN(st), Callbacks: store, Policy: policy, SNS: topic}
+	r := cwl.NewRouter()
+	n := 0
+	invoke := func(caller, handler, event string) ([]byte, error) {
+		n++
+		ctx := cwl.WithClients(context.Background(), clients)
+		ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{
+			AwsRequestID:  "req-" + strings.Repeat("x", n),
+			ClientContext: lambdacontext.ClientContext{Custom: map[string]string{"caller": caller}},
+		})
+		return r.InvokeHandler(ctx, handler, []byte(event))
+	}
+	return st, store, invoke
+}
+
+func TestApproval(t *testing.T) {
+	a := &approvers{}
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	st, store, invoke := approvalEnv(t, srv.URL, nil)
+
+	// the stop waits for approval
+	_, err := invoke("alice", "EC2InstancesStop", `{"instances": ["i-000000000000000d1"]}`)
+	var areq *cwl.ApprovalRequiredError
+	if !errors.As(err, &areq) {
+		t.Fatalf("got %v, want an ApprovalRequiredError", err)
+	}
+	if in, _ := st.Instance("i-000000000000000d1"); in.State != awsfake.InstanceRunning {
+		t.Fatalf("instance is %s before approval", in.State)
+	}
+	n := a.last(t)
+	if n.Request != areq.Request || n.Requester != "alice" || n.Handler != "EC2InstancesStop" || n.Approve.Token == "" {
+		t.Fatalf("notification %+v", n)
+	}
+	approve, _ := json.Marshal(n.Approve)
+
+	// by someone else, with the token
+	if _, err := invoke("alice", "ApproveAction", string(approve)); err == nil {
+		t.Error("requester approved their own request")
+	}
+	bad := n.Approve
+	bad.Token = strings.Repeat("0", len(bad.Token))
+	b, _ := json.Marshal(bad)
+	if _, err := invoke("bob", "ApproveAction", string(b)); err == nil {
+		t.Error("request approved with an invalid token")
+	}
+	out, err := invoke("bob", "ApproveAction", string(approve))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status cwl.ApprovalStatus
+	json.Unmarshal(out, &status)
+	if status.Status != cwl.ApprovalExecuted || status.Approver != "bob" {
+		t.Errorf("approval status %+v", status)
+	}
+	if in, _ := st.Instance("i-000000000000000d1"); in.State != awsfake.InstanceStopped {
+		t.Errorf("instance is %s after approval, want stopped", in.State)
+	}
+	if _, err := invoke("carol", "ApproveAction", string(approve)); err == nil {
+		t.Error("request approved twice")
+	}
+
+	// a workflow task waits for the approval, and is told of the rejection
+	out, err = invoke("alice", "AwaitApproval", `{"handler": "EC2InstancesStop", "event": {"instances": ["i-000000000000000d2"]}, "taskToken": "token-1"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(out, &status)
+	if status.Status != cwl.ApprovalPending || status.Request == "" {
+		t.Fatalf("approval status %+v", status)
+	}
+	if _, ok := st.TaskResult("token-1"); ok {
+		t.Fatal("task completed before approval")
+	}
+	reject := a.last(t).Approve
+	reject.Reject, reject.Reason = true, "change freeze"
+	b, _ = json.Marshal(reject)
+	if _, err := invoke("bob", "ApproveAction", string(b)); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := st.TaskResult("token-1"); r.Success || r.Error != cwl.ErrApprovalRejected {
+		t.Errorf("task result %+v, want %s", r, cwl.ErrApprovalRejected)
+	}
+	if in, _ := st.Instance("i-000000000000000d2"); in.State != awsfake.InstanceRunning {
+		t.Errorf("rejected stop left instance %s", in.State)
+	}
+
+	// a callback handler keeps its task waiting
+	out, err = invoke("alice", "EC2InstancesStartCallback", `{"instances": ["i-000000000000000d3"], "taskToken": "token-2"}`)
+	if err != nil || string(out) != "null" {
+		t.Fatalf("got %s, %v; want the task left waiting", out, err)
+	}
+	cbs := store.Callbacks()
+	if len(cbs) != 1 || cbs[0].Approval == nil || cbs[0].TaskToken != "token-2" {
+		t.Fatalf("pending callbacks %+v, want only the approval request", cbs)
+	}
+	b, _ = json.Marshal(a.last(t).Approve)
+	if _, err := invoke("bob", "ApproveAction", string(b)); err != nil {
+		t.Fatal(err)
+	}
+	if in, _ := st.Instance("i-000000000000000d3"); in.State != awsfake.InstanceRunning {
+		t.Errorf("instance is %s after approval, want running", in.State)
+	}
+	cbs = store.Callbacks()
+	if len(cbs) != 1 || cbs[0].Key != "instance#i-000000000000000d3" || cbs[0].TaskToken != "token-2" {
+		t.Errorf("pending callbacks %+v, want the start of the instance", cbs)
+	}
+}
+
+func TestApprovalNotify(t *testing.T) {
+	topic := &fakeTopic{}
+	_, store, invoke := approvalEnv(t, "sns://arn:aws:sns:us-west-2:123456789012:cwl-approvals", topic)
+	_, err := invoke("alice", "EC2InstancesStop", `{"instances": ["i-000000000000000d1"]}`)
+	if !errors.As(err, new(*cwl.ApprovalRequiredError)) {
+		t.Fatalf("got %v, want an ApprovalRequiredError", err)
+	}
+	if len(store.Callbacks()) != 1 || len(topic.messages) != 1 {
+		t.Errorf("approval request not stored and published")
+	}
+
+	// a request that cannot be sent is not kept
+	a := &approvers{status: http.StatusInternalServerError}
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	_, store, invoke = approvalEnv(t, srv.URL, nil)
+	_, err = invoke("alice", "EC2InstancesStop", `{"instances": ["i-000000000000000d1"]}`)
+	if err == nil || errors.As(err, new(*cwl.ApprovalRequiredError)) {
+		t.Errorf("got %v, want a notification error", err)
+	}
+	if cbs := store.Callbacks(); len(cbs) != 0 {
+		t.Errorf("unsent approval requests stored: %+v", cbs)
+	}
+
+	for _, bad := range []string{`{"approval": {"handlers": ["*"]}}`, `{"approval": {"notify": "mailto:ops@example.com"}}`, `{"approval": {"notify": "https://example.com/hook", "expiresIn": "48h"}}`} {
+		if _, err := cwl.ParseProtectionPolicy([]byte(bad)); err == nil {
+			t.Errorf("policy %s accepted", bad)
+		}
+	}
+}
+
+// racingStore is a callback store whose Get of an approval request waits,
+// once racing is set, until two approvers have read it, so that both pass
+// their checks before either decides the request.
+type racingStore struct {
+	*cwl.MemoryCallbackStore
+	racing  bool
+	readers sync.WaitGroup
+}
+
+func (s *racingStore) Get(ctx context.Context, key string) (*cwl.Callback, error) {
+	cb, err := s.MemoryCallbackStore.Get(ctx, key)
+	if s.racing && strings.HasPrefix(key, "approval#") {
+		s.readers.Done()
+		s.readers.Wait()
+	}
+	return cb, err
+}
+
+func TestApprovalRace(t *testing.T) {
+	a := &approvers{}
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	policy, err := cwl.ParseProtectionPolicy([]byte(`{"approval": {"handlers": ["EC2InstancesReboot"], "notify": "` + srv.URL + `"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := awsfake.NewState()
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000d4"})
+	store := &racingStore{MemoryCallbackStore: cwl.NewMemoryCallbackStore()}
+	clients := &cwl.Clients{EC2: awsfake.NewEC2(st), Callbacks: store, Policy: policy}
+	r := cwl.NewRouter()
+	invoke := func(caller, handler, event string) ([]byte, error) {
+		ctx := cwl.WithClients(context.Background(), clients)
+		ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{
+			ClientContext: lambdacontext.ClientContext{Custom: map[string]string{"caller": caller}},
+		})
+		return r.InvokeHandler(ctx, handler, []byte(event))
+	}
+
+	if _, err := invoke("alice", "EC2InstancesReboot", `{"instances": ["i-000000000000000d4"]}`); !errors.As(err, new(*cwl.ApprovalRequiredError)) {
+		t.Fatalf("got %v, want an ApprovalRequiredError", err)
+	}
+	approve, _ := json.Marshal(a.last(t).Approve)
+
+	// two approvers respond at once; the reboot is taken once
+	store.racing = true
+	store.readers.Add(2)
+	errs := make(chan error, 2)
+	for _, approver := range []string{"bob", "carol"} {
+		go func(approver string) {
+			_, err := invoke(approver, "ApproveAction", string(approve))
+			errs <- err
+		}(approver)
+	}
+	var failed []error
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) != 1 || !strings.Contains(failed[0].Error(), "already been decided") {
+		t.Errorf("approvals failed with %v; want one to find the request already decided", failed)
+	}
+}
+
+// TestApprovalSchedule checks that each action the scheduler asks approval
+// for in one invocation has its own request, and that a later run does not
+// ask again for actions still pending.
+func TestApprovalSchedule(t *testing.T) {
+	a := &approvers{}
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+	policy, err := cwl.ParseProtectionPolicy([]byte(`{"approval": {"handlers": ["EC2InstancesStart"], "notify": "` + srv.URL + `"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := awsfake.NewState()
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000e1", State: awsfake.InstanceStopped, Tags: map[string]string{"Schedule": "daily-08:00-18:00"}})
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000e2", State: awsfake.InstanceStopped, Tags: map[string]string{"Schedule": "daily-08:00-18:00"}})
+	store := cwl.NewMemoryCallbackStore()
+	clients := &cwl.Clients{EC2: awsfake.NewEC2(st), Callbacks: store, Policy: policy}
+	r := cwl.NewRouter()
+	invoke := func(requestID, caller, handler, event string) ([]byte, error) {
+		ctx := cwl.WithClients(context.Background(), clients)
+		ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{
+			AwsRequestID:  requestID,
+			ClientContext: lambdacontext.ClientContext{Custom: map[string]string{"caller": caller}},
+		})
+		return r.InvokeHandler(ctx, handler, []byte(event))
+	}
+
+	for _, requestID := range []string{"req-1", "req-2"} {
+		if _, err := invoke(requestID, "scheduler", "EC2InstancesSchedule", `{"time": "2024-03-01T12:00:00Z"}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(a.received) != 2 || a.received[0].Request == a.received[1].Request {
+		t.Fatalf("approvers received %+v, want one request for each instance", a.received)
+	}
+	if cbs := store.Callbacks(); len(cbs) != 2 {
+		t.Fatalf("pending callbacks %+v, want one for each instance", cbs)
+	}
+	for _, n := range a.received {
+		b, _ := json.Marshal(n.Approve)
+		if _, err := invoke("req-3", "bob", "ApproveAction", string(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"i-000000000000000e1", "i-000000000000000e2"} {
+		if in, _ := st.Instance(id); in.State == awsfake.InstanceStopped {
+			t.Errorf("instance %s is stopped after approval", id)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package cwl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// AuditSinkEnvVar names the environment variable locating the audit trail
+// of the handlers that change the state of AWS resources:
+//
+//	dynamodb://<table>        a DynamoDB table with the string partition
+//	                          key "target" and string sort key "time"
+//	s3://<bucket>/<prefix>    JSON lines objects under <prefix>
+//	file://<path>             a local JSON lines file, for tests
+//
+// If it is not set, audit records are written to the function log only,
+// and cannot be queried with ListAuditRecords.
+const AuditSinkEnvVar = "CWL_AUDIT_SINK"
+
+// auditWriteTimeout bounds the time taken to write an audit record.
+const auditWriteTimeout = 5 * time.Second
+
+// auditTimeFormat formats audit record times in keys.  It is fixed-width, so
+// that keys sort in time order.
+const auditTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// results of audited actions
+const (
+	AuditSucceeded = "succeeded"
+	AuditFailed    = "failed"
+	AuditDenied    = "denied"
+	AuditPending   = "pending"
+)
+
+// AuditRecord records an action that changed, or attempted to change, the
+// state of AWS resources.  Targets holds the IDs of the resources acted
+// on; Parameters and Output hold the inputs and outcome of the action
+// beyond the targets.  Approval is the approval request made for, or
+// approving, the action, and ApprovedBy the approver.
+type AuditRecord struct {
+	ID            string                 `json:"id"`
+	Time          time.Time              `json:"time"`
+	Handler       string                 `json:"handler"`
+	Action        string                 `json:"action"`
+	Caller        string                 `json:"caller,omitempty"`
+	ExecutionArn  string                 `json:"executionArn,omitempty"`
+	RequestID     string                 `json:"requestId,omitempty"`
+	CorrelationID string                 `json:"correlationId,omitempty"`
+	Targets       []string               `json:"targets"`
+	Parameters    map[string]interface{} `json:"parameters,omitempty"`
+	Result        string                 `json:"result"`
+	Output        map[string]interface{} `json:"output,omitempty"`
+	Error         string                 `json:"error,omitempty"`
+	Approval      string                 `json:"approval,omitempty"`
+	ApprovedBy    string                 `json:"approvedBy,omitempty"`
+}
+
+// hasTarget reports whether target is one of the targets of the record.
+func (r *AuditRecord) hasTarget(target string) bool {
+	return containsString(r.Targets, target)
+}
+
+// AuditSink stores audit records.  Query returns the records for target
+// made at or after since, newest first, up to limit records.
+type AuditSink interface {
+	Record(ctx context.Context, rec *AuditRecord) error
+	Query(ctx context.Context, target string, since time.Time, limit int) ([]AuditRecord, error)
+}
+
+// errAuditQueryUnsupported is returned by the sink used when no audit sink
+// is configured.
+var errAuditQueryUnsupported = fmt.Errorf("audit records are only written to the function log; set %s to a queryable sink", AuditSinkEnvVar)
+
+// auditSink returns the sink supplied with ctx, or the sink named by
+// CWL_AUDIT_SINK.
+func auditSink(ctx context.Context) (AuditSink, error) {
+	if s := clientsFrom(ctx).Audit; s != nil {
+		return s, nil
+	}
+	spec := os.Getenv(AuditSinkEnvVar)
+	if spec == "" {
+		return logAuditSink{}, nil
+	}
+	kind, location, err := ParseAuditSink(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "dynamodb":
+		svc, err := dynamoDBClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &dynamoAuditSink{svc: svc, table: location}, nil
+	case "s3":
+		svc, err := s3Client(ctx)
+		if err != nil {
+			return nil, err
+		}
+		bucket, prefix, _ := strings.Cut(location, "/")
+		return &s3AuditSink{svc: svc, bucket: bucket, prefix: prefix}, nil
+	}
+	return NewFileAuditSink(location), nil
+}
+
+// ParseAuditSink splits an audit sink of the form described for
+// CWL_AUDIT_SINK into its kind, "dynamodb", "s3" or "file", and the table,
+// bucket and prefix, or path.
+func ParseAuditSink(spec string) (kind, location string, err error) {
+	kind, location, ok := strings.Cut(spec, "://")
+	if !ok || location == "" {
+		return "", "", fmt.Errorf("invalid audit sink %q; use dynamodb://<table>, s3://<bucket>/<prefix> or file://<path>", spec)
+	}
+	switch kind {
+	case "dynamodb", "s3", "file":
+		return kind, location, nil
+	}
+	return "", "", fmt.Errorf("unknown audit sink %q; use dynamodb://<table>, s3://<bucket>/<prefix> or file://<path>", spec)
+}
+
+// audit records the outcome of action on targets in the audit trail.  The
+// action has already been taken, so a record that cannot be written is
+// logged in full, and counted in the AuditErrors metric, rather than
+// failing the handler and so causing the action to be retried.
+func audit(ctx context.Context, action string, targets []string, params, output map[string]interface{}, err error) {
+	inv, _ := invocationFrom(ctx)
+	rec := &AuditRecord{
+		ID:            newSegmentID(),
+		Time:          time.Now().UTC(),
+		Handler:       inv.handler,
+		Action:        action,
+		Caller:        inv.caller,
+		ExecutionArn:  inv.executionArn,
+		RequestID:     inv.requestID,
+		CorrelationID: inv.correlationID,
+		Targets:       targets,
+		Parameters:    params,
+		Result:        AuditSucceeded,
+		Output:        output,
+	}
+	if a, ok := approvalFrom(ctx); ok {
+		rec.Approval, rec.ApprovedBy = a.request, a.approver
+	}
+	if err != nil {
+		rec.Result = AuditFailed
+		switch e := err.(type) {
+		case *PolicyViolationError, *InstanceCheckError:
+			rec.Result = AuditDenied
+		case *ApprovalRequiredError:
+			rec.Result = AuditPending
+			rec.Approval = e.Request
+		}
+		rec.Error = err.Error()
+	}
+
+	// the handler's context may have expired with the action
+	wctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditWriteTimeout)
+	defer cancel()
+	sink, serr := auditSink(wctx)
+	if serr == nil {
+		serr = sink.Record(wctx, rec)
+	}
+	if serr != nil {
+		logger(ctx).Error("unable to write audit record", "audit", rec, logKeyError, serr)
+		metrics(ctx).count(metricAuditErrors, 1)
+	}
+}
+
+// auditStates returns the audit output of an EC2 start, stop or terminate
+// call: the state of each instance after the call.  The output of a failed
+// call is nil.
+func auditStates(result interface{}) map[string]interface{} {
+	var changes []*ec2.InstanceStateChange
+	switch r := result.(type) {
+	case *ec2.StartInstancesOutput:
+		if r != nil {
+			changes = r.StartingInstances
+		}
+	case *ec2.StopInstancesOutput:
+		if r != nil {
+			changes = r.StoppingInstances
+		}
+	case *ec2.TerminateInstancesOutput:
+		if r != nil {
+			changes = r.TerminatingInstances
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	states := make(map[string]string)
+	for _, c := range changes {
+		if c.CurrentState != nil {
+			states[aws.StringValue(c.InstanceId)] = aws.StringValue(c.CurrentState.Name)
+		}
+	}
+	return map[string]interface{}{"states": states}
+}
+
+// logAuditSink writes audit records to the function log.  As with
+// metrics, the records are written whatever CWL_LOG_LEVEL is set to.
+type logAuditSink struct{}
+
+// Record writes rec as a log record with the message "audit".
+func (logAuditSink) Record(ctx context.Context, rec *AuditRecord) error {
+	b, err := json.Marshal(map[string]interface{}{
+		"time":  rec.Time,
+		"level": "INFO",
+		"msg":   "audit",
+		"audit": rec,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(logWriter{}, string(b))
+	return err
+}
+
+// Query fails; the log cannot be queried by the handlers.
+func (logAuditSink) Query(ctx context.Context, target string, since time.Time, limit int) ([]AuditRecord, error) {
+	return nil, errAuditQueryUnsupported
+}
+
+// FileAuditSink is an AuditSink appending records to a local JSON lines
+// file, for running the handlers in-process.
+type FileAuditSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileAuditSink returns a FileAuditSink writing to the file at path,
+// which is created when the first record is written.
+func NewFileAuditSink(path string) *FileAuditSink {
+	return &FileAuditSink{path: path}
+}
+
+// Record appends rec to the file.
+func (s *FileAuditSink) Record(ctx context.Context, rec *AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open audit file: %v", err)
+	}
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write audit file %s: %v", s.path, err)
+	}
+	return nil
+}
+
+// Query returns the records for target in the file.
+func (s *FileAuditSink) Query(ctx context.Context, target string, since time.Time, limit int) ([]AuditRecord, error) {
+	recs, err := s.Records()
+	if err != nil {
+		return nil, err
+	}
+	var out []AuditRecord
+	for i := len(recs) - 1; i >= 0 && len(out) < limit; i-- {
+		if recs[i].hasTarget(target) && !recs[i].Time.Before(since) {
+			out = append(out, recs[i])
+		}
+	}
+	return out, nil
+}
+
+// Records returns every record in the file, in the order written.
+func (s *FileAuditSink) Records() ([]AuditRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read audit file: %v", err)
+	}
+	return decodeAuditLines(bytes.NewReader(b))
+}
+
+// decodeAuditLines decodes the JSON lines audit records read from r.
+func decodeAuditLines(r io.Reader) ([]AuditRecord, error) {
+	var recs []AuditRecord
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("invalid audit record: %v", err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, sc.Err()
+}
+
+// dynamoAuditSink stores audit records in a DynamoDB table, with one item
+// per target so that the records of a target can be queried in time
+// order.  The sort key is the time of the record followed by its ID.
+type dynamoAuditSink struct {
+	svc   dynamodbiface.DynamoDBAPI
+	table string
+}
+
+// Record stores an item for each target of rec.
+func (s *dynamoAuditSink) Record(ctx context.Context, rec *AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	for _, target := range rec.Targets {
+		_, err := s.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(s.table),
+			Item: map[string]*dynamodb.AttributeValue{
+				"target":  {S: aws.String(target)},
+				"time":    {S: aws.String(rec.Time.UTC().Format(auditTimeFormat) + "#" + rec.ID)},
+				"handler": {S: aws.String(rec.Handler)},
+				"action":  {S: aws.String(rec.Action)},
+				"result":  {S: aws.String(rec.Result)},
+				"record":  {S: aws.String(string(b))},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to store audit record %s in table %s: %v", rec.ID, s.table, err)
+		}
+	}
+	return nil
+}
+
+// Query reads the items of target from the table, newest first.
+func (s *dynamoAuditSink) Query(ctx context.Context, target string, since time.Time, limit int) ([]AuditRecord, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("#target = :target AND #time >= :since"),
+		ExpressionAttributeNames: map[string]*string{
+			"#target": aws.String("target"),
+			"#time":   aws.String("time"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":target": {S: aws.String(target)},
+			":since":  {S: aws.String(since.UTC().Format(auditTimeFormat))},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(int64(limit)),
+	}
+	var recs []AuditRecord
+	var derr error
+	err := s.svc.QueryPagesWithContext(ctx, input, func(out *dynamodb.QueryOutput, last bool) bool {
+		for _, item := range out.Items {
+			var rec AuditRecord
+			if v, ok := item["record"]; ok {
+				if derr = json.Unmarshal([]byte(aws.StringValue(v.S)), &rec); derr != nil {
+					return false
+				}
+			}
+			recs = append(recs, rec)
+		}
+		return len(recs) < limit
+	})
+	if err == nil {
+		err = derr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query audit records of %s in table %s: %v", target, s.table, err)
+	}
+	if len(recs) > limit {
+		recs = recs[:limit]
+	}
+	return recs, nil
+}
+
+// s3AuditSink stores audit records as JSON lines objects in an S3 bucket,
+// under <prefix><target>/<time>-<id>.jsonl for each target of the record,
+// so that the keys of a target list in time order.
+type s3AuditSink struct {
+	svc    s3iface.S3API
+	bucket string
+	prefix string
+}
+
+// key returns the key of the object holding a record of target at t.
+func (s *s3AuditSink) key(target string, t time.Time, id string) string {
+	return s.prefix + target + "/" + t.UTC().Format(auditTimeFormat) + "-" + id + ".jsonl"
+}
+
+// Record writes an object for each target of rec.
+func (s *s3AuditSink) Record(ctx context.Context, rec *AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	for _, target := range rec.Targets {
+		key := s.key(target, rec.Time, rec.ID)
+		_, err := s.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(b),
+			ContentType: aws.String("application/x-ndjson"),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to write audit record s3://%s/%s: %v", s.bucket, key, err)
+		}
+	}
+	return nil
+}
+
+// Query lists the objects of target written since since, and reads the
+// newest of them.
+func (s *s3AuditSink) Query(ctx context.Context, target string, since time.Time, limit int) ([]AuditRecord, error) {
+	prefix := s.prefix + target + "/"
+	var keys []string
+	err := s.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:     aws.String(s.bucket),
+		Prefix:     aws.String(prefix),
+		StartAfter: aws.String(prefix + since.UTC().Format(auditTimeFormat)),
+	}, func(out *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range out.Contents {
+			keys = append(keys, aws.StringValue(o.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list audit records s3://%s/%s: %v", s.bucket, prefix, err)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	var recs []AuditRecord
+	for _, key := range keys {
+		out, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+		if err != nil {
+			return nil, fmt.Errorf("unable to read audit record s3://%s/%s: %v", s.bucket, key, err)
+		}
+		lines, err := decodeAuditLines(out.Body)
+		out.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("audit record s3://%s/%s: %v", s.bucket, key, err)
+		}
+		recs = append(recs, lines...)
+	}
+	return recs, nil
+}
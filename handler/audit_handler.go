@@ -0,0 +1,60 @@
+package cwl
+
+import (
+	"context"
+	"time"
+)
+
+// defaults of ListAuditRecords
+const (
+	defaultAuditLimit  = 50
+	defaultAuditWindow = 30 * 24 * time.Hour
+)
+
+// ListAuditRecordsEvent triggers function cwl.ListAuditRecords.  Since
+// defaults to 30 days ago, and Limit to 50 records.
+type ListAuditRecordsEvent struct {
+	Instance string    `json:"instance" validate:"required,format=instance-id"`
+	Since    time.Time `json:"since,omitempty"`
+	Limit    int       `json:"limit,omitempty" validate:"min=1,max=1000"`
+}
+
+// AuditRecords is the result of ListAuditRecords.
+type AuditRecords struct {
+	Instance string        `json:"instance"`
+	Records  []AuditRecord `json:"records"`
+}
+
+// ListAuditRecords lists the recent audit records of the actions taken on
+// an EC2 instance, newest first, from the sink named by CWL_AUDIT_SINK.
+func ListAuditRecords(ctx context.Context, event ListAuditRecordsEvent) (*AuditRecords, error) {
+
+	logInvocation(ctx)
+	logger(ctx).Info("received event", logKeyInstances, []string{event.Instance})
+	traceAnnotate(ctx, "instance_ids", event.Instance)
+
+	sink, err := auditSink(ctx)
+	if err != nil {
+		return nil, err
+	}
+	since, limit := event.Since, event.Limit
+	if since.IsZero() {
+		since = time.Now().Add(-defaultAuditWindow)
+	}
+	if limit == 0 {
+		limit = defaultAuditLimit
+	}
+
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
+
+	recs, err := sink.Query(ctx, event.Instance, since, limit)
+	if err != nil {
+		logger(ctx).Error("audit query failed", logKeyInstances, []string{event.Instance}, logKeyError, err)
+		return nil, deadlineErr(ctx, "list audit records of "+event.Instance, err)
+	}
+	if recs == nil {
+		recs = []AuditRecord{}
+	}
+	return &AuditRecords{Instance: event.Instance, Records: recs}, nil
+}
@@ -0,0 +1,269 @@
+package cwl_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1414C/cwl/awsfake"
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeAuditTable is an in-memory DynamoDB table with the key schema of an
+// audit table, supporting the calls made by the audit sink.
+type fakeAuditTable struct {
+	dynamodbiface.DynamoDBAPI
+	mu    sync.Mutex
+	items []map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeAuditTable) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, _ ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items = append(f.items, in.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeAuditTable) QueryPagesWithContext(ctx aws.Context, in *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, _ ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	target := aws.StringValue(in.ExpressionAttributeValues[":target"].S)
+	since := aws.StringValue(in.ExpressionAttributeValues[":since"].S)
+	var items []map[string]*dynamodb.AttributeValue
+	for _, item := range f.items {
+		if aws.StringValue(item["target"].S) == target && aws.StringValue(item["time"].S) >= since {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return aws.StringValue(items[i]["time"].S) > aws.StringValue(items[j]["time"].S) })
+	if n := int(aws.Int64Value(in.Limit)); n > 0 && len(items) > n {
+		items = items[:n]
+	}
+	fn(&dynamodb.QueryOutput{Items: items}, true)
+	return nil
+}
+
+// fakeAuditBucket is an in-memory S3 bucket supporting the calls made by
+// the audit sink.
+type fakeAuditBucket struct {
+	s3iface.S3API
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeAuditBucket) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	b, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.objects == nil {
+		f.objects = make(map[string][]byte)
+	}
+	f.objects[aws.StringValue(in.Key)] = b
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeAuditBucket) ListObjectsV2PagesWithContext(ctx aws.Context, in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, aws.StringValue(in.Prefix)) && k > aws.StringValue(in.StartAfter) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{}
+	for _, k := range keys {
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(k)})
+	}
+	fn(out, true)
+	return nil
+}
+
+func (f *fakeAuditBucket) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.objects[aws.StringValue(in.Key)]
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(b))}, nil
+}
+
+// TestAuditSinks records actions with each kind of sink named by
+// CWL_AUDIT_SINK, and lists them with ListAuditRecords.
+func TestAuditSinks(t *testing.T) {
+	tests := []struct {
+		sink    string
+		clients func() *cwl.Clients
+	}{
+		{"file://" + filepath.Join(t.TempDir(), "audit.jsonl"), func() *cwl.Clients { return &cwl.Clients{} }},
+		{"dynamodb://cwl-audit", func() *cwl.Clients { return &cwl.Clients{DynamoDB: &fakeAuditTable{}} }},
+		{"s3://audit-bucket/cwl/", func() *cwl.Clients { return &cwl.Clients{S3: &fakeAuditBucket{}} }},
+	}
+	for _, tt := range tests {
+		kind, _, _ := strings.Cut(tt.sink, ":")
+		t.Run(kind, func(t *testing.T) {
+			t.Setenv(cwl.AuditSinkEnvVar, tt.sink)
+			st := awsfake.NewState()
+			st.AddInstance(awsfake.Instance{ID: "i-000000000000000a1", State: awsfake.InstanceStopped})
+			st.AddInstance(awsfake.Instance{ID: "i-000000000000000a2", State: awsfake.InstanceStopped})
+			clients := tt.clients()
+			clients.EC2 = awsfake.NewEC2(st)
+			clients.SSM = awsfake.NewSSM(st)
+			ctx := cwl.WithClients(context.Background(), clients)
+			ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{
+				AwsRequestID:  "req-1",
+				ClientContext: lambdacontext.ClientContext{Custom: map[string]string{"caller": "ops"}},
+			})
+			r := cwl.NewRouter()
+
+			invoke := func(name, event string) []byte {
+				t.Helper()
+				out, err := r.InvokeHandler(ctx, name, []byte(event))
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				return out
+			}
+			invoke("EC2InstancesStart", `{"instances": ["i-000000000000000a1", "i-000000000000000a2"]}`)
+			time.Sleep(time.Millisecond)
+			invoke("EC2IssueCmd", `{"instances": ["i-000000000000000a1"], "cmd": "uptime", "executionArn": "arn:aws:states:us-west-2:123456789012:execution:sm:run-1"}`)
+			if _, err := r.InvokeHandler(ctx, "EC2InstancesReboot", []byte(`{"instances": ["i-000000000000000a9"]}`)); err == nil {
+				t.Fatal("reboot of an unknown instance succeeded")
+			}
+
+			var got cwl.AuditRecords
+			json.Unmarshal(invoke("ListAuditRecords", `{"instance": "i-000000000000000a1"}`), &got)
+			if len(got.Records) != 2 {
+				t.Fatalf("got %d records for i-000000000000000a1, want 2: %+v", len(got.Records), got.Records)
+			}
+			cmd, start := got.Records[0], got.Records[1]
+			if cmd.Action != "ssm:SendCommand" || cmd.Handler != "EC2IssueCmd" || cmd.Result != cwl.AuditSucceeded ||
+				cmd.ExecutionArn != "arn:aws:states:us-west-2:123456789012:execution:sm:run-1" || cmd.Parameters["cmd"] != "uptime" || cmd.Output["commandId"] == nil {
+				t.Errorf("command record %+v", cmd)
+			}
+			if start.Action != "ec2:StartInstances" || start.Caller != "ops" || start.RequestID != "req-1" || len(start.Targets) != 2 || start.Result != cwl.AuditSucceeded {
+				t.Errorf("start record %+v", start)
+			}
+			if !start.Time.Before(cmd.Time) {
+				t.Errorf("records are not newest first: %v, %v", cmd.Time, start.Time)
+			}
+
+			json.Unmarshal(invoke("ListAuditRecords", `{"instance": "i-000000000000000a1", "limit": 1}`), &got)
+			if len(got.Records) != 1 || got.Records[0].Action != "ssm:SendCommand" {
+				t.Errorf("limit 1: %+v", got.Records)
+			}
+			json.Unmarshal(invoke("ListAuditRecords", `{"instance": "i-000000000000000a9"}`), &got)
+			if len(got.Records) != 1 || got.Records[0].Result != cwl.AuditFailed || got.Records[0].Error == "" {
+				t.Errorf("failed reboot: %+v", got.Records)
+			}
+			since := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+			json.Unmarshal(invoke("ListAuditRecords", `{"instance": "i-000000000000000a2", "since": "`+since+`"}`), &got)
+			if len(got.Records) != 0 {
+				t.Errorf("records after %s: %+v", since, got.Records)
+			}
+		})
+	}
+}
+
+// failingSink is an AuditSink that cannot be written.
+type failingSink struct{}
+
+func (failingSink) Record(ctx context.Context, rec *cwl.AuditRecord) error {
+	return errors.New("table is unavailable")
+}
+
+func (failingSink) Query(ctx context.Context, target string, since time.Time, limit int) ([]cwl.AuditRecord, error) {
+	return nil, errors.New("table is unavailable")
+}
+
+// TestAuditFailure checks that an action whose audit record cannot be
+// written still succeeds, and that the record is logged instead.
+func TestAuditFailure(t *testing.T) {
+	st := awsfake.NewState()
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000b1"})
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{EC2: awsfake.NewEC2(st), Audit: failingSink{}})
+
+	var err error
+	records := captureLog(t, func() {
+		_, err = cwl.NewRouter().InvokeHandler(ctx, "EC2InstancesStop", []byte(`{"instances": ["i-000000000000000b1"]}`))
+	})
+	if err != nil {
+		t.Fatalf("stop failed with the audit sink: %v", err)
+	}
+	var logged, counted bool
+	for _, r := range records {
+		if r["msg"] == "unable to write audit record" {
+			rec, _ := r["audit"].(map[string]interface{})
+			logged = rec["action"] == "ec2:StopInstances" && r["error"] == "table is unavailable"
+		}
+		if r["AuditErrors"] == 1.0 {
+			counted = true
+		}
+	}
+	if !logged || !counted {
+		t.Errorf("audit failure logged %v, counted %v in:\n%v", logged, counted, records)
+	}
+}
+
+func TestAuditPolicy(t *testing.T) {
+	actions := func(doc *cwl.PolicyDocument) map[string][]string {
+		m := make(map[string][]string)
+		for _, st := range doc.Statement {
+			for _, a := range st.Action {
+				m[a] = append(m[a], st.Resource...)
+			}
+		}
+		return m
+	}
+
+	doc, err := cwl.HandlerPolicy([]string{"EC2InstancesStop", "GetEC2Statuses"}, cwl.PolicyOptions{AuditSink: "dynamodb://cwl-audit", Region: "us-west-2", Account: "123456789012"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := actions(doc)
+	if r := a["dynamodb:PutItem"]; len(r) == 0 || r[0] != "arn:aws:dynamodb:us-west-2:123456789012:table/cwl-audit" {
+		t.Errorf("dynamodb:PutItem on %v", r)
+	}
+	if _, ok := a["dynamodb:Query"]; ok {
+		t.Error("dynamodb:Query granted to handlers that do not query the audit trail")
+	}
+
+	doc, err = cwl.HandlerPolicy([]string{"ListAuditRecords"}, cwl.PolicyOptions{AuditSink: "s3://audit-bucket/cwl/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = actions(doc)
+	if r := a["s3:GetObject"]; len(r) != 1 || r[0] != "arn:aws:s3:::audit-bucket/cwl/*" {
+		t.Errorf("s3:GetObject on %v", r)
+	}
+	if r := a["s3:ListBucket"]; len(r) != 1 || r[0] != "arn:aws:s3:::audit-bucket" {
+		t.Errorf("s3:ListBucket on %v", r)
+	}
+	if _, ok := a["s3:PutObject"]; ok {
+		t.Error("s3:PutObject granted to ListAuditRecords")
+	}
+
+	if _, err := cwl.HandlerPolicy([]string{"EC2InstancesStart"}, cwl.PolicyOptions{AuditSink: "mysql://audit"}); err == nil {
+		t.Error("unknown audit sink accepted")
+	}
+}
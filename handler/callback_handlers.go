@@ -0,0 +1,374 @@
+package cwl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// operations awaiting a callback
+const (
+	opStartInstances = "start-instances"
+	opSendCommand    = "send-command"
+)
+
+// detail-types of the EventBridge events processed by CallbackCompletion
+const (
+	ec2StateChangeDetailType   = "EC2 Instance State-change Notification"
+	ssmCommandStatusDetailType = "EC2 Command Status-change Notification"
+)
+
+// error names reported to Step Functions with SendTaskFailure
+const (
+	ErrInstanceStartFailed = "cwl.InstanceStartFailed"
+	ErrCommandFailed       = "cwl.CommandFailed"
+)
+
+// EC2InstancesStartCallbackEvent triggers function
+// cwl.EC2InstancesStartCallback.  TaskToken is the token of the Step
+// Functions Task state waiting for the instances to start.
+type EC2InstancesStartCallbackEvent struct {
+	Instances []string `json:"instances" validate:"required,max=1000,format=instance-id"`
+	TaskToken string   `json:"taskToken" validate:"required,max=1024"`
+}
+
+// InstancesStartedResult is the Task output sent to Step Functions when all
+// of the instances have started.
+type InstancesStartedResult struct {
+	Instances []string `json:"instances"`
+	State     string   `json:"state"`
+}
+
+// EC2InstancesStartCallback starts the named EC2 instances and returns
+// without waiting for them to reach the running state.  It is invoked by a
+// Step Functions Task state using the
+// "arn:aws:states:::lambda:invoke.waitForTaskToken" integration, which
+// passes the task token in the event.  When EC2 reports that every instance
+// is running, CallbackCompletion sends the token back with
+// SendTaskSuccess, so no Wait/poll loop is needed in the state machine.  If
+// the start needs approval, the task also waits for the approval.
+func EC2InstancesStartCallback(ctx context.Context, event EC2InstancesStartCallbackEvent) (*ec2.StartInstancesOutput, error) {
+
+	if event.TaskToken == "" {
+		return nil, fmt.Errorf("no task token was provided in triggering event; invoke the function with the waitForTaskToken integration")
+	}
+	if event.Instances == nil {
+		return nil, fmt.Errorf("no instance names were specified in triggering event %v", event)
+	}
+
+	store, err := callbackStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// record the callbacks before starting the instances, so that a
+	// state-change event arriving immediately will find them
+	traceAnnotate(ctx, "instance_ids", event.Instances)
+	sctx, seg := traceSegment(ctx, "register callbacks")
+	expires := time.Now().Add(callbackTTL)
+	for _, id := range event.Instances {
+		err := store.Put(sctx, &Callback{
+			Key:       instanceKey(id),
+			TaskToken: event.TaskToken,
+			Operation: opStartInstances,
+			Instances: event.Instances,
+			Expires:   expires,
+		})
+		if err != nil {
+			seg.close(err)
+			return nil, err
+		}
+	}
+	seg.close(nil)
+
+	// an action awaiting approval keeps the task waiting; ApproveAction
+	// invokes the function again once it is approved
+	ctx = withApprovalTask(ctx, event.TaskToken, false)
+	result, err := EC2InstancesStart(ctx, EC2InstancesStartEvent{Instances: event.Instances})
+	if err != nil {
+		forgetCallbacks(ctx, store, event.Instances)
+		if errors.As(err, new(*ApprovalRequiredError)) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// instances that were already running will not emit a state-change
+	// event, so they are complete now
+	for _, c := range result.StartingInstances {
+		if aws.StringValue(c.CurrentState.Name) == ec2.InstanceStateNameRunning {
+			if err := store.Delete(ctx, instanceKey(aws.StringValue(c.InstanceId))); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := completeInstances(ctx, store, event.TaskToken, event.Instances); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// EC2IssueCmdCallbackEvent triggers function cwl.EC2IssueCmdCallback.
+// TaskToken is the token of the Step Functions Task state waiting for the
+// command to complete.
+type EC2IssueCmdCallbackEvent struct {
+	Instances []string `json:"instances" validate:"required,max=50,format=instance-id"`
+	Cmd       string   `json:"cmd" validate:"required,max=4096"`
+	TaskToken string   `json:"taskToken" validate:"required,max=1024"`
+}
+
+// CommandResult is the Task output sent to Step Functions when a command
+// completes successfully.
+type CommandResult struct {
+	CommandID string `json:"commandId"`
+	Status    string `json:"status"`
+}
+
+// EC2IssueCmdCallback runs the specified command on the specified EC2
+// instances and returns without waiting for it to complete.  As with
+// EC2InstancesStartCallback, it is invoked with the waitForTaskToken
+// integration, and CallbackCompletion reports the outcome of the command to
+// Step Functions when SSM publishes its final status.
+func EC2IssueCmdCallback(ctx context.Context, event EC2IssueCmdCallbackEvent) (*ssm.Command, error) {
+
+	if event.TaskToken == "" {
+		return nil, fmt.Errorf("no task token was provided in triggering event; invoke the function with the waitForTaskToken integration")
+	}
+
+	store, err := callbackStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = withApprovalTask(ctx, event.TaskToken, false)
+	cmd, err := EC2IssueCmd(ctx, EC2IssueCmdEvent{Instances: event.Instances, Cmd: event.Cmd})
+	if errors.As(err, new(*ApprovalRequiredError)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cb := &Callback{
+		Key:       commandKey(aws.StringValue(cmd.CommandId)),
+		TaskToken: event.TaskToken,
+		Operation: opSendCommand,
+		Instances: event.Instances,
+		CommandID: aws.StringValue(cmd.CommandId),
+		Expires:   time.Now().Add(callbackTTL),
+	}
+	if err := store.Put(ctx, cb); err != nil {
+		return nil, err
+	}
+
+	// the command may have completed before the callback was stored, in
+	// which case the status event has already been missed
+	svc, err := ssmClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list, err := svc.ListCommandsWithContext(ctx, &ssm.ListCommandsInput{CommandId: cmd.CommandId})
+	if err != nil {
+		return nil, fmt.Errorf("unable to check status of command %s: %v", cb.CommandID, err)
+	}
+	if len(list.Commands) > 0 {
+		if err := completeCommand(ctx, store, cb, aws.StringValue(list.Commands[0].Status)); err != nil {
+			return nil, err
+		}
+	}
+	return cmd, nil
+}
+
+// ec2StateChangeDetail is the detail of an EC2 instance state-change event.
+type ec2StateChangeDetail struct {
+	InstanceID string `json:"instance-id"`
+	State      string `json:"state"`
+}
+
+// ssmCommandStatusDetail is the detail of an SSM command status event.
+type ssmCommandStatusDetail struct {
+	CommandID string `json:"command-id"`
+	Status    string `json:"status"`
+}
+
+// CallbackCompletion is triggered by EventBridge rules matching EC2 instance
+// state-change and SSM command status-change events.  If a Step Functions
+// task is waiting for the instance or command, the task token is returned
+// with SendTaskSuccess or SendTaskFailure.  Events for resources without a
+// pending callback are ignored.  An error is returned only if the callback
+// could not be processed, so that EventBridge retries the event.
+func CallbackCompletion(ctx context.Context, event events.CloudWatchEvent) error {
+
+	logInvocation(ctx)
+	logger(ctx).Info("received event", "detailType", event.DetailType, "detail", event.Detail)
+
+	store, err := callbackStore(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch event.DetailType {
+	case ec2StateChangeDetailType:
+		var d ec2StateChangeDetail
+		if err := json.Unmarshal(event.Detail, &d); err != nil {
+			return fmt.Errorf("invalid %s detail: %v", event.DetailType, err)
+		}
+		ctx = withLogAttrs(ctx, logKeyInstances, []string{d.InstanceID})
+		traceAnnotate(ctx, "instance_ids", d.InstanceID)
+		cb, err := store.Get(ctx, instanceKey(d.InstanceID))
+		if err != nil || cb == nil {
+			return err
+		}
+		return instanceStateChanged(ctx, store, cb, d.InstanceID, d.State)
+
+	case ssmCommandStatusDetailType:
+		var d ssmCommandStatusDetail
+		if err := json.Unmarshal(event.Detail, &d); err != nil {
+			return fmt.Errorf("invalid %s detail: %v", event.DetailType, err)
+		}
+		ctx = withLogAttrs(ctx, logKeyCommandID, d.CommandID)
+		traceAnnotate(ctx, "command_id", d.CommandID)
+		cb, err := store.Get(ctx, commandKey(d.CommandID))
+		if err != nil || cb == nil {
+			return err
+		}
+		return completeCommand(ctx, store, cb, d.Status)
+	}
+
+	logger(ctx).Info("ignoring event", "detailType", event.DetailType)
+	return nil
+}
+
+// instanceStateChanged processes a state-change of an instance with a
+// pending start callback.
+func instanceStateChanged(ctx context.Context, store CallbackStore, cb *Callback, id, state string) error {
+	if cb.Operation != opStartInstances {
+		logger(ctx).Info("ignoring instance state", logKeyInstances, []string{id}, "state", state, "operation", cb.Operation)
+		return nil
+	}
+	switch state {
+	case ec2.InstanceStateNameRunning:
+		if err := store.Delete(ctx, instanceKey(id)); err != nil {
+			return err
+		}
+		return completeInstances(ctx, store, cb.TaskToken, cb.Instances)
+	case ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped,
+		ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated:
+		forgetCallbacks(ctx, store, cb.Instances)
+		return sendTaskFailure(ctx, cb.TaskToken, ErrInstanceStartFailed,
+			fmt.Sprintf("instance %s entered state %s while starting", id, state))
+	}
+	return nil
+}
+
+// completeInstances sends the task token back with SendTaskSuccess if none
+// of the instances is still waiting to start for the token.  Each instance
+// deletes its own callback before checking the others, so the last of
+// several concurrent events always completes the task.
+func completeInstances(ctx context.Context, store CallbackStore, token string, instances []string) error {
+	for _, id := range instances {
+		cb, err := store.Get(ctx, instanceKey(id))
+		if err != nil {
+			return err
+		}
+		if cb != nil && cb.TaskToken == token {
+			return nil
+		}
+	}
+	return sendTaskSuccess(ctx, token, InstancesStartedResult{Instances: instances, State: ec2.InstanceStateNameRunning})
+}
+
+// completeCommand reports the outcome of a command to Step Functions once
+// it has reached a final status.
+func completeCommand(ctx context.Context, store CallbackStore, cb *Callback, status string) error {
+	switch status {
+	case ssm.CommandStatusSuccess:
+		if err := sendTaskSuccess(ctx, cb.TaskToken, CommandResult{CommandID: cb.CommandID, Status: status}); err != nil {
+			return err
+		}
+		metrics(ctx).count(metricCommandsSucceeded, 1)
+	case ssm.CommandStatusFailed, ssm.CommandStatusCancelled, ssm.CommandStatusTimedOut:
+		if err := sendTaskFailure(ctx, cb.TaskToken, ErrCommandFailed, fmt.Sprintf("command %s finished with status %s", cb.CommandID, status)); err != nil {
+			return err
+		}
+		metrics(ctx).count(metricCommandsFailed, 1, "Status", status)
+	default:
+		return nil
+	}
+	return store.Delete(ctx, cb.Key)
+}
+
+// forgetCallbacks deletes the start callbacks of the instances.  Errors are
+// logged; the callbacks expire in any case.
+func forgetCallbacks(ctx context.Context, store CallbackStore, instances []string) {
+	for _, id := range instances {
+		if err := store.Delete(ctx, instanceKey(id)); err != nil {
+			logger(ctx).Warn("unable to delete callback", logKeyInstances, []string{id}, logKeyError, err)
+		}
+	}
+}
+
+// sendTaskSuccess returns the task token to Step Functions with the JSON
+// encoding of output.  A token that has already been used or has timed out
+// is logged and otherwise ignored.
+func sendTaskSuccess(ctx context.Context, token string, output interface{}) error {
+	svc, err := sfnClient(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(output)
+	if err != nil {
+		return err
+	}
+	_, err = svc.SendTaskSuccessWithContext(ctx, &sfn.SendTaskSuccessInput{
+		TaskToken: aws.String(token),
+		Output:    aws.String(string(b)),
+	})
+	if err = staleToken(ctx, err); err != nil {
+		return fmt.Errorf("unable to send task success: %v", err)
+	}
+	logger(ctx).Info("sent task success", "output", json.RawMessage(b))
+	return nil
+}
+
+// sendTaskFailure returns the task token to Step Functions with an error
+// name and cause.
+func sendTaskFailure(ctx context.Context, token, name, cause string) error {
+	svc, err := sfnClient(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = svc.SendTaskFailureWithContext(ctx, &sfn.SendTaskFailureInput{
+		TaskToken: aws.String(token),
+		Error:     aws.String(name),
+		Cause:     aws.String(cause),
+	})
+	if err = staleToken(ctx, err); err != nil {
+		return fmt.Errorf("unable to send task failure: %v", err)
+	}
+	logger(ctx).Info("sent task failure", logKeyError, name, "cause", cause)
+	return nil
+}
+
+// staleToken discards the errors returned for task tokens that are no
+// longer valid; the task has already completed or timed out, and retrying
+// the event cannot help.
+func staleToken(ctx context.Context, err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case sfn.ErrCodeTaskTimedOut, sfn.ErrCodeTaskDoesNotExist, sfn.ErrCodeInvalidToken:
+			logger(ctx).Warn("ignoring stale task token", logKeyError, aerr.Message())
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,264 @@
+package cwl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// CallbackTableEnvVar names the environment variable holding the name of
+// the DynamoDB table in which pending callbacks are stored.  The table has
+// a string partition key "key", and time-to-live enabled on "expires".
+const CallbackTableEnvVar = "CWL_CALLBACK_TABLE"
+
+// defaultCallbackTable is used when CWL_CALLBACK_TABLE is not set.
+const defaultCallbackTable = "cwl-callbacks"
+
+// callbackTTL is the time after which an incomplete callback is forgotten.
+// The Task state waiting for the callback should time out well before.
+const callbackTTL = 24 * time.Hour
+
+// Callback is a Step Functions task token waiting for the completion of an
+// operation on an AWS resource.  Key identifies the resource whose events
+// complete the operation, e.g. "instance#i-0123456789abcdef0" or
+// "command#<command-id>".  Pending approval requests are also kept as
+// callbacks, under "approval#<request-id>", with a task token only if a
+// task is waiting on the request.
+type Callback struct {
+	Key       string           `json:"key"`
+	TaskToken string           `json:"taskToken"`
+	Operation string           `json:"operation"`
+	Instances []string         `json:"instances,omitempty"`
+	CommandID string           `json:"commandId,omitempty"`
+	Approval  *ApprovalRequest `json:"approval,omitempty"`
+	Expires   time.Time        `json:"expires"`
+}
+
+// CallbackStore persists pending callbacks between the handler starting an
+// operation and the handler processing its completion event.  Get returns
+// nil and no error if no callback is stored under key.  Take removes and
+// returns the callback stored under key in one atomic step, so that of
+// several concurrent callers only one gets it; the others get nil.
+type CallbackStore interface {
+	Put(ctx context.Context, cb *Callback) error
+	Get(ctx context.Context, key string) (*Callback, error)
+	Delete(ctx context.Context, key string) error
+	Take(ctx context.Context, key string) (*Callback, error)
+}
+
+// instanceKey and commandKey return the callback keys of EC2 instances and
+// SSM commands; approvalKey those of approval requests.
+func instanceKey(id string) string { return "instance#" + id }
+func commandKey(id string) string  { return "command#" + id }
+func approvalKey(id string) string { return "approval#" + id }
+
+// callbackStore returns the store supplied with ctx, or the DynamoDB store.
+func callbackStore(ctx context.Context) (CallbackStore, error) {
+	if s := clientsFrom(ctx).Callbacks; s != nil {
+		return s, nil
+	}
+	svc, err := dynamoDBClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	table := os.Getenv(CallbackTableEnvVar)
+	if table == "" {
+		table = defaultCallbackTable
+	}
+	return &dynamoCallbackStore{svc: svc, table: table}, nil
+}
+
+// MemoryCallbackStore is a CallbackStore held in memory, for running the
+// callback handlers in-process.
+type MemoryCallbackStore struct {
+	mu        sync.Mutex
+	callbacks map[string]Callback
+}
+
+// NewMemoryCallbackStore returns an empty MemoryCallbackStore.
+func NewMemoryCallbackStore() *MemoryCallbackStore {
+	return &MemoryCallbackStore{callbacks: make(map[string]Callback)}
+}
+
+// Put stores cb under cb.Key.
+func (s *MemoryCallbackStore) Put(ctx context.Context, cb *Callback) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.callbacks[cb.Key] = *cb
+	return nil
+}
+
+// Get returns the callback stored under key.
+func (s *MemoryCallbackStore) Get(ctx context.Context, key string) (*Callback, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cb, ok := s.callbacks[key]
+	if !ok || time.Now().After(cb.Expires) {
+		return nil, nil
+	}
+	return &cb, nil
+}
+
+// Delete removes the callback stored under key.
+func (s *MemoryCallbackStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.callbacks, key)
+	return nil
+}
+
+// Take removes and returns the callback stored under key.
+func (s *MemoryCallbackStore) Take(ctx context.Context, key string) (*Callback, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cb, ok := s.callbacks[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.callbacks, key)
+	if time.Now().After(cb.Expires) {
+		return nil, nil
+	}
+	return &cb, nil
+}
+
+// Callbacks returns every stored callback, sorted by key.
+func (s *MemoryCallbackStore) Callbacks() []Callback {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cbs []Callback
+	for _, cb := range s.callbacks {
+		cbs = append(cbs, cb)
+	}
+	sort.Slice(cbs, func(i, j int) bool { return cbs[i].Key < cbs[j].Key })
+	return cbs
+}
+
+// dynamoCallbackStore stores callbacks in a DynamoDB table.
+type dynamoCallbackStore struct {
+	svc   dynamodbiface.DynamoDBAPI
+	table string
+}
+
+// Put stores cb under cb.Key.
+func (s *dynamoCallbackStore) Put(ctx context.Context, cb *Callback) error {
+	item := map[string]*dynamodb.AttributeValue{
+		"key":       {S: aws.String(cb.Key)},
+		"taskToken": {S: aws.String(cb.TaskToken)},
+		"operation": {S: aws.String(cb.Operation)},
+		"expires":   {N: aws.String(strconv.FormatInt(cb.Expires.Unix(), 10))},
+	}
+	if len(cb.Instances) > 0 {
+		item["instances"] = &dynamodb.AttributeValue{SS: aws.StringSlice(cb.Instances)}
+	}
+	if cb.CommandID != "" {
+		item["commandId"] = &dynamodb.AttributeValue{S: aws.String(cb.CommandID)}
+	}
+	if cb.Approval != nil {
+		b, err := json.Marshal(cb.Approval)
+		if err != nil {
+			return err
+		}
+		item["approval"] = &dynamodb.AttributeValue{S: aws.String(string(b))}
+	}
+	_, err := s.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to store callback %s in table %s: %v", cb.Key, s.table, err)
+	}
+	return nil
+}
+
+// Get returns the callback stored under key.  Expired items that DynamoDB
+// has not yet removed are ignored.
+func (s *dynamoCallbackStore) Get(ctx context.Context, key string) (*Callback, error) {
+	out, err := s.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]*dynamodb.AttributeValue{"key": {S: aws.String(key)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read callback %s from table %s: %v", key, s.table, err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+	return callbackFromItem(key, out.Item)
+}
+
+// callbackFromItem decodes the callback stored under key as item.  Expired
+// items that DynamoDB has not yet removed are ignored.
+func callbackFromItem(key string, item map[string]*dynamodb.AttributeValue) (*Callback, error) {
+	cb := &Callback{
+		Key:       key,
+		TaskToken: aws.StringValue(item["taskToken"].S),
+		Operation: aws.StringValue(item["operation"].S),
+	}
+	if v, ok := item["instances"]; ok {
+		cb.Instances = aws.StringValueSlice(v.SS)
+	}
+	if v, ok := item["commandId"]; ok {
+		cb.CommandID = aws.StringValue(v.S)
+	}
+	if v, ok := item["approval"]; ok {
+		cb.Approval = &ApprovalRequest{}
+		if err := json.Unmarshal([]byte(aws.StringValue(v.S)), cb.Approval); err != nil {
+			return nil, fmt.Errorf("invalid approval request in callback %s: %v", key, err)
+		}
+	}
+	if v, ok := item["expires"]; ok {
+		secs, _ := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+		cb.Expires = time.Unix(secs, 0)
+	}
+	if time.Now().After(cb.Expires) {
+		return nil, nil
+	}
+	return cb, nil
+}
+
+// Delete removes the callback stored under key.
+func (s *dynamoCallbackStore) Delete(ctx context.Context, key string) error {
+	_, err := s.svc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       map[string]*dynamodb.AttributeValue{"key": {S: aws.String(key)}},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete callback %s from table %s: %v", key, s.table, err)
+	}
+	return nil
+}
+
+// Take removes and returns the callback stored under key, with a delete
+// conditional on the item existing.  A failed condition means another
+// caller took the item first.
+func (s *dynamoCallbackStore) Take(ctx context.Context, key string) (*Callback, error) {
+	out, err := s.svc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:                aws.String(s.table),
+		Key:                      map[string]*dynamodb.AttributeValue{"key": {S: aws.String(key)}},
+		ConditionExpression:      aws.String("attribute_exists(#key)"),
+		ExpressionAttributeNames: map[string]*string{"#key": aws.String("key")},
+		ReturnValues:             aws.String(dynamodb.ReturnValueAllOld),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to take callback %s from table %s: %v", key, s.table, err)
+	}
+	if out.Attributes == nil {
+		return nil, nil
+	}
+	return callbackFromItem(key, out.Attributes)
+}
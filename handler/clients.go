@@ -0,0 +1,203 @@
+package cwl
+
+import (
+	"context"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/batch/batchiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sfn/sfniface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// defaultRegion is the AWS Region of the sessions established by the
+// handlers when AWS_REGION is unset.
+const defaultRegion = "us-west-2"
+
+// functionRegion returns the Region of the Lambda function, which Lambda
+// sets in AWS_REGION, or defaultRegion when AWS_REGION is unset.
+func functionRegion() string {
+	if r := os.Getenv("AWS_REGION"); r != "" {
+		return r
+	}
+	return defaultRegion
+}
+
+// sessionConfig returns the configuration of the sessions established by
+// the handlers, in the Region of the Lambda function.
+func sessionConfig() *aws.Config {
+	return &aws.Config{Region: aws.String(functionRegion())}
+}
+
+// Clients holds the AWS service clients used by the cwl handlers.  Clients
+// supplied with the invocation context via WithClients replace the clients
+// the handlers would otherwise create from the Lambda function's
+// credentials, allowing the handlers to be run in-process against fakes.
+// A nil field means the default client is used for that service.  AWS SDK
+// clients are instrumented to record the metrics of their API calls.
+type Clients struct {
+	EC2      ec2iface.EC2API
+	SSM      ssmiface.SSMAPI
+	Batch    batchiface.BatchAPI
+	SFN      sfniface.SFNAPI
+	DynamoDB dynamodbiface.DynamoDBAPI
+	S3       s3iface.S3API
+	SNS      snsiface.SNSAPI
+
+	// Callbacks stores the task tokens of pending Step Functions
+	// callbacks; by default the DynamoDB table named by CWL_CALLBACK_TABLE
+	// is used.
+	Callbacks CallbackStore
+
+	// Audit stores the audit trail of the handlers; by default the sink
+	// named by CWL_AUDIT_SINK is used.
+	Audit AuditSink
+
+	// Policy is the protection policy checked before the handlers change
+	// the state of AWS resources; by default the policy named by
+	// CWL_POLICY is used.
+	Policy *ProtectionPolicy
+
+	// Idempotency stores the responses of requests made with idempotency
+	// keys; by default the DynamoDB table named by CWL_IDEMPOTENCY_TABLE
+	// is used.
+	Idempotency IdempotencyStore
+}
+
+// clientsKey is the context key for *Clients.
+type clientsKey struct{}
+
+// WithClients returns a copy of ctx carrying c.  The handlers invoked with
+// the returned context call AWS through the clients in c.
+func WithClients(ctx context.Context, c *Clients) context.Context {
+	return context.WithValue(ctx, clientsKey{}, c)
+}
+
+// clientsFrom returns the clients carried by ctx, or an empty set.
+func clientsFrom(ctx context.Context) *Clients {
+	if c, ok := ctx.Value(clientsKey{}).(*Clients); ok && c != nil {
+		return c
+	}
+	return &Clients{}
+}
+
+// ec2Client returns the EC2 client supplied with ctx or, using the IAM
+// credentials assigned to the Lambda function, a client for a new session
+// in the Region of the Lambda function.
+func ec2Client(ctx context.Context) (ec2iface.EC2API, error) {
+	if c := clientsFrom(ctx).EC2; c != nil {
+		instrument(c)
+		return c, nil
+	}
+	sess, err := session.NewSession(sessionConfig())
+	if err != nil {
+		return nil, err
+	}
+	svc := ec2.New(sess)
+	instrument(svc)
+	return svc, nil
+}
+
+// ssmClient returns the SSM client supplied with ctx or a client for a new
+// session in the Region of the Lambda function.
+func ssmClient(ctx context.Context) (ssmiface.SSMAPI, error) {
+	if c := clientsFrom(ctx).SSM; c != nil {
+		instrument(c)
+		return c, nil
+	}
+	sess, err := session.NewSession(sessionConfig())
+	if err != nil {
+		return nil, err
+	}
+	svc := ssm.New(sess)
+	instrument(svc)
+	return svc, nil
+}
+
+// batchClient returns the Batch client supplied with ctx or a client for a
+// session in the Region of the Lambda function.
+func batchClient(ctx context.Context) batchiface.BatchAPI {
+	if c := clientsFrom(ctx).Batch; c != nil {
+		instrument(c)
+		return c
+	}
+	svc := batch.New(session.New(sessionConfig()))
+	instrument(svc)
+	return svc
+}
+
+// sfnClient returns the Step Functions client supplied with ctx or a client
+// for a new session in the Region of the Lambda function.
+func sfnClient(ctx context.Context) (sfniface.SFNAPI, error) {
+	if c := clientsFrom(ctx).SFN; c != nil {
+		instrument(c)
+		return c, nil
+	}
+	sess, err := session.NewSession(sessionConfig())
+	if err != nil {
+		return nil, err
+	}
+	svc := sfn.New(sess)
+	instrument(svc)
+	return svc, nil
+}
+
+// dynamoDBClient returns the DynamoDB client supplied with ctx or a client
+// for a new session in the Region of the Lambda function.
+func dynamoDBClient(ctx context.Context) (dynamodbiface.DynamoDBAPI, error) {
+	if c := clientsFrom(ctx).DynamoDB; c != nil {
+		instrument(c)
+		return c, nil
+	}
+	sess, err := session.NewSession(sessionConfig())
+	if err != nil {
+		return nil, err
+	}
+	svc := dynamodb.New(sess)
+	instrument(svc)
+	return svc, nil
+}
+
+// s3Client returns the S3 client supplied with ctx or a client for a new
+// session in the Region of the Lambda function.
+func s3Client(ctx context.Context) (s3iface.S3API, error) {
+	if c := clientsFrom(ctx).S3; c != nil {
+		instrument(c)
+		return c, nil
+	}
+	sess, err := session.NewSession(sessionConfig())
+	if err != nil {
+		return nil, err
+	}
+	svc := s3.New(sess)
+	instrument(svc)
+	return svc, nil
+}
+
+// snsClient returns the SNS client supplied with ctx or a client for a new
+// session in the Region of the Lambda function.
+func snsClient(ctx context.Context) (snsiface.SNSAPI, error) {
+	if c := clientsFrom(ctx).SNS; c != nil {
+		instrument(c)
+		return c, nil
+	}
+	sess, err := session.NewSession(sessionConfig())
+	if err != nil {
+		return nil, err
+	}
+	svc := sns.New(sess)
+	instrument(svc)
+	return svc, nil
+}
@@ -0,0 +1,30 @@
+package cwl_test
+
+import (
+	"testing"
+
+	"github.com/1414C/cwl/handler"
+)
+
+// TestClientRegions checks that every client created by the handlers is in
+// the Region of the Lambda function, or us-west-2 when it has none.
+func TestClientRegions(t *testing.T) {
+	for _, want := range []string{"eu-central-1", ""} {
+		t.Setenv("AWS_REGION", want)
+		if want == "" {
+			want = "us-west-2"
+		}
+		regions, err := cwl.DefaultClientRegions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(regions) != 7 {
+			t.Errorf("got clients %v, want 7", regions)
+		}
+		for name, got := range regions {
+			if got != want {
+				t.Errorf("%s client in %q, want %q", name, got, want)
+			}
+		}
+	}
+}
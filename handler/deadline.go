@@ -0,0 +1,48 @@
+package cwl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// deadlineMargin is the time reserved ahead of the Lambda deadline for a
+// handler to stop work and return a response.  Without the margin an
+// in-flight AWS SDK call would simply be killed along with the function.
+const deadlineMargin = 500 * time.Millisecond
+
+// ErrDeadlineApproaching is returned (wrapped) when a handler stops work
+// because the Lambda invocation deadline is about to expire.
+var ErrDeadlineApproaching = errors.New("lambda deadline approaching")
+
+// withDeadlineMargin returns a copy of ctx that is cancelled deadlineMargin
+// before the deadline of ctx.  Contexts without a deadline are returned
+// with a no-op cancel function.
+func withDeadlineMargin(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-deadlineMargin))
+}
+
+// deadlineApproaching reports whether the margin-adjusted context has
+// expired, or will expire before another call can reasonably be made.
+func deadlineApproaching(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < deadlineMargin
+}
+
+// deadlineErr converts an error caused by the expiry of the margin-adjusted
+// context into an ErrDeadlineApproaching error describing the operation that
+// was interrupted.  Other errors are returned unchanged.
+func deadlineErr(ctx context.Context, op string, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s: %w; the operation may not have completed", op, ErrDeadlineApproaching)
+	}
+	return err
+}
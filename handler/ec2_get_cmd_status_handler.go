@@ -1,49 +1,42 @@
 package cwl
 
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ssm"
-	"log"
 )
 
 // EC2ListCmdEvent triggers function cwl.EC2ListCmd
 type EC2ListCmdEvent struct {
-	Cmd       string   `json:"cmd"`
-	Instances []string `json:"instances"`
+	Cmd       string   `json:"cmd" validate:"required,format=uuid"`
+	Instances []string `json:"instances" validate:"max=50,format=instance-id"`
 }
 
 // EC2ListCmd lists the specified command status/properties
-func EC2ListCmd(event EC2ListCmdEvent) (*ssm.ListCommandsOutput, error) {
+func EC2ListCmd(ctx context.Context, event EC2ListCmdEvent) (*ssm.ListCommandsOutput, error) {
 
 	// log the received event, this will write the raw event to the
 	// CloudWatch log stream
-	log.Println("loading function...")
-	log.Println("received event.Cmd:", event.Cmd)
-	log.Println("received event.Instances:", event.Instances)
+	logInvocation(ctx)
+	logger(ctx).Info("received event", logKeyCommandID, event.Cmd, logKeyInstances, event.Instances)
+	traceAnnotate(ctx, "command_id", event.Cmd)
 
 	// if no commandID was passed in the event, return an error.
 	if event.Cmd == "" {
 		return nil, fmt.Errorf("no command-id was provided in triggering event %v", event)
 	}
 
-	// using the IAM credentials asigned to the Lambda function, establish
-	// a session in the 'us-west-2' AWS Region.  If a session cannot be
-	// established, return an empty string and the error returned by the
-	// AWS SDK NewSession(...) method.
-	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-west-2")})
+	// use the SSM client supplied with the context or, using the IAM
+	// credentials asigned to the Lambda function, establish a session in
+	// the Region of the Lambda function.  If a session cannot be established,
+	// return the error returned by the AWS SDK NewSession(...) method.
+	svc, err := ssmClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	// create a new instance of the SSM client using the 'us-west-2' session
-	svc := ssm.New(sess)
-	if svc == nil {
-		return nil, fmt.Errorf("failed to create EC2 client for us-west-2 session. session.Config follows: %v", sess.Config)
-	}
-
 	listCommandsInput := ssm.ListCommandsInput{
 		CommandId: aws.String(event.Cmd),
 		// CommandId: result.Command.CommandId,
@@ -51,17 +44,23 @@ func EC2ListCmd(event EC2ListCmdEvent) (*ssm.ListCommandsOutput, error) {
 		// MaxResults: aws.Int64(100),
 	}
 
-	listCommandsResult, err := svc.ListCommands(&listCommandsInput)
+	// stop short of the Lambda deadline so that a response is returned
+	// rather than the function being killed mid-call.
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
+
+	listCommandsResult, err := svc.ListCommandsWithContext(ctx, &listCommandsInput)
 	if err != nil {
-		fmt.Printf("error calling ssm.ListCommands for commandID: %s\n", event.Cmd)
+		logger(ctx).Error("list commands failed", logKeyCommandID, event.Cmd, logKeyError, err)
 		// Cast err to awserr.Error to handle specific error codes.
 		aerr, ok := err.(awserr.Error)
-		log.Printf("error code %s received for ssm.ListCommands call\n", aerr.Code())
 		if ok && aerr.Code() == "400" {
 			// Specific error code handling
 		}
-		return nil, err
+		return nil, deadlineErr(ctx, fmt.Sprintf("list command %s", event.Cmd), err)
+	}
+	for _, c := range listCommandsResult.Commands {
+		logger(ctx).Info("command status", logKeyCommandID, aws.StringValue(c.CommandId), logKeyInstances, aws.StringValueSlice(c.InstanceIds), "status", aws.StringValue(c.Status))
 	}
-	log.Println(listCommandsResult)
 	return listCommandsResult, nil
 }
@@ -1,49 +1,46 @@
 package cwl
 
 import (
+	"context"
 	"fmt"
-	"log"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ssm"
 )
 
-// EC2IssueCmdEvent triggers function cwl.EC2IssueCmd.
+// EC2IssueCmdEvent triggers function cwl.EC2IssueCmd.  A duplicate of an
+// event with an IdempotencyKey returns the command first sent, so that a
+// retried script is not run twice.
 type EC2IssueCmdEvent struct {
-	Instances []string `json:"instances"`
-	Cmd       string   `json:"cmd"`
+	Instances      []string `json:"instances" validate:"required,max=50,format=instance-id"`
+	Cmd            string   `json:"cmd" validate:"required,max=4096"`
+	IdempotencyKey string   `json:"idempotencyKey,omitempty" validate:"max=512"`
 }
 
 // EC2IssueCmd runs the specified command on the specified EC2 instances.
-func EC2IssueCmd(event EC2IssueCmdEvent) (*ssm.Command, error) {
+func EC2IssueCmd(ctx context.Context, event EC2IssueCmdEvent) (*ssm.Command, error) {
 
 	// log the received event, this will write the raw event to the
 	// CloudWatch log stream
-	log.Println("loading function...")
-	log.Println("received event:", event.Instances)
+	logInvocation(ctx)
+	logger(ctx).Info("received event", logKeyInstances, event.Instances)
+	traceAnnotate(ctx, "instance_ids", event.Instances)
 
 	// if no EC2 instance names were provided by the event, return an error.
 	if event.Instances == nil {
 		return nil, fmt.Errorf("no instance names were specified in triggering event %v", event)
 	}
 
-	// using the IAM credentials asigned to the Lambda function, establish
-	// a session in the 'us-west-2' AWS Region.  If a session cannot be
-	// established, return an empty string and the error returned by the
-	// AWS SDK NewSession(...) method.
-	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-west-2")})
+	// use the SSM client supplied with the context or, using the IAM
+	// credentials asigned to the Lambda function, establish a session in
+	// the Region of the Lambda function.  If a session cannot be established,
+	// return the error returned by the AWS SDK NewSession(...) method.
+	svc, err := ssmClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	// create a new instance of the SSM client using the 'us-west-2' session
-	svc := ssm.New(sess)
-	if svc == nil {
-		return nil, fmt.Errorf("failed to create EC2 client for us-west-2 session. session.Config follows: %v", sess.Config)
-	}
-
 	// convert instanceIds to []*string
 	var instIds []*string
 	for _, inst := range event.Instances {
@@ -93,16 +90,35 @@ func EC2IssueCmd(event EC2IssueCmdEvent) (*ssm.Command, error) {
 		TimeoutSeconds: aws.Int64(30), // minimum value = 30
 	}
 
-	result, err := svc.SendCommand(&commandInput)
+	// stop short of the Lambda deadline so that a response is returned
+	// rather than the function being killed mid-call.
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
+
+	// refuse actions forbidden by the protection policy
+	if err := checkPolicy(ctx, policyRequest{Instances: event.Instances, Cmd: event.Cmd}); err != nil {
+		audit(ctx, "ssm:SendCommand", event.Instances, map[string]interface{}{"document": aws.StringValue(commandInput.DocumentName), "cmd": event.Cmd}, nil, err)
+		return nil, err
+	}
+
+	result, err := svc.SendCommandWithContext(ctx, &commandInput)
+	var output map[string]interface{}
+	if err == nil && result.Command != nil {
+		output = map[string]interface{}{"commandId": aws.StringValue(result.Command.CommandId)}
+	}
+	audit(ctx, "ssm:SendCommand", event.Instances, map[string]interface{}{"document": aws.StringValue(commandInput.DocumentName), "cmd": event.Cmd}, output, err)
 	if err != nil {
-		fmt.Println("error detected...")
+		logger(ctx).Error("send command failed", logKeyInstances, event.Instances, logKeyError, err)
 		// Cast err to awserr.Error to handle specific error codes.
 		aerr, ok := err.(awserr.Error)
 		if ok && aerr.Code() == "400" {
 			// Specific error code handling
 		}
+		return nil, deadlineErr(ctx, fmt.Sprintf("send command to instances %v", event.Instances), err)
 	}
-	log.Println("SendCommandInput result:")
-	log.Println(result)
+	logger(ctx).Info("command sent", logKeyCommandID, aws.StringValue(result.Command.CommandId), logKeyInstances, event.Instances)
+	metrics(ctx).count(metricCommandsSent, 1)
+	traceAnnotate(ctx, "command_id", aws.StringValue(result.Command.CommandId))
+	logger(ctx).Debug("send command result", "result", result.String())
 	return result.Command, nil
 }
@@ -0,0 +1,89 @@
+package cwl
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// EC2InstancesHibernateEvent triggers function cwl.EC2InstancesHibernate.
+// As with EC2InstancesStop, a retry carrying the IdempotencyKey of an
+// earlier event gets that event's response back.
+type EC2InstancesHibernateEvent struct {
+	Instances      []string `json:"instances" validate:"required,max=1000,format=instance-id"`
+	IdempotencyKey string   `json:"idempotencyKey,omitempty" validate:"max=512"`
+}
+
+// EC2InstancesHibernate stops the named EC2 instances with hibernate, so
+// that the contents of their memory are saved and restored when they are
+// next started.  Unlike EC2InstancesStop it checks the instances first:
+// each must be running, and launched with hibernation configured.  If any
+// instance fails the checks none is stopped, and an *InstanceCheckError
+// lists every instance refused, where EC2 would name only the first.
+func EC2InstancesHibernate(ctx context.Context, event EC2InstancesHibernateEvent) (*ec2.StopInstancesOutput, error) {
+
+	// log the received event, this will write the raw event to the
+	// CloudWatch log stream
+	logInvocation(ctx)
+	logger(ctx).Info("received event", logKeyInstances, event.Instances)
+	traceAnnotate(ctx, "instance_ids", event.Instances)
+
+	// if no EC2 instance names were provided by the event, return an error.
+	if event.Instances == nil {
+		return nil, fmt.Errorf("no instance names were specified in triggering event %v", event)
+	}
+
+	svc, err := ec2Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// stop short of the Lambda deadline so that a response is returned
+	// rather than the function being killed mid-call.
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
+
+	params := map[string]interface{}{"hibernate": true}
+
+	// refuse actions forbidden by the protection policy
+	if err := checkPolicy(ctx, policyRequest{Instances: event.Instances}); err != nil {
+		audit(ctx, "ec2:StopInstances", event.Instances, params, nil, err)
+		return nil, err
+	}
+
+	// refuse instances that cannot hibernate
+	err = checkInstances(ctx, svc, event.Instances, func(in *ec2.Instance) (string, error) {
+		if state := instanceState(in); state != ec2.InstanceStateNameRunning {
+			return fmt.Sprintf("instance is %s; only running instances can hibernate", state), nil
+		}
+		if in.HibernationOptions == nil || !aws.BoolValue(in.HibernationOptions.Configured) {
+			return "hibernation is not configured for the instance", nil
+		}
+		return "", nil
+	})
+	if err != nil {
+		audit(ctx, "ec2:StopInstances", event.Instances, params, nil, err)
+		return nil, err
+	}
+
+	input := &ec2.StopInstancesInput{
+		DryRun:      aws.Bool(false),
+		Hibernate:   aws.Bool(true),
+		InstanceIds: aws.StringSlice(event.Instances),
+	}
+	result, err := svc.StopInstancesWithContext(ctx, input)
+	audit(ctx, "ec2:StopInstances", event.Instances, params, auditStates(result), err)
+	if err != nil {
+		logger(ctx).Error("hibernate instances failed", logKeyInstances, event.Instances, logKeyError, err)
+		return nil, deadlineErr(ctx, fmt.Sprintf("hibernate instances %v", event.Instances), err)
+	}
+
+	if result == nil || result.StoppingInstances == nil {
+		return nil, fmt.Errorf("instance hibernate for instances %v returned no information - status unknown", event.Instances)
+	}
+	logStateChanges(ctx, result.StoppingInstances)
+	metrics(ctx).count(metricInstancesHibernated, len(result.StoppingInstances))
+	return result, nil
+}
@@ -2,49 +2,46 @@ package cwl
 
 // smacleod - 2018-06-01
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"log"
 )
 
-// EC2InstancesRebootEvent triggers function cwl.EC2InstancesReboot.
+// EC2InstancesRebootEvent triggers function cwl.EC2InstancesReboot.  Events
+// retried by Step Functions or SQS should carry an IdempotencyKey, so that
+// a host is not rebooted twice.
 type EC2InstancesRebootEvent struct {
-	Instances []string `json:"instances"`
+	Instances      []string `json:"instances" validate:"required,max=1000,format=instance-id"`
+	IdempotencyKey string   `json:"idempotencyKey,omitempty" validate:"max=512"`
 }
 
 // EC2InstancesReboot is a test function, the purpose of which is to reboot the
 // named EC2 Instances.  The function does not attempt to determine the status
 // of the named instances prior to executing the reboot attempts.  Determination
 // of instance status should be performed prior to calling this function.
-func EC2InstancesReboot(event EC2InstancesRebootEvent) (string, error) {
+func EC2InstancesReboot(ctx context.Context, event EC2InstancesRebootEvent) (string, error) {
 
 	// log the received event, this will write the raw event to the
 	// CloudWatch log stream
-	log.Println("loading function...")
-	log.Println("received event:", event.Instances)
+	logInvocation(ctx)
+	logger(ctx).Info("received event", logKeyInstances, event.Instances)
+	traceAnnotate(ctx, "instance_ids", event.Instances)
 
 	// if no EC2 instance names were provided by the event, return an error.
 	if event.Instances == nil {
 		return "", fmt.Errorf("no instance names were specified in triggering event %v", event)
 	}
 
-	// using the IAM credentials asigned to the Lambda function, establish
-	// a session in the 'us-west-2' AWS Region.  If a session cannot be
-	// established, return an empty string and the error returned by the
-	// AWS SDK NewSession(...) method.
-	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-west-2")})
+	// use the EC2 client supplied with the context or, using the IAM
+	// credentials asigned to the Lambda function, establish a session in
+	// the Region of the Lambda function.  If a session cannot be established,
+	// return the error returned by the AWS SDK NewSession(...) method.
+	svc, err := ec2Client(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	// create a new instance of the EC2 client using the 'us-west-2' session
-	svc := ec2.New(sess)
-	if svc == nil {
-		return "", fmt.Errorf("failed to create EC2 client for us-west-2 session. session.Config follows: %v", sess.Config)
-	}
-
 	// declare a variable to hold the result of the AWS SDK call to
 	// ec2.StopInstances(...)
 	var result *ec2.RebootInstancesOutput
@@ -64,15 +61,29 @@ func EC2InstancesReboot(event EC2InstancesRebootEvent) (string, error) {
 		InstanceIds: instIds,
 	}
 
-	result, err = svc.RebootInstances(input)
+	// stop short of the Lambda deadline so that a response is returned
+	// rather than the function being killed mid-call.
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
+
+	// refuse actions forbidden by the protection policy
+	if err := checkPolicy(ctx, policyRequest{Instances: event.Instances}); err != nil {
+		audit(ctx, "ec2:RebootInstances", event.Instances, nil, nil, err)
+		return "", err
+	}
+
+	result, err = svc.RebootInstancesWithContext(ctx, input)
+	audit(ctx, "ec2:RebootInstances", event.Instances, nil, nil, err)
 	if err != nil {
-		return result.String(), fmt.Errorf("%s", err)
+		logger(ctx).Error("reboot instances failed", logKeyInstances, event.Instances, logKeyError, err)
+		return "", deadlineErr(ctx, fmt.Sprintf("reboot instances %v", event.Instances), err)
 	}
 
 	// no error, also no result(possible?)
 	if result == nil || result.String() == "" {
 		return "", fmt.Errorf("instance reboot for instances %v returned no information - status unknown", instIds)
 	}
-	log.Println(result.String())
+	logger(ctx).Info("instances rebooting", logKeyInstances, event.Instances)
+	metrics(ctx).count(metricInstancesRebooted, len(event.Instances))
 	return result.String(), nil
 }
@@ -0,0 +1,198 @@
+package cwl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// actions of the scheduler
+const (
+	ScheduleStart = "start"
+	ScheduleStop  = "stop"
+)
+
+// EC2InstancesScheduleEvent triggers function cwl.EC2InstancesSchedule.
+// Time is the time at which the schedules are applied; by default the
+// time of invocation.  An EventBridge scheduled event passes the time of
+// the schedule in its "time" field.  If DryRun is set the instances that
+// would be started or stopped are reported, and left alone.
+type EC2InstancesScheduleEvent struct {
+	Time   time.Time `json:"time"`
+	DryRun bool      `json:"dryRun"`
+}
+
+// ScheduledInstance reports the schedule of an instance.  Action is the
+// start or stop taken, or due in a dry run, if any, and Error the reason
+// it failed, or the schedule could not be applied.
+type ScheduledInstance struct {
+	ID       string `json:"id"`
+	Schedule string `json:"schedule"`
+	State    string `json:"state"`
+	Desired  string `json:"desired,omitempty"`
+	Action   string `json:"action,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// EC2InstancesScheduleResponse reports the schedules applied by
+// cwl.EC2InstancesSchedule.  Started and Stopped list the instances acted
+// on, and are empty in a dry run.
+type EC2InstancesScheduleResponse struct {
+	Time      time.Time           `json:"time"`
+	DryRun    bool                `json:"dryRun,omitempty"`
+	Started   []string            `json:"started,omitempty"`
+	Stopped   []string            `json:"stopped,omitempty"`
+	Instances []ScheduledInstance `json:"instances"`
+}
+
+// EC2InstancesSchedule starts and stops the instances carrying a schedule
+// tag, so that they run during the office hours of their Schedule.  It is
+// meant to be triggered every few minutes by an EventBridge schedule.
+// Instances are started and stopped through EC2InstancesStart and
+// EC2InstancesStop, one instance at a time, so that each action is checked
+// against the protection policy and audited, and an instance that cannot
+// be acted on does not hold up the others.  Instances that are pending or
+// stopping are left alone until the next run.
+func EC2InstancesSchedule(ctx context.Context, event EC2InstancesScheduleEvent) (*EC2InstancesScheduleResponse, error) {
+
+	logInvocation(ctx)
+	logger(ctx).Info("received event", "time", event.Time, "dryRun", event.DryRun)
+
+	r, ok := routerFrom(ctx)
+	if !ok {
+		return nil, fmt.Errorf("EC2InstancesSchedule must be invoked through the router")
+	}
+	svc, err := ec2Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	h, err := holidays(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tag := os.Getenv(ScheduleTagEnvVar)
+	if tag == "" {
+		tag = defaultScheduleTag
+	}
+	at := event.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
+
+	// read the scheduled instances a page at a time
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag-key"), Values: aws.StringSlice([]string{tag})},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"})},
+		},
+	}
+	response := &EC2InstancesScheduleResponse{Time: at.UTC(), DryRun: event.DryRun}
+	for {
+		out, err := svc.DescribeInstancesWithContext(ctx, input)
+		if err != nil {
+			return nil, deadlineErr(ctx, "describe scheduled instances", err)
+		}
+		for _, res := range out.Reservations {
+			for _, in := range res.Instances {
+				if si, ok := scheduledInstance(in, tag, at, h); ok {
+					response.Instances = append(response.Instances, si)
+				}
+			}
+		}
+		if aws.StringValue(out.NextToken) == "" {
+			break
+		}
+		input.NextToken = out.NextToken
+	}
+
+	inv, _ := invocationFrom(ctx)
+	caller := inv.caller
+	if caller == "" {
+		caller = "EC2InstancesSchedule"
+	}
+	for i := range response.Instances {
+		si := &response.Instances[i]
+		if si.Error != "" {
+			logger(ctx).Warn("schedule not applied", logKeyInstances, []string{si.ID}, "schedule", si.Schedule, logKeyError, si.Error)
+			metrics(ctx).count(metricScheduleErrors, 1)
+			continue
+		}
+		if si.Action == "" || event.DryRun {
+			continue
+		}
+		if deadlineApproaching(ctx) {
+			si.Error = "deadline approaching; left for the next run"
+			metrics(ctx).count(metricScheduleErrors, 1)
+			continue
+		}
+		handler := "EC2InstancesStart"
+		if si.Action == ScheduleStop {
+			handler = "EC2InstancesStop"
+		}
+		payload, _ := json.Marshal(map[string]interface{}{
+			"instances":     []string{si.ID},
+			"caller":        caller,
+			"executionArn":  inv.executionArn,
+			"correlationId": inv.correlationID,
+		})
+		if _, err := r.InvokeHandler(ctx, handler, payload); err != nil {
+			si.Error = err.Error()
+			logger(ctx).Error("scheduled "+si.Action+" failed", logKeyInstances, []string{si.ID}, logKeyError, err)
+			metrics(ctx).count(metricScheduleErrors, 1)
+			continue
+		}
+		if si.Action == ScheduleStart {
+			response.Started = append(response.Started, si.ID)
+		} else {
+			response.Stopped = append(response.Stopped, si.ID)
+		}
+	}
+	logger(ctx).Info("schedules applied", "scheduled", len(response.Instances), "started", response.Started, "stopped", response.Stopped, "dryRun", event.DryRun)
+	return response, nil
+}
+
+// scheduledInstance returns the schedule of in, read from tag, and the
+// action needed to bring it to its desired state at t.  It returns false
+// if in carries no schedule.
+func scheduledInstance(in *ec2.Instance, tag string, t time.Time, h Holidays) (ScheduledInstance, bool) {
+	si := ScheduledInstance{ID: aws.StringValue(in.InstanceId)}
+	found := false
+	for _, tg := range in.Tags {
+		if aws.StringValue(tg.Key) == tag {
+			si.Schedule, found = aws.StringValue(tg.Value), true
+		}
+	}
+	if !found {
+		return si, false
+	}
+	if in.State != nil {
+		si.State = aws.StringValue(in.State.Name)
+	}
+	s, err := ParseSchedule(si.Schedule)
+	if err == nil {
+		err = s.checkCalendar(h)
+	}
+	if err != nil {
+		si.Error = err.Error()
+		return si, true
+	}
+	si.Desired = "stopped"
+	if s.Running(t, h) {
+		si.Desired = "running"
+	}
+	switch {
+	case si.Desired == "running" && si.State == "stopped":
+		si.Action = ScheduleStart
+	case si.Desired == "stopped" && si.State == "running":
+		si.Action = ScheduleStop
+	}
+	return si, true
+}
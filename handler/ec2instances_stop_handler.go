@@ -2,50 +2,46 @@ package cwl
 
 // smacleod - 2018-06-01
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"log"
 )
 
-// EC2InstancesStopEvent triggers function cwl.EC2InstancesStop.
+// EC2InstancesStopEvent triggers function cwl.EC2InstancesStop.  Events
+// with the IdempotencyKey of an earlier event get its response back.
 type EC2InstancesStopEvent struct {
-	Instances []string `json:"instances"`
-	Force     bool     `json:"force"`
+	Instances      []string `json:"instances" validate:"required,max=1000,format=instance-id"`
+	Force          bool     `json:"force"`
+	IdempotencyKey string   `json:"idempotencyKey,omitempty" validate:"max=512"`
 }
 
 // EC2InstancesStop is a test function, the purpose of which is to stop the
 // named EC2 Instances.  The function does not attempt to determine the status
 // of the named instances prior to executing the stop attempts.  Determination
 // of instance status should be performed prior to calling this function.
-func EC2InstancesStop(event EC2InstancesStopEvent) (*ec2.StopInstancesOutput, error) {
+func EC2InstancesStop(ctx context.Context, event EC2InstancesStopEvent) (*ec2.StopInstancesOutput, error) {
 
 	// log the received event, this will write the raw event to the
 	// CloudWatch log stream
-	log.Println("loading function...")
-	log.Println("received event:", event.Instances)
+	logInvocation(ctx)
+	logger(ctx).Info("received event", logKeyInstances, event.Instances)
+	traceAnnotate(ctx, "instance_ids", event.Instances)
 
 	// if no EC2 instance names were provided by the event, return an error.
 	if event.Instances == nil {
 		return nil, fmt.Errorf("no instance names were specified in triggering event %v", event)
 	}
 
-	// using the IAM credentials asigned to the Lambda function, establish
-	// a session in the 'us-west-2' AWS Region.  If a session cannot be
-	// established, return an empty string and the error returned by the
-	// AWS SDK NewSession(...) method.
-	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-west-2")})
+	// use the EC2 client supplied with the context or, using the IAM
+	// credentials asigned to the Lambda function, establish a session in
+	// the Region of the Lambda function.  If a session cannot be established,
+	// return the error returned by the AWS SDK NewSession(...) method.
+	svc, err := ec2Client(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	// create a new instance of the EC2 client using the 'us-west-2' session
-	svc := ec2.New(sess)
-	if svc == nil {
-		return nil, fmt.Errorf("failed to create EC2 client for us-west-2 session. session.Config follows: %v", sess.Config)
-	}
-
 	// declare a variable to hold the result of the AWS SDK call to
 	// ec2.StopInstances(...)
 	var result *ec2.StopInstancesOutput
@@ -66,14 +62,29 @@ func EC2InstancesStop(event EC2InstancesStopEvent) (*ec2.StopInstancesOutput, er
 		InstanceIds: instIds,
 	}
 
-	result, err = svc.StopInstances(input)
+	// stop short of the Lambda deadline so that a response is returned
+	// rather than the function being killed mid-call.
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
+
+	// refuse actions forbidden by the protection policy
+	if err := checkPolicy(ctx, policyRequest{Instances: event.Instances}); err != nil {
+		audit(ctx, "ec2:StopInstances", event.Instances, map[string]interface{}{"force": event.Force}, nil, err)
+		return nil, err
+	}
+
+	result, err = svc.StopInstancesWithContext(ctx, input)
+	audit(ctx, "ec2:StopInstances", event.Instances, map[string]interface{}{"force": event.Force}, auditStates(result), err)
 	if err != nil {
-		return nil, fmt.Errorf("%s", err)
+		logger(ctx).Error("stop instances failed", logKeyInstances, event.Instances, logKeyError, err)
+		return nil, deadlineErr(ctx, fmt.Sprintf("stop instances %v", event.Instances), err)
 	}
 
 	// no error, also no result(possible?)
 	if result == nil || result.StoppingInstances == nil {
 		return nil, fmt.Errorf("instance stop for instances %v returned no information - status unknown", instIds)
 	}
+	logStateChanges(ctx, result.StoppingInstances)
+	metrics(ctx).count(metricInstancesStopped, len(result.StoppingInstances))
 	return result, nil
 }
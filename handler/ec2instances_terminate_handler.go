@@ -0,0 +1,128 @@
+package cwl
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// EC2InstancesTerminateEvent triggers function cwl.EC2InstancesTerminate.
+// Confirm must list the same instances as Instances, in any order, so that
+// an instance is terminated only when named twice.  Retries should carry an
+// IdempotencyKey, so that the response to the first attempt is returned.
+type EC2InstancesTerminateEvent struct {
+	Instances      []string `json:"instances" validate:"required,max=1000,format=instance-id"`
+	Confirm        []string `json:"confirm" validate:"required,max=1000,format=instance-id"`
+	IdempotencyKey string   `json:"idempotencyKey,omitempty" validate:"max=512"`
+}
+
+// EC2InstancesTerminate terminates the named EC2 instances.  Termination
+// cannot be undone, so the instances are checked first: none may already
+// be shutting down or terminated, or be protected by its
+// DisableApiTermination attribute.  If any instance fails the checks none
+// is terminated, and an *InstanceCheckError lists every instance refused.
+func EC2InstancesTerminate(ctx context.Context, event EC2InstancesTerminateEvent) (*ec2.TerminateInstancesOutput, error) {
+
+	// log the received event, this will write the raw event to the
+	// CloudWatch log stream
+	logInvocation(ctx)
+	logger(ctx).Info("received event", logKeyInstances, event.Instances)
+	traceAnnotate(ctx, "instance_ids", event.Instances)
+
+	// if no EC2 instance names were provided by the event, return an error.
+	if event.Instances == nil {
+		return nil, fmt.Errorf("no instance names were specified in triggering event %v", event)
+	}
+	if !sameInstances(event.Instances, event.Confirm) {
+		return nil, &ValidationError{Event: "EC2InstancesTerminateEvent", Violations: []Violation{
+			{Field: "confirm", Message: "must list the same instances as instances"},
+		}}
+	}
+
+	svc, err := ec2Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// stop short of the Lambda deadline so that a response is returned
+	// rather than the function being killed mid-call.
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
+
+	// refuse actions forbidden by the protection policy
+	if err := checkPolicy(ctx, policyRequest{Instances: event.Instances}); err != nil {
+		audit(ctx, "ec2:TerminateInstances", event.Instances, nil, nil, err)
+		return nil, err
+	}
+
+	// refuse instances already gone or protected from termination
+	err = checkInstances(ctx, svc, event.Instances, func(in *ec2.Instance) (string, error) {
+		switch state := instanceState(in); state {
+		case ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated:
+			return fmt.Sprintf("instance is already %s", state), nil
+		}
+		attr, err := svc.DescribeInstanceAttributeWithContext(ctx, &ec2.DescribeInstanceAttributeInput{
+			InstanceId: in.InstanceId,
+			Attribute:  aws.String(ec2.InstanceAttributeNameDisableApiTermination),
+		})
+		if err != nil {
+			return "", deadlineErr(ctx, fmt.Sprintf("describe termination protection of %s", aws.StringValue(in.InstanceId)), err)
+		}
+		if attr.DisableApiTermination != nil && aws.BoolValue(attr.DisableApiTermination.Value) {
+			return "termination protection (DisableApiTermination) is enabled", nil
+		}
+		return "", nil
+	})
+	if err != nil {
+		audit(ctx, "ec2:TerminateInstances", event.Instances, nil, nil, err)
+		return nil, err
+	}
+
+	input := &ec2.TerminateInstancesInput{
+		DryRun:      aws.Bool(false),
+		InstanceIds: aws.StringSlice(event.Instances),
+	}
+	result, err := svc.TerminateInstancesWithContext(ctx, input)
+	audit(ctx, "ec2:TerminateInstances", event.Instances, nil, auditStates(result), err)
+	if err != nil {
+		logger(ctx).Error("terminate instances failed", logKeyInstances, event.Instances, logKeyError, err)
+		return nil, deadlineErr(ctx, fmt.Sprintf("terminate instances %v", event.Instances), err)
+	}
+
+	if result == nil || result.TerminatingInstances == nil {
+		return nil, fmt.Errorf("instance terminate for instances %v returned no information - status unknown", event.Instances)
+	}
+	logStateChanges(ctx, result.TerminatingInstances)
+	metrics(ctx).count(metricInstancesTerminated, len(result.TerminatingInstances))
+	return result, nil
+}
+
+// sameInstances reports whether a and b list the same instances, ignoring
+// order and repeats.
+func sameInstances(a, b []string) bool {
+	set := func(ids []string) []string {
+		m := make(map[string]bool)
+		for _, id := range ids {
+			m[id] = true
+		}
+		var s []string
+		for id := range m {
+			s = append(s, id)
+		}
+		sort.Strings(s)
+		return s
+	}
+	sa, sb := set(a), set(b)
+	if len(sa) != len(sb) {
+		return false
+	}
+	for i := range sa {
+		if sa[i] != sb[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package cwl
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// envelope holds the fields used to recognise the events delivered by the
+// SQS, SNS and API Gateway (HTTP API) triggers of a function.  Field names
+// are matched without regard to case, so eventSource matches the
+// EventSource of SNS records as well as the eventSource of SQS records.
+type envelope struct {
+	Records []struct {
+		EventSource string `json:"eventSource"`
+	} `json:"Records"`
+	Version        string `json:"version"`
+	RequestContext struct {
+		HTTP *struct{} `json:"http"`
+	} `json:"requestContext"`
+}
+
+// event sources of the records delivered by SQS and SNS
+const (
+	eventSourceSQS = "aws:sqs"
+	eventSourceSNS = "aws:sns"
+)
+
+// messageKeyKey is the context key for the idempotency key of a message,
+// used by the handler it is passed to when the message carries none.
+type messageKeyKey struct{}
+
+// invokeFunc invokes a handler with a single event.
+type invokeFunc func(ctx context.Context, payload []byte) ([]byte, error)
+
+// unwrap passes the events carried by an SQS, SNS or API Gateway trigger
+// event in payload to invoke, one at a time, and returns the response the
+// trigger expects.  Any other payload is passed to invoke unchanged.
+func unwrap(ctx context.Context, payload []byte, invoke invokeFunc) ([]byte, error) {
+	var env envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return invoke(ctx, payload)
+	}
+	switch {
+	case len(env.Records) > 0 && env.Records[0].EventSource == eventSourceSQS:
+		return unwrapSQS(ctx, payload, invoke)
+	case len(env.Records) > 0 && env.Records[0].EventSource == eventSourceSNS:
+		return unwrapSNS(ctx, payload, invoke)
+	case env.Version == "2.0" && env.RequestContext.HTTP != nil:
+		return unwrapHTTP(ctx, payload, invoke)
+	}
+	return invoke(ctx, payload)
+}
+
+// unwrapSQS invokes the handler with the body of each message, and reports
+// the messages that failed, so that SQS redelivers only those.  A message
+// without an idempotencyKey is keyed by its message ID, so that a message
+// delivered twice is acted on once.
+func unwrapSQS(ctx context.Context, payload []byte, invoke invokeFunc) ([]byte, error) {
+	var ev events.SQSEvent
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return nil, fmt.Errorf("unable to decode SQS event: %v", err)
+	}
+	resp := events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
+	for _, m := range ev.Records {
+		mctx := context.WithValue(ctx, messageKeyKey{}, "sqs-"+m.MessageId)
+		if _, err := invoke(mctx, []byte(m.Body)); err != nil {
+			logger(ctx).Error("message failed", "messageId", m.MessageId, logKeyError, err)
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: m.MessageId})
+		}
+	}
+	return json.Marshal(resp)
+}
+
+// unwrapSNS invokes the handler with each notification message.  SNS
+// retries the whole event if any message fails.
+func unwrapSNS(ctx context.Context, payload []byte, invoke invokeFunc) ([]byte, error) {
+	var ev events.SNSEvent
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return nil, fmt.Errorf("unable to decode SNS event: %v", err)
+	}
+	var responses []json.RawMessage
+	for _, r := range ev.Records {
+		out, err := invoke(ctx, []byte(r.SNS.Message))
+		if err != nil {
+			return nil, fmt.Errorf("SNS message %s: %w", r.SNS.MessageID, err)
+		}
+		responses = append(responses, out)
+	}
+	return json.Marshal(responses)
+}
+
+// unwrapHTTP invokes the handler with the body of an API Gateway HTTP API
+// request, or {} if it has none, and returns the response or error as an
+// HTTP response.  Invalid events are answered with 400 Bad Request.
+func unwrapHTTP(ctx context.Context, payload []byte, invoke invokeFunc) ([]byte, error) {
+	var req events.APIGatewayV2HTTPRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("unable to decode API Gateway request: %v", err)
+	}
+	body := []byte(req.Body)
+	if req.IsBase64Encoded {
+		b, err := base64.StdEncoding.DecodeString(req.Body)
+		if err != nil {
+			return httpError(http.StatusBadRequest, fmt.Errorf("unable to decode request body: %v", err))
+		}
+		body = b
+	}
+	if len(body) == 0 {
+		body = []byte("{}")
+	}
+
+	out, err := invoke(ctx, body)
+	if err != nil {
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			return httpError(http.StatusBadRequest, err)
+		}
+		return httpError(http.StatusInternalServerError, err)
+	}
+	return json.Marshal(events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(out),
+	})
+}
+
+// httpError returns an HTTP response with status whose body reports err as
+// Lambda would: {"errorMessage": ..., "errorType": ...}.
+func httpError(status int, err error) ([]byte, error) {
+	body, merr := json.Marshal(map[string]string{"errorMessage": err.Error(), "errorType": errorTypeName(err)})
+	if merr != nil {
+		return nil, merr
+	}
+	return json.Marshal(events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	})
+}
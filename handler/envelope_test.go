@@ -0,0 +1,58 @@
+package cwl_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/1414C/cwl/awsfake"
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// TestRouterEnvelopes checks that the router passes the messages of SNS
+// events and the body of API Gateway requests to the handler.
+func TestRouterEnvelopes(t *testing.T) {
+	st := awsfake.NewState()
+	st.AddInstance(awsfake.Instance{ID: "i-0000000000000002a", State: awsfake.InstanceStopped})
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{EC2: awsfake.NewEC2(st)})
+	h := cwl.NewRouter().Handler("EC2InstancesStart")
+
+	sns, _ := json.Marshal(events.SNSEvent{Records: []events.SNSEventRecord{
+		{EventSource: "aws:sns", SNS: events.SNSEntity{MessageID: "n-1", Message: `{"instances": ["i-0000000000000002a"]}`}},
+	}})
+	if _, err := h.Invoke(ctx, sns); err != nil {
+		t.Fatal(err)
+	}
+	if in, _ := st.Instance("i-0000000000000002a"); in.State == awsfake.InstanceStopped {
+		t.Error("SNS message did not start the instance")
+	}
+
+	for _, tc := range []struct {
+		body   string
+		status int
+		want   string
+	}{
+		{`{"instances": ["i-0000000000000002a"]}`, 200, `"StartingInstances"`},
+		{`{"instances": ["web-1"]}`, 400, `"errorType":"ValidationError"`},
+	} {
+		req, _ := json.Marshal(events.APIGatewayV2HTTPRequest{
+			Version:        "2.0",
+			RouteKey:       "POST /start",
+			RequestContext: events.APIGatewayV2HTTPRequestContext{HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{Method: "POST"}},
+			Body:           tc.body,
+		})
+		out, err := h.Invoke(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp events.APIGatewayV2HTTPResponse
+		if err := json.Unmarshal(out, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.status || !strings.Contains(resp.Body, tc.want) {
+			t.Errorf("%s: got %d %s, want %d with %s", tc.body, resp.StatusCode, resp.Body, tc.status, tc.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package cwl
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// DefaultClientRegions returns the Region of the client the handlers create
+// for each AWS service when none is supplied with the context, keyed by the
+// name of the service.
+func DefaultClientRegions() (map[string]string, error) {
+	ctx := context.Background()
+	var clients []interface{}
+	for _, newClient := range []func() (interface{}, error){
+		func() (interface{}, error) { return ec2Client(ctx) },
+		func() (interface{}, error) { return ssmClient(ctx) },
+		func() (interface{}, error) { return batchClient(ctx), nil },
+		func() (interface{}, error) { return sfnClient(ctx) },
+		func() (interface{}, error) { return dynamoDBClient(ctx) },
+		func() (interface{}, error) { return s3Client(ctx) },
+		func() (interface{}, error) { return snsClient(ctx) },
+	} {
+		c, err := newClient()
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+
+	regions := map[string]string{}
+	for _, c := range clients {
+		var cl *client.Client
+		switch c := c.(type) {
+		case *ec2.EC2:
+			cl = c.Client
+		case *ssm.SSM:
+			cl = c.Client
+		case *batch.Batch:
+			cl = c.Client
+		case *sfn.SFN:
+			cl = c.Client
+		case *dynamodb.DynamoDB:
+			cl = c.Client
+		case *s3.S3:
+			cl = c.Client
+		case *sns.SNS:
+			cl = c.Client
+		}
+		regions[cl.ServiceName] = aws.StringValue(cl.Config.Region)
+	}
+	return regions, nil
+}
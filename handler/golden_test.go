@@ -0,0 +1,247 @@
+package cwl_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/1414C/cwl/awsfake"
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// update rewrites the golden files with the current results:
+//
+//	go test ./handler -run Golden -update
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// goldenDir holds a directory per handler, containing a directory per test
+// case with the files:
+//
+//	event.json      the event passed to the handler
+//	state.json      optional awsfake.Snapshot seeding the fake AWS backend
+//	callbacks.json  optional pending callbacks, as a list of cwl.Callback
+//	audit.json      optional audit trail, as a list of cwl.AuditRecord
+//	idempotency.json  optional earlier requests made with idempotency
+//	                keys, as a list of cwl.IdempotencyRecord
+//	response.json   golden: the response, or error, returned to Lambda
+//	after.json      golden: the fake AWS state, pending callbacks, audit
+//	                records and idempotency records written by the
+//	                invocation
+const goldenDir = "testdata/golden"
+
+// goldenNow is the time at which every case runs, so that times in the
+// fake AWS state are stable.
+var goldenNow = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// goldenAfter is the content of after.json.
+type goldenAfter struct {
+	State       *awsfake.Snapshot   `json:"state"`
+	Callbacks   []goldenCallback    `json:"callbacks,omitempty"`
+	Audit       []goldenAudit       `json:"audit,omitempty"`
+	Idempotency []goldenIdempotency `json:"idempotency,omitempty"`
+}
+
+// goldenCallback is a pending callback without its expiry time, which
+// depends on the wall clock.
+type goldenCallback struct {
+	cwl.Callback
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// goldenAudit is an audit record without its ID and time, which are
+// random and depend on the wall clock.
+type goldenAudit struct {
+	cwl.AuditRecord
+	ID   *string    `json:"id,omitempty"`
+	Time *time.Time `json:"time,omitempty"`
+}
+
+// goldenIdempotency is an idempotency record without its expiry time,
+// which depends on the wall clock.
+type goldenIdempotency struct {
+	cwl.IdempotencyRecord
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// TestGoldenCoverage requires at least one golden case for every
+// registered handler.
+func TestGoldenCoverage(t *testing.T) {
+	for _, def := range cwl.Handlers() {
+		cases, _ := filepath.Glob(filepath.Join(goldenDir, def.Name, "*", "event.json"))
+		if len(cases) == 0 {
+			t.Errorf("handler %s has no golden cases in %s", def.Name, filepath.Join(goldenDir, def.Name))
+		}
+	}
+}
+
+// TestGolden runs every golden case, comparing the response and resulting
+// state with the golden files.
+func TestGolden(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join(goldenDir, "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		dir := dir
+		name := filepath.Base(filepath.Dir(dir))
+		t.Run(name+"/"+filepath.Base(dir), func(t *testing.T) {
+			if _, ok := cwl.LookupHandler(name); !ok {
+				t.Fatalf("%s is not a registered handler", name)
+			}
+			response, after := runGolden(t, name, dir)
+			checkGolden(t, filepath.Join(dir, "response.json"), response)
+			checkGolden(t, filepath.Join(dir, "after.json"), after)
+		})
+	}
+}
+
+// runGolden invokes the handler with the case in dir against the fake AWS
+// backend, returning the response and the resulting state.
+func runGolden(t *testing.T, name, dir string) ([]byte, []byte) {
+	event, err := os.ReadFile(filepath.Join(dir, "event.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := awsfake.NewState()
+	st.Now = func() time.Time { return goldenNow }
+	snap := &awsfake.Snapshot{}
+	readOptional(t, filepath.Join(dir, "state.json"), snap)
+	if err := st.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	store := cwl.NewMemoryCallbackStore()
+	var cbs []cwl.Callback
+	readOptional(t, filepath.Join(dir, "callbacks.json"), &cbs)
+	for i := range cbs {
+		cbs[i].Expires = time.Now().Add(time.Hour)
+		store.Put(context.Background(), &cbs[i])
+	}
+
+	sink := cwl.NewFileAuditSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	var recs []cwl.AuditRecord
+	readOptional(t, filepath.Join(dir, "audit.json"), &recs)
+	for i := range recs {
+		sink.Record(context.Background(), &recs[i])
+	}
+
+	idem := cwl.NewMemoryIdempotencyStore()
+	var irecs []cwl.IdempotencyRecord
+	readOptional(t, filepath.Join(dir, "idempotency.json"), &irecs)
+	for i := range irecs {
+		irecs[i].Expires = time.Now().Add(time.Hour)
+		idem.Put(context.Background(), &irecs[i])
+	}
+
+	srv := awsfake.NewServer(st)
+	defer srv.Close()
+	sess := srv.Session()
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{
+		EC2:         ec2.New(sess),
+		SSM:         ssm.New(sess),
+		Batch:       batch.New(sess),
+		SFN:         awsfake.NewSFN(st),
+		Callbacks:   store,
+		Audit:       sink,
+		Idempotency: idem,
+	})
+	ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{AwsRequestID: "golden-" + filepath.Base(dir)})
+
+	response, err := cwl.NewRouter().InvokeHandler(ctx, name, event)
+	if err != nil {
+		response, _ = json.Marshal(errorResponse(err))
+	}
+
+	a := goldenAfter{State: st.Snapshot()}
+	for _, cb := range store.Callbacks() {
+		a.Callbacks = append(a.Callbacks, goldenCallback{Callback: cb})
+	}
+	written, err := sink.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range written[len(recs):] {
+		a.Audit = append(a.Audit, goldenAudit{AuditRecord: rec})
+	}
+	for _, rec := range idem.Records() {
+		a.Idempotency = append(a.Idempotency, goldenIdempotency{IdempotencyRecord: rec})
+	}
+	after, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, after
+}
+
+// readOptional decodes the JSON file at path into v, if the file exists.
+func readOptional(t *testing.T, path string, v interface{}) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(b, v)
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+}
+
+// errorResponse returns the error response Lambda reports for err.
+func errorResponse(err error) *messages.InvokeResponse_Error {
+	var ierr *messages.InvokeResponse_Error
+	if errors.As(err, &ierr) {
+		return ierr
+	}
+	typ := reflect.TypeOf(err)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return &messages.InvokeResponse_Error{Message: err.Error(), Type: typ.Name()}
+}
+
+// checkGolden compares got, indented, with the golden file at path, or
+// rewrites the file if -update is set.
+func checkGolden(t *testing.T, path string, got []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, got, "", "  "); err != nil {
+		t.Fatalf("%s: result is not JSON: %v\n%s", path, err, got)
+	}
+	buf.WriteByte('\n')
+	if *update {
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run go test -run Golden -update to create it", err)
+	}
+	if !bytes.Equal(want, buf.Bytes()) {
+		t.Errorf("%s differs from the golden file; run go test -run Golden -update and review the diff\ngot:\n%s\nwant:\n%s", path, buf.Bytes(), want)
+	}
+}
@@ -0,0 +1,456 @@
+package cwl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IAMAction is an AWS API action called by a cwl handler, together with the
+// resources the action is applied to.  TagConditionKey names the condition
+// key prefix (e.g. "ec2:ResourceTag") that can be used to restrict the
+// action to tagged resources; it is empty for actions that do not support
+// resource-level permissions.
+type IAMAction struct {
+	Action          string
+	Resources       []string
+	TagConditionKey string
+}
+
+// the AWS actions called by the cwl handlers.  ${Region} and ${Account} are
+// replaced when a policy is generated.
+var (
+	iamBatchDescribeJobs = IAMAction{
+		Action:    "batch:DescribeJobs",
+		Resources: []string{"*"},
+	}
+	iamBatchSubmitJob = IAMAction{
+		Action: "batch:SubmitJob",
+		Resources: []string{
+			"arn:aws:batch:${Region}:${Account}:job-definition/*",
+			"arn:aws:batch:${Region}:${Account}:job-queue/*",
+		},
+	}
+	iamEC2DescribeInstances = IAMAction{
+		Action:    "ec2:DescribeInstances",
+		Resources: []string{"*"},
+	}
+	iamEC2DescribeInstanceStatus = IAMAction{
+		Action:    "ec2:DescribeInstanceStatus",
+		Resources: []string{"*"},
+	}
+	iamEC2StartInstances = IAMAction{
+		Action:          "ec2:StartInstances",
+		Resources:       []string{"arn:aws:ec2:${Region}:${Account}:instance/*"},
+		TagConditionKey: "ec2:ResourceTag",
+	}
+	iamEC2StopInstances = IAMAction{
+		Action:          "ec2:StopInstances",
+		Resources:       []string{"arn:aws:ec2:${Region}:${Account}:instance/*"},
+		TagConditionKey: "ec2:ResourceTag",
+	}
+	iamEC2TerminateInstances = IAMAction{
+		Action:          "ec2:TerminateInstances",
+		Resources:       []string{"arn:aws:ec2:${Region}:${Account}:instance/*"},
+		TagConditionKey: "ec2:ResourceTag",
+	}
+	iamEC2DescribeInstanceAttribute = IAMAction{
+		Action:    "ec2:DescribeInstanceAttribute",
+		Resources: []string{"*"},
+	}
+	iamEC2RebootInstances = IAMAction{
+		Action:          "ec2:RebootInstances",
+		Resources:       []string{"arn:aws:ec2:${Region}:${Account}:instance/*"},
+		TagConditionKey: "ec2:ResourceTag",
+	}
+	iamSSMSendCommandInstances = IAMAction{
+		Action:          "ssm:SendCommand",
+		Resources:       []string{"arn:aws:ec2:${Region}:${Account}:instance/*"},
+		TagConditionKey: "ssm:resourceTag",
+	}
+	iamSSMSendCommandDocument = IAMAction{
+		Action:    "ssm:SendCommand",
+		Resources: []string{"arn:aws:ssm:${Region}::document/AWS-RunShellScript"},
+	}
+	iamSSMListCommands = IAMAction{
+		Action:    "ssm:ListCommands",
+		Resources: []string{"*"},
+	}
+)
+
+// iamCallbacks holds the actions used to store task tokens in the callback
+// table and to return them to Step Functions.
+var iamCallbacks = []IAMAction{
+	{
+		Action:    "dynamodb:PutItem",
+		Resources: []string{"arn:aws:dynamodb:${Region}:${Account}:table/" + defaultCallbackTable},
+	},
+	{
+		Action:    "dynamodb:GetItem",
+		Resources: []string{"arn:aws:dynamodb:${Region}:${Account}:table/" + defaultCallbackTable},
+	},
+	{
+		Action:    "dynamodb:DeleteItem",
+		Resources: []string{"arn:aws:dynamodb:${Region}:${Account}:table/" + defaultCallbackTable},
+	},
+	{
+		Action:    "states:SendTaskSuccess",
+		Resources: []string{"*"},
+	},
+	{
+		Action:    "states:SendTaskFailure",
+		Resources: []string{"*"},
+	},
+}
+
+// iamIdempotency holds the actions used to store the responses of requests
+// made with idempotency keys.
+var iamIdempotency = []IAMAction{
+	{
+		Action:    "dynamodb:PutItem",
+		Resources: []string{"arn:aws:dynamodb:${Region}:${Account}:table/" + defaultIdempotencyTable},
+	},
+	{
+		Action:    "dynamodb:GetItem",
+		Resources: []string{"arn:aws:dynamodb:${Region}:${Account}:table/" + defaultIdempotencyTable},
+	},
+	{
+		Action:    "dynamodb:DeleteItem",
+		Resources: []string{"arn:aws:dynamodb:${Region}:${Account}:table/" + defaultIdempotencyTable},
+	},
+}
+
+// iamLogging holds the CloudWatch Logs actions required by every handler.
+var iamLogging = []IAMAction{
+	{
+		Action:    "logs:CreateLogGroup",
+		Resources: []string{"arn:aws:logs:${Region}:${Account}:*"},
+	},
+	{
+		Action:    "logs:CreateLogStream",
+		Resources: []string{"arn:aws:logs:${Region}:${Account}:log-group:/aws/lambda/*"},
+	},
+	{
+		Action:    "logs:PutLogEvents",
+		Resources: []string{"arn:aws:logs:${Region}:${Account}:log-group:/aws/lambda/*"},
+	},
+}
+
+// iamTracing holds the X-Ray actions required by functions with active
+// tracing.  X-Ray does not support resource-level permissions.
+var iamTracing = []IAMAction{
+	{
+		Action:    "xray:PutTraceSegments",
+		Resources: []string{"*"},
+	},
+	{
+		Action:    "xray:PutTelemetryRecords",
+		Resources: []string{"*"},
+	},
+}
+
+// queueActions returns the actions Lambda needs, on the function's behalf,
+// to poll the SQS queues whose ARNs are listed in queues.
+func queueActions(queues []string) []IAMAction {
+	var arns []string
+	for _, q := range queues {
+		if !containsString(arns, q) {
+			arns = append(arns, q)
+		}
+	}
+	if len(arns) == 0 {
+		return nil
+	}
+	var actions []IAMAction
+	for _, a := range []string{"sqs:ReceiveMessage", "sqs:DeleteMessage", "sqs:GetQueueAttributes"} {
+		actions = append(actions, IAMAction{Action: a, Resources: arns})
+	}
+	return actions
+}
+
+// auditActions returns the actions used to write (or, if read is true, to
+// query) the audit trail in sink, a sink of the form accepted by
+// CWL_AUDIT_SINK.  A file sink, or none, needs no access.
+func auditActions(sink string, read bool) ([]IAMAction, error) {
+	if sink == "" {
+		return nil, nil
+	}
+	kind, location, err := ParseAuditSink(sink)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "dynamodb":
+		table := "arn:aws:dynamodb:${Region}:${Account}:table/" + location
+		if read {
+			return []IAMAction{{Action: "dynamodb:Query", Resources: []string{table}}}, nil
+		}
+		return []IAMAction{{Action: "dynamodb:PutItem", Resources: []string{table}}}, nil
+	case "s3":
+		bucket, prefix, _ := strings.Cut(location, "/")
+		objects := "arn:aws:s3:::" + bucket + "/" + prefix + "*"
+		if read {
+			return []IAMAction{
+				{Action: "s3:ListBucket", Resources: []string{"arn:aws:s3:::" + bucket}},
+				{Action: "s3:GetObject", Resources: []string{objects}},
+			}, nil
+		}
+		return []IAMAction{{Action: "s3:PutObject", Resources: []string{objects}}}, nil
+	}
+	return nil, nil
+}
+
+// protectionActions returns the actions used to check the protection policy
+// at source, a location of the form accepted by CWL_POLICY: the tags of the
+// instances are described and, for a policy held in SSM, the parameter is
+// read.
+func protectionActions(source string) ([]IAMAction, error) {
+	actions := []IAMAction{iamEC2DescribeInstances}
+	if source == "" {
+		return actions, nil
+	}
+	kind, location, err := ParsePolicySource(source)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "ssm" {
+		actions = append(actions, ssmParameterAction(location))
+	}
+	return actions, nil
+}
+
+// holidayActions returns the actions used to read the holiday calendars at
+// source, a location of the form accepted by CWL_HOLIDAYS.
+func holidayActions(source string) ([]IAMAction, error) {
+	if source == "" {
+		return nil, nil
+	}
+	kind, location, err := ParseHolidaySource(source)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "ssm" {
+		return []IAMAction{ssmParameterAction(location)}, nil
+	}
+	return nil, nil
+}
+
+// ssmParameterAction returns the action used to read the SSM parameter
+// named name.
+func ssmParameterAction(name string) IAMAction {
+	return IAMAction{
+		Action:    "ssm:GetParameter",
+		Resources: []string{"arn:aws:ssm:${Region}:${Account}:parameter/" + strings.TrimPrefix(name, "/")},
+	}
+}
+
+// approvalActions returns the actions used to request approval from the
+// approvers at notify, the notify field of an approval policy: the request
+// is stored in the callback table and, for an SNS topic, published.
+func approvalActions(notify string) ([]IAMAction, error) {
+	if notify == "" {
+		return nil, nil
+	}
+	kind, err := ParseApprovalNotify(notify)
+	if err != nil {
+		return nil, err
+	}
+	actions := []IAMAction{iamCallbacks[0]}
+	if kind == "sns" {
+		actions = append(actions, IAMAction{
+			Action:    "sns:Publish",
+			Resources: []string{strings.TrimPrefix(notify, "sns://")},
+		})
+	}
+	return actions, nil
+}
+
+// PolicyOptions controls the generation of IAM policy documents.
+type PolicyOptions struct {
+	// Region and Account scope the resource ARNs; both default to "*".
+	Region  string
+	Account string
+
+	// Tags restricts actions that support resource tags to resources
+	// carrying every one of the given tag key/value pairs.
+	Tags map[string]string
+
+	// Tracing adds the X-Ray access needed by functions with active
+	// tracing.
+	Tracing bool
+
+	// AuditSink is the audit trail of the functions, in the form accepted
+	// by CWL_AUDIT_SINK.  Functions that change AWS resources are granted
+	// access to write to it, and ListAuditRecords to query it.
+	AuditSink string
+
+	// ProtectionPolicy locates the protection policy of the functions, in
+	// the form accepted by CWL_POLICY.  Functions that change AWS
+	// resources are granted access to read it, and to read the tags of
+	// the instances it is checked against.
+	ProtectionPolicy string
+
+	// Approvals is where the protection policy sends approval requests, in
+	// the form of its approval notify field.  Functions that change AWS
+	// resources are granted access to store and send the requests.
+	Approvals string
+
+	// Holidays locates the holiday calendars of the scheduler, in the form
+	// accepted by CWL_HOLIDAYS.  EC2InstancesSchedule is granted access to
+	// read them.
+	Holidays string
+
+	// Queues holds the ARNs of the SQS queues that trigger the functions.
+	// The functions are granted the access that Lambda needs to receive
+	// and delete messages from them.
+	Queues []string
+}
+
+// PolicyDocument is an IAM policy document.
+type PolicyDocument struct {
+	Version   string             `json:"Version"`
+	Statement []*PolicyStatement `json:"Statement"`
+}
+
+// PolicyStatement is a single statement of an IAM policy document.
+type PolicyStatement struct {
+	Sid       string                       `json:"Sid,omitempty"`
+	Effect    string                       `json:"Effect"`
+	Action    []string                     `json:"Action"`
+	Resource  []string                     `json:"Resource"`
+	Condition map[string]map[string]string `json:"Condition,omitempty"`
+}
+
+// HandlerPolicy generates a least-privilege IAM policy document granting the
+// AWS actions called by the named handlers, plus the CloudWatch Logs access
+// needed by every Lambda function.  Actions operating on the same resources
+// are combined into a single statement.
+func HandlerPolicy(names []string, opts PolicyOptions) (*PolicyDocument, error) {
+	actions := append([]IAMAction{}, iamLogging...)
+	if opts.Tracing {
+		actions = append(actions, iamTracing...)
+	}
+	actions = append(actions, queueActions(opts.Queues)...)
+	for _, n := range names {
+		d, ok := LookupHandler(n)
+		if !ok {
+			return nil, fmt.Errorf("unknown handler %q", n)
+		}
+		a, err := handlerActions(d, opts)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, a...)
+
+		// handlers taking actions on behalf of others need their access
+		if d.runsActions {
+			for _, o := range handlerDefs {
+				if o.Mutates && !o.runsActions {
+					a, err := handlerActions(o, opts)
+					if err != nil {
+						return nil, err
+					}
+					actions = append(actions, a...)
+				}
+			}
+		}
+	}
+
+	region, account := opts.Region, opts.Account
+	if region == "" {
+		region = "*"
+	}
+	if account == "" {
+		account = "*"
+	}
+	replacer := strings.NewReplacer("${Region}", region, "${Account}", account)
+
+	// group the actions by resource set and tag condition
+	statements := make(map[string]*PolicyStatement)
+	var keys []string
+	for _, a := range actions {
+		var resources []string
+		for _, r := range a.Resources {
+			resources = append(resources, replacer.Replace(r))
+		}
+		sort.Strings(resources)
+
+		var condition map[string]map[string]string
+		if a.TagConditionKey != "" && len(opts.Tags) > 0 {
+			condition = map[string]map[string]string{"StringEquals": {}}
+			for k, v := range opts.Tags {
+				condition["StringEquals"][a.TagConditionKey+"/"+k] = v
+			}
+		}
+
+		key := strings.Join(resources, ",") + "|" + a.TagConditionKey
+		st, ok := statements[key]
+		if !ok {
+			st = &PolicyStatement{
+				Effect:    "Allow",
+				Resource:  resources,
+				Condition: condition,
+			}
+			statements[key] = st
+			keys = append(keys, key)
+		}
+		if !containsString(st.Action, a.Action) {
+			st.Action = append(st.Action, a.Action)
+		}
+	}
+
+	doc := &PolicyDocument{Version: "2012-10-17"}
+	for i, k := range keys {
+		st := statements[k]
+		sort.Strings(st.Action)
+		st.Sid = fmt.Sprintf("CWL%d", i+1)
+		doc.Statement = append(doc.Statement, st)
+	}
+	return doc, nil
+}
+
+// handlerActions returns the actions called by the handler d, including
+// those needed to write its audit records and check its protection policy.
+func handlerActions(d HandlerDef, opts PolicyOptions) ([]IAMAction, error) {
+	actions := append([]IAMAction{}, d.Actions...)
+	if d.Mutates || d.readsAudit {
+		a, err := auditActions(opts.AuditSink, d.readsAudit)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, a...)
+	}
+	if d.Mutates {
+		a, err := protectionActions(opts.ProtectionPolicy)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, a...)
+		a, err = approvalActions(opts.Approvals)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, a...)
+	}
+	if d.idempotent {
+		actions = append(actions, iamIdempotency...)
+	}
+	if d.schedules {
+		a, err := holidayActions(opts.Holidays)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, a...)
+	}
+	return actions, nil
+}
+
+// containsString reports whether s is present in list.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package cwl_test
+
+import (
+	"testing"
+
+	"github.com/1414C/cwl/handler"
+)
+
+func TestHandlerPolicyQueues(t *testing.T) {
+	queues := []string{
+		"arn:aws:sqs:us-west-2:123456789012:cwl-work",
+		"arn:aws:sqs:us-west-2:123456789012:cwl-retry",
+		"arn:aws:sqs:us-west-2:123456789012:cwl-work",
+	}
+	doc, err := cwl.HandlerPolicy([]string{"EC2InstancesStart"}, cwl.PolicyOptions{Queues: queues})
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted := make(map[string][]string)
+	for _, st := range doc.Statement {
+		for _, a := range st.Action {
+			granted[a] = append(granted[a], st.Resource...)
+		}
+	}
+	for _, a := range []string{"sqs:ReceiveMessage", "sqs:DeleteMessage", "sqs:GetQueueAttributes"} {
+		r := granted[a]
+		if len(r) != 2 || r[0] != queues[1] || r[1] != queues[0] {
+			t.Errorf("%s on %v, want the two queues", a, r)
+		}
+	}
+
+	doc, err = cwl.HandlerPolicy([]string{"EC2InstancesStart"}, cwl.PolicyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range doc.Statement {
+		for _, a := range st.Action {
+			if a == "sqs:ReceiveMessage" {
+				t.Error("sqs:ReceiveMessage granted without an sqs trigger")
+			}
+		}
+	}
+}
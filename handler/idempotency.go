@@ -0,0 +1,380 @@
+package cwl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// IdempotencyTableEnvVar names the environment variable holding the name of
+// the DynamoDB table in which the results of requests carrying an
+// idempotency key are stored.  The table has a string partition key "key",
+// and time-to-live enabled on "expires".
+const IdempotencyTableEnvVar = "CWL_IDEMPOTENCY_TABLE"
+
+// defaultIdempotencyTable is used when CWL_IDEMPOTENCY_TABLE is not set.
+const defaultIdempotencyTable = "cwl-idempotency"
+
+// IdempotencyWindowEnvVar names the environment variable holding the time,
+// as a Go duration, for which the result of a request is returned to
+// duplicates; by default a day.
+const IdempotencyWindowEnvVar = "CWL_IDEMPOTENCY_WINDOW"
+
+// defaultIdempotencyWindow is used when CWL_IDEMPOTENCY_WINDOW is not set.
+const defaultIdempotencyWindow = 24 * time.Hour
+
+// idempotencyLease is the time for which a request is held in progress
+// when the invocation has no deadline.  It is the longest a Lambda
+// function may run.
+const idempotencyLease = 15 * time.Minute
+
+// states of idempotency records
+const (
+	IdempotencyInProgress = "in-progress"
+	IdempotencyCompleted  = "completed"
+)
+
+// IdempotencyRecord is a request made with an idempotency key.
+// Fingerprint identifies the handler and the event of the request, without
+// its invocation fields, and Response is the response of a completed
+// request.
+type IdempotencyRecord struct {
+	Key         string          `json:"key"`
+	Handler     string          `json:"handler"`
+	Fingerprint string          `json:"fingerprint"`
+	Status      string          `json:"status"`
+	Response    json.RawMessage `json:"response,omitempty"`
+	Expires     time.Time       `json:"expires"`
+}
+
+// IdempotencyStore persists the requests made with idempotency keys.
+// Claim stores rec, unless an unexpired record is stored under rec.Key, in
+// which case the stored record is returned and rec is not stored.
+type IdempotencyStore interface {
+	Claim(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error)
+	Put(ctx context.Context, rec *IdempotencyRecord) error
+	Delete(ctx context.Context, key string) error
+}
+
+// IdempotencyKeyReusedError is returned for a request whose idempotency key
+// was used by an earlier request with another handler or event.
+type IdempotencyKeyReusedError struct {
+	Key     string `json:"key"`
+	Handler string `json:"handler"`
+}
+
+func (e *IdempotencyKeyReusedError) Error() string {
+	return fmt.Sprintf("idempotency key %q was used by an earlier %s request with different parameters", e.Key, e.Handler)
+}
+
+// IdempotencyInProgressError is returned for a duplicate of a request that
+// has not yet completed.  The duplicate may be retried once the request
+// completes, when it returns the result of the request.
+type IdempotencyInProgressError struct {
+	Key string `json:"key"`
+}
+
+func (e *IdempotencyInProgressError) Error() string {
+	return fmt.Sprintf("a request with idempotency key %q is in progress", e.Key)
+}
+
+// idempotencyStore returns the store supplied with ctx, or the DynamoDB
+// store.
+func idempotencyStore(ctx context.Context) (IdempotencyStore, error) {
+	if s := clientsFrom(ctx).Idempotency; s != nil {
+		return s, nil
+	}
+	svc, err := dynamoDBClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	table := os.Getenv(IdempotencyTableEnvVar)
+	if table == "" {
+		table = defaultIdempotencyTable
+	}
+	return &dynamoIdempotencyStore{svc: svc, table: table}, nil
+}
+
+// idempotencyWindow returns the time for which results are kept.
+func idempotencyWindow() (time.Duration, error) {
+	s := os.Getenv(IdempotencyWindowEnvVar)
+	if s == "" {
+		return defaultIdempotencyWindow, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s %q must be a positive duration, e.g. 24h", IdempotencyWindowEnvVar, s)
+	}
+	return d, nil
+}
+
+// requestFingerprint hashes the handler name and the event in payload.
+// The invocation fields and the idempotency key are left out, so that a
+// retry by another caller or execution is recognised, and the event is
+// re-encoded, so that the layout of the JSON does not matter.
+func requestFingerprint(handler string, payload []byte) (string, error) {
+	var ev map[string]interface{}
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return "", fmt.Errorf("unable to decode event: %v", err)
+	}
+	for _, k := range []string{"action", "caller", "executionArn", "correlationId", "idempotencyKey"} {
+		delete(ev, k)
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(handler+"\n"), b...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// idempotentHandler returns the stored response to a duplicate of a
+// request carrying an "idempotencyKey", or delivered in an SQS message,
+// rather than passing it to the handler registered under name.  A request that fails is forgotten, so
+// that it may be retried with the same key.
+type idempotentHandler struct {
+	name    string
+	handler lambda.Handler
+}
+
+func (h *idempotentHandler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	var ev struct {
+		IdempotencyKey string `json:"idempotencyKey"`
+	}
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return h.handler.Invoke(ctx, payload)
+	}
+	key := ev.IdempotencyKey
+	if key == "" {
+		inv, _ := invocationFrom(ctx)
+		key = inv.messageKey
+	}
+	if key == "" {
+		return h.handler.Invoke(ctx, payload)
+	}
+	window, err := idempotencyWindow()
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := requestFingerprint(h.name, payload)
+	if err != nil {
+		return nil, err
+	}
+	store, err := idempotencyStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// hold the key for the life of the invocation, so that a duplicate
+	// arriving meanwhile is refused rather than run alongside
+	lease, ok := ctx.Deadline()
+	if !ok {
+		lease = time.Now().Add(idempotencyLease)
+	}
+	rec := &IdempotencyRecord{Key: key, Handler: h.name, Fingerprint: fingerprint, Status: IdempotencyInProgress, Expires: lease}
+	prev, err := store.Claim(ctx, rec)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		switch {
+		case prev.Fingerprint != fingerprint:
+			logger(ctx).Warn("idempotency key reused", logKeyIdempotencyKey, key, "previousHandler", prev.Handler)
+			return nil, &IdempotencyKeyReusedError{Key: key, Handler: prev.Handler}
+		case prev.Status != IdempotencyCompleted:
+			return nil, &IdempotencyInProgressError{Key: key}
+		}
+		logger(ctx).Info("duplicate request, returning the original response", logKeyIdempotencyKey, key)
+		metrics(ctx).count(metricIdempotentReplays, 1)
+		return prev.Response, nil
+	}
+
+	out, err := h.handler.Invoke(ctx, payload)
+	if err != nil {
+		if derr := store.Delete(ctx, key); derr != nil {
+			logger(ctx).Error("unable to release idempotency key", logKeyIdempotencyKey, key, logKeyError, derr)
+		}
+		return nil, err
+	}
+	rec.Status = IdempotencyCompleted
+	rec.Response = out
+	rec.Expires = time.Now().Add(window)
+
+	// the action has been taken, so its response is returned even if it
+	// cannot be kept for duplicates
+	if err := store.Put(ctx, rec); err != nil {
+		logger(ctx).Error("unable to store idempotent response", logKeyIdempotencyKey, key, logKeyError, err)
+	}
+	return out, nil
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore held in memory, for
+// running the handlers in-process.
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]IdempotencyRecord
+}
+
+// NewMemoryIdempotencyStore returns an empty MemoryIdempotencyStore.
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{records: make(map[string]IdempotencyRecord)}
+}
+
+// Claim stores rec unless an unexpired record is stored under rec.Key.
+func (s *MemoryIdempotencyStore) Claim(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.records[rec.Key]; ok && time.Now().Before(prev.Expires) {
+		return &prev, nil
+	}
+	s.records[rec.Key] = *rec
+	return nil, nil
+}
+
+// Put stores rec under rec.Key.
+func (s *MemoryIdempotencyStore) Put(ctx context.Context, rec *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[rec.Key] = *rec
+	return nil
+}
+
+// Delete removes the record stored under key.
+func (s *MemoryIdempotencyStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// Records returns every stored record, sorted by key.
+func (s *MemoryIdempotencyStore) Records() []IdempotencyRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var recs []IdempotencyRecord
+	for _, rec := range s.records {
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Key < recs[j].Key })
+	return recs
+}
+
+// dynamoIdempotencyStore stores idempotency records in a DynamoDB table.
+type dynamoIdempotencyStore struct {
+	svc   dynamodbiface.DynamoDBAPI
+	table string
+}
+
+// item returns the DynamoDB item of rec.
+func (s *dynamoIdempotencyStore) item(rec *IdempotencyRecord) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		"key":         {S: aws.String(rec.Key)},
+		"handler":     {S: aws.String(rec.Handler)},
+		"fingerprint": {S: aws.String(rec.Fingerprint)},
+		"status":      {S: aws.String(rec.Status)},
+		"expires":     {N: aws.String(strconv.FormatInt(rec.Expires.Unix(), 10))},
+	}
+	if len(rec.Response) > 0 {
+		item["response"] = &dynamodb.AttributeValue{S: aws.String(string(rec.Response))}
+	}
+	return item
+}
+
+// Claim stores rec unless an unexpired record is stored under rec.Key.
+// Items that have expired, but that DynamoDB has not yet removed, are
+// replaced.
+func (s *dynamoIdempotencyStore) Claim(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+	// the stored record may be removed between a failed put and the get,
+	// so try again a few times before giving up
+	for i := 0; i < 3; i++ {
+		_, err := s.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName:                aws.String(s.table),
+			Item:                     s.item(rec),
+			ConditionExpression:      aws.String("attribute_not_exists(#key) OR #expires < :now"),
+			ExpressionAttributeNames: map[string]*string{"#key": aws.String("key"), "#expires": aws.String("expires")},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":now": {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+			},
+		})
+		if err == nil {
+			return nil, nil
+		}
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil, fmt.Errorf("unable to store idempotency key %s in table %s: %v", rec.Key, s.table, err)
+		}
+		prev, err := s.get(ctx, rec.Key)
+		if err != nil || prev != nil {
+			return prev, err
+		}
+	}
+	return nil, fmt.Errorf("unable to store idempotency key %s in table %s: the key is being claimed and released repeatedly", rec.Key, s.table)
+}
+
+// get returns the unexpired record stored under key.
+func (s *dynamoIdempotencyStore) get(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	out, err := s.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]*dynamodb.AttributeValue{"key": {S: aws.String(key)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read idempotency key %s from table %s: %v", key, s.table, err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+	rec := &IdempotencyRecord{
+		Key:         key,
+		Handler:     aws.StringValue(out.Item["handler"].S),
+		Fingerprint: aws.StringValue(out.Item["fingerprint"].S),
+		Status:      aws.StringValue(out.Item["status"].S),
+	}
+	if v, ok := out.Item["response"]; ok {
+		rec.Response = json.RawMessage(aws.StringValue(v.S))
+	}
+	if v, ok := out.Item["expires"]; ok {
+		secs, _ := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+		rec.Expires = time.Unix(secs, 0)
+	}
+	if time.Now().After(rec.Expires) {
+		return nil, nil
+	}
+	return rec, nil
+}
+
+// Put stores rec under rec.Key.
+func (s *dynamoIdempotencyStore) Put(ctx context.Context, rec *IdempotencyRecord) error {
+	_, err := s.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      s.item(rec),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to store idempotency key %s in table %s: %v", rec.Key, s.table, err)
+	}
+	return nil
+}
+
+// Delete removes the record stored under key.
+func (s *dynamoIdempotencyStore) Delete(ctx context.Context, key string) error {
+	_, err := s.svc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       map[string]*dynamodb.AttributeValue{"key": {S: aws.String(key)}},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete idempotency key %s from table %s: %v", key, s.table, err)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package cwl_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1414C/cwl/awsfake"
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeIdempotencyTable is an in-memory DynamoDB table with the key schema
+// of the idempotency table, supporting the calls made by the store.  A
+// conditional put fails if an unexpired item is stored under its key.
+type fakeIdempotencyTable struct {
+	dynamodbiface.DynamoDBAPI
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeIdempotencyTable) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, _ ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := aws.StringValue(in.Item["key"].S)
+	if prev, ok := f.items[key]; ok && in.ConditionExpression != nil {
+		expires, _ := strconv.ParseInt(aws.StringValue(prev["expires"].N), 10, 64)
+		now, _ := strconv.ParseInt(aws.StringValue(in.ExpressionAttributeValues[":now"].N), 10, 64)
+		if expires >= now {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "the conditional request failed", nil)
+		}
+	}
+	f.items[key] = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeIdempotencyTable) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, _ ...request.Option) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &dynamodb.GetItemOutput{Item: f.items[aws.StringValue(in.Key["key"].S)]}, nil
+}
+
+func (f *fakeIdempotencyTable) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, _ ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.items, aws.StringValue(in.Key["key"].S))
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func TestIdempotency(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		clients func() *cwl.Clients
+	}{
+		{"memory", func() *cwl.Clients { return &cwl.Clients{Idempotency: cwl.NewMemoryIdempotencyStore()} }},
+		{"dynamodb", func() *cwl.Clients {
+			return &cwl.Clients{DynamoDB: &fakeIdempotencyTable{items: make(map[string]map[string]*dynamodb.AttributeValue)}}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			st := awsfake.NewState()
+			st.AddInstance(awsfake.Instance{ID: "i-000000000000000e1"})
+			clients := tt.clients()
+			clients.EC2, clients.SSM, clients.Policy = awsfake.NewEC2(st), awsfake.NewSSM(st), &cwl.ProtectionPolicy{}
+			ctx := cwl.WithClients(context.Background(), clients)
+			r := cwl.NewRouter()
+			send := func(event string) (string, error) {
+				out, err := r.InvokeHandler(ctx, "EC2IssueCmd", []byte(event))
+				if err != nil {
+					return "", err
+				}
+				var cmd struct{ CommandId string }
+				json.Unmarshal(out, &cmd)
+				return cmd.CommandId, nil
+			}
+
+			first, err := send(`{"instances": ["i-000000000000000e1"], "cmd": "deploy.sh", "idempotencyKey": "deploy-1"}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a retry, differing only in layout and invocation fields,
+			// gets the command first sent
+			retry, err := send(`{"cmd":"deploy.sh","instances":["i-000000000000000e1"],"idempotencyKey":"deploy-1","caller":"sqs"}`)
+			if err != nil || retry != first {
+				t.Errorf("retry sent command %s, %v; want the original command %s", retry, err, first)
+			}
+			other, err := send(`{"instances": ["i-000000000000000e1"], "cmd": "deploy.sh"}`)
+			if err != nil || other == first {
+				t.Errorf("request without a key sent command %s, %v; want a new command", other, err)
+			}
+
+			var reused *cwl.IdempotencyKeyReusedError
+			if _, err := send(`{"instances": ["i-000000000000000e1"], "cmd": "rollback.sh", "idempotencyKey": "deploy-1"}`); !errors.As(err, &reused) {
+				t.Errorf("key reused with another command: got %v, want an IdempotencyKeyReusedError", err)
+			}
+			if _, err := r.InvokeHandler(ctx, "EC2InstancesReboot", []byte(`{"instances": ["i-000000000000000e1"], "idempotencyKey": "deploy-1"}`)); !errors.As(err, &reused) {
+				t.Errorf("key reused by another handler: got %v, want an IdempotencyKeyReusedError", err)
+			}
+
+			// a failed request may be retried with its key
+			bad := `{"instances": ["i-000000000000000ff"], "idempotencyKey": "start-1"}`
+			for i := 0; i < 2; i++ {
+				_, err := r.InvokeHandler(ctx, "EC2InstancesStart", []byte(bad))
+				if err == nil || errors.As(err, new(*cwl.IdempotencyInProgressError)) {
+					t.Errorf("attempt %d: got %v, want the EC2 error", i+1, err)
+				}
+			}
+		})
+	}
+}
+
+// TestIdempotencySingleHandler checks that the single-function binaries,
+// which serve one handler through Router.Handler, honour keys.
+func TestIdempotencySingleHandler(t *testing.T) {
+	st := awsfake.NewState()
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000e3", State: awsfake.InstanceStopped})
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{EC2: awsfake.NewEC2(st), Policy: &cwl.ProtectionPolicy{}, Idempotency: cwl.NewMemoryIdempotencyStore()})
+	h := cwl.NewRouter().Handler("EC2InstancesStart")
+	event := []byte(`{"instances": ["i-000000000000000e3"], "idempotencyKey": "start-e3"}`)
+	first, err := h.Invoke(ctx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the instance is stopped again, so a second start would be seen
+	st.SetInstanceState("i-000000000000000e3", awsfake.InstanceStopped)
+	retry, err := h.Invoke(ctx, event)
+	if err != nil || string(retry) != string(first) {
+		t.Errorf("retry returned %s, %v; want the first response %s", retry, err, first)
+	}
+	if in, _ := st.Instance("i-000000000000000e3"); in.State != awsfake.InstanceStopped {
+		t.Errorf("retry started the instance again; it is %s", in.State)
+	}
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+	st := awsfake.NewState()
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000e2"})
+	store := cwl.NewMemoryIdempotencyStore()
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{EC2: awsfake.NewEC2(st), Policy: &cwl.ProtectionPolicy{}, Idempotency: store})
+	r := cwl.NewRouter()
+	if _, err := r.InvokeHandler(ctx, "EC2InstancesReboot", []byte(`{"instances": ["i-000000000000000e2"], "idempotencyKey": "reboot-0"}`)); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := store.Records()[0].Fingerprint
+	store.Delete(ctx, "reboot-0")
+	event := []byte(`{"instances": ["i-000000000000000e2"], "idempotencyKey": "reboot-1"}`)
+
+	// another invocation holds the key
+	store.Put(ctx, &cwl.IdempotencyRecord{Key: "reboot-1", Handler: "EC2InstancesReboot", Fingerprint: fingerprint, Status: cwl.IdempotencyInProgress, Expires: time.Now().Add(time.Minute)})
+	if _, err := r.InvokeHandler(ctx, "EC2InstancesReboot", event); !errors.As(err, new(*cwl.IdempotencyInProgressError)) {
+		t.Errorf("got %v, want an IdempotencyInProgressError", err)
+	}
+
+	// whose lease runs out if it dies
+	store.Put(ctx, &cwl.IdempotencyRecord{Key: "reboot-1", Handler: "EC2InstancesReboot", Fingerprint: fingerprint, Status: cwl.IdempotencyInProgress, Expires: time.Now().Add(-time.Second)})
+	if _, err := r.InvokeHandler(ctx, "EC2InstancesReboot", event); err != nil {
+		t.Fatal(err)
+	}
+	if recs := store.Records(); len(recs) != 1 || recs[0].Status != cwl.IdempotencyCompleted {
+		t.Errorf("records %+v, want the reboot completed", recs)
+	}
+
+	t.Setenv(cwl.IdempotencyWindowEnvVar, "forever")
+	if _, err := r.InvokeHandler(ctx, "EC2InstancesReboot", event); err == nil {
+		t.Error("invalid idempotency window accepted")
+	}
+}
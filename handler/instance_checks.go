@@ -0,0 +1,90 @@
+package cwl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// InstanceCheckFailure is an instance that a handler refused to act on,
+// with its state and the reason.
+type InstanceCheckFailure struct {
+	Instance string `json:"instance"`
+	State    string `json:"state,omitempty"`
+	Message  string `json:"message"`
+}
+
+// InstanceCheckError is returned, in place of taking an action, when some
+// of the instances are not in a state, or not configured, for it.  It lists
+// every instance refused, and is reported by Lambda with errorType
+// InstanceCheckError, so that Step Functions can catch it by name.
+type InstanceCheckError struct {
+	Handler  string                 `json:"handler"`
+	Failures []InstanceCheckFailure `json:"failures"`
+}
+
+func (e *InstanceCheckError) Error() string {
+	var msgs []string
+	for _, f := range e.Failures {
+		msgs = append(msgs, f.Instance+": "+f.Message)
+	}
+	return fmt.Sprintf("%s refused: %s", e.Handler, strings.Join(msgs, "; "))
+}
+
+// checkInstances describes the named instances, and calls check with each
+// of them.  check returns the reason the instance may not be acted on, or
+// "", or an error if it cannot tell.  checkInstances returns an
+// *InstanceCheckError listing every instance refused, or the first error.
+func checkInstances(ctx context.Context, svc ec2iface.EC2API, ids []string, check func(*ec2.Instance) (string, error)) error {
+	inv, _ := invocationFrom(ctx)
+	input := &ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice(ids)}
+	found := make(map[string]*ec2.Instance)
+	for {
+		out, err := svc.DescribeInstancesWithContext(ctx, input)
+		if err != nil {
+			return deadlineErr(ctx, fmt.Sprintf("describe instances %v", ids), err)
+		}
+		for _, res := range out.Reservations {
+			for _, in := range res.Instances {
+				found[aws.StringValue(in.InstanceId)] = in
+			}
+		}
+		if aws.StringValue(out.NextToken) == "" {
+			break
+		}
+		input.NextToken = out.NextToken
+	}
+
+	e := &InstanceCheckError{Handler: inv.handler}
+	for _, id := range ids {
+		in, ok := found[id]
+		if !ok {
+			e.Failures = append(e.Failures, InstanceCheckFailure{Instance: id, Message: "instance not found"})
+			continue
+		}
+		msg, err := check(in)
+		if err != nil {
+			return err
+		}
+		if msg != "" {
+			e.Failures = append(e.Failures, InstanceCheckFailure{Instance: id, State: instanceState(in), Message: msg})
+		}
+	}
+	if len(e.Failures) > 0 {
+		logger(ctx).Warn("instance checks failed", logKeyInstances, ids, logKeyError, e)
+		return e
+	}
+	return nil
+}
+
+// instanceState returns the state name of in, or "".
+func instanceState(in *ec2.Instance) string {
+	if in.State == nil {
+		return ""
+	}
+	return aws.StringValue(in.State.Name)
+}
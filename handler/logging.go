@@ -0,0 +1,209 @@
+package cwl
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// LogLevelEnvVar names the environment variable holding the minimum level
+// of the log records written by the handlers: debug, info (the default),
+// warn or error.
+const LogLevelEnvVar = "CWL_LOG_LEVEL"
+
+// The keys of the attributes of handler log records.  They are queried in
+// CloudWatch Logs Insights, for example:
+//
+//	fields @timestamp, msg, instances
+//	| filter correlationId = "nightly-2024-03-01" and level = "ERROR"
+const (
+	logKeyRequestID      = "requestId"
+	logKeyHandler        = "handler"
+	logKeyCorrelationID  = "correlationId"
+	logKeyInstances      = "instances"
+	logKeyCommandID      = "commandId"
+	logKeyJobID          = "jobId"
+	logKeyJobName        = "jobName"
+	logKeyError          = "error"
+	logKeyIdempotencyKey = "idempotencyKey"
+)
+
+// InvocationMeta holds the invocation fields that may be supplied with any
+// event alongside the fields of the handler's event type.
+//
+// CorrelationID is a caller-supplied ID added to every log record written
+// for the invocation, so that the records of the functions called by one
+// Step Functions execution or one client request can be queried together.
+// It may also be passed as the "correlationId" custom field of the Lambda
+// client context.  By default the Lambda request ID is used.
+//
+// Caller and ExecutionArn identify who invoked the function in the audit
+// trail, since Lambda does not pass the identity of the invoker to the
+// function.  Step Functions passes the execution ARN with
+// "executionArn.$": "$$.Execution.Id".  Both may also be passed as custom
+// fields of the client context.  They are declared by the invoker, and are
+// not verified.
+type InvocationMeta struct {
+	Action        string `json:"action,omitempty"`
+	CorrelationID string `json:"correlationId,omitempty"`
+	Caller        string `json:"caller,omitempty"`
+	ExecutionArn  string `json:"executionArn,omitempty"`
+}
+
+// logWriter writes log records to the output of the standard logger, so
+// that the records are redirected along with it by the cwl tool and tests.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	return log.Writer().Write(p)
+}
+
+// logLevel returns the level named by CWL_LOG_LEVEL, or info.
+func logLevel() slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.TrimSpace(os.Getenv(LogLevelEnvVar)))); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+// newLogger returns a logger writing JSON lines at the level named by
+// CWL_LOG_LEVEL.
+func newLogger() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(logWriter{}, &slog.HandlerOptions{Level: logLevel()}))
+}
+
+// invocation identifies the invocation of a handler in its log records,
+// metrics and audit records.  payload is the raw event, kept so that an
+// action awaiting approval can be run later.  messageKey is the idempotency
+// key of the SQS message carrying the event, if any.
+type invocation struct {
+	handler       string
+	requestID     string
+	correlationID string
+	caller        string
+	executionArn  string
+	payload       []byte
+	messageKey    string
+}
+
+// invocationKey and loggerKey are the context keys for the invocation and
+// its *slog.Logger.
+type (
+	invocationKey struct{}
+	loggerKey     struct{}
+)
+
+// withInvocation returns a copy of ctx carrying the invocation of handler
+// with payload, and a logger whose records name the handler, the Lambda
+// request ID and the correlation ID of the invocation.
+func withInvocation(ctx context.Context, handler string, payload []byte) context.Context {
+	inv := invocation{handler: handler, payload: payload}
+
+	// the message key applies to this handler alone, not to the handlers
+	// it invokes
+	if key, ok := ctx.Value(messageKeyKey{}).(string); ok {
+		inv.messageKey = key
+		ctx = context.WithValue(ctx, messageKeyKey{}, nil)
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		inv.requestID = lc.AwsRequestID
+	}
+	inv.correlationID = correlationID(ctx, payload, inv.requestID)
+	inv.caller, inv.executionArn = callerOf(ctx, payload)
+	l := newLogger().With(
+		logKeyRequestID, inv.requestID,
+		logKeyHandler, inv.handler,
+		logKeyCorrelationID, inv.correlationID,
+	)
+	ctx = context.WithValue(ctx, invocationKey{}, inv)
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// invocationFrom returns the invocation carried by ctx.
+func invocationFrom(ctx context.Context) (invocation, bool) {
+	inv, ok := ctx.Value(invocationKey{}).(invocation)
+	return inv, ok
+}
+
+// correlationID returns the correlation ID supplied with the event or the
+// client context, or requestID.
+func correlationID(ctx context.Context, payload []byte, requestID string) string {
+	var meta InvocationMeta
+	if err := json.Unmarshal(payload, &meta); err == nil && meta.CorrelationID != "" {
+		return meta.CorrelationID
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.ClientContext.Custom["correlationId"] != "" {
+		return lc.ClientContext.Custom["correlationId"]
+	}
+	return requestID
+}
+
+// callerOf returns the caller and Step Functions execution ARN supplied
+// with the event or the client context.  The Cognito identity of the
+// invoker, if any, is the default caller.
+func callerOf(ctx context.Context, payload []byte) (caller, executionArn string) {
+	var meta InvocationMeta
+	json.Unmarshal(payload, &meta)
+	caller, executionArn = meta.Caller, meta.ExecutionArn
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		if caller == "" {
+			caller = lc.ClientContext.Custom["caller"]
+		}
+		if caller == "" {
+			caller = lc.Identity.CognitoIdentityID
+		}
+		if executionArn == "" {
+			executionArn = lc.ClientContext.Custom["executionArn"]
+		}
+	}
+	return caller, executionArn
+}
+
+// logger returns the logger of the invocation carried by ctx, or a logger
+// without invocation attributes for handlers called directly.
+func logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return newLogger()
+}
+
+// withLogAttrs returns a copy of ctx carrying the logger of ctx with the
+// attributes args added to its records.
+func withLogAttrs(ctx context.Context, args ...interface{}) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger(ctx).With(args...))
+}
+
+// logInvocation logs the start of the invocation and the execution time
+// remaining before the Lambda deadline.
+func logInvocation(ctx context.Context) {
+	if deadline, ok := ctx.Deadline(); ok {
+		logger(ctx).Info("invocation started", "timeRemaining", time.Until(deadline).Round(time.Millisecond).String())
+		return
+	}
+	logger(ctx).Info("invocation started")
+}
+
+// logStateChanges logs the state transition of each instance returned by
+// an EC2 start or stop call.
+func logStateChanges(ctx context.Context, changes []*ec2.InstanceStateChange) {
+	for _, c := range changes {
+		var prev, cur string
+		if c.PreviousState != nil {
+			prev = aws.StringValue(c.PreviousState.Name)
+		}
+		if c.CurrentState != nil {
+			cur = aws.StringValue(c.CurrentState.Name)
+		}
+		logger(ctx).Info("instance state changed", logKeyInstances, []string{aws.StringValue(c.InstanceId)}, "previousState", prev, "currentState", cur)
+	}
+}
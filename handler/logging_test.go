@@ -0,0 +1,97 @@
+package cwl_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/1414C/cwl/awsfake"
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// captureLog returns the JSON log records, including EMF metric records,
+// written while f runs.
+func captureLog(t *testing.T, f func()) []map[string]interface{} {
+	t.Helper()
+	var buf bytes.Buffer
+	w := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(w)
+	f()
+
+	var records []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var r map[string]interface{}
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("log output is not JSON lines: %v\n%s", err, buf.String())
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestInvocationLogging(t *testing.T) {
+	st := awsfake.NewState()
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{EC2: awsfake.NewEC2(st)})
+	ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{AwsRequestID: "req-1"})
+	payload := []byte(`{"action": "EC2InstancesStart", "instances": ["i-0000000000000005a"], "correlationId": "nightly-42"}`)
+
+	for _, tc := range []struct {
+		level string
+		want  int
+	}{
+		// the audit record of the start is written at every level
+		{"", 4},
+		{"debug", 5},
+		{"error", 1},
+	} {
+		os.Setenv(cwl.LogLevelEnvVar, tc.level)
+		st.AddInstance(awsfake.Instance{ID: "i-0000000000000005a", State: awsfake.InstanceStopped})
+		records := captureLog(t, func() {
+			if _, err := cwl.NewRouter().Invoke(ctx, payload); err != nil {
+				t.Fatal(err)
+			}
+		})
+		records = logRecords(records)
+		if len(records) != tc.want {
+			t.Errorf("level %q: got %d records, want %d", tc.level, len(records), tc.want)
+		}
+		for _, r := range records {
+			if r["msg"] == "audit" {
+				continue
+			}
+			if r["requestId"] != "req-1" || r["handler"] != "EC2InstancesStart" || r["correlationId"] != "nightly-42" {
+				t.Errorf("record %v lacks the invocation attributes", r)
+			}
+			if r["msg"] == "instance state changed" && (r["previousState"] != ec2.InstanceStateNameStopped || r["currentState"] != ec2.InstanceStateNamePending) {
+				t.Errorf("record %v", r)
+			}
+		}
+	}
+	os.Unsetenv(cwl.LogLevelEnvVar)
+
+	// without a correlation ID the request ID is used
+	records := captureLog(t, func() {
+		cwl.NewRouter().InvokeHandler(ctx, "EC2InstancesStop", []byte(`{"instances": ["i-0000000000000005a"]}`))
+	})
+	if records = logRecords(records); len(records) == 0 || records[0]["correlationId"] != "req-1" {
+		t.Errorf("got records %v, want correlationId req-1", records)
+	}
+}
+
+// logRecords returns the records that are not EMF metric records.
+func logRecords(records []map[string]interface{}) []map[string]interface{} {
+	var logs []map[string]interface{}
+	for _, r := range records {
+		if _, ok := r["_aws"]; !ok {
+			logs = append(logs, r)
+		}
+	}
+	return logs
+}
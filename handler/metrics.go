@@ -0,0 +1,280 @@
+package cwl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// MetricsNamespaceEnvVar names the environment variable holding the
+// CloudWatch namespace of the handler metrics; by default "cwl".
+const MetricsNamespaceEnvVar = "CWL_METRICS_NAMESPACE"
+
+// defaultMetricsNamespace is the CloudWatch namespace of the handler
+// metrics if CWL_METRICS_NAMESPACE is not set.
+const defaultMetricsNamespace = "cwl"
+
+// The names of the handler metrics.  Every metric has the Handler
+// dimension; the API metrics also have the Service and Operation
+// dimensions, and JobsCompleted and CommandsFailed the Status dimension.
+const (
+	metricInstancesStarted    = "InstancesStarted"
+	metricInstancesStopped    = "InstancesStopped"
+	metricInstancesRebooted   = "InstancesRebooted"
+	metricInstancesHibernated = "InstancesHibernated"
+	metricInstancesTerminated = "InstancesTerminated"
+	metricCommandsSent        = "CommandsSent"
+	metricCommandsSucceeded   = "CommandsSucceeded"
+	metricCommandsFailed      = "CommandsFailed"
+	metricJobsSubmitted       = "JobsSubmitted"
+	metricJobsCompleted       = "JobsCompleted"
+	metricJobQueueTime        = "JobQueueTime"
+	metricJobRunTime          = "JobRunTime"
+	metricAPILatency          = "ApiLatency"
+	metricAPIErrors           = "ApiErrors"
+	metricAPIRetries          = "ApiRetries"
+	metricAPIThrottles        = "ApiThrottles"
+	metricAuditErrors         = "AuditErrors"
+	metricPolicyViolations    = "PolicyViolations"
+	metricApprovalRequests    = "ApprovalRequests"
+	metricIdempotentReplays   = "IdempotentReplays"
+	metricScheduleErrors      = "ScheduleErrors"
+)
+
+// The CloudWatch units of the handler metrics.
+const (
+	unitCount        = "Count"
+	unitMilliseconds = "Milliseconds"
+	unitSeconds      = "Seconds"
+)
+
+// metric is a named metric and the values recorded for it.
+type metric struct {
+	name   string
+	unit   string
+	values []float64
+}
+
+// metricGroup holds the metrics recorded with one set of dimension values.
+type metricGroup struct {
+	dims    []string // alternating names and values
+	metrics []*metric
+}
+
+// metricSet collects the metrics recorded during an invocation, and writes
+// them as CloudWatch Embedded Metric Format (EMF) log records when the
+// handler returns.  CloudWatch extracts the metrics from the log records
+// asynchronously, so recording metrics adds no API calls to the handlers.
+type metricSet struct {
+	mu     sync.Mutex
+	inv    invocation
+	groups []*metricGroup
+}
+
+// metricsKey is the context key for the *metricSet of an invocation.
+type metricsKey struct{}
+
+// withMetrics returns a copy of ctx carrying a new metric set for the
+// invocation carried by ctx.
+func withMetrics(ctx context.Context) (context.Context, *metricSet) {
+	inv, _ := invocationFrom(ctx)
+	m := &metricSet{inv: inv}
+	return context.WithValue(ctx, metricsKey{}, m), m
+}
+
+// metrics returns the metric set carried by ctx.  Metrics recorded by
+// handlers called directly, rather than through a Router, are discarded.
+func metrics(ctx context.Context) *metricSet {
+	if ctx != nil {
+		if m, ok := ctx.Value(metricsKey{}).(*metricSet); ok {
+			return m
+		}
+	}
+	return nil
+}
+
+// add records value for the named metric with the Handler dimension and
+// the dimensions dims, given as alternating names and values.
+func (m *metricSet) add(name, unit string, value float64, dims ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g := m.group(dims)
+	for _, mt := range g.metrics {
+		if mt.name == name {
+			mt.values = append(mt.values, value)
+			return
+		}
+	}
+	g.metrics = append(g.metrics, &metric{name: name, unit: unit, values: []float64{value}})
+}
+
+// count adds n to the named count metric.
+func (m *metricSet) count(name string, n int, dims ...string) {
+	m.add(name, unitCount, float64(n), dims...)
+}
+
+// group returns the metric group with the dimension values dims, adding
+// it if needed.
+func (m *metricSet) group(dims []string) *metricGroup {
+	for _, g := range m.groups {
+		if equalStrings(g.dims, dims) {
+			return g
+		}
+	}
+	g := &metricGroup{dims: dims}
+	m.groups = append(m.groups, g)
+	return g
+}
+
+// flush writes one EMF log record for each group of recorded metrics.
+func (m *metricSet) flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	namespace := os.Getenv(MetricsNamespaceEnvVar)
+	if namespace == "" {
+		namespace = defaultMetricsNamespace
+	}
+	for _, g := range m.groups {
+		b, err := json.Marshal(g.record(namespace, m.inv, time.Now()))
+		if err != nil {
+			logger(context.Background()).Error("unable to encode metrics", logKeyError, err)
+			continue
+		}
+		fmt.Fprintln(logWriter{}, string(b))
+	}
+	m.groups = nil
+}
+
+// emfMetadata is the "_aws" member of an EMF log record, which tells
+// CloudWatch which members of the record are metrics and dimensions.
+type emfMetadata struct {
+	Timestamp         int64             `json:"Timestamp"`
+	CloudWatchMetrics []emfMetricFamily `json:"CloudWatchMetrics"`
+}
+
+type emfMetricFamily struct {
+	Namespace  string          `json:"Namespace"`
+	Dimensions [][]string      `json:"Dimensions"`
+	Metrics    []emfMetricName `json:"Metrics"`
+}
+
+type emfMetricName struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// record returns the EMF log record of the group.  The request and
+// correlation IDs are included as properties, which are not dimensions but
+// can be queried in CloudWatch Logs Insights.
+func (g *metricGroup) record(namespace string, inv invocation, now time.Time) map[string]interface{} {
+	r := map[string]interface{}{
+		logKeyHandler:       inv.handler,
+		logKeyRequestID:     inv.requestID,
+		logKeyCorrelationID: inv.correlationID,
+	}
+	dims := []string{"Handler"}
+	r["Handler"] = inv.handler
+	for i := 0; i+1 < len(g.dims); i += 2 {
+		dims = append(dims, g.dims[i])
+		r[g.dims[i]] = g.dims[i+1]
+	}
+	family := emfMetricFamily{Namespace: namespace, Dimensions: [][]string{dims}}
+	for _, mt := range g.metrics {
+		family.Metrics = append(family.Metrics, emfMetricName{Name: mt.name, Unit: mt.unit})
+		if len(mt.values) == 1 {
+			r[mt.name] = mt.values[0]
+		} else {
+			r[mt.name] = mt.values
+		}
+	}
+	r["_aws"] = emfMetadata{Timestamp: now.UnixMilli(), CloudWatchMetrics: []emfMetricFamily{family}}
+	return r
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The AWS SDK request handlers that record the latency, errors, retries and
+// throttling of the AWS API calls made by the handlers.
+var (
+	apiMetricsHandler = request.NamedHandler{Name: "cwl.apiMetrics", Fn: func(r *request.Request) {
+		m := metrics(r.Context())
+		dims := []string{"Service", r.ClientInfo.ServiceName, "Operation", r.Operation.Name}
+		m.add(metricAPILatency, unitMilliseconds, float64(time.Since(r.Time).Microseconds())/1000, dims...)
+		if r.Error != nil {
+			m.count(metricAPIErrors, 1, dims...)
+		}
+		if r.RetryCount > 0 {
+			m.count(metricAPIRetries, r.RetryCount, dims...)
+		}
+	}}
+	apiThrottleHandler = request.NamedHandler{Name: "cwl.apiThrottles", Fn: func(r *request.Request) {
+		if request.IsErrorThrottle(r.Error) {
+			metrics(r.Context()).count(metricAPIThrottles, 1, "Service", r.ClientInfo.ServiceName, "Operation", r.Operation.Name)
+		}
+	}}
+)
+
+// instrument adds the API metric and tracing handlers to an AWS SDK client,
+// if it is one.  Clients that are already instrumented, and fakes, are
+// unchanged.
+func instrument(c interface{}) {
+	var h *request.Handlers
+	switch c := c.(type) {
+	case *ec2.EC2:
+		h = &c.Handlers
+	case *ssm.SSM:
+		h = &c.Handlers
+	case *batch.Batch:
+		h = &c.Handlers
+	case *sfn.SFN:
+		h = &c.Handlers
+	case *dynamodb.DynamoDB:
+		h = &c.Handlers
+	case *s3.S3:
+		h = &c.Handlers
+	case *sns.SNS:
+		h = &c.Handlers
+	default:
+		return
+	}
+	if !h.Complete.SwapNamed(apiMetricsHandler) {
+		h.Complete.PushBackNamed(apiMetricsHandler)
+	}
+	if !h.Retry.SwapNamed(apiThrottleHandler) {
+		h.Retry.PushBackNamed(apiThrottleHandler)
+	}
+	if !h.Validate.SwapNamed(traceStartHandler) {
+		h.Validate.PushFrontNamed(traceStartHandler)
+	}
+	if !h.Build.SwapNamed(traceHeaderHandler) {
+		h.Build.PushBackNamed(traceHeaderHandler)
+	}
+	if !h.Complete.SwapNamed(traceEndHandler) {
+		h.Complete.PushBackNamed(traceEndHandler)
+	}
+}
@@ -0,0 +1,108 @@
+package cwl_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/1414C/cwl/awsfake"
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/batch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// emfRecords returns the EMF records among log records, keyed by the names
+// of their metrics.
+func emfRecords(records []map[string]interface{}) map[string]map[string]interface{} {
+	m := make(map[string]map[string]interface{})
+	for _, r := range records {
+		meta, ok := r["_aws"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, f := range meta["CloudWatchMetrics"].([]interface{}) {
+			for _, mt := range f.(map[string]interface{})["Metrics"].([]interface{}) {
+				m[mt.(map[string]interface{})["Name"].(string)] = r
+			}
+		}
+	}
+	return m
+}
+
+func TestMetrics(t *testing.T) {
+	st := awsfake.NewState()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	st.Now = func() time.Time { return now }
+	st.AddInstance(awsfake.Instance{ID: "i-0000000000000006a", State: awsfake.InstanceStopped})
+	st.AddInstance(awsfake.Instance{ID: "i-0000000000000006b", State: awsfake.InstanceStopped})
+	st.JobQueueTime = time.Minute
+	st.JobDuration = 5 * time.Minute
+	srv := awsfake.NewServer(st)
+	defer srv.Close()
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{EC2: ec2.New(srv.Session()), Batch: batch.New(srv.Session())})
+	router := cwl.NewRouter()
+
+	records := emfRecords(captureLog(t, func() {
+		if _, err := router.InvokeHandler(ctx, "EC2InstancesStart", []byte(`{"instances": ["i-0000000000000006a", "i-0000000000000006b"], "correlationId": "c-1"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	if r := records["InstancesStarted"]; r == nil || r["InstancesStarted"] != 2.0 || r["Handler"] != "EC2InstancesStart" || r["correlationId"] != "c-1" {
+		t.Errorf("InstancesStarted record %v", r)
+	}
+	if r := records["ApiLatency"]; r == nil || r["Service"] != "ec2" || r["Operation"] != "StartInstances" {
+		t.Errorf("ApiLatency record %v", r)
+	}
+
+	var job cwl.JobGuid
+	captureLog(t, func() {
+		job, _ = cwl.SubmitJobFunc3(ctx, cwl.JobEvent{JobName: "report", JobQueue: "q", JobDefinition: "d"})
+	})
+	now = now.Add(6 * time.Minute)
+	records = emfRecords(captureLog(t, func() {
+		if _, err := router.InvokeHandler(ctx, "CheckJobFunc3", []byte(`{"jobID": "`+job.JobID+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	if r := records["JobsCompleted"]; r == nil || r["Status"] != "SUCCEEDED" || r["JobsCompleted"] != 1.0 {
+		t.Errorf("JobsCompleted record %v", r)
+	}
+	if r := records["JobRunTime"]; r == nil || r["JobQueueTime"] != 60.0 || r["JobRunTime"] != 300.0 {
+		t.Errorf("JobRunTime record %v", r)
+	}
+}
+
+func TestAPIThrottleMetrics(t *testing.T) {
+	throttle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amzn-Errortype", "TooManyRequestsException")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"message": "Too many requests"}`))
+	}))
+	defer throttle.Close()
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(throttle.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(1),
+	}))
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{Batch: batch.New(sess)})
+
+	records := emfRecords(captureLog(t, func() {
+		if _, err := cwl.NewRouter().InvokeHandler(ctx, "CheckJobFunc3", []byte(`{"jobID": "00000001-0000-4000-8000-000000000001"}`)); err == nil {
+			t.Fatal("throttled call succeeded")
+		}
+	}))
+	r := records["ApiThrottles"]
+	if r == nil || r["Operation"] != "DescribeJobs" {
+		t.Fatalf("ApiThrottles record %v", r)
+	}
+	if got := r["ApiThrottles"]; !reflect.DeepEqual(got, []interface{}{1.0, 1.0}) || r["ApiRetries"] != 1.0 || r["ApiErrors"] != 1.0 {
+		t.Errorf("got throttles %v, retries %v, errors %v; want [1 1], 1, 1", got, r["ApiRetries"], r["ApiErrors"])
+	}
+}
@@ -0,0 +1,412 @@
+package cwl
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// PolicyEnvVar names the environment variable locating the protection
+// policy consulted by the handlers before they change the state of AWS
+// resources:
+//
+//	ssm://<parameter-name>    an SSM Parameter Store parameter
+//	file://<path>             a file, relative to the working directory
+//
+// If it is not set, the default policy bundled with the binary is used.
+// It blocks actions on instances tagged Protected=true, calls naming more
+// than 100 instances, and commands that destroy or shut down a system.
+const PolicyEnvVar = "CWL_POLICY"
+
+// policyCacheTTL is the time for which a policy read from SSM or a file is
+// used before it is read again.
+const policyCacheTTL = time.Minute
+
+// defaultEnvironmentTag is the tag holding the environment of an instance
+// unless the policy names another.
+const defaultEnvironmentTag = "Environment"
+
+// defaultPolicy is the policy used if CWL_POLICY is not set.
+//
+//go:embed protection_policy.json
+var defaultPolicy []byte
+
+// ProtectionPolicy restricts the actions of the handlers that change the
+// state of AWS resources.  Policies are JSON, for example:
+//
+//	{
+//	  "denyTags": {"Protected": "true", "Tier": "database"},
+//	  "environmentTag": "Environment",
+//	  "environments": {"EC2InstancesStop": ["dev", "test"], "*": ["dev", "test", "prod"]},
+//	  "maxInstances": {"EC2InstancesReboot": 5, "*": 100},
+//	  "forbiddenCommands": ["\\brm\\s+(-[A-Za-z-]+\\s+)*/(\\*|\\s|;|&|$)", "\\bshutdown\\b"]
+//	}
+//
+// Environments and MaxInstances are keyed by handler name, with "*" for
+// the handlers not named.  A handler with no entry may act on instances in
+// any environment, or on any number of instances.
+type ProtectionPolicy struct {
+	// DenyTags blocks actions on instances carrying any of the tags.  The
+	// value "*" matches any value of the tag.
+	DenyTags map[string]string `json:"denyTags,omitempty"`
+
+	// EnvironmentTag names the tag holding the environment of an
+	// instance; by default "Environment".
+	EnvironmentTag string `json:"environmentTag,omitempty"`
+
+	// Environments lists the environments whose instances each handler
+	// may act on.  Instances without the environment tag are blocked.
+	Environments map[string][]string `json:"environments,omitempty"`
+
+	// MaxInstances limits the number of instances named in one call.
+	MaxInstances map[string]int `json:"maxInstances,omitempty"`
+
+	// ForbiddenCommands holds regular expressions matching the commands
+	// EC2IssueCmd must not run.
+	ForbiddenCommands []string `json:"forbiddenCommands,omitempty"`
+
+	// Approval names the actions that need the approval of a second
+	// person before they are taken.
+	Approval *ApprovalPolicy `json:"approval,omitempty"`
+}
+
+// ParseProtectionPolicy decodes and checks a JSON protection policy.
+// Unknown fields are rejected, since a misspelt rule would otherwise
+// silently protect nothing.
+func ParseProtectionPolicy(b []byte) (*ProtectionPolicy, error) {
+	p := &ProtectionPolicy{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("invalid protection policy: %v", err)
+	}
+	if _, err := p.commandPatterns(); err != nil {
+		return nil, err
+	}
+	for name, n := range p.MaxInstances {
+		if n < 1 {
+			return nil, fmt.Errorf("invalid protection policy: maxInstances of %s must be at least 1", name)
+		}
+	}
+	if p.Approval != nil {
+		if err := p.Approval.check(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// commandPatterns compiles the forbidden command patterns.
+func (p *ProtectionPolicy) commandPatterns() ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, s := range p.ForbiddenCommands {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protection policy: forbidden command %q: %v", s, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// environments returns the environments handler may act in, or nil if it
+// is not restricted.
+func (p *ProtectionPolicy) environments(handler string) []string {
+	if envs, ok := p.Environments[handler]; ok {
+		return envs
+	}
+	return p.Environments["*"]
+}
+
+// maxInstances returns the limit on the instances named in a call to
+// handler, or 0 if there is none.
+func (p *ProtectionPolicy) maxInstances(handler string) int {
+	if n, ok := p.MaxInstances[handler]; ok {
+		return n
+	}
+	return p.MaxInstances["*"]
+}
+
+// the protection policy rules
+const (
+	RuleDenyTag          = "denyTag"
+	RuleEnvironment      = "environment"
+	RuleMaxInstances     = "maxInstances"
+	RuleForbiddenCommand = "forbiddenCommand"
+)
+
+// PolicyViolation is a single broken protection policy rule.
+type PolicyViolation struct {
+	Rule     string `json:"rule"`
+	Instance string `json:"instance,omitempty"`
+	Message  string `json:"message"`
+}
+
+// PolicyViolationError is returned, in place of taking an action, when
+// the action breaks the protection policy.  It lists every violation
+// found, and is reported by Lambda with errorType PolicyViolationError, so
+// that Step Functions can catch it by name.
+type PolicyViolationError struct {
+	Handler    string            `json:"handler"`
+	Violations []PolicyViolation `json:"violations"`
+}
+
+func (e *PolicyViolationError) Error() string {
+	var msgs []string
+	for _, v := range e.Violations {
+		if v.Instance != "" {
+			msgs = append(msgs, v.Instance+": "+v.Message)
+		} else {
+			msgs = append(msgs, v.Message)
+		}
+	}
+	return fmt.Sprintf("protection policy forbids %s: %s", e.Handler, strings.Join(msgs, "; "))
+}
+
+// policyCache holds the policy last read from CWL_POLICY.
+var policyCache struct {
+	sync.Mutex
+	source string
+	policy *ProtectionPolicy
+	read   time.Time
+}
+
+// protectionPolicy returns the policy supplied with ctx, or the policy
+// named by CWL_POLICY.
+func protectionPolicy(ctx context.Context) (*ProtectionPolicy, error) {
+	if p := clientsFrom(ctx).Policy; p != nil {
+		return p, nil
+	}
+	source := os.Getenv(PolicyEnvVar)
+	policyCache.Lock()
+	defer policyCache.Unlock()
+	if policyCache.policy != nil && policyCache.source == source && time.Since(policyCache.read) < policyCacheTTL {
+		return policyCache.policy, nil
+	}
+	p, err := loadProtectionPolicy(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	policyCache.source, policyCache.policy, policyCache.read = source, p, time.Now()
+	return p, nil
+}
+
+// loadProtectionPolicy reads the policy at source, a location of the form
+// accepted by CWL_POLICY, or the default policy if source is empty.
+func loadProtectionPolicy(ctx context.Context, source string) (*ProtectionPolicy, error) {
+	if source == "" {
+		return ParseProtectionPolicy(defaultPolicy)
+	}
+	b, err := readConfig(ctx, source, "protection policy")
+	if err != nil {
+		return nil, err
+	}
+	return ParseProtectionPolicy(b)
+}
+
+// ParsePolicySource splits a policy location of the form accepted by
+// CWL_POLICY into its kind, "ssm" or "file", and the parameter name or
+// path.
+func ParsePolicySource(source string) (kind, location string, err error) {
+	return parseConfigSource(source, "protection policy")
+}
+
+// parseConfigSource splits the location of a configuration document, what,
+// into its kind, "ssm" or "file", and the parameter name or path.
+func parseConfigSource(source, what string) (kind, location string, err error) {
+	kind, location, ok := strings.Cut(source, "://")
+	if !ok || location == "" || (kind != "ssm" && kind != "file") {
+		return "", "", fmt.Errorf("invalid %s location %q; use ssm://<parameter-name> or file://<path>", what, source)
+	}
+	return kind, location, nil
+}
+
+// readConfig reads the configuration document what from source, an SSM
+// parameter or a file.
+func readConfig(ctx context.Context, source, what string) ([]byte, error) {
+	kind, location, err := parseConfigSource(source, what)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "file" {
+		b, err := os.ReadFile(location)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %v", what, err)
+		}
+		return b, nil
+	}
+	svc, err := ssmClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out, err := svc.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(location),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s from parameter %s: %v", what, location, err)
+	}
+	if out.Parameter == nil {
+		return nil, fmt.Errorf("%s parameter %s has no value", what, location)
+	}
+	return []byte(aws.StringValue(out.Parameter.Value)), nil
+}
+
+// policyRequest describes an action to be checked against the protection
+// policy.  Cmd is the command to be run, if any.
+type policyRequest struct {
+	Instances []string
+	Cmd       string
+}
+
+// checkPolicy checks req against the protection policy, before the
+// invoked handler acts on the instances.  It returns a
+// *PolicyViolationError if the policy forbids the action, an
+// *ApprovalRequiredError if the action awaits approval, or an error if the
+// policy or the tags of the instances cannot be read, in which case the
+// action must not be taken either.
+func checkPolicy(ctx context.Context, req policyRequest) error {
+	p, err := protectionPolicy(ctx)
+	if err != nil {
+		logger(ctx).Error("unable to read protection policy", logKeyError, err)
+		return err
+	}
+	inv, _ := invocationFrom(ctx)
+	handler := inv.handler
+	if handler == "" {
+		handler = "*"
+	}
+
+	var violations []PolicyViolation
+	if max := p.maxInstances(handler); max > 0 && len(req.Instances) > max {
+		violations = append(violations, PolicyViolation{
+			Rule:    RuleMaxInstances,
+			Message: fmt.Sprintf("%d instances named, at most %d allowed", len(req.Instances), max),
+		})
+	}
+	if req.Cmd != "" {
+		patterns, err := p.commandPatterns()
+		if err != nil {
+			return err
+		}
+		for _, re := range patterns {
+			if re.MatchString(req.Cmd) {
+				violations = append(violations, PolicyViolation{
+					Rule:    RuleForbiddenCommand,
+					Message: fmt.Sprintf("command matches forbidden pattern %q", re.String()),
+				})
+			}
+		}
+	}
+
+	envs := p.environments(handler)
+	var tags map[string]map[string]string
+	if len(p.DenyTags) > 0 || envs != nil || (p.Approval != nil && len(p.Approval.Tags) > 0) {
+		tags, err = instanceTags(ctx, req.Instances)
+		if err != nil {
+			logger(ctx).Error("unable to read instance tags for the protection policy", logKeyInstances, req.Instances, logKeyError, err)
+			return err
+		}
+		envTag := p.EnvironmentTag
+		if envTag == "" {
+			envTag = defaultEnvironmentTag
+		}
+		for _, id := range req.Instances {
+			violations = append(violations, tagViolations(id, tags[id], p.DenyTags, envTag, envs)...)
+		}
+	}
+
+	if len(violations) > 0 {
+		err = &PolicyViolationError{Handler: handler, Violations: violations}
+		logger(ctx).Warn("action blocked by protection policy", logKeyInstances, req.Instances, "violations", violations)
+		metrics(ctx).count(metricPolicyViolations, 1)
+		return err
+	}
+
+	// an action needing approval is taken only when invoked by
+	// ApproveAction
+	reasons := p.Approval.reasons(handler, req, tags)
+	if len(reasons) == 0 {
+		return nil
+	}
+	if a, ok := approvalFrom(ctx); ok && a.handler == handler {
+		logger(ctx).Info("action approved", "request", a.request, "approver", a.approver)
+		return nil
+	}
+	return requestApproval(ctx, p.Approval, handler, req, reasons)
+}
+
+// tagViolations returns the violations of the deny tags and allowed
+// environments by the instance id with tags.  envs is nil if the handler
+// may act in any environment.
+func tagViolations(id string, tags, denyTags map[string]string, envTag string, envs []string) []PolicyViolation {
+	var violations []PolicyViolation
+	var keys []string
+	for k := range denyTags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v, ok := tags[k]; ok && (denyTags[k] == "*" || denyTags[k] == v) {
+			violations = append(violations, PolicyViolation{
+				Rule:     RuleDenyTag,
+				Instance: id,
+				Message:  fmt.Sprintf("instance is tagged %s=%s", k, v),
+			})
+		}
+	}
+	if envs != nil {
+		env, ok := tags[envTag]
+		switch {
+		case !ok:
+			violations = append(violations, PolicyViolation{
+				Rule:     RuleEnvironment,
+				Instance: id,
+				Message:  fmt.Sprintf("instance has no %s tag; allowed environments are %s", envTag, strings.Join(envs, ", ")),
+			})
+		case !containsString(envs, env):
+			violations = append(violations, PolicyViolation{
+				Rule:     RuleEnvironment,
+				Instance: id,
+				Message:  fmt.Sprintf("instance is in environment %s; allowed environments are %s", env, strings.Join(envs, ", ")),
+			})
+		}
+	}
+	return violations
+}
+
+// instanceTags returns the tags of the named instances, by instance ID.
+func instanceTags(ctx context.Context, ids []string) (map[string]map[string]string, error) {
+	svc, err := ec2Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// a call naming instance IDs is not paginated
+	out, err := svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice(ids)})
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]map[string]string)
+	for _, r := range out.Reservations {
+		for _, in := range r.Instances {
+			t := make(map[string]string)
+			for _, tag := range in.Tags {
+				t[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+			tags[aws.StringValue(in.InstanceId)] = t
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,165 @@
+package cwl_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/1414C/cwl/awsfake"
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// fakeParameters is an in-memory SSM Parameter Store, supporting the calls
+// made to read a protection policy.
+type fakeParameters struct {
+	ssmiface.SSMAPI
+	values map[string]string
+	reads  int
+}
+
+func (f *fakeParameters) GetParameterWithContext(ctx aws.Context, in *ssm.GetParameterInput, _ ...request.Option) (*ssm.GetParameterOutput, error) {
+	f.reads++
+	v, ok := f.values[aws.StringValue(in.Name)]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "parameter not found", nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: in.Name, Value: aws.String(v)}}, nil
+}
+
+func TestProtectionPolicy(t *testing.T) {
+	policy, err := cwl.ParseProtectionPolicy([]byte(`{
+		"denyTags": {"Tier": "*"},
+		"environments": {"EC2InstancesReboot": ["dev"], "*": ["dev", "test"]},
+		"maxInstances": {"EC2InstancesStart": 2},
+		"forbiddenCommands": ["\\bshutdown\\b"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := awsfake.NewState()
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000b1", State: awsfake.InstanceStopped, Tags: map[string]string{"Environment": "dev"}})
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000b2", State: awsfake.InstanceStopped, Tags: map[string]string{"Environment": "test"}})
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000b3", State: awsfake.InstanceStopped, Tags: map[string]string{"Environment": "dev", "Tier": "database"}})
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000b4", State: awsfake.InstanceStopped})
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{EC2: awsfake.NewEC2(st), SSM: awsfake.NewSSM(st), Policy: policy})
+	r := cwl.NewRouter()
+
+	tests := []struct {
+		handler, event string
+		rules          []string
+	}{
+		{"EC2InstancesStart", `{"instances": ["i-000000000000000b1", "i-000000000000000b2"]}`, nil},
+		{"EC2InstancesStart", `{"instances": ["i-000000000000000b1", "i-000000000000000b2", "i-000000000000000b3"]}`, []string{cwl.RuleMaxInstances, cwl.RuleDenyTag}},
+		{"EC2InstancesReboot", `{"instances": ["i-000000000000000b1", "i-000000000000000b2"]}`, []string{cwl.RuleEnvironment}},
+		{"EC2InstancesStop", `{"instances": ["i-000000000000000b4"]}`, []string{cwl.RuleEnvironment}},
+		{"EC2IssueCmd", `{"instances": ["i-000000000000000b1"], "cmd": "sudo shutdown -r now"}`, []string{cwl.RuleForbiddenCommand}},
+		{"EC2IssueCmd", `{"instances": ["i-000000000000000b1"], "cmd": "uptime"}`, nil},
+	}
+	for _, tt := range tests {
+		_, err := r.InvokeHandler(ctx, tt.handler, []byte(tt.event))
+		if tt.rules == nil {
+			if err != nil {
+				t.Errorf("%s %s: %v", tt.handler, tt.event, err)
+			}
+			continue
+		}
+		var perr *cwl.PolicyViolationError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s %s: got %v, want a PolicyViolationError", tt.handler, tt.event, err)
+			continue
+		}
+		var rules []string
+		for _, v := range perr.Violations {
+			rules = append(rules, v.Rule)
+		}
+		if perr.Handler != tt.handler || strings.Join(rules, ",") != strings.Join(tt.rules, ",") {
+			t.Errorf("%s %s: got violations %+v of %s, want rules %v", tt.handler, tt.event, perr.Violations, perr.Handler, tt.rules)
+		}
+	}
+
+	// blocked instances are left alone
+	for _, id := range []string{"i-000000000000000b3", "i-000000000000000b4"} {
+		if in, _ := st.Instance(id); in.State != awsfake.InstanceStopped {
+			t.Errorf("instance %s is %s, want it left stopped", id, in.State)
+		}
+	}
+}
+
+func TestProtectionPolicySources(t *testing.T) {
+	st := awsfake.NewState()
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000c1", State: awsfake.InstanceStopped, Tags: map[string]string{"Owner": "dba"}})
+	params := &fakeParameters{values: map[string]string{"/cwl/policy": `{"denyTags": {"Owner": "dba"}}`}}
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{EC2: awsfake.NewEC2(st), SSM: params})
+	r := cwl.NewRouter()
+	start := func() error {
+		_, err := r.InvokeHandler(ctx, "EC2InstancesStart", []byte(`{"instances": ["i-000000000000000c1"]}`))
+		return err
+	}
+	var perr *cwl.PolicyViolationError
+
+	t.Setenv(cwl.PolicyEnvVar, "ssm:///cwl/policy")
+	for i := 0; i < 2; i++ {
+		if err := start(); !errors.As(err, &perr) {
+			t.Errorf("policy from SSM: got %v, want a PolicyViolationError", err)
+		}
+	}
+	if params.reads > 1 {
+		t.Errorf("policy read from SSM %d times, want it cached", params.reads)
+	}
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{"denyTags": {"Owner": "*"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(cwl.PolicyEnvVar, "file://"+path)
+	if err := start(); !errors.As(err, &perr) {
+		t.Errorf("policy from file: got %v, want a PolicyViolationError", err)
+	}
+
+	// a policy that cannot be read blocks every action
+	for _, source := range []string{"ssm:///cwl/missing", "file://" + filepath.Join(t.TempDir(), "missing.json"), "https://example.com/policy"} {
+		t.Setenv(cwl.PolicyEnvVar, source)
+		if err := start(); err == nil || errors.As(err, &perr) {
+			t.Errorf("policy %s: got %v, want a read error", source, err)
+		}
+	}
+	if in, _ := st.Instance("i-000000000000000c1"); in.State != awsfake.InstanceStopped {
+		t.Errorf("instance is %s, want it left stopped", in.State)
+	}
+
+	for _, bad := range []string{`{"denyTag": {"Protected": "true"}}`, `{"forbiddenCommands": ["("]}`, `{"maxInstances": {"*": 0}}`} {
+		if _, err := cwl.ParseProtectionPolicy([]byte(bad)); err == nil {
+			t.Errorf("policy %s accepted", bad)
+		}
+	}
+}
+
+func TestProtectionIAMPolicy(t *testing.T) {
+	doc, err := cwl.HandlerPolicy([]string{"EC2InstancesStop", "GetEC2Statuses"}, cwl.PolicyOptions{ProtectionPolicy: "ssm:///cwl/policy", Region: "us-west-2", Account: "123456789012"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources := make(map[string][]string)
+	for _, st := range doc.Statement {
+		for _, a := range st.Action {
+			resources[a] = append(resources[a], st.Resource...)
+		}
+	}
+	if r := resources["ssm:GetParameter"]; len(r) != 1 || r[0] != "arn:aws:ssm:us-west-2:123456789012:parameter/cwl/policy" {
+		t.Errorf("ssm:GetParameter on %v", r)
+	}
+	if _, ok := resources["ec2:DescribeInstances"]; !ok {
+		t.Error("ec2:DescribeInstances not granted to check instance tags")
+	}
+	if _, err := cwl.HandlerPolicy([]string{"EC2InstancesStop"}, cwl.PolicyOptions{ProtectionPolicy: "s3://bucket/policy.json"}); err == nil {
+		t.Error("unknown protection policy location accepted")
+	}
+}
@@ -0,0 +1,88 @@
+package cwl
+
+import "sort"
+
+// HandlerDef describes a cwl function that can be served from the single
+// multi-function Lambda binary.  Name is the key used to route an incoming
+// event to the function, and is aligned with the AWS Lambda function-name
+// used by the m<n> deployment scripts.  Actions lists the AWS API actions
+// called by the function, from which its IAM policy is generated.  Mutates
+// marks the functions that change the state of AWS resources, and so write
+// audit records.
+type HandlerDef struct {
+	Name    string
+	Fn      interface{}
+	Actions []IAMAction
+	Mutates bool
+
+	// readsAudit marks the functions that query the audit trail.
+	readsAudit bool
+
+	// runsActions marks the functions that invoke the handlers changing
+	// the state of AWS resources, and so need their access.
+	runsActions bool
+
+	// idempotent marks the functions whose events may carry an
+	// idempotency key, the response to which is returned to duplicates.
+	idempotent bool
+
+	// schedules marks the functions that apply instance schedules, and so
+	// read the holiday calendars.
+	schedules bool
+}
+
+// handlerDefs contains every cwl function known to the router.  Adding a
+// new handler to the project means adding it here; no new folder or build
+// script is required.
+var handlerDefs = []HandlerDef{
+	{Name: "CheckJobFunc3", Fn: CheckJobFunc3, Actions: []IAMAction{iamBatchDescribeJobs}},
+	{Name: "SubmitJobFunc3", Fn: SubmitJobFunc3, Actions: []IAMAction{iamBatchSubmitJob}},
+	{Name: "GetEC2Instances", Fn: GetEC2Instances, Actions: []IAMAction{iamEC2DescribeInstances}},
+	{Name: "GetEC2Instances2", Fn: GetEC2Instances2, Actions: []IAMAction{iamEC2DescribeInstances}},
+	{Name: "GetEC2Statuses", Fn: GetEC2Statuses, Actions: []IAMAction{iamEC2DescribeInstanceStatus}},
+	{Name: "EC2InstancesStart", Fn: EC2InstancesStart, Actions: []IAMAction{iamEC2StartInstances}, Mutates: true, idempotent: true},
+	{Name: "EC2InstancesStop", Fn: EC2InstancesStop, Actions: []IAMAction{iamEC2StopInstances}, Mutates: true, idempotent: true},
+	{Name: "EC2InstancesReboot", Fn: EC2InstancesReboot, Actions: []IAMAction{iamEC2RebootInstances}, Mutates: true, idempotent: true},
+	{Name: "EC2InstancesHibernate", Fn: EC2InstancesHibernate, Actions: []IAMAction{iamEC2DescribeInstances, iamEC2StopInstances}, Mutates: true, idempotent: true},
+	{Name: "EC2InstancesTerminate", Fn: EC2InstancesTerminate, Actions: []IAMAction{iamEC2DescribeInstances, iamEC2DescribeInstanceAttribute, iamEC2TerminateInstances}, Mutates: true, idempotent: true},
+	{Name: "EC2IssueCmd", Fn: EC2IssueCmd, Actions: []IAMAction{iamSSMSendCommandInstances, iamSSMSendCommandDocument}, Mutates: true, idempotent: true},
+	{Name: "EC2InstancesSchedule", Fn: EC2InstancesSchedule, Actions: []IAMAction{iamEC2DescribeInstances, iamEC2StartInstances, iamEC2StopInstances}, Mutates: true, schedules: true},
+	{Name: "EC2ListCmd", Fn: EC2ListCmd, Actions: []IAMAction{iamSSMListCommands}},
+	{Name: "EC2InstancesStartCallback", Fn: EC2InstancesStartCallback, Actions: append([]IAMAction{iamEC2StartInstances}, iamCallbacks...), Mutates: true},
+	{Name: "EC2IssueCmdCallback", Fn: EC2IssueCmdCallback, Actions: append([]IAMAction{iamSSMSendCommandInstances, iamSSMSendCommandDocument, iamSSMListCommands}, iamCallbacks...), Mutates: true},
+	{Name: "CallbackCompletion", Fn: CallbackCompletion, Actions: iamCallbacks},
+	{Name: "ListAuditRecords", Fn: ListAuditRecords, readsAudit: true},
+	{Name: "AwaitApproval", Fn: AwaitApproval, Actions: iamCallbacks, Mutates: true, runsActions: true},
+	{Name: "ApproveAction", Fn: ApproveAction, Actions: iamCallbacks, Mutates: true, runsActions: true},
+}
+
+// mutatingHandlers holds the names of the handlers that change the state of
+// AWS resources.  It is filled in by init, since AwaitApproval, itself a
+// registered handler, refers to it.
+var mutatingHandlers = make(map[string]bool)
+
+func init() {
+	for _, d := range handlerDefs {
+		if d.Mutates {
+			mutatingHandlers[d.Name] = true
+		}
+	}
+}
+
+// Handlers returns the registered handler definitions sorted by name.
+func Handlers() []HandlerDef {
+	defs := make([]HandlerDef, len(handlerDefs))
+	copy(defs, handlerDefs)
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
+
+// LookupHandler returns the handler definition registered under name.
+func LookupHandler(name string) (HandlerDef, bool) {
+	for _, d := range handlerDefs {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return HandlerDef{}, false
+}
@@ -0,0 +1,171 @@
+package cwl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// HandlerEnvVar names the environment variable used to select the handler
+// served by the multi-function binary.  It is normally set in the Lambda
+// function configuration.
+const HandlerEnvVar = "CWL_HANDLER"
+
+// Router dispatches incoming Lambda events to one of the registered cwl
+// functions.  Router implements the lambda.Handler interface, so a single
+// binary can be deployed to many Lambda functions:
+//
+//	lambda.Start(cwl.NewRouter())
+//
+// The target handler is selected by, in order of precedence:
+//   - the CWL_HANDLER environment variable
+//   - the "action" field of the incoming event
+//   - the AWS_LAMBDA_FUNCTION_NAME environment variable set by the runtime
+type Router struct {
+	handlers map[string]lambda.Handler
+}
+
+// NewRouter returns a Router with every registered cwl function added.
+func NewRouter() *Router {
+	r := &Router{handlers: make(map[string]lambda.Handler)}
+	for _, d := range handlerDefs {
+		r.register(d)
+	}
+	return r
+}
+
+// Register adds fn to the router under name.  fn must be a valid Lambda
+// handler function as accepted by lambda.Start.  Events are checked with
+// Validate before fn is called.
+func (r *Router) Register(name string, fn interface{}) {
+	r.register(HandlerDef{Name: name, Fn: fn})
+}
+
+// register adds the handler defined by d.  Events are validated before
+// idempotency keys are claimed, so that an invalid event holds no key.
+func (r *Router) register(d HandlerDef) {
+	var h lambda.Handler = lambda.NewHandler(d.Fn)
+	if d.idempotent {
+		h = &idempotentHandler{name: d.Name, handler: h}
+	}
+	if et := d.EventType(); et != nil {
+		h = &validatingHandler{handler: h, eventType: et}
+	}
+	r.handlers[d.Name] = h
+}
+
+// Names returns the sorted names of the handlers known to the router.
+func (r *Router) Names() []string {
+	var names []string
+	for n := range r.handlers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Invoke routes the raw event payload to the selected handler and returns
+// the JSON encoded response.  The messages of SQS and SNS events, and the
+// body of API Gateway requests, are routed one at a time in place of the
+// event, and the response is the one the trigger expects.
+func (r *Router) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	return unwrap(ctx, payload, func(ctx context.Context, payload []byte) ([]byte, error) {
+		name, err := r.route(payload)
+		if err != nil {
+			return nil, err
+		}
+		return r.invoke(ctx, name, r.handlers[name], payload)
+	})
+}
+
+// InvokeHandler passes payload to the handler registered under name,
+// bypassing the routing rules.  It is used to run handlers in-process, for
+// example from the local Step Functions interpreter.
+func (r *Router) InvokeHandler(ctx context.Context, name string, payload []byte) ([]byte, error) {
+	h, ok := r.handlers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown handler %q. known handlers: %s", name, strings.Join(r.Names(), ", "))
+	}
+	return r.invoke(ctx, name, h, payload)
+}
+
+// Handler returns a lambda.Handler serving only the handler registered
+// under name, whatever the event or environment select.  Events pass
+// through the same validation, idempotency, logging and metrics as those
+// routed by r.  It is the entry point of the single-function binaries:
+//
+//	lambda.Start(cwl.NewRouter().Handler("EC2InstancesStart"))
+func (r *Router) Handler(name string) lambda.Handler {
+	return singleHandler{router: r, name: name}
+}
+
+// singleHandler is the lambda.Handler returned by Router.Handler.
+type singleHandler struct {
+	router *Router
+	name   string
+}
+
+func (h singleHandler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	return unwrap(ctx, payload, func(ctx context.Context, payload []byte) ([]byte, error) {
+		return h.router.InvokeHandler(ctx, h.name, payload)
+	})
+}
+
+// routerKey is the context key for the *Router invoking a handler.
+type routerKey struct{}
+
+// invoke passes payload to h, the handler registered under name, with the
+// logger, metrics and trace segment of the invocation, and writes the
+// metrics and segment recorded by the handler when it returns.  The router
+// is carried by the context, so that handlers can invoke other handlers.
+func (r *Router) invoke(ctx context.Context, name string, h lambda.Handler, payload []byte) (resp []byte, err error) {
+	ctx = context.WithValue(ctx, routerKey{}, r)
+	ctx = withInvocation(ctx, name, payload)
+	inv, _ := invocationFrom(ctx)
+	ctx, m := withMetrics(ctx)
+	defer m.flush()
+	ctx, seg := withTrace(ctx, inv)
+	defer func() { closeTrace(seg, err) }()
+	logger(ctx).Debug("invoking handler")
+	return h.Invoke(ctx, payload)
+}
+
+// routerFrom returns the router invoking the handler with ctx.
+func routerFrom(ctx context.Context) (*Router, bool) {
+	r, ok := ctx.Value(routerKey{}).(*Router)
+	return r, ok
+}
+
+// route determines the name of the handler that should receive payload.
+func (r *Router) route(payload []byte) (string, error) {
+	if name := os.Getenv(HandlerEnvVar); name != "" {
+		return r.known(name, HandlerEnvVar)
+	}
+
+	// a non-object payload is legal for some handlers, so ignore any
+	// decoding errors here and fall through to the function name.
+	var ev InvocationMeta
+	if err := json.Unmarshal(payload, &ev); err == nil && ev.Action != "" {
+		return r.known(ev.Action, "event action")
+	}
+
+	if name := os.Getenv("AWS_LAMBDA_FUNCTION_NAME"); name != "" {
+		if _, ok := r.handlers[name]; ok {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no handler selected; set %s or supply an \"action\" in the event. known handlers: %s", HandlerEnvVar, strings.Join(r.Names(), ", "))
+}
+
+// known verifies that name has been registered with the router.
+func (r *Router) known(name, source string) (string, error) {
+	if _, ok := r.handlers[name]; !ok {
+		return "", fmt.Errorf("unknown handler %q selected by %s. known handlers: %s", name, source, strings.Join(r.Names(), ", "))
+	}
+	return name, nil
+}
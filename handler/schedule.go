@@ -0,0 +1,228 @@
+package cwl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	// schedules name IANA time zones, which the Lambda provided runtimes
+	// do not install
+	_ "time/tzdata"
+)
+
+// ScheduleTagEnvVar names the environment variable holding the key of the
+// instance tag read by EC2InstancesSchedule; by default "Schedule".
+const ScheduleTagEnvVar = "CWL_SCHEDULE_TAG"
+
+// defaultScheduleTag is used when CWL_SCHEDULE_TAG is not set.
+const defaultScheduleTag = "Schedule"
+
+// HolidaysEnvVar names the environment variable locating the holiday
+// calendars of EC2InstancesSchedule, as ssm://<parameter-name> or
+// file://<path>.  Without it, schedules have no holidays.
+const HolidaysEnvVar = "CWL_HOLIDAYS"
+
+// defaultCalendar is the holiday calendar of schedules naming none.
+const defaultCalendar = "default"
+
+// noCalendar is the calendar name of schedules that keep no holidays.
+const noCalendar = "none"
+
+// scheduleDays maps the day names of schedule periods to their days.
+var scheduleDays = map[string][]time.Weekday{
+	"daily":    {time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"sun":      {time.Sunday},
+}
+
+// Schedule is the office hours of an instance, during which it should be
+// running, parsed from the value of its schedule tag:
+//
+//	weekdays-08:00-19:00 America/New_York
+//	mon-07:00-12:00 thu-13:00-18:00 Europe/London holidays=uk
+//	daily-22:00-06:00
+//
+// Each period names its days, daily, weekdays, weekends or mon to sun, and
+// the local start and stop times.  A period stopping before it starts runs
+// overnight, into the following day.  The time zone is UTC unless given.
+// On the holidays of the named calendar, "default" unless given, periods do
+// not start; holidays=none keeps no holidays.
+type Schedule struct {
+	periods  []schedulePeriod
+	location *time.Location
+	calendar string
+}
+
+// schedulePeriod is a period of a schedule.  start and stop are local
+// times, in minutes since midnight.
+type schedulePeriod struct {
+	days        [7]bool
+	start, stop int
+}
+
+// ParseSchedule parses the value of a schedule tag.
+func ParseSchedule(value string) (*Schedule, error) {
+	s := &Schedule{location: time.UTC, calendar: defaultCalendar}
+	zone := ""
+	for _, f := range strings.Fields(value) {
+		if name, ok := strings.CutPrefix(f, "holidays="); ok {
+			if name == "" {
+				return nil, fmt.Errorf("invalid schedule %q: holidays names no calendar", value)
+			}
+			s.calendar = name
+			continue
+		}
+		parts := strings.Split(f, "-")
+		if len(parts) != 3 {
+			if zone != "" {
+				return nil, fmt.Errorf("invalid schedule %q: %q is not a period of the form weekdays-08:00-19:00", value, f)
+			}
+			loc, err := time.LoadLocation(f)
+			if err != nil {
+				return nil, fmt.Errorf("invalid schedule %q: %q is neither a period of the form weekdays-08:00-19:00 nor a time zone", value, f)
+			}
+			zone, s.location = f, loc
+			continue
+		}
+		var p schedulePeriod
+		days, ok := scheduleDays[strings.ToLower(parts[0])]
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule %q: unknown days %q; use daily, weekdays, weekends or mon to sun", value, parts[0])
+		}
+		for _, d := range days {
+			p.days[d] = true
+		}
+		var err error
+		if p.start, err = scheduleTime(parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", value, err)
+		}
+		if p.stop, err = scheduleTime(parts[2]); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", value, err)
+		}
+		if p.start == p.stop {
+			return nil, fmt.Errorf("invalid schedule %q: period %s starts and stops at the same time", value, f)
+		}
+		s.periods = append(s.periods, p)
+	}
+	if len(s.periods) == 0 {
+		return nil, fmt.Errorf("invalid schedule %q: no periods, such as weekdays-08:00-19:00", value)
+	}
+	return s, nil
+}
+
+// scheduleTime parses a local time of the form 08:00, returning the minutes
+// since midnight.
+func scheduleTime(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of the form 08:00", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Running reports whether an instance on schedule s should be running at
+// t, given the holiday calendars h.
+func (s *Schedule) Running(t time.Time, h Holidays) bool {
+	local := t.In(s.location)
+	now := local.Hour()*60 + local.Minute()
+	yesterday := local.AddDate(0, 0, -1)
+	for _, p := range s.periods {
+		if p.days[local.Weekday()] && now >= p.start && (p.start > p.stop || now < p.stop) && !s.holiday(local, h) {
+			return true
+		}
+		// the overnight part of a period started the day before
+		if p.start > p.stop && p.days[yesterday.Weekday()] && now < p.stop && !s.holiday(yesterday, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// holiday reports whether the date of local is a holiday of the calendar
+// of s.
+func (s *Schedule) holiday(local time.Time, h Holidays) bool {
+	if s.calendar == noCalendar {
+		return false
+	}
+	date := local.Format(holidayDateFormat)
+	for _, d := range h[s.calendar] {
+		if d == date {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCalendar reports a schedule naming a calendar that h does not hold.
+func (s *Schedule) checkCalendar(h Holidays) error {
+	if s.calendar == noCalendar || s.calendar == defaultCalendar {
+		return nil
+	}
+	if _, ok := h[s.calendar]; !ok {
+		return fmt.Errorf("schedule names holiday calendar %q, which is not defined", s.calendar)
+	}
+	return nil
+}
+
+// holidayDateFormat is the format of the dates of holiday calendars.
+const holidayDateFormat = "2006-01-02"
+
+// Holidays holds named holiday calendars, listing the dates on which the
+// periods of schedules do not start:
+//
+//	{
+//	  "default": ["2024-12-25", "2025-01-01"],
+//	  "uk": ["2024-12-25", "2024-12-26", "2025-01-01"]
+//	}
+//
+// Dates are local to the time zone of each schedule.
+type Holidays map[string][]string
+
+// ParseHolidays parses and checks holiday calendars.
+func ParseHolidays(b []byte) (Holidays, error) {
+	var h Holidays
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, fmt.Errorf("invalid holiday calendars: %v", err)
+	}
+	for name, dates := range h {
+		if name == noCalendar {
+			return nil, fmt.Errorf("invalid holiday calendars: %q is reserved for schedules keeping no holidays", noCalendar)
+		}
+		for _, d := range dates {
+			if _, err := time.Parse(holidayDateFormat, d); err != nil {
+				return nil, fmt.Errorf("invalid holiday calendars: %s: %q is not a date of the form 2024-12-25", name, d)
+			}
+		}
+	}
+	return h, nil
+}
+
+// holidays returns the calendars named by CWL_HOLIDAYS, or none.
+func holidays(ctx context.Context) (Holidays, error) {
+	source := os.Getenv(HolidaysEnvVar)
+	if source == "" {
+		return Holidays{}, nil
+	}
+	b, err := readConfig(ctx, source, "holiday calendars")
+	if err != nil {
+		return nil, err
+	}
+	return ParseHolidays(b)
+}
+
+// ParseHolidaySource splits a calendar location of the form accepted by
+// CWL_HOLIDAYS into its kind, "ssm" or "file", and the parameter name or
+// path.
+func ParseHolidaySource(source string) (kind, location string, err error) {
+	return parseConfigSource(source, "holiday calendars")
+}
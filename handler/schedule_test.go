@@ -0,0 +1,130 @@
+package cwl_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/1414C/cwl/awsfake"
+	"github.com/1414C/cwl/handler"
+)
+
+func TestSchedule(t *testing.T) {
+	holidays, err := cwl.ParseHolidays([]byte(`{"default": ["2024-12-25"], "uk": ["2024-12-26"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		schedule string
+		at       string
+		running  bool
+	}{
+		// Friday 1 March 2024; 07:00 in New York
+		{"weekdays-08:00-19:00 America/New_York", "2024-03-01T12:00:00Z", false},
+		{"weekdays-08:00-19:00 America/New_York", "2024-03-01T13:00:00Z", true},
+		{"weekdays-08:00-19:00 America/New_York", "2024-03-02T13:00:00Z", false},
+		{"weekdays-08:00-19:00", "2024-03-01T18:59:00Z", true},
+		{"weekdays-08:00-19:00", "2024-03-01T19:00:00Z", false},
+		// 08:30 in New York, once daylight saving time has started
+		{"weekdays-08:00-19:00 America/New_York", "2024-03-11T12:30:00Z", true},
+		{"mon-08:00-12:00 thu-13:00-18:00 Europe/London", "2024-03-07T14:00:00Z", true},
+		{"mon-08:00-12:00 thu-13:00-18:00 Europe/London", "2024-03-07T10:00:00Z", false},
+		// overnight, from Friday night into Saturday morning
+		{"fri-22:00-06:00", "2024-03-01T23:00:00Z", true},
+		{"fri-22:00-06:00", "2024-03-02T05:00:00Z", true},
+		{"fri-22:00-06:00", "2024-03-02T23:00:00Z", false},
+		{"weekends-10:00-16:00", "2024-03-03T12:00:00Z", true},
+		// holidays
+		{"daily-08:00-18:00", "2024-12-25T12:00:00Z", false},
+		{"daily-08:00-18:00 holidays=none", "2024-12-25T12:00:00Z", true},
+		{"daily-08:00-18:00 Europe/London holidays=uk", "2024-12-25T12:00:00Z", true},
+		{"daily-08:00-18:00 Europe/London holidays=uk", "2024-12-26T12:00:00Z", false},
+		{"daily-22:00-06:00", "2024-12-25T05:00:00Z", true},
+		{"daily-22:00-06:00", "2024-12-26T05:00:00Z", false},
+	}
+	for _, tt := range tests {
+		s, err := cwl.ParseSchedule(tt.schedule)
+		if err != nil {
+			t.Errorf("%s: %v", tt.schedule, err)
+			continue
+		}
+		at, _ := time.Parse(time.RFC3339, tt.at)
+		if got := s.Running(at, holidays); got != tt.running {
+			t.Errorf("%s at %s: running %v, want %v", tt.schedule, tt.at, got, tt.running)
+		}
+	}
+
+	for _, bad := range []string{"", "America/New_York", "weekdays-9am-5pm", "workdays-08:00-19:00", "daily-08:00-08:00", "daily-08:00-19:00 Mars/Olympus", "daily-08:00-19:00 UTC UTC", "daily-08:00-19:00 holidays="} {
+		if _, err := cwl.ParseSchedule(bad); err == nil {
+			t.Errorf("schedule %q accepted", bad)
+		}
+	}
+	for _, bad := range []string{`["2024-12-25"]`, `{"default": ["25/12/2024"]}`, `{"none": []}`} {
+		if _, err := cwl.ParseHolidays([]byte(bad)); err == nil {
+			t.Errorf("holidays %s accepted", bad)
+		}
+	}
+}
+
+func TestScheduleHolidays(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "holidays.json")
+	if err := os.WriteFile(path, []byte(`{"default": ["2024-12-25"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(cwl.HolidaysEnvVar, "file://"+path)
+	st := awsfake.NewState()
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000f1", State: awsfake.InstanceStopped, Tags: map[string]string{"Schedule": "weekdays-08:00-18:00"}})
+	st.AddInstance(awsfake.Instance{ID: "i-000000000000000f2", State: awsfake.InstanceStopped, Tags: map[string]string{"Schedule": "weekdays-08:00-18:00 holidays=us"}})
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{EC2: awsfake.NewEC2(st), Policy: &cwl.ProtectionPolicy{}})
+	r := cwl.NewRouter()
+
+	// Christmas Day, a Wednesday
+	out, err := r.InvokeHandler(ctx, "EC2InstancesSchedule", []byte(`{"time": "2024-12-25T12:00:00Z"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp cwl.EC2InstancesScheduleResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Started) != 0 || len(resp.Instances) != 2 {
+		t.Fatalf("response %+v, want no instance started", resp)
+	}
+	if si := resp.Instances[0]; si.Desired != "stopped" || si.Action != "" {
+		t.Errorf("instance on holiday %+v, want it left stopped", si)
+	}
+	if si := resp.Instances[1]; si.Error == "" {
+		t.Errorf("instance %+v naming an undefined calendar not reported", si)
+	}
+
+	out, err = r.InvokeHandler(ctx, "EC2InstancesSchedule", []byte(`{"time": "2024-12-27T12:00:00Z"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(out, &resp)
+	if len(resp.Started) != 1 || resp.Started[0] != "i-000000000000000f1" {
+		t.Errorf("started %v, want the instance started after the holiday", resp.Started)
+	}
+
+	t.Setenv(cwl.HolidaysEnvVar, "file://"+filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := r.InvokeHandler(ctx, "EC2InstancesSchedule", []byte(`{}`)); err == nil {
+		t.Error("missing holiday calendars ignored")
+	}
+
+	doc, err := cwl.HandlerPolicy([]string{"EC2InstancesSchedule"}, cwl.PolicyOptions{Holidays: "ssm:///cwl/holidays", Region: "us-west-2", Account: "123456789012"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted := false
+	for _, st := range doc.Statement {
+		for _, a := range st.Action {
+			granted = granted || (a == "ssm:GetParameter" && st.Resource[0] == "arn:aws:ssm:us-west-2:123456789012:parameter/cwl/holidays")
+		}
+	}
+	if !granted {
+		t.Error("ssm:GetParameter not granted on the holiday calendars")
+	}
+}
@@ -0,0 +1,172 @@
+package cwl
+
+//go:generate go run ../cmd/cwl schema -o ../schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSONSchema is a JSON Schema (draft 2020-12) describing an event, so that
+// callers can validate events before invoking a function.
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	ID                   string                 `json:"$id,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	Minimum              *int                   `json:"minimum,omitempty"`
+	Maximum              *int                   `json:"maximum,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+}
+
+// jsonSchemaDraft identifies the JSON Schema version of the schemas.
+const jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// EventSchema returns the JSON Schema of the event accepted by the handler,
+// including the rules of its validate tags, or nil if the handler takes no
+// event.  Properties not declared by the event type or by InvocationMeta
+// are disallowed; Lambda ignores them, but they are usually misspellings.
+func (d HandlerDef) EventSchema() *JSONSchema {
+	t := d.EventType()
+	if t == nil {
+		return nil
+	}
+	s := typeSchema(t)
+	if s.Properties != nil {
+		for name, p := range typeSchema(reflect.TypeOf(InvocationMeta{})).Properties {
+			if _, ok := s.Properties[name]; !ok {
+				s.Properties[name] = p
+			}
+		}
+	}
+	s.Schema = jsonSchemaDraft
+	s.ID = "https://github.com/1414C/cwl/schema/" + d.Name + ".schema.json"
+	s.Title = d.Name + " event"
+	return s
+}
+
+// typeSchema returns the schema of values of type t.
+func typeSchema(t reflect.Type) *JSONSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return &JSONSchema{Type: "string", Format: "date-time"}
+	case t == rawMessageType:
+		return &JSONSchema{}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return &JSONSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: "number"}
+	case reflect.Slice:
+		return &JSONSchema{Type: "array", Items: typeSchema(t.Elem())}
+	case reflect.Map:
+		return &JSONSchema{Type: "object"}
+	case reflect.Struct:
+		no := false
+		s := &JSONSchema{Type: "object", Properties: make(map[string]*JSONSchema), AdditionalProperties: &no}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+				continue
+			}
+			name := jsonName(f)
+			p := typeSchema(f.Type)
+			if applyRules(p, f.Tag.Get("validate")) {
+				s.Required = append(s.Required, name)
+			}
+			s.Properties[name] = p
+		}
+		return s
+	}
+	return &JSONSchema{}
+}
+
+// applyRules adds the constraints of validate rules to the schema of a
+// property, and reports whether the property is required.
+func applyRules(s *JSONSchema, rules string) bool {
+	required := false
+	target := s
+	if s.Type == "array" && s.Items != nil {
+		target = s.Items
+	}
+	for _, rule := range strings.Split(rules, ",") {
+		key, arg, _ := strings.Cut(rule, "=")
+		n, _ := strconv.Atoi(arg)
+		switch key {
+		case "required":
+			required = true
+			switch s.Type {
+			case "string":
+				s.MinLength = intPtr(1)
+			case "array":
+				s.MinItems = intPtr(1)
+			}
+		case "min", "max":
+			bound := intPtr(n)
+			switch {
+			case s.Type == "string" && key == "min":
+				s.MinLength = bound
+			case s.Type == "string":
+				s.MaxLength = bound
+			case s.Type == "array" && key == "min":
+				s.MinItems = bound
+			case s.Type == "array":
+				s.MaxItems = bound
+			case key == "min":
+				s.Minimum = bound
+			default:
+				s.Maximum = bound
+			}
+		case "oneof":
+			target.Enum = strings.Split(arg, "|")
+		case "format":
+			if f, ok := eventFormats[arg]; ok {
+				target.Pattern = f.pattern.String()
+				target.Description = "must be " + f.desc
+			}
+		}
+	}
+
+	// empty optional values are not checked against their format or
+	// values, as in Validate
+	if !required && target == s && s.Type == "string" {
+		if s.Pattern != "" {
+			s.Pattern = "^$|" + s.Pattern
+		}
+		if s.Enum != nil {
+			s.Enum = append([]string{""}, s.Enum...)
+		}
+	}
+	return required
+}
+
+func intPtr(n int) *int {
+	return &n
+}
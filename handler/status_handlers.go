@@ -1,30 +1,30 @@
 package cwl
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/aws/aws-sdk-go/service/ec2"
 	// "github.com/aws/aws-lambda-go/lambda"
-	"log"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/batch"
 )
 
 // JobEvent holds AWS Batch job definition details
 type JobEvent struct {
-	JobName       string `json:"jobName"`
-	JobDefinition string `json:"jobDefinition"`
-	JobQueue      string `json:"jobQueue"`
-	WaitTime      int    `json:"wait_time"`
+	JobName       string `json:"jobName" validate:"required,format=job-name"`
+	JobDefinition string `json:"jobDefinition" validate:"required"`
+	JobQueue      string `json:"jobQueue" validate:"required"`
+	WaitTime      int    `json:"wait_time" validate:"min=0,max=86400"`
 }
 
 // JobGuid is the event input structure containing the
 // one-and-only input parameter for this function.
 type JobGuid struct {
-	JobID string `json:"jobID"`
+	JobID string `json:"jobID" validate:"required,format=uuid"`
 }
 
 // CheckJobFunc3 checks and returns the status of the job
@@ -32,16 +32,17 @@ type JobGuid struct {
 // encountered an empty string and non-nil error are
 // returned.
 // The return string parameter is mapped to:
-// "ResultPath": "%.status" in the State Machine Definition.
-func CheckJobFunc3(event JobGuid) (string, error) {
+// "ResultPath": "$.status" in the State Machine Definition.
+func CheckJobFunc3(ctx context.Context, event JobGuid) (string, error) {
 
-	log.Println("loading function...")
+	logInvocation(ctx)
 
 	// log the received event
-	log.Println("received event:", event)
+	logger(ctx).Info("received event", logKeyJobID, event.JobID)
+	traceAnnotate(ctx, "job_id", event.JobID)
 
-	// create a new batch-session
-	svc := batch.New(session.New())
+	// use the batch client supplied with the context, or a new batch-session
+	svc := batchClient(ctx)
 
 	// setup the input values
 	input := &batch.DescribeJobsInput{
@@ -50,40 +51,55 @@ func CheckJobFunc3(event JobGuid) (string, error) {
 		},
 	}
 
+	// stop short of the Lambda deadline so that an error can be returned
+	// to the State Machine rather than the function being killed.
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
+
 	// get the job status
-	result, err := svc.DescribeJobs(input)
+	result, err := svc.DescribeJobsWithContext(ctx, input)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case batch.ErrCodeClientException:
-				fmt.Println(batch.ErrCodeClientException, aerr.Error())
-			case batch.ErrCodeServerException:
-				fmt.Println(batch.ErrCodeServerException, aerr.Error())
-			default:
-				fmt.Println(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			fmt.Println(err.Error())
-		}
-		return "", err
+		logger(ctx).Error("describe job failed", logKeyJobID, event.JobID, logKeyError, err)
+		return "", deadlineErr(ctx, fmt.Sprintf("describe job %s", event.JobID), err)
 	}
 
-	log.Println("result:", result)
+	logger(ctx).Debug("describe jobs result", "result", result.String())
 
 	// return the job status; JobStatusFailed if no Job found for JobId
 	if len(result.Jobs) > 0 {
 		jobDetail := result.Jobs[0]
+		logger(ctx).Info("job status", logKeyJobID, event.JobID, logKeyJobName, aws.StringValue(jobDetail.JobName), "status", aws.StringValue(jobDetail.Status))
+		jobMetrics(ctx, jobDetail)
+		traceAnnotate(ctx, "job_status", aws.StringValue(jobDetail.Status))
 
 		// return response, nil
 		return *jobDetail.Status, nil
 	}
 
 	// "status": <status>
+	logger(ctx).Warn("job not found", logKeyJobID, event.JobID)
 	return batch.JobStatusFailed, nil
 }
 
+// jobMetrics records the outcome of a job that has reached a final status,
+// and the time it spent queued and running.  The state machine stops
+// polling a job once its status is final, so each outcome is recorded once.
+func jobMetrics(ctx context.Context, job *batch.JobDetail) {
+	status := aws.StringValue(job.Status)
+	if status != batch.JobStatusSucceeded && status != batch.JobStatusFailed {
+		return
+	}
+	m := metrics(ctx)
+	m.count(metricJobsCompleted, 1, "Status", status)
+	created, started, stopped := aws.Int64Value(job.CreatedAt), aws.Int64Value(job.StartedAt), aws.Int64Value(job.StoppedAt)
+	if created > 0 && started >= created {
+		m.add(metricJobQueueTime, unitSeconds, float64(started-created)/1000)
+	}
+	if started > 0 && stopped >= started {
+		m.add(metricJobRunTime, unitSeconds, float64(stopped-started)/1000)
+	}
+}
+
 // SubmitJobFunc3 submits a job to AWS Batch based on the incoming
 // event structure.  The Job must be defined in the AWS batch
 // console (for this one anyway), and is part of the event
@@ -95,15 +111,16 @@ func CheckJobFunc3(event JobGuid) (string, error) {
 //	  "jobQueue": "arn:aws:batch:us-west-2:755561232688:job-queue/SampleJobQueue-40e2ee4d7b7d43b",
 //	  "wait_time": 60
 // }
-func SubmitJobFunc3(event JobEvent) (JobGuid, error) {
+func SubmitJobFunc3(ctx context.Context, event JobEvent) (JobGuid, error) {
 
-	log.Println("loading function...")
+	logInvocation(ctx)
 
 	// log the received event
-	log.Println("received event:", event)
+	logger(ctx).Info("received event", logKeyJobName, event.JobName, "jobQueue", event.JobQueue, "jobDefinition", event.JobDefinition)
+	traceAnnotate(ctx, "job_name", event.JobName)
 
-	// create a new batch-session
-	svc := batch.New(session.New())
+	// use the batch client supplied with the context, or a new batch-session
+	svc := batchClient(ctx)
 
 	// setup the job submission parameters
 	input := &batch.SubmitJobInput{
@@ -112,27 +129,21 @@ func SubmitJobFunc3(event JobEvent) (JobGuid, error) {
 		JobQueue:      &event.JobQueue,
 	}
 
+	// stop short of the Lambda deadline so that an error can be returned
+	// to the State Machine rather than the function being killed.
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
+
 	// submit the job and then check for errors
-	result, err := svc.SubmitJob(input)
+	result, err := svc.SubmitJobWithContext(ctx, input)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case batch.ErrCodeClientException:
-				fmt.Println(batch.ErrCodeClientException, aerr.Error())
-			case batch.ErrCodeServerException:
-				fmt.Println(batch.ErrCodeServerException, aerr.Error())
-			default:
-				fmt.Println(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			fmt.Println(err.Error())
-		}
-		return JobGuid{}, err
+		logger(ctx).Error("submit job failed", logKeyJobName, event.JobName, logKeyError, err)
+		return JobGuid{}, deadlineErr(ctx, fmt.Sprintf("submit job %s", event.JobName), err)
 	}
 
-	log.Println("result:", result)
+	logger(ctx).Info("job submitted", logKeyJobID, aws.StringValue(result.JobId), logKeyJobName, event.JobName)
+	metrics(ctx).count(metricJobsSubmitted, 1)
+	traceAnnotate(ctx, "job_id", aws.StringValue(result.JobId))
 
 	// create the response in the format of:
 	// "guid": {
@@ -149,31 +160,32 @@ func SubmitJobFunc3(event JobEvent) (JobGuid, error) {
 
 // GetEC2InstancesEvent is a test event structure for Lambda->EC2 access.
 type GetEC2InstancesEvent struct {
-	Instance string `json:"instance"`
+	Instance string `json:"instance" validate:"format=instance-id"`
 }
 
 // GetEC2Instances is a test method for Lambda->EC2 AWS SDK access
-func GetEC2Instances(event GetEC2InstancesEvent) (string, error) {
+func GetEC2Instances(ctx context.Context, event GetEC2InstancesEvent) (string, error) {
 
-	log.Println("loading function...")
+	logInvocation(ctx)
 
 	// log the received event
-	log.Println("received event:", event)
+	logger(ctx).Info("received event", logKeyInstances, []string{event.Instance})
 
-	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-west-2")})
+	svc, err := ec2Client(ctx)
 	if err != nil {
 		panic(err)
 	}
 
-	// log.Println("sess:", sess)
-	svc := ec2.New(sess)
+	// stop short of the Lambda deadline rather than being killed mid-call
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
 
 	if event.Instance == "" {
-		result, err := svc.DescribeInstances(nil)
+		result, err := svc.DescribeInstancesWithContext(ctx, nil)
 		if err != nil {
-			return "", fmt.Errorf("%s", err)
+			return "", deadlineErr(ctx, "describe instances", err)
 		}
-		log.Println("Success", result)
+		logger(ctx).Debug("describe instances result", "result", result.String())
 		return result.String(), nil
 	}
 
@@ -183,42 +195,43 @@ func GetEC2Instances(event GetEC2InstancesEvent) (string, error) {
 		InstanceIds: instIds,
 		DryRun:      aws.Bool(false), // convert to *
 	}
-	result, err := svc.DescribeInstances(input)
+	result, err := svc.DescribeInstancesWithContext(ctx, input)
 	if err != nil {
-		return "", fmt.Errorf("%s", err)
+		return "", deadlineErr(ctx, "describe instances", err)
 	}
-	log.Println("Success", result)
+	logger(ctx).Debug("describe instances result", "result", result.String())
 	return result.String(), nil
 
 }
 
 // GetEC2InstancesEvent2 is a test event structure for Lambda->EC2 access.
 type GetEC2InstancesEvent2 struct {
-	Instances []string `json:"instances"`
+	Instances []string `json:"instances" validate:"max=1000,format=instance-id"`
 }
 
 // GetEC2Instances2 is a test method for Lambda->EC2 AWS SDK access
-func GetEC2Instances2(event GetEC2InstancesEvent2) (string, error) {
+func GetEC2Instances2(ctx context.Context, event GetEC2InstancesEvent2) (string, error) {
 
-	log.Println("loading function...")
+	logInvocation(ctx)
 
 	// log the received event
-	log.Println("received event:", event)
+	logger(ctx).Info("received event", logKeyInstances, event.Instances)
 
-	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-west-2")})
+	svc, err := ec2Client(ctx)
 	if err != nil {
 		panic(err)
 	}
 
-	// log.Println("sess:", sess)
-	svc := ec2.New(sess)
+	// stop short of the Lambda deadline rather than being killed mid-call
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
 
 	if event.Instances == nil {
-		result, err := svc.DescribeInstances(nil)
+		result, err := svc.DescribeInstancesWithContext(ctx, nil)
 		if err != nil {
-			return "", fmt.Errorf("%s", err)
+			return "", deadlineErr(ctx, "describe instances", err)
 		}
-		log.Println("Success", result)
+		logger(ctx).Debug("describe instances result", "result", result.String())
 		return result.String(), nil
 	}
 
@@ -233,22 +246,22 @@ func GetEC2Instances2(event GetEC2InstancesEvent2) (string, error) {
 		InstanceIds: instIds,
 		DryRun:      aws.Bool(false), // convert to *
 	}
-	result, err := svc.DescribeInstances(input)
+	result, err := svc.DescribeInstancesWithContext(ctx, input)
 	if err != nil {
-		return "", fmt.Errorf("%s", err)
+		return "", deadlineErr(ctx, "describe instances", err)
 	}
 
 	// log.Printf("Got %d Reservations.\n", len(result.Reservations))
 	if result.Reservations != nil {
 		for _, v := range result.Reservations {
 			if v.Instances != nil {
-				log.Printf("Reservation %v has %d Instances:\n", v.ReservationId, len(v.Instances))
+				logger(ctx).Info("reservation", "reservationId", aws.StringValue(v.ReservationId), "instanceCount", len(v.Instances))
 				for _, vi := range v.Instances {
 					// fmt.Printf("instance-id: %s, instance-type: %s, instance-lifecycle: %s, launch-time: %v\n", *vi.InstanceId, *vi.InstanceType, *vi.InstanceLifecycle, vi.LaunchTime)
-					log.Printf("instance-id: %s, instance-type: %s, launch-time: %v, public-ip: %s\n", *vi.InstanceId, *vi.InstanceType, *vi.LaunchTime, *vi.PublicIpAddress)
+					logger(ctx).Info("instance", logKeyInstances, []string{aws.StringValue(vi.InstanceId)}, "instanceType", aws.StringValue(vi.InstanceType), "launchTime", aws.TimeValue(vi.LaunchTime), "publicIp", aws.StringValue(vi.PublicIpAddress))
 				}
 			} else {
-				log.Printf("Reservation %v has no Instances.\n", v.ReservationId)
+				logger(ctx).Info("reservation has no instances", "reservationId", aws.StringValue(v.ReservationId))
 			}
 		}
 	}
@@ -257,87 +270,157 @@ func GetEC2Instances2(event GetEC2InstancesEvent2) (string, error) {
 }
 
 // GetEC2StatusesEvent is a test event structure for Lambda->EC2 access.
+// Setting MaxResults or NextToken asks for the statuses a page at a time:
+// MaxResults limits the statuses returned to one page of at most that
+// many, and NextToken, the value returned in an earlier response, resumes
+// the retrieval where that response stopped.  MaxResults cannot be used
+// with Instances.
 type GetEC2StatusesEvent struct {
-	Instances []string `json:"instances"`
+	Instances  []string `json:"instances" validate:"max=1000,format=instance-id"`
+	MaxResults int64    `json:"maxResults,omitempty" validate:"min=5,max=1000"`
+	NextToken  string   `json:"nextToken,omitempty"`
+}
+
+// paged reports whether the event asks for the statuses a page at a time.
+func (e GetEC2StatusesEvent) paged() bool {
+	return e.MaxResults > 0 || e.NextToken != ""
+}
+
+// GetEC2StatusesResponse is returned by GetEC2Statuses.  Unless Paged is
+// set, it is encoded in JSON as the bare list of instance statuses, as it
+// was before the statuses could be read a page at a time.  Paged is set in
+// response to an event asking for pages; the response is then encoded as
+// an object, and NextToken, if set, may be passed back in a new
+// GetEC2StatusesEvent to continue where this one stopped.
+// DeadlineApproaching is set if that was because the Lambda deadline
+// approached.
+type GetEC2StatusesResponse struct {
+	InstanceStatuses    []*ec2.InstanceStatus `json:"instanceStatuses"`
+	NextToken           string                `json:"nextToken,omitempty"`
+	DeadlineApproaching bool                  `json:"deadlineApproaching,omitempty"`
+	Paged               bool                  `json:"-"`
+}
+
+// MarshalJSON encodes r as the list of instance statuses, or as an object
+// if r is Paged.
+func (r *GetEC2StatusesResponse) MarshalJSON() ([]byte, error) {
+	if !r.Paged {
+		return json.Marshal(r.InstanceStatuses)
+	}
+	type paged GetEC2StatusesResponse
+	return json.Marshal((*paged)(r))
 }
 
 // GetEC2Statuses is a test function for Lambda->EC2 AWS SDK access,
 // the purpose of which is to write the statuses of the selected EC2
 // instances to stdout.
-func GetEC2Statuses(event GetEC2StatusesEvent) ([]*ec2.InstanceStatus, error) {
+func GetEC2Statuses(ctx context.Context, event GetEC2StatusesEvent) (*GetEC2StatusesResponse, error) {
 
 	// this writes to stdout, and updates the AWS CloudWatch
 	// log stream
-	log.Println("loading function...")
+	logInvocation(ctx)
 
 	// log the received event, this will write the raw event to the
 	// CloudWatch log stream
-	log.Println("received event:", event.Instances)
-
-	// using the IAM credentials asigned to the Lambda function, establish
-	// a session in the 'us-west-2' AWS Region.  If a session cannot be
-	// established, return an empty string and the error returned by the
-	// AWS SDK NewSession(...) method.
-	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-west-2")})
+	logger(ctx).Info("received event", logKeyInstances, event.Instances)
+	traceAnnotate(ctx, "instance_ids", event.Instances)
+
+	// use the EC2 client supplied with the context or, using the IAM
+	// credentials asigned to the Lambda function, establish a session in
+	// the Region of the Lambda function.  If a session cannot be established,
+	// return the error returned by the AWS SDK NewSession(...) method.
+	svc, err := ec2Client(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	// create a new instance of the EC2 client using the 'us-west-2' session
-	svc := ec2.New(sess)
-	if svc == nil {
-		return nil, fmt.Errorf("failed to create EC2 client for us-west-2 session. session.Config follows: %v", sess.Config)
-	}
-
-	// declare a variable to hold the result of the AWS SDK call to
-	// ec2.DescribeInstanceStatus(..)
-	var result *ec2.DescribeInstanceStatusOutput
-
 	// if no EC2 instance names were provided by the event, call the AWS
-	// SDK ec2.DescribeInstanceStatuses method without an instance list
-	// and return the result.  Otherwise, iterate through the slice of
-	// EC2 instances provided in the incoming event and build a slice of
-	// string pointers as required be the the AWS SDK ec2.DescribeInstanceStatusInput
-	// struct.  Next, call the ec2.DescribeInstanceStatuses method with the
-	// input structure to get the statuses of the EC2 instances.  Errors
-	// will be returned to the caller (AWS Lambda runtime).
-	if event.Instances == nil {
-		result, err = svc.DescribeInstanceStatus(nil)
-		if err != nil {
-			return nil, fmt.Errorf("%s", err)
-		}
-	} else {
-		// populate a ec2.DescribeInstanceStatusInput struct based on
-		// the instance-id's.
+	// SDK ec2.DescribeInstanceStatus method without an instance list.
+	// Otherwise, iterate through the slice of EC2 instances provided in
+	// the incoming event and build a slice of string pointers as required
+	// by the AWS SDK ec2.DescribeInstanceStatusInput struct.
+	input := &ec2.DescribeInstanceStatusInput{}
+	if event.Instances != nil {
 		var instIds []*string
 		for _, inst := range event.Instances {
 			instIds = append(instIds, aws.String(inst))
 		}
-
-		input := &ec2.DescribeInstanceStatusInput{
-			InstanceIds:         instIds,
-			IncludeAllInstances: aws.Bool(true),  // include stopped/terminated instances
-			DryRun:              aws.Bool(false), // convert to *
+		input.InstanceIds = instIds
+		input.IncludeAllInstances = aws.Bool(true) // include stopped/terminated instances
+		input.DryRun = aws.Bool(false)             // convert to *
+	}
+	if event.MaxResults > 0 {
+		if event.Instances != nil {
+			return nil, &ValidationError{Event: "GetEC2StatusesEvent", Violations: []Violation{
+				{Field: "maxResults", Message: "cannot be used with instances"},
+			}}
 		}
+		input.MaxResults = aws.Int64(event.MaxResults)
+	}
+	if event.NextToken != "" {
+		input.NextToken = aws.String(event.NextToken)
+	}
 
-		result, err = svc.DescribeInstanceStatus(input)
-		if err != nil {
-			return nil, fmt.Errorf("%s", err)
+	// read the instance statuses a page at a time, stopping early if the
+	// Lambda deadline is approaching.  In that case, if the event asked for
+	// pages, the statuses read so far are returned along with the token
+	// needed to resume.  Errors will be returned to the caller (AWS Lambda
+	// runtime).
+	ctx, cancel := withDeadlineMargin(ctx)
+	defer cancel()
+
+	// trace the reading of the pages as one phase, with a subsegment for
+	// each page request
+	pctx, seg := traceSegment(ctx, "read instance status pages")
+	pages := 0
+	response := &GetEC2StatusesResponse{Paged: event.paged()}
+	// resume is the token of the page following the last page read
+	resume := ""
+	err = svc.DescribeInstanceStatusPagesWithContext(pctx, input, func(page *ec2.DescribeInstanceStatusOutput, lastPage bool) bool {
+		pages++
+		resume = aws.StringValue(page.NextToken)
+		response.InstanceStatuses = append(response.InstanceStatuses, page.InstanceStatuses...)
+		if !lastPage && event.MaxResults > 0 {
+			response.NextToken = aws.StringValue(page.NextToken)
+			return false
+		}
+		if !lastPage && deadlineApproaching(ctx) {
+			response.NextToken = aws.StringValue(page.NextToken)
+			response.DeadlineApproaching = true
+			return false
+		}
+		return true
+	})
+	seg.annotate("pages", pages)
+	seg.close(err)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && pages > 0 {
+			// a page request was interrupted; return what has been read
+			// so far, with the token of the interrupted page so that the
+			// caller can resume from it
+			response.NextToken = resume
+			response.DeadlineApproaching = true
+		} else {
+			return nil, deadlineErr(ctx, "describe instance status", err)
 		}
 	}
-
-	// no error, but no instances were found
-	if result == nil || result.InstanceStatuses == nil {
-		return nil, nil
+	if response.DeadlineApproaching {
+		// the list returned to callers not reading pages cannot say that
+		// it is incomplete
+		if !response.Paged {
+			logger(ctx).Warn("deadline approaching; instance statuses not all read", "read", len(response.InstanceStatuses))
+			return nil, fmt.Errorf("describe instance status: %w after %d statuses; set maxResults or nextToken to read them a page at a time", ErrDeadlineApproaching, len(response.InstanceStatuses))
+		}
+		logger(ctx).Warn("deadline approaching; returning partial instance statuses", "nextToken", response.NextToken)
 	}
 
-	// write the instance statuses to stdout
-	for _, v := range result.InstanceStatuses {
-		log.Printf("instance-id: %s, instance-state: %s, instance-status: %s, system-status: %s\n", *v.InstanceId, *v.InstanceState, *v.InstanceStatus, *v.SystemStatus.Status)
-		log.Printf("system-status: %s\n", *v.SystemStatus.Status)
+	// write the instance statuses to the CloudWatch log stream
+	for _, v := range response.InstanceStatuses {
+		l := logger(ctx).With(logKeyInstances, []string{aws.StringValue(v.InstanceId)})
+		l.Info("instance status", "instanceState", aws.StringValue(v.InstanceState.Name), "instanceStatus", aws.StringValue(v.InstanceStatus.Status), "systemStatus", aws.StringValue(v.SystemStatus.Status))
 		for _, d := range v.SystemStatus.Details {
-			log.Printf("system-status name %v impaired since %v\n", d.Name, d.ImpairedSince)
+			l.Warn("system status impaired", "name", aws.StringValue(d.Name), "impairedSince", aws.TimeValue(d.ImpairedSince))
 		}
 	}
-	return result.InstanceStatuses, nil
+	return response, nil
 }
@@ -0,0 +1,118 @@
+package cwl_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// expiringContext has a distant deadline, but expires when expire is
+// called, as if the deadline had passed.
+type expiringContext struct {
+	context.Context
+	done chan struct{}
+	once sync.Once
+}
+
+func newExpiringContext(parent context.Context) *expiringContext {
+	return &expiringContext{Context: parent, done: make(chan struct{})}
+}
+
+func (c *expiringContext) Deadline() (time.Time, bool) { return time.Now().Add(time.Hour), true }
+func (c *expiringContext) Done() <-chan struct{}       { return c.done }
+func (c *expiringContext) expire()                     { c.once.Do(func() { close(c.done) }) }
+
+func (c *expiringContext) Err() error {
+	select {
+	case <-c.done:
+		return context.DeadlineExceeded
+	default:
+		return nil
+	}
+}
+
+// slowStatusPages returns one page of instance statuses, then expires the
+// invocation context during the request for the next page.
+type slowStatusPages struct {
+	ec2iface.EC2API
+	invocation *expiringContext
+}
+
+func (f *slowStatusPages) DescribeInstanceStatusPagesWithContext(ctx aws.Context, in *ec2.DescribeInstanceStatusInput, fn func(*ec2.DescribeInstanceStatusOutput, bool) bool, _ ...request.Option) error {
+	page := &ec2.DescribeInstanceStatusOutput{
+		InstanceStatuses: []*ec2.InstanceStatus{{
+			InstanceId:     aws.String("i-0000000000000000a"),
+			InstanceState:  &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)},
+			InstanceStatus: &ec2.InstanceStatusSummary{Status: aws.String("ok")},
+			SystemStatus:   &ec2.InstanceStatusSummary{Status: aws.String("ok")},
+		}},
+		NextToken: aws.String("page-2"),
+	}
+	if !fn(page, false) {
+		return nil
+	}
+	f.invocation.expire()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestGetEC2StatusesDeadline(t *testing.T) {
+	invoke := func(event cwl.GetEC2StatusesEvent) ([]byte, error) {
+		svc := &slowStatusPages{}
+		ctx := newExpiringContext(cwl.WithClients(context.Background(), &cwl.Clients{EC2: svc}))
+		svc.invocation = ctx
+		res, err := cwl.GetEC2Statuses(ctx, event)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(res)
+	}
+
+	// a caller reading pages is given the token of the interrupted page
+	out, err := invoke(cwl.GetEC2StatusesEvent{NextToken: "page-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res cwl.GetEC2StatusesResponse
+	if err := json.Unmarshal(out, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.DeadlineApproaching || res.NextToken != "page-2" || len(res.InstanceStatuses) != 1 {
+		t.Errorf("got %s; want deadlineApproaching, nextToken %q and 1 status", out, "page-2")
+	}
+
+	// the list returned to other callers cannot be resumed, so it is not
+	// returned incomplete
+	out, err = invoke(cwl.GetEC2StatusesEvent{})
+	if !errors.Is(err, cwl.ErrDeadlineApproaching) {
+		t.Errorf("got %s, %v; want ErrDeadlineApproaching", out, err)
+	}
+}
+
+func TestGetEC2StatusesShape(t *testing.T) {
+	res := &cwl.GetEC2StatusesResponse{InstanceStatuses: []*ec2.InstanceStatus{{InstanceId: aws.String("i-0000000000000000a")}}}
+	b, _ := json.Marshal(res)
+	if !strings.HasPrefix(string(b), "[") {
+		t.Errorf("response encoded as %s, want a list", b)
+	}
+	res.Paged, res.NextToken = true, "page-2"
+	b, _ = json.Marshal(res)
+	if !strings.HasPrefix(string(b), `{"instanceStatuses":[`) || !strings.Contains(string(b), `"nextToken":"page-2"`) {
+		t.Errorf("paged response encoded as %s", b)
+	}
+
+	_, err := cwl.GetEC2Statuses(context.Background(), cwl.GetEC2StatusesEvent{Instances: []string{"i-0000000000000000a"}, MaxResults: 5})
+	if !errors.As(err, new(*cwl.ValidationError)) {
+		t.Errorf("got %v, want a ValidationError for maxResults with instances", err)
+	}
+}
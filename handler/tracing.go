@@ -0,0 +1,355 @@
+package cwl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// TracingEnvVar names the environment variable that enables AWS X-Ray
+// tracing of the handlers when set to "active".  Active tracing must also
+// be enabled in the Lambda function configuration, so that Lambda samples
+// invocations and runs the X-Ray daemon.
+const TracingEnvVar = "CWL_TRACING"
+
+// xrayDaemonEnvVar names the environment variable holding the UDP address
+// of the X-Ray daemon, which is set by Lambda.
+const xrayDaemonEnvVar = "AWS_XRAY_DAEMON_ADDRESS"
+
+// defaultXRayDaemon is the address of the X-Ray daemon if
+// AWS_XRAY_DAEMON_ADDRESS is not set.
+const defaultXRayDaemon = "127.0.0.1:2000"
+
+// xrayHeader precedes each segment document sent to the X-Ray daemon.
+const xrayHeader = `{"format": "json", "version": 1}` + "\n"
+
+// tracingEnabled reports whether CWL_TRACING enables tracing.
+func tracingEnabled() bool {
+	return strings.EqualFold(os.Getenv(TracingEnvVar), "active")
+}
+
+// segmentDoc is an X-Ray segment document.  Subsegments are sent to the
+// daemon as independent documents naming their parent.
+type segmentDoc struct {
+	Name        string                 `json:"name"`
+	ID          string                 `json:"id"`
+	TraceID     string                 `json:"trace_id"`
+	ParentID    string                 `json:"parent_id,omitempty"`
+	Type        string                 `json:"type,omitempty"`
+	Origin      string                 `json:"origin,omitempty"`
+	Namespace   string                 `json:"namespace,omitempty"`
+	StartTime   float64                `json:"start_time"`
+	EndTime     float64                `json:"end_time"`
+	Error       bool                   `json:"error,omitempty"`
+	Fault       bool                   `json:"fault,omitempty"`
+	Throttle    bool                   `json:"throttle,omitempty"`
+	Cause       *segmentCause          `json:"cause,omitempty"`
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+	AWS         map[string]interface{} `json:"aws,omitempty"`
+	HTTP        map[string]interface{} `json:"http,omitempty"`
+}
+
+type segmentCause struct {
+	Exceptions []segmentException `json:"exceptions"`
+}
+
+type segmentException struct {
+	ID      string `json:"id"`
+	Type    string `json:"type,omitempty"`
+	Message string `json:"message"`
+	Remote  bool   `json:"remote,omitempty"`
+}
+
+// segment is an X-Ray segment or subsegment in progress.  The methods of a
+// nil *segment do nothing, so that code can be traced unconditionally.
+type segment struct {
+	mu   sync.Mutex
+	doc  segmentDoc
+	conn net.Conn
+
+	// req is the AWS SDK request traced by the subsegment, if any
+	req *request.Request
+}
+
+// segmentKey is the context key for the current *segment.
+type segmentKey struct{}
+
+// segmentFrom returns the segment carried by ctx, or nil.
+func segmentFrom(ctx context.Context) *segment {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(segmentKey{}).(*segment)
+	return s
+}
+
+// withTrace returns a copy of ctx carrying a subsegment for the invocation
+// of a handler, if tracing is enabled and the invocation is sampled.  The
+// subsegment is a child of the function segment recorded by Lambda.  An
+// invocation without a trace header, such as a local one, is recorded as a
+// segment of a new trace.
+func withTrace(ctx context.Context, inv invocation) (context.Context, *segment) {
+	if !tracingEnabled() {
+		return ctx, nil
+	}
+	traceID, parentID, sampled := parseTraceHeader(traceHeader(ctx))
+	if !sampled {
+		return ctx, nil
+	}
+	addr := os.Getenv(xrayDaemonEnvVar)
+	if addr == "" {
+		addr = defaultXRayDaemon
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		logger(ctx).Warn("unable to reach the X-Ray daemon", logKeyError, err)
+		return ctx, nil
+	}
+	s := &segment{conn: conn, doc: segmentDoc{
+		Name:      inv.handler,
+		ID:        newSegmentID(),
+		TraceID:   traceID,
+		ParentID:  parentID,
+		StartTime: epochSeconds(time.Now()),
+	}}
+	if traceID == "" {
+		s.doc.TraceID = newTraceID(time.Now())
+		s.doc.Origin = "AWS::Lambda::Function"
+	} else {
+		s.doc.Type = "subsegment"
+	}
+	s.annotate("handler", inv.handler)
+	s.annotate("correlation_id", inv.correlationID)
+	return context.WithValue(ctx, segmentKey{}, s), s
+}
+
+// traceHeader returns the X-Ray trace header of the invocation, which the
+// Lambda runtime supplies with the context and the _X_AMZN_TRACE_ID
+// environment variable.
+func traceHeader(ctx context.Context) string {
+	if h, ok := ctx.Value("x-amzn-trace-id").(string); ok && h != "" {
+		return h
+	}
+	return os.Getenv("_X_AMZN_TRACE_ID")
+}
+
+// parseTraceHeader returns the trace and parent segment IDs of a trace
+// header of the form Root=1-...;Parent=...;Sampled=1, and whether the
+// trace is sampled.  An empty header is sampled, with no trace ID.
+func parseTraceHeader(h string) (traceID, parentID string, sampled bool) {
+	if h == "" {
+		return "", "", true
+	}
+	for _, part := range strings.Split(h, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "Root":
+			traceID = v
+		case "Parent":
+			parentID = v
+		case "Sampled":
+			sampled = v == "1"
+		}
+	}
+	return traceID, parentID, sampled && traceID != ""
+}
+
+// traceSegment returns a copy of ctx carrying a new subsegment named name
+// of the segment carried by ctx, for timing a phase of a handler.  If ctx
+// is not traced the subsegment is nil.
+func traceSegment(ctx context.Context, name string) (context.Context, *segment) {
+	parent := segmentFrom(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	parent.mu.Lock()
+	s := &segment{conn: parent.conn, doc: segmentDoc{
+		Name:      name,
+		ID:        newSegmentID(),
+		TraceID:   parent.doc.TraceID,
+		ParentID:  parent.doc.ID,
+		Type:      "subsegment",
+		StartTime: epochSeconds(time.Now()),
+	}}
+	parent.mu.Unlock()
+	return context.WithValue(ctx, segmentKey{}, s), s
+}
+
+// traceAnnotate adds an annotation to the segment carried by ctx.
+func traceAnnotate(ctx context.Context, key string, value interface{}) {
+	segmentFrom(ctx).annotate(key, value)
+}
+
+// annotate adds an indexed annotation to the segment.  Lists of strings
+// are recorded as comma-separated strings, since annotation values must be
+// strings, numbers or booleans.
+func (s *segment) annotate(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if ss, ok := value.([]string); ok {
+		value = strings.Join(ss, ",")
+	}
+	if v, ok := value.(string); ok && v == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.doc.Annotations == nil {
+		s.doc.Annotations = make(map[string]interface{})
+	}
+	s.doc.Annotations[key] = value
+}
+
+// close ends the segment, records err if it is not nil, and sends the
+// segment to the X-Ray daemon.  err is recorded as a fault unless the
+// segment has been marked as a client error.
+func (s *segment) close(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.doc.EndTime = epochSeconds(time.Now())
+	if err != nil {
+		var aerr awserr.Error
+		s.doc.Fault = !s.doc.Error
+		e := segmentException{ID: newSegmentID(), Type: errorTypeName(err), Message: err.Error()}
+		if errors.As(err, &aerr) {
+			e.Type = aerr.Code()
+			e.Remote = true
+		}
+		s.doc.Cause = &segmentCause{Exceptions: []segmentException{e}}
+	}
+	b, jerr := json.Marshal(s.doc)
+	if jerr != nil {
+		return
+	}
+	s.conn.Write(append([]byte(xrayHeader), b...))
+}
+
+// closeTrace closes the segment of an invocation and its connection to
+// the X-Ray daemon.
+func closeTrace(s *segment, err error) {
+	if s == nil {
+		return
+	}
+	s.close(err)
+	s.conn.Close()
+}
+
+// errorTypeName returns the name of the type of err, as reported by Lambda.
+func errorTypeName(err error) string {
+	t := reflect.TypeOf(err)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// epochSeconds returns t in fractional seconds since the epoch.
+func epochSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// newSegmentID returns a random 64-bit segment ID in hex.
+func newSegmentID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newTraceID returns a new X-Ray trace ID for a trace starting at t.
+func newTraceID(t time.Time) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return fmt.Sprintf("1-%08x-%s", t.Unix(), hex.EncodeToString(b))
+}
+
+// The AWS SDK request handlers that record each AWS API call as an X-Ray
+// subsegment of the segment carried by the request context, and pass the
+// trace header on to the service.
+var (
+	traceStartHandler = request.NamedHandler{Name: "cwl.traceStart", Fn: func(r *request.Request) {
+		ctx, s := traceSegment(r.Context(), r.ClientInfo.ServiceID)
+		if s == nil {
+			return
+		}
+		s.req = r
+		s.doc.Namespace = "aws"
+		for k, v := range requestAnnotations(r.Params) {
+			s.annotate(k, v)
+		}
+		r.SetContext(ctx)
+	}}
+	traceHeaderHandler = request.NamedHandler{Name: "cwl.traceHeader", Fn: func(r *request.Request) {
+		if s := segmentFrom(r.Context()); s != nil && s.req == r {
+			r.HTTPRequest.Header.Set("X-Amzn-Trace-Id", fmt.Sprintf("Root=%s;Parent=%s;Sampled=1", s.doc.TraceID, s.doc.ID))
+		}
+	}}
+	traceEndHandler = request.NamedHandler{Name: "cwl.traceEnd", Fn: func(r *request.Request) {
+		s := segmentFrom(r.Context())
+		if s == nil || s.req != r {
+			return
+		}
+		s.mu.Lock()
+		s.doc.AWS = map[string]interface{}{
+			"operation":  r.Operation.Name,
+			"region":     aws.StringValue(r.Config.Region),
+			"request_id": r.RequestID,
+			"retries":    r.RetryCount,
+		}
+		if r.HTTPResponse != nil {
+			status := r.HTTPResponse.StatusCode
+			s.doc.HTTP = map[string]interface{}{"response": map[string]interface{}{"status": status}}
+			s.doc.Throttle = status == 429 || request.IsErrorThrottle(r.Error)
+			s.doc.Error = status >= 400 && status < 500
+		}
+		s.mu.Unlock()
+		s.close(r.Error)
+	}}
+)
+
+// requestAnnotations returns the instance, command and job IDs among the
+// parameters of an AWS API call.
+func requestAnnotations(params interface{}) map[string]interface{} {
+	v := reflect.ValueOf(params)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	a := make(map[string]interface{})
+	for field, key := range map[string]string{
+		"InstanceIds": "instance_ids",
+		"CommandId":   "command_id",
+		"JobId":       "job_id",
+		"Jobs":        "job_ids",
+	} {
+		switch f := v.FieldByName(field); f.Kind() {
+		case reflect.Ptr:
+			if s, ok := f.Interface().(*string); ok && s != nil {
+				a[key] = *s
+			}
+		case reflect.Slice:
+			if ss, ok := f.Interface().([]*string); ok && len(ss) > 0 {
+				a[key] = aws.StringValueSlice(ss)
+			}
+		}
+	}
+	return a
+}
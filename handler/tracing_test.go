@@ -0,0 +1,97 @@
+package cwl_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/1414C/cwl/awsfake"
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	testTraceID = "1-65e1c340-0123456789abcdef01234567"
+	testParent  = "53995c3f42cd8ad8"
+)
+
+// tracedEnv enables tracing to an X-Ray daemon stand-in, and returns a
+// context for invocations sampled by Lambda with EC2 calls served by an
+// awsfake.Server.  The invocations are not subject to a protection policy,
+// so that only the calls taking the actions are traced.
+func tracedEnv(t *testing.T, sampled string) (*awsfake.XRayDaemon, *awsfake.State, context.Context) {
+	t.Helper()
+	d, err := awsfake.NewXRayDaemon()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	t.Setenv(cwl.TracingEnvVar, "active")
+	t.Setenv("AWS_XRAY_DAEMON_ADDRESS", d.Addr())
+	os.Unsetenv("_X_AMZN_TRACE_ID")
+
+	st := awsfake.NewState()
+	srv := awsfake.NewServer(st)
+	t.Cleanup(srv.Close)
+	ctx := cwl.WithClients(context.Background(), &cwl.Clients{EC2: ec2.New(srv.Session()), Policy: &cwl.ProtectionPolicy{}})
+	ctx = context.WithValue(ctx, "x-amzn-trace-id", "Root="+testTraceID+";Parent="+testParent+";Sampled="+sampled)
+	return d, st, ctx
+}
+
+func TestTracing(t *testing.T) {
+	d, st, ctx := tracedEnv(t, "1")
+	st.AddInstance(awsfake.Instance{ID: "i-0000000000000007a", State: awsfake.InstanceStopped})
+
+	if _, err := cwl.NewRouter().InvokeHandler(ctx, "EC2InstancesStart", []byte(`{"instances": ["i-0000000000000007a"], "correlationId": "c-7"}`)); err != nil {
+		t.Fatal(err)
+	}
+	segs := d.WaitFor(2, time.Second)
+	if len(segs) != 2 || d.Invalid() != 0 {
+		t.Fatalf("got %d segments and %d invalid datagrams, want 2 segments", len(segs), d.Invalid())
+	}
+	h, call := segs[0], segs[1]
+	if h.Name != "EC2InstancesStart" || h.Type != "subsegment" || h.TraceID != testTraceID || h.ParentID != testParent {
+		t.Errorf("handler segment %+v is not a subsegment of the function segment", h)
+	}
+	if h.Annotations["instance_ids"] != "i-0000000000000007a" || h.Annotations["correlation_id"] != "c-7" || h.Fault {
+		t.Errorf("handler segment %+v", h)
+	}
+	if call.Name != "EC2" || call.Namespace != "aws" || call.ParentID != h.ID || call.TraceID != testTraceID ||
+		call.AWS["operation"] != "StartInstances" || call.Annotations["instance_ids"] != "i-0000000000000007a" {
+		t.Errorf("API call segment %+v", call)
+	}
+	if call.StartTime < h.StartTime || call.EndTime > h.EndTime {
+		t.Errorf("API call %v-%v is outside the handler %v-%v", call.StartTime, call.EndTime, h.StartTime, h.EndTime)
+	}
+}
+
+func TestTracingErrors(t *testing.T) {
+	d, _, ctx := tracedEnv(t, "1")
+
+	if _, err := cwl.NewRouter().InvokeHandler(ctx, "EC2InstancesStart", []byte(`{"instances": ["i-000000000000000ff"]}`)); err == nil {
+		t.Fatal("start of an unknown instance succeeded")
+	}
+	segs := d.WaitFor(2, time.Second)
+	if len(segs) != 2 {
+		t.Fatalf("got %d segments, want 2", len(segs))
+	}
+	if h := segs[0]; !h.Fault || h.Cause == nil {
+		t.Errorf("handler segment %+v is not a fault", h)
+	}
+	if call := segs[1]; !call.Error || call.Fault || call.Cause == nil {
+		t.Errorf("API call segment %+v is not a client error", call)
+	}
+}
+
+func TestTracingNotSampled(t *testing.T) {
+	d, st, ctx := tracedEnv(t, "0")
+	st.AddInstance(awsfake.Instance{ID: "i-0000000000000007b"})
+
+	if _, err := cwl.NewRouter().InvokeHandler(ctx, "EC2InstancesStop", []byte(`{"instances": ["i-0000000000000007b"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if segs := d.WaitFor(1, 100*time.Millisecond); len(segs) != 0 {
+		t.Errorf("got %d segments for an unsampled invocation", len(segs))
+	}
+}
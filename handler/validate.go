@@ -0,0 +1,239 @@
+package cwl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// Event fields are validated against the rules in their "validate" struct
+// tag before the event is passed to the handler.  The rules are separated
+// by commas:
+//
+//	required      the field must be present and non-empty
+//	min=N, max=N  the length of a string or list, or the value of a number
+//	oneof=a|b     the value, or each member of a list, must be a or b
+//	format=F      the value, or each member of a list, must match the
+//	              named format; see eventFormats
+//
+// Empty optional values are not checked against min, oneof or format.
+// For example:
+//
+//	Instances []string `json:"instances" validate:"required,max=50,format=instance-id"`
+
+// eventFormat is a named format of event string values.
+type eventFormat struct {
+	pattern *regexp.Regexp
+	desc    string
+}
+
+// eventFormats are the formats that may be named in validate tags.
+var eventFormats = map[string]eventFormat{
+	"instance-id": {regexp.MustCompile(`^i-([0-9a-f]{8}|[0-9a-f]{17})$`), "an EC2 instance ID (i-xxxxxxxx or i-xxxxxxxxxxxxxxxxx)"},
+	"uuid":        {regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`), "a UUID"},
+	"job-name":    {regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,127}$`), "a Batch job name of up to 128 letters, numbers, hyphens and underscores"},
+}
+
+// Violation is a single failed validation rule.
+type Violation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned, in place of calling the handler, for an
+// event that breaks the rules declared on its type.  It lists every
+// violation found, and is reported by Lambda with errorType
+// ValidationError.
+type ValidationError struct {
+	Event      string      `json:"event"`
+	Violations []Violation `json:"violations"`
+}
+
+func (e *ValidationError) Error() string {
+	var msgs []string
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.Field+": "+v.Message)
+	}
+	return fmt.Sprintf("invalid %s: %s", e.Event, strings.Join(msgs, "; "))
+}
+
+// Validate checks event, a struct or pointer to a struct, against the rules
+// in the validate tags of its fields.  It returns a *ValidationError
+// listing every violation, or nil.
+func Validate(event interface{}) error {
+	v := reflect.ValueOf(event)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	var violations []Violation
+	validateStruct(v, "", &violations)
+	if len(violations) == 0 {
+		return nil
+	}
+	return &ValidationError{Event: v.Type().Name(), Violations: violations}
+}
+
+// validateStruct appends the violations of the fields of v, naming them
+// with prefix.
+func validateStruct(v reflect.Value, prefix string, violations *[]Violation) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := prefix + jsonName(f)
+		fv := v.Field(i)
+		for _, rule := range strings.Split(f.Tag.Get("validate"), ",") {
+			if rule == "" {
+				continue
+			}
+			if msg := checkRule(rule, fv); msg != "" {
+				*violations = append(*violations, Violation{Field: name, Message: msg})
+			}
+		}
+		if fv.Kind() == reflect.Struct {
+			validateStruct(fv, name+".", violations)
+		}
+	}
+}
+
+// checkRule returns a description of the violation of rule by v, or "".
+func checkRule(rule string, v reflect.Value) string {
+	key, arg, _ := strings.Cut(rule, "=")
+	switch key {
+	case "required":
+		if v.IsZero() || (v.Kind() == reflect.Slice && v.Len() == 0) {
+			return "is required"
+		}
+	case "min", "max":
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			panic(fmt.Sprintf("cwl: invalid validate rule %q", rule))
+		}
+		size, unit, ok := measure(v)
+		if !ok || v.IsZero() {
+			return ""
+		}
+		if key == "min" && size < n {
+			return fmt.Sprintf("must be at least %d%s", n, unit)
+		}
+		if key == "max" && size > n {
+			return fmt.Sprintf("must be at most %d%s", n, unit)
+		}
+	case "oneof":
+		allowed := strings.Split(arg, "|")
+		var bad []string
+		for _, s := range stringValues(v) {
+			if !containsString(allowed, s) {
+				bad = append(bad, strconv.Quote(s))
+			}
+		}
+		if len(bad) > 0 {
+			return fmt.Sprintf("%s: must be one of %s", strings.Join(bad, ", "), strings.Join(allowed, ", "))
+		}
+	case "format":
+		format, ok := eventFormats[arg]
+		if !ok {
+			panic(fmt.Sprintf("cwl: unknown format in validate rule %q", rule))
+		}
+		var bad []string
+		for _, s := range stringValues(v) {
+			if !format.pattern.MatchString(s) {
+				bad = append(bad, strconv.Quote(s))
+			}
+		}
+		if len(bad) > 0 {
+			return fmt.Sprintf("%s: must be %s", strings.Join(bad, ", "), format.desc)
+		}
+	default:
+		panic(fmt.Sprintf("cwl: unknown validate rule %q", rule))
+	}
+	return ""
+}
+
+// measure returns the length of a string or list, or the value of a number,
+// with the unit of the length.  ok is false for other kinds.
+func measure(v reflect.Value) (size int, unit string, ok bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return v.Len(), " characters long", true
+	case reflect.Slice:
+		return v.Len(), " members long", true
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return int(v.Int()), "", true
+	}
+	return 0, "", false
+}
+
+// stringValues returns the non-empty string value of v, or the members of
+// a list of strings.
+func stringValues(v reflect.Value) []string {
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() > 0 {
+			return []string{v.String()}
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			var ss []string
+			for i := 0; i < v.Len(); i++ {
+				ss = append(ss, v.Index(i).String())
+			}
+			return ss
+		}
+	}
+	return nil
+}
+
+// jsonName returns the name of a field in JSON.
+func jsonName(f reflect.StructField) string {
+	if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" && name != "-" {
+		return name
+	}
+	return f.Name
+}
+
+// EventType returns the type of the event accepted by the handler, or nil
+// if the handler takes no event.
+func (d HandlerDef) EventType() reflect.Type {
+	t := reflect.TypeOf(d.Fn)
+	if t.NumIn() == 0 {
+		return nil
+	}
+	et := t.In(t.NumIn() - 1)
+	if et.Implements(reflect.TypeOf((*context.Context)(nil)).Elem()) {
+		return nil
+	}
+	return et
+}
+
+// validatingHandler validates the event decoded from each payload before
+// passing the payload to the handler.  A payload that cannot be decoded is
+// passed on, so that the handler reports the decoding error as usual.
+type validatingHandler struct {
+	handler   lambda.Handler
+	eventType reflect.Type
+}
+
+func (h *validatingHandler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	ev := reflect.New(h.eventType)
+	if err := json.Unmarshal(payload, ev.Interface()); err == nil {
+		if err := Validate(ev.Interface()); err != nil {
+			return nil, err
+		}
+	}
+	return h.handler.Invoke(ctx, payload)
+}
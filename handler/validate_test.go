@@ -0,0 +1,101 @@
+package cwl_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/1414C/cwl/handler"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		event interface{}
+		want  []cwl.Violation
+	}{
+		{cwl.EC2InstancesStopEvent{Instances: []string{"i-0123456789abcdef0", "i-01234567"}}, nil},
+		{cwl.EC2InstancesStopEvent{}, []cwl.Violation{{Field: "instances", Message: "is required"}}},
+		{&cwl.EC2IssueCmdEvent{Instances: []string{"web-1"}, Cmd: "uptime"}, []cwl.Violation{
+			{Field: "instances", Message: `"web-1": must be an EC2 instance ID (i-xxxxxxxx or i-xxxxxxxxxxxxxxxxx)`},
+		}},
+		{cwl.EC2IssueCmdEvent{Instances: make([]string, 51), Cmd: "uptime"}, []cwl.Violation{
+			{Field: "instances", Message: "must be at most 50 members long"},
+			{Field: "instances", Message: `"", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "": must be an EC2 instance ID (i-xxxxxxxx or i-xxxxxxxxxxxxxxxxx)`},
+		}},
+		{cwl.JobGuid{JobID: "job-1"}, []cwl.Violation{{Field: "jobID", Message: `"job-1": must be a UUID`}}},
+		{cwl.JobEvent{JobName: "report", JobDefinition: "report:1", JobQueue: "jobs", WaitTime: 90000}, []cwl.Violation{
+			{Field: "wait_time", Message: "must be at most 86400"},
+		}},
+		{cwl.GetEC2StatusesEvent{}, nil},
+	} {
+		err := cwl.Validate(tc.event)
+		var verr *cwl.ValidationError
+		if tc.want == nil {
+			if err != nil {
+				t.Errorf("%T: unexpected error %v", tc.event, err)
+			}
+			continue
+		}
+		if !errors.As(err, &verr) {
+			t.Errorf("%T: got %v, want a ValidationError", tc.event, err)
+			continue
+		}
+		if !reflect.DeepEqual(verr.Violations, tc.want) {
+			t.Errorf("%T: got violations %q, want %q", tc.event, verr.Violations, tc.want)
+		}
+	}
+}
+
+// TestRouterHandler checks that the single-function binaries, which serve
+// one handler through Router.Handler, validate its events.
+func TestRouterHandler(t *testing.T) {
+	h := cwl.NewRouter().Handler("EC2InstancesStop")
+	_, err := h.Invoke(context.Background(), []byte(`{"action": "GetEC2Statuses", "instances": ["web-1"]}`))
+	var verr *cwl.ValidationError
+	if !errors.As(err, &verr) || verr.Event != "EC2InstancesStopEvent" {
+		t.Errorf("got %v, want a ValidationError of the EC2InstancesStop event", err)
+	}
+}
+
+// TestEventSchemas checks that the schema of every handler's event declares
+// each property, and that its patterns agree with Validate.
+func TestEventSchemas(t *testing.T) {
+	for _, def := range cwl.Handlers() {
+		s := def.EventSchema()
+		if s == nil {
+			t.Errorf("%s: no event schema", def.Name)
+			continue
+		}
+		if s.Type != "object" || len(s.Properties) == 0 {
+			t.Errorf("%s: schema is not an object with properties", def.Name)
+		}
+		for name, p := range s.Properties {
+			if p.Items != nil {
+				p = p.Items
+			}
+			if p.Pattern != "" {
+				if _, err := regexp.Compile(p.Pattern); err != nil {
+					t.Errorf("%s: property %s: %v", def.Name, name, err)
+				}
+			}
+		}
+	}
+
+	s := mustLookup(t, "EC2InstancesStart").EventSchema()
+	re := regexp.MustCompile(s.Properties["instances"].Items.Pattern)
+	for id, valid := range map[string]bool{"i-0123456789abcdef0": true, "i-01234567": true, "web-1": false, "i-0123": false} {
+		if re.MatchString(id) != valid {
+			t.Errorf("schema pattern matches %s: %v, want %v", id, !valid, valid)
+		}
+	}
+}
+
+func mustLookup(t *testing.T, name string) cwl.HandlerDef {
+	def, ok := cwl.LookupHandler(name)
+	if !ok {
+		t.Fatalf("%s is not registered", name)
+	}
+	return def
+}
@@ -6,5 +6,5 @@ import (
 )
 
 func main() {
-	lambda.Start(cwl.CheckJobFunc3)
+	lambda.Start(cwl.NewRouter().Handler("CheckJobFunc3"))
 }
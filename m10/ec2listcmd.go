@@ -6,5 +6,5 @@ import (
 )
 
 func main() {
-	lambda.Start(cwl.EC2ListCmd)
+	lambda.Start(cwl.NewRouter().Handler("EC2ListCmd"))
 }
@@ -6,5 +6,5 @@ import (
 )
 
 func main() {
-	lambda.Start(cwl.SubmitJobFunc3)
+	lambda.Start(cwl.NewRouter().Handler("SubmitJobFunc3"))
 }
@@ -6,5 +6,5 @@ import (
 )
 
 func main() {
-	lambda.Start(cwl.GetEC2Instances2)
+	lambda.Start(cwl.NewRouter().Handler("GetEC2Instances2"))
 }
@@ -6,5 +6,5 @@ import (
 )
 
 func main() {
-	lambda.Start(cwl.GetEC2Statuses)
+	lambda.Start(cwl.NewRouter().Handler("GetEC2Statuses"))
 }
@@ -6,5 +6,5 @@ import (
 )
 
 func main() {
-	lambda.Start(cwl.EC2InstancesStart)
+	lambda.Start(cwl.NewRouter().Handler("EC2InstancesStart"))
 }
@@ -1,6 +1,4 @@
 export AWS_PROFILE=smacleod
+ARCH=$(../pkglambda.sh EC2InstancesStop) || exit 1
 aws lambda delete-function --function-name EC2InstancesStop
-GOOS=linux go build -o main ec2instancestop.go
-chmod 555 main
-zip deployment.zip ./main
-aws lambda create-function --region us-west-2 --function-name EC2InstancesStop --memory 128 --role arn:aws:iam::907538708243:role/LambdaEC2Access --runtime go1.x --zip-file fileb:///Users/stevem/gowork/src/github.com/1414C/cwl/m7/deployment.zip --handler main
\ No newline at end of file
+aws lambda create-function --region us-west-2 --function-name EC2InstancesStop --memory 128 --role arn:aws:iam::907538708243:role/LambdaEC2Access --runtime provided.al2023 --architectures $ARCH --zip-file fileb:///Users/stevem/gowork/src/github.com/1414C/cwl/m7/deployment.zip --handler bootstrap
\ No newline at end of file
@@ -6,5 +6,5 @@ import (
 )
 
 func main() {
-	lambda.Start(cwl.EC2InstancesStop)
+	lambda.Start(cwl.NewRouter().Handler("EC2InstancesStop"))
 }
@@ -6,5 +6,5 @@ import (
 )
 
 func main() {
-	lambda.Start(cwl.EC2InstancesReboot)
+	lambda.Start(cwl.NewRouter().Handler("EC2InstancesReboot"))
 }
@@ -0,0 +1,15 @@
+export AWS_PROFILE=smacleod
+JOB_FUNCTIONS="CheckJobFunc3 SubmitJobFunc3"
+EC2_FUNCTIONS="GetEC2Instances GetEC2Instances2 GetEC2Statuses EC2InstancesStart EC2InstancesStop EC2InstancesReboot EC2IssueCmd EC2ListCmd"
+ARCH=$(../pkglambda.sh $JOB_FUNCTIONS $EC2_FUNCTIONS) || exit 1
+
+# deploy the same artifact to every function, selecting the handler with CWL_HANDLER
+for fn in $JOB_FUNCTIONS; do
+	aws lambda delete-function --function-name $fn
+	aws lambda create-function --region us-west-2 --function-name $fn --memory 128 --role arn:aws:iam::907538708243:role/SimpleJobSubmissionAndStatus --runtime provided.al2023 --architectures $ARCH --zip-file fileb:///Users/stevem/gowork/src/github.com/1414C/cwl/mrouter/deployment.zip --handler bootstrap --environment Variables={CWL_HANDLER=$fn}
+done
+
+for fn in $EC2_FUNCTIONS; do
+	aws lambda delete-function --function-name $fn
+	aws lambda create-function --region us-west-2 --function-name $fn --memory 128 --role arn:aws:iam::907538708243:role/LambdaEC2Access --runtime provided.al2023 --architectures $ARCH --zip-file fileb:///Users/stevem/gowork/src/github.com/1414C/cwl/mrouter/deployment.zip --handler bootstrap --environment Variables={CWL_HANDLER=$fn}
+done
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"github.com/1414C/cwl/handler"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// main serves every registered cwl function from a single binary.  The
+// handler is selected per-function via the CWL_HANDLER environment
+// variable, or per-event via the "action" field.
+func main() {
+	lambda.Start(cwl.NewRouter())
+}
@@ -0,0 +1,86 @@
+#!/bin/sh
+# pkglambda.sh builds the main package in the current directory as a
+# "bootstrap" binary for the provided.al2023 Lambda runtime and packages it
+# in deployment.zip.  The Lambda architecture (arm64 or x86_64) is written
+# to stdout so that the calling cwbldlambda.sh script can pass it on to
+# aws lambda create-function.
+#
+# usage: ../pkglambda.sh [function-name ...]
+#
+# The target architecture is taken from $ARCH if set (arm64, x86_64 or
+# amd64), otherwise from the configuration in AWS Lambda of the named
+# functions, otherwise arm64.  The packaged binary is checked and refused
+# if its GOOS is not linux, or its GOARCH does not match the architecture
+# configured for each named function that already exists.
+set -e
+
+# read the architecture configured for the existing functions
+FUNCTION_ARCH=
+FUNCTION=
+for fn in "$@"; do
+	fn_arch=$(aws lambda get-function-configuration --function-name "$fn" --query 'Architectures[0]' --output text 2>/dev/null || true)
+	case "$fn_arch" in
+	"" | None)
+		continue
+		;;
+	esac
+	if [ -n "$FUNCTION_ARCH" ] && [ "$fn_arch" != "$FUNCTION_ARCH" ]; then
+		echo "pkglambda.sh: $FUNCTION is configured for $FUNCTION_ARCH but $fn for $fn_arch; package them separately" >&2
+		exit 1
+	fi
+	FUNCTION_ARCH=$fn_arch
+	FUNCTION=$fn
+done
+
+ARCH=${ARCH:-$FUNCTION_ARCH}
+
+case "${ARCH:-arm64}" in
+arm64)
+	GOARCH=arm64
+	LAMBDA_ARCH=arm64
+	;;
+amd64 | x86_64)
+	GOARCH=amd64
+	LAMBDA_ARCH=x86_64
+	;;
+*)
+	echo "pkglambda.sh: unsupported architecture '$ARCH'" >&2
+	exit 1
+	;;
+esac
+
+rm -f bootstrap deployment.zip
+GOOS=linux GOARCH=$GOARCH CGO_ENABLED=0 go build -tags lambda.norpc -o bootstrap . >&2
+
+# refuse to package a binary built for a different platform than the target
+# functions; go version -m reports the GOOS/GOARCH recorded at build time,
+# which is compared with the architecture configured in AWS Lambda rather
+# than with the one requested here.
+BUILT_GOOS=$(go version -m bootstrap | awk '$1 == "build" && $2 ~ /^GOOS=/ { sub("GOOS=", "", $2); print $2 }')
+BUILT_GOARCH=$(go version -m bootstrap | awk '$1 == "build" && $2 ~ /^GOARCH=/ { sub("GOARCH=", "", $2); print $2 }')
+case "$FUNCTION_ARCH" in
+"")
+	WANT_GOARCH=$GOARCH
+	;;
+arm64)
+	WANT_GOARCH=arm64
+	;;
+x86_64)
+	WANT_GOARCH=amd64
+	;;
+*)
+	echo "pkglambda.sh: $FUNCTION has unsupported architecture '$FUNCTION_ARCH'" >&2
+	rm -f bootstrap
+	exit 1
+	;;
+esac
+if [ "$BUILT_GOOS" != "linux" ] || [ "$BUILT_GOARCH" != "$WANT_GOARCH" ]; then
+	echo "pkglambda.sh: bootstrap was built for $BUILT_GOOS/$BUILT_GOARCH but ${FUNCTION:-the target function} requires linux/$WANT_GOARCH; refusing to package" >&2
+	echo "pkglambda.sh: to change the architecture of a function, delete it before packaging" >&2
+	rm -f bootstrap
+	exit 1
+fi
+
+chmod 555 bootstrap
+zip -q deployment.zip ./bootstrap >&2
+echo "$LAMBDA_ARCH"
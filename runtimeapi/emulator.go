@@ -0,0 +1,498 @@
+// Package runtimeapi emulates the AWS Lambda Runtime API so that compiled
+// cwl function binaries can be tested end-to-end on the local machine,
+// including the event and response serialization performed by lambda.Start.
+//
+// The emulator launches the binary with AWS_LAMBDA_RUNTIME_API pointing at
+// a local server implementing the /runtime/invocation/next, response and
+// error endpoints, hands it one event per Invoke, and collects the response
+// or error.  As in Lambda, the function is killed if it exceeds its timeout
+// or memory size, and restarted (a cold start) on the next invocation.
+package runtimeapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/1414C/cwl/deploy"
+)
+
+// errors types reported by the emulator, as reported by AWS Lambda
+const (
+	ErrorTypeTimeout      = "Sandbox.Timedout"
+	ErrorTypeOutOfMemory  = "Runtime.OutOfMemory"
+	ErrorTypeExit         = "Runtime.ExitError"
+	ErrorTypeInit         = "Runtime.InitError"
+	ErrorTypeResponseSize = "Function.ResponseSizeTooLarge"
+)
+
+const (
+	// initTimeout limits the time taken by the function to initialize and
+	// request its first event.
+	initTimeout = 10 * time.Second
+
+	// maxResponseSize is the largest response payload Lambda accepts for
+	// a synchronous invocation.
+	maxResponseSize = 6 * 1024 * 1024
+)
+
+// Config describes the function run by the emulator.
+type Config struct {
+	// Name is the function name reported to the binary.
+	Name string
+
+	// Binary is the path of the compiled bootstrap executable.
+	Binary string
+
+	// Region, Memory (MB) and Timeout have the meaning of the function
+	// configuration settings.
+	Region  string
+	Memory  int
+	Timeout time.Duration
+
+	// Env holds the environment variables of the function configuration.
+	Env map[string]string
+
+	// Tracing marks each invocation as sampled for X-Ray, as Lambda does
+	// for functions with active tracing.  The segments are sent to the
+	// daemon named by AWS_XRAY_DAEMON_ADDRESS in Env.
+	Tracing bool
+
+	// Log receives the output of the function and the START, END and
+	// REPORT lines of each invocation; the default is os.Stderr.
+	Log io.Writer
+}
+
+// ConfigFromManifest returns the configuration of the function described by
+// a manifest, run from the given binary.
+func ConfigFromManifest(m *deploy.Manifest, binary string) Config {
+	return Config{
+		Name:    m.Name,
+		Binary:  binary,
+		Region:  m.Region,
+		Memory:  int(m.Memory),
+		Timeout: time.Duration(m.Timeout) * time.Second,
+		Env:     m.Env(),
+		Tracing: m.Tracing,
+	}
+}
+
+// ErrorResponse is the error returned by a failed invocation, in the form
+// returned by the Lambda Invoke API.
+type ErrorResponse struct {
+	Message    string          `json:"errorMessage"`
+	Type       string          `json:"errorType,omitempty"`
+	StackTrace json.RawMessage `json:"stackTrace,omitempty"`
+}
+
+func (e *ErrorResponse) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+// Result is the outcome of an invocation.  Exactly one of Payload and Error
+// is set.
+type Result struct {
+	RequestID     string          `json:"requestId"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	Error         *ErrorResponse  `json:"error,omitempty"`
+	Duration      time.Duration   `json:"duration"`
+	InitDuration  time.Duration   `json:"initDuration,omitempty"`
+	MaxMemoryUsed int             `json:"maxMemoryUsed"`
+}
+
+// BilledDuration returns the duration rounded up to the millisecond, as
+// billed by Lambda.
+func (r *Result) BilledDuration() time.Duration {
+	return r.Duration.Truncate(time.Millisecond) + time.Millisecond
+}
+
+// invocation is an event waiting for, or being processed by, the function.
+type invocation struct {
+	id        string
+	payload   []byte
+	timeout   time.Duration
+	delivered chan time.Time
+	done      chan *Result
+}
+
+// Emulator runs a function binary against a local Runtime API server.  An
+// Emulator processes one invocation at a time.
+type Emulator struct {
+	cfg Config
+	ln  net.Listener
+	srv *http.Server
+
+	invokeMu sync.Mutex // serializes Invoke
+
+	mu      sync.Mutex
+	proc    *process
+	current *invocation
+	next    chan *invocation
+	initErr *ErrorResponse
+}
+
+// New starts the Runtime API server for the function described by cfg.  The
+// binary is launched by the first Invoke.
+func New(cfg Config) (*Emulator, error) {
+	if cfg.Binary == "" {
+		return nil, fmt.Errorf("no function binary specified")
+	}
+	if cfg.Name == "" {
+		cfg.Name = "function"
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-west-2"
+	}
+	if cfg.Memory == 0 {
+		cfg.Memory = 128
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 3 * time.Second
+	}
+	if cfg.Log == nil {
+		cfg.Log = os.Stderr
+	}
+	// the output of the binary is copied to the log by os/exec, while the
+	// emulator writes its own lines
+	cfg.Log = &syncWriter{w: cfg.Log}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	e := &Emulator{
+		cfg:  cfg,
+		ln:   ln,
+		next: make(chan *invocation, 1),
+	}
+	e.srv = &http.Server{Handler: e.routes()}
+	go e.srv.Serve(ln)
+	return e, nil
+}
+
+// Addr returns the host:port of the Runtime API server, the value given to
+// the function in AWS_LAMBDA_RUNTIME_API.
+func (e *Emulator) Addr() string {
+	return e.ln.Addr().String()
+}
+
+// Close stops the function and the Runtime API server.
+func (e *Emulator) Close() error {
+	e.mu.Lock()
+	p := e.proc
+	e.proc = nil
+	e.mu.Unlock()
+	if p != nil {
+		p.kill()
+	}
+	return e.srv.Close()
+}
+
+// Invoke passes payload to the function and waits for its response.  A
+// function error, timeout, crash or memory exhaustion is reported in the
+// Error of the Result; the returned error is for failures of the emulator
+// itself, such as being unable to launch the binary, or ctx being done.
+func (e *Emulator) Invoke(ctx context.Context, payload []byte) (*Result, error) {
+	e.invokeMu.Lock()
+	defer e.invokeMu.Unlock()
+
+	inv := &invocation{
+		id:        requestID(),
+		payload:   payload,
+		timeout:   e.cfg.Timeout,
+		delivered: make(chan time.Time, 1),
+		done:      make(chan *Result, 1),
+	}
+
+	p, cold, err := e.process()
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	e.current = inv
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		e.current = nil
+		e.mu.Unlock()
+	}()
+	e.next <- inv
+	fmt.Fprintf(e.cfg.Log, "START RequestId: %s Version: $LATEST\n", inv.id)
+
+	// wait for the function to take the event
+	var start time.Time
+	select {
+	case start = <-inv.delivered:
+	case <-p.exited:
+		e.drain()
+		res := e.failure(inv, time.Now(), ErrorTypeExit, "Runtime exited with error: %v", p.err)
+		if ierr := e.takeInitErr(); ierr != nil {
+			res.Error = ierr
+		}
+		return e.report(res, p, cold), nil
+	case <-time.After(initTimeout):
+		e.drain()
+		p.kill()
+		return e.report(e.failure(inv, time.Now(), ErrorTypeInit, "init timed out after %.2f seconds", initTimeout.Seconds()), p, cold), nil
+	case <-ctx.Done():
+		e.drain()
+		p.kill()
+		return nil, ctx.Err()
+	}
+
+	timer := time.NewTimer(inv.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-inv.done:
+		res.Duration = time.Since(start)
+		return e.report(res, p, cold), nil
+	case <-timer.C:
+		p.kill()
+		return e.report(e.failure(inv, start, ErrorTypeTimeout, "Task timed out after %.2f seconds", inv.timeout.Seconds()), p, cold), nil
+	case <-p.oom:
+		p.kill()
+		return e.report(e.failure(inv, start, ErrorTypeOutOfMemory, "Runtime exited with error: signal: killed"), p, cold), nil
+	case <-p.exited:
+		return e.report(e.failure(inv, start, ErrorTypeExit, "Runtime exited with error: %v", p.err), p, cold), nil
+	case <-ctx.Done():
+		p.kill()
+		return nil, ctx.Err()
+	}
+}
+
+// drain removes an undelivered invocation from the queue.
+func (e *Emulator) drain() {
+	select {
+	case <-e.next:
+	default:
+	}
+}
+
+// failure returns the Result of an invocation ended by the emulator.
+func (e *Emulator) failure(inv *invocation, start time.Time, typ, format string, args ...interface{}) *Result {
+	return &Result{
+		RequestID: inv.id,
+		Duration:  time.Since(start),
+		Error: &ErrorResponse{
+			Type:    typ,
+			Message: fmt.Sprintf("RequestId: %s Error: %s", inv.id, fmt.Sprintf(format, args...)),
+		},
+	}
+}
+
+// report completes the Result with the init duration and memory used, and
+// writes the END and REPORT lines to the log.
+func (e *Emulator) report(res *Result, p *process, cold bool) *Result {
+	if cold {
+		res.InitDuration = p.initDuration()
+	}
+	res.MaxMemoryUsed = p.maxRSS()
+	fmt.Fprintf(e.cfg.Log, "END RequestId: %s\n", res.RequestID)
+	line := fmt.Sprintf("REPORT RequestId: %s\tDuration: %.2f ms\tBilled Duration: %d ms\tMemory Size: %d MB\tMax Memory Used: %d MB",
+		res.RequestID, float64(res.Duration)/float64(time.Millisecond), res.BilledDuration().Milliseconds(), e.cfg.Memory, res.MaxMemoryUsed)
+	if cold {
+		line += fmt.Sprintf("\tInit Duration: %.2f ms", float64(res.InitDuration)/float64(time.Millisecond))
+	}
+	fmt.Fprintln(e.cfg.Log, line)
+	return res
+}
+
+// process returns the running function process, launching it if necessary.
+// cold reports whether the process was launched for this invocation.
+func (e *Emulator) process() (*process, bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.proc != nil && !e.proc.hasExited() {
+		return e.proc, false, nil
+	}
+	e.initErr = nil
+	p, err := startProcess(e.cfg, e.Addr())
+	if err != nil {
+		return nil, false, err
+	}
+	e.proc = p
+	return p, true, nil
+}
+
+// takeInitErr returns and clears the error reported to /init/error.
+func (e *Emulator) takeInitErr() *ErrorResponse {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	err := e.initErr
+	e.initErr = nil
+	return err
+}
+
+// environ returns the environment of the function process.
+func environ(cfg Config, addr string) []string {
+	env := map[string]string{
+		"AWS_LAMBDA_RUNTIME_API":          addr,
+		"AWS_LAMBDA_FUNCTION_NAME":        cfg.Name,
+		"AWS_LAMBDA_FUNCTION_VERSION":     "$LATEST",
+		"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": fmt.Sprint(cfg.Memory),
+		"AWS_LAMBDA_LOG_GROUP_NAME":       "/aws/lambda/" + cfg.Name,
+		"AWS_LAMBDA_LOG_STREAM_NAME":      time.Now().UTC().Format("2006/01/02") + "/[$LATEST]local",
+		"AWS_REGION":                      cfg.Region,
+		"AWS_DEFAULT_REGION":              cfg.Region,
+		"_HANDLER":                        "bootstrap",
+		"TZ":                              ":UTC",
+		"PATH":                            os.Getenv("PATH"),
+		"HOME":                            os.Getenv("HOME"),
+	}
+
+	// pass the caller's credentials through so the function can call AWS
+	for _, k := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_CONFIG_FILE", "AWS_SHARED_CREDENTIALS_FILE"} {
+		if v, ok := os.LookupEnv(k); ok {
+			env[k] = v
+		}
+	}
+	for k, v := range cfg.Env {
+		env[k] = v
+	}
+	var out []string
+	for k, v := range env {
+		out = append(out, k+"="+v)
+	}
+	return out
+}
+
+// process is a running function binary.
+type process struct {
+	cmd     *exec.Cmd
+	started time.Time
+	memory  int // limit in MB
+
+	mu        sync.Mutex
+	firstNext time.Time
+	maxKB     int
+	err       error
+
+	exited chan struct{}
+	oom    chan struct{}
+}
+
+// startProcess launches the function binary and begins monitoring its
+// memory use.
+func startProcess(cfg Config, addr string) (*process, error) {
+	cmd := exec.Command(cfg.Binary)
+	cmd.Env = environ(cfg, addr)
+	cmd.Stdout = cfg.Log
+	cmd.Stderr = cfg.Log
+	p := &process{
+		cmd:    cmd,
+		memory: cfg.Memory,
+		exited: make(chan struct{}),
+		oom:    make(chan struct{}),
+	}
+	p.started = time.Now()
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to launch %s: %v", cfg.Binary, err)
+	}
+	go func() {
+		err := cmd.Wait()
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+		close(p.exited)
+	}()
+	go p.watchMemory()
+	return p, nil
+}
+
+// watchMemory samples the resident set size of the process until it exits,
+// recording the maximum and signalling when the memory size is exceeded.
+// Sampling relies on /proc, so memory is neither reported nor enforced on
+// platforms other than Linux.
+func (p *process) watchMemory() {
+	t := time.NewTicker(5 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.exited:
+			return
+		case <-t.C:
+		}
+		kb, err := residentKB(p.cmd.Process.Pid)
+		if err != nil {
+			continue
+		}
+		p.mu.Lock()
+		if kb > p.maxKB {
+			p.maxKB = kb
+		}
+		p.mu.Unlock()
+		if kb > p.memory*1024 {
+			close(p.oom)
+			return
+		}
+	}
+}
+
+// maxRSS returns the largest resident set size observed, in MB.
+func (p *process) maxRSS() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return (p.maxKB + 1023) / 1024
+}
+
+// initDuration returns the time from launch until the first event was
+// requested.
+func (p *process) initDuration() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.firstNext.IsZero() {
+		return time.Since(p.started)
+	}
+	return p.firstNext.Sub(p.started)
+}
+
+// hasExited reports whether the process has exited.
+func (p *process) hasExited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// kill stops the process and waits for it to exit.
+func (p *process) kill() {
+	if !p.hasExited() {
+		p.cmd.Process.Kill()
+	}
+	<-p.exited
+}
+
+// requestID returns a random UUID in the form used for Lambda request-ids.
+func requestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// errResponseTooLarge is reported when a response exceeds maxResponseSize.
+var errResponseTooLarge = errors.New("response payload size exceeded maximum allowed payload size")
+
+// syncWriter serializes the writes to w.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
@@ -0,0 +1,145 @@
+package runtimeapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// testFunctionEnvVar makes the test binary act as the function binary.
+const testFunctionEnvVar = "RUNTIMEAPI_TEST_FUNCTION"
+
+type testEvent struct {
+	Op string `json:"op"`
+	MB int    `json:"mb"`
+}
+
+var ballast [][]byte
+
+func testFunction(ctx context.Context, e testEvent) (testEvent, error) {
+	switch e.Op {
+	case "fail":
+		return e, errors.New("failed as requested")
+	case "sleep":
+		time.Sleep(time.Minute)
+	case "alloc":
+		for i := 0; i < e.MB; i++ {
+			b := make([]byte, 1<<20)
+			for j := range b {
+				b[j] = 1
+			}
+			ballast = append(ballast, b)
+		}
+		time.Sleep(time.Second)
+	case "exit":
+		os.Exit(3)
+	}
+	return e, nil
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testFunctionEnvVar) != "" {
+		lambda.Start(testFunction)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func newTestEmulator(t *testing.T, memory int) (*Emulator, *bytes.Buffer) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := &bytes.Buffer{}
+	e, err := New(Config{
+		Name:    "test",
+		Binary:  exe,
+		Memory:  memory,
+		Timeout: time.Second,
+		Env:     map[string]string{testFunctionEnvVar: "1"},
+		Log:     log,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e, log
+}
+
+func invoke(t *testing.T, e *Emulator, payload string) *Result {
+	t.Helper()
+	res, err := e.Invoke(context.Background(), []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestInvoke(t *testing.T) {
+	e, log := newTestEmulator(t, 128)
+
+	res := invoke(t, e, `{"op":"echo"}`)
+	if res.Error != nil || string(res.Payload) != `{"op":"echo","mb":0}` {
+		t.Fatalf("got %s %v", res.Payload, res.Error)
+	}
+	if res.InitDuration == 0 {
+		t.Error("first invocation was not a cold start")
+	}
+
+	res = invoke(t, e, `{"op":"fail"}`)
+	if res.Error == nil || res.Error.Message != "failed as requested" || res.Error.Type != "errorString" {
+		t.Fatalf("got %s %v", res.Payload, res.Error)
+	}
+	if res.InitDuration != 0 {
+		t.Error("second invocation was a cold start")
+	}
+	if !strings.Contains(log.String(), "REPORT RequestId: "+res.RequestID) {
+		t.Errorf("no REPORT line in log:\n%s", log)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	e, _ := newTestEmulator(t, 128)
+	res := invoke(t, e, `{"op":"sleep"}`)
+	if res.Error == nil || res.Error.Type != ErrorTypeTimeout {
+		t.Fatalf("got %s %v", res.Payload, res.Error)
+	}
+	if !strings.Contains(res.Error.Message, "Task timed out after 1.00 seconds") {
+		t.Errorf("message %q", res.Error.Message)
+	}
+
+	// the function is restarted for the next invocation
+	res = invoke(t, e, `{"op":"echo"}`)
+	if res.Error != nil || res.InitDuration == 0 {
+		t.Fatalf("got %s %v, init %v", res.Payload, res.Error, res.InitDuration)
+	}
+}
+
+func TestExit(t *testing.T) {
+	e, _ := newTestEmulator(t, 128)
+	res := invoke(t, e, `{"op":"exit"}`)
+	if res.Error == nil || res.Error.Type != ErrorTypeExit {
+		t.Fatalf("got %s %v", res.Payload, res.Error)
+	}
+}
+
+func TestOutOfMemory(t *testing.T) {
+	if _, err := residentKB(os.Getpid()); err != nil {
+		t.Skip("memory use is not available on this platform")
+	}
+	e, _ := newTestEmulator(t, 128)
+	res := invoke(t, e, `{"op":"alloc","mb":256}`)
+	if res.Error == nil || res.Error.Type != ErrorTypeOutOfMemory {
+		t.Fatalf("got %s %v", res.Payload, res.Error)
+	}
+	if res.MaxMemoryUsed <= 128 {
+		t.Errorf("max memory used %d MB", res.MaxMemoryUsed)
+	}
+}
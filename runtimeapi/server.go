@@ -0,0 +1,154 @@
+package runtimeapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// runtimeAPIPrefix is the path prefix of the Runtime API endpoints.
+const runtimeAPIPrefix = "/2018-06-01/runtime/"
+
+// routes returns the handler serving the Runtime API endpoints:
+//
+//	GET  /2018-06-01/runtime/invocation/next
+//	POST /2018-06-01/runtime/invocation/{request-id}/response
+//	POST /2018-06-01/runtime/invocation/{request-id}/error
+//	POST /2018-06-01/runtime/init/error
+func (e *Emulator) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(runtimeAPIPrefix+"invocation/next", e.handleNext)
+	mux.HandleFunc(runtimeAPIPrefix+"invocation/", e.handleResult)
+	mux.HandleFunc(runtimeAPIPrefix+"init/error", e.handleInitError)
+	return mux
+}
+
+// handleNext blocks until an event is available and returns it with the
+// invocation headers.
+func (e *Emulator) handleNext(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "InvalidRequest", "method not allowed")
+		return
+	}
+	e.mu.Lock()
+	if p := e.proc; p != nil {
+		p.mu.Lock()
+		if p.firstNext.IsZero() {
+			p.firstNext = time.Now()
+		}
+		p.mu.Unlock()
+	}
+	e.mu.Unlock()
+
+	select {
+	case inv := <-e.next:
+		deadline := time.Now().Add(inv.timeout)
+		h := w.Header()
+		h.Set("Content-Type", "application/json")
+		h.Set("Lambda-Runtime-Aws-Request-Id", inv.id)
+		h.Set("Lambda-Runtime-Deadline-Ms", fmt.Sprint(deadline.UnixNano()/int64(time.Millisecond)))
+		h.Set("Lambda-Runtime-Invoked-Function-Arn", fmt.Sprintf("arn:aws:lambda:%s:000000000000:function:%s", e.cfg.Region, e.cfg.Name))
+		h.Set("Lambda-Runtime-Trace-Id", traceID(e.cfg.Tracing))
+		w.WriteHeader(http.StatusOK)
+		w.Write(inv.payload)
+		inv.delivered <- time.Now()
+	case <-r.Context().Done():
+	}
+}
+
+// handleResult accepts the response or error for the current invocation.
+func (e *Emulator) handleResult(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, runtimeAPIPrefix+"invocation/")
+	parts := strings.Split(rest, "/")
+	if r.Method != http.MethodPost || len(parts) != 2 || (parts[1] != "response" && parts[1] != "error") {
+		apiError(w, http.StatusNotFound, "InvalidRequest", "unknown endpoint")
+		return
+	}
+	id, kind := parts[0], parts[1]
+
+	e.mu.Lock()
+	inv := e.current
+	e.mu.Unlock()
+	if inv == nil || inv.id != id {
+		apiError(w, http.StatusBadRequest, "InvalidRequestID", "Invalid request ID")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxResponseSize+1))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	res := &Result{RequestID: id}
+	switch {
+	case kind == "error":
+		res.Error = decodeError(body, r.Header.Get("Lambda-Runtime-Function-Error-Type"))
+	case len(body) > maxResponseSize:
+		res.Error = &ErrorResponse{Type: ErrorTypeResponseSize, Message: errResponseTooLarge.Error()}
+		apiError(w, http.StatusRequestEntityTooLarge, ErrorTypeResponseSize, errResponseTooLarge.Error())
+		inv.complete(res)
+		return
+	default:
+		res.Payload = body
+	}
+	inv.complete(res)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"status":"OK"}`))
+}
+
+// handleInitError records an error reported by the function before it
+// requested its first event.
+func (e *Emulator) handleInitError(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, http.StatusMethodNotAllowed, "InvalidRequest", "method not allowed")
+		return
+	}
+	body, _ := io.ReadAll(io.LimitReader(r.Body, maxResponseSize))
+	e.mu.Lock()
+	e.initErr = decodeError(body, r.Header.Get("Lambda-Runtime-Function-Error-Type"))
+	e.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"status":"OK"}`))
+}
+
+// complete delivers the result of the invocation, once.
+func (inv *invocation) complete(res *Result) {
+	select {
+	case inv.done <- res:
+	default:
+	}
+}
+
+// decodeError parses an error posted by the function.  The error type is
+// taken from the body or, failing that, the error-type header.
+func decodeError(body []byte, typ string) *ErrorResponse {
+	e := &ErrorResponse{}
+	if err := json.Unmarshal(body, e); err != nil {
+		e.Message = string(body)
+	}
+	if e.Type == "" {
+		e.Type = typ
+	}
+	return e
+}
+
+// apiError writes a Runtime API error response.
+func apiError(w http.ResponseWriter, status int, typ, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ErrorResponse{Type: typ, Message: msg})
+}
+
+// traceID returns an X-Ray trace header for an invocation, marked as
+// sampled or not.
+func traceID(sampled bool) string {
+	id := requestID()
+	s := 0
+	if sampled {
+		s = 1
+	}
+	return fmt.Sprintf("Root=1-%08x-%s;Parent=%s;Sampled=%d", time.Now().Unix(), strings.ReplaceAll(id, "-", "")[:24], strings.ReplaceAll(id, "-", "")[16:32], s)
+}
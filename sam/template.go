@@ -0,0 +1,412 @@
+// Package sam generates an AWS SAM (CloudFormation) template describing the
+// cwl Lambda functions, their IAM roles, triggers and the Step Functions
+// state machine used to drive AWS Batch jobs.
+package sam
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/1414C/cwl/asl"
+	"github.com/1414C/cwl/deploy"
+	"github.com/1414C/cwl/handler"
+)
+
+// Template is a CloudFormation template in JSON form.
+type Template map[string]interface{}
+
+// Options controls the generation of the template.
+type Options struct {
+	// CodeURI is the location of the router main package relative to the
+	// template; "sam build" compiles it for every function.
+	CodeURI string
+
+	// Architecture of the functions that have no manifest.
+	Architecture string
+
+	// Tags scopes the tag-aware actions of the generated IAM policies.
+	Tags map[string]string
+}
+
+// defaults for handlers without a function manifest
+const (
+	defaultCodeURI      = "mrouter/"
+	defaultArchitecture = "arm64"
+	defaultMemory       = 128
+	defaultTimeout      = 10
+)
+
+// nonAlnum matches the characters that are not permitted in logical-ids
+var nonAlnum = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+// Generate builds a SAM template containing a function and IAM role for
+// every registered cwl handler.  Where a manifest exists for a handler, its
+// function name, memory, timeout, environment, alias and triggers are used;
+// handlers without a manifest are given a function of the same name with
+// the default settings.  The template also contains the state machines of
+// the Batch submit/check and instance command workflows, and the table used
+// by the callback handlers.
+func Generate(manifests []*deploy.Manifest, opts Options) (Template, error) {
+	if opts.CodeURI == "" {
+		opts.CodeURI = defaultCodeURI
+	}
+	if opts.Architecture == "" {
+		opts.Architecture = defaultArchitecture
+	}
+
+	byHandler := make(map[string][]*deploy.Manifest)
+	for _, m := range manifests {
+		if _, ok := cwl.LookupHandler(m.Handler); !ok {
+			return nil, fmt.Errorf("manifest for %s names unknown handler %q", m.Name, m.Handler)
+		}
+		byHandler[m.Handler] = append(byHandler[m.Handler], m)
+	}
+
+	resources := make(map[string]interface{})
+	outputs := make(map[string]interface{})
+	functionIDs := make(map[string]string) // handler name -> function logical-id
+
+	for _, d := range cwl.Handlers() {
+		ms := byHandler[d.Name]
+		if len(ms) == 0 {
+			ms = []*deploy.Manifest{{
+				Name:         d.Name,
+				Handler:      d.Name,
+				Memory:       defaultMemory,
+				Timeout:      defaultTimeout,
+				Architecture: opts.Architecture,
+			}}
+		}
+		for _, m := range ms {
+			id := logicalID(m.Name)
+			if _, dup := resources[id+"Function"]; dup {
+				return nil, fmt.Errorf("more than one manifest for function %s", m.Name)
+			}
+			policy, err := cwl.HandlerPolicy([]string{d.Name}, cwl.PolicyOptions{
+				Region:           "${AWS::Region}",
+				Account:          "${AWS::AccountId}",
+				Tags:             opts.Tags,
+				Tracing:          m.Tracing,
+				AuditSink:        m.Audit,
+				ProtectionPolicy: m.Policy,
+				Approvals:        m.Approvals,
+				Holidays:         m.Holidays,
+				Queues:           m.Queues(),
+			})
+			if err != nil {
+				return nil, err
+			}
+			if kind, table, err := cwl.ParseAuditSink(m.Audit); err == nil && kind == "dynamodb" {
+				resources["AuditTable"+logicalID(table)] = auditTable(table)
+			}
+			resources[id+"Role"] = role(policy)
+			resources[id+"Function"] = function(m, id, opts)
+			for k, v := range triggerResources(m, id) {
+				resources[k] = v
+			}
+			outputs[id+"FunctionArn"] = map[string]interface{}{
+				"Value": getAtt(id+"Function", "Arn"),
+			}
+			if _, ok := functionIDs[d.Name]; !ok {
+				functionIDs[d.Name] = id + "Function"
+			}
+		}
+	}
+
+	resources["BatchJobStateMachine"] = stateMachine("cwl-batch-job",
+		asl.BatchJob("${SubmitJobFunc3Arn}", "${CheckJobFunc3Arn}"),
+		functionIDs, "SubmitJobFunc3", "CheckJobFunc3")
+	resources["InstanceCommandStateMachine"] = stateMachine("cwl-instance-command",
+		asl.InstanceCommand("${EC2InstancesStartCallbackArn}", "${EC2IssueCmdCallbackArn}"),
+		functionIDs, "EC2InstancesStartCallback", "EC2IssueCmdCallback")
+	resources["CallbackTable"] = keyTable("cwl-callbacks")
+	resources["IdempotencyTable"] = keyTable("cwl-idempotency")
+	for _, id := range []string{"BatchJobStateMachine", "InstanceCommandStateMachine"} {
+		outputs[id+"Arn"] = map[string]interface{}{
+			"Value": ref(id),
+		}
+	}
+
+	return Template{
+		"AWSTemplateFormatVersion": "2010-09-09",
+		"Transform":                "AWS::Serverless-2016-10-31",
+		"Description":              "cwl Lambda functions and workflows",
+		"Resources":                resources,
+		"Outputs":                  outputs,
+	}, nil
+}
+
+// function returns the AWS::Serverless::Function resource for a manifest.
+func function(m *deploy.Manifest, id string, opts Options) map[string]interface{} {
+	props := map[string]interface{}{
+		"FunctionName":  m.Name,
+		"CodeUri":       opts.CodeURI,
+		"Handler":       "bootstrap",
+		"Runtime":       "provided.al2023",
+		"Architectures": []string{m.Architecture},
+		"MemorySize":    m.Memory,
+		"Timeout":       m.Timeout,
+		"Role":          getAtt(id+"Role", "Arn"),
+		"Environment": map[string]interface{}{
+			"Variables": m.Env(),
+		},
+	}
+	if m.Description != "" {
+		props["Description"] = m.Description
+	}
+	if m.TriggerAlias != "" {
+		props["AutoPublishAlias"] = m.TriggerAlias
+	}
+	if m.Tracing {
+		props["Tracing"] = "Active"
+	}
+	if events := samEvents(m); len(events) > 0 {
+		props["Events"] = events
+	}
+	return map[string]interface{}{
+		"Type":       "AWS::Serverless::Function",
+		"Properties": props,
+		"Metadata": map[string]interface{}{
+			"BuildMethod": "go1.x",
+		},
+	}
+}
+
+// role returns an AWS::IAM::Role resource assumable by AWS Lambda with the
+// given policy attached.
+func role(policy *cwl.PolicyDocument) map[string]interface{} {
+	var statements []interface{}
+	for _, st := range policy.Statement {
+		var resources []interface{}
+		for _, r := range st.Resource {
+			if strings.Contains(r, "${") {
+				resources = append(resources, map[string]interface{}{"Fn::Sub": r})
+			} else {
+				resources = append(resources, r)
+			}
+		}
+		s := map[string]interface{}{
+			"Sid":      st.Sid,
+			"Effect":   st.Effect,
+			"Action":   st.Action,
+			"Resource": resources,
+		}
+		if st.Condition != nil {
+			s["Condition"] = st.Condition
+		}
+		statements = append(statements, s)
+	}
+
+	return map[string]interface{}{
+		"Type": "AWS::IAM::Role",
+		"Properties": map[string]interface{}{
+			"AssumeRolePolicyDocument": map[string]interface{}{
+				"Version": "2012-10-17",
+				"Statement": []interface{}{
+					map[string]interface{}{
+						"Effect":    "Allow",
+						"Principal": map[string]interface{}{"Service": "lambda.amazonaws.com"},
+						"Action":    "sts:AssumeRole",
+					},
+				},
+			},
+			"Policies": []interface{}{
+				map[string]interface{}{
+					"PolicyName": "cwl",
+					"PolicyDocument": map[string]interface{}{
+						"Version":   policy.Version,
+						"Statement": statements,
+					},
+				},
+			},
+		},
+	}
+}
+
+// samEvents converts the schedule, event, sqs and sns triggers of a manifest to
+// SAM function event sources.
+func samEvents(m *deploy.Manifest) map[string]interface{} {
+	events := make(map[string]interface{})
+	for i, t := range m.Triggers {
+		name := fmt.Sprintf("%s%d", logicalID(t.Type), i+1)
+		switch t.Type {
+		case deploy.TriggerSchedule:
+			props := map[string]interface{}{
+				"Name":     fmt.Sprintf("cwl-%s-%s", m.Name, t.Name),
+				"Schedule": t.Schedule,
+			}
+			if len(t.Input) > 0 {
+				props["Input"] = string(t.Input)
+			}
+			events[logicalID(t.Name)] = map[string]interface{}{"Type": "Schedule", "Properties": props}
+		case deploy.TriggerEvent:
+			props := map[string]interface{}{
+				"RuleName": fmt.Sprintf("cwl-%s-%s", m.Name, t.Name),
+				"Pattern":  t.Pattern,
+			}
+			if len(t.Input) > 0 {
+				props["Input"] = string(t.Input)
+			}
+			events[logicalID(t.Name)] = map[string]interface{}{"Type": "EventBridgeRule", "Properties": props}
+		case deploy.TriggerSQS:
+			props := map[string]interface{}{
+				"Queue":                 t.QueueArn,
+				"FunctionResponseTypes": []string{"ReportBatchItemFailures"},
+			}
+			if t.BatchSize > 0 {
+				props["BatchSize"] = t.BatchSize
+			}
+			events[name] = map[string]interface{}{"Type": "SQS", "Properties": props}
+		case deploy.TriggerSNS:
+			events[name] = map[string]interface{}{
+				"Type":       "SNS",
+				"Properties": map[string]interface{}{"Topic": t.TopicArn},
+			}
+		}
+	}
+	return events
+}
+
+// triggerResources returns the resources for API Gateway triggers, which
+// refer to existing HTTP APIs and so cannot be expressed as SAM events.
+func triggerResources(m *deploy.Manifest, id string) map[string]interface{} {
+	target := getAtt(id+"Function", "Arn")
+	if m.TriggerAlias != "" {
+		target = ref(id + "Function.Alias")
+	}
+
+	resources := make(map[string]interface{})
+	for i, t := range m.Triggers {
+		if t.Type != deploy.TriggerAPI {
+			continue
+		}
+		rid := fmt.Sprintf("%sApi%d", id, i+1)
+		resources[rid+"Integration"] = map[string]interface{}{
+			"Type": "AWS::ApiGatewayV2::Integration",
+			"Properties": map[string]interface{}{
+				"ApiId":                t.APIID,
+				"IntegrationType":      "AWS_PROXY",
+				"IntegrationUri":       target,
+				"PayloadFormatVersion": "2.0",
+			},
+		}
+		resources[rid+"Route"] = map[string]interface{}{
+			"Type": "AWS::ApiGatewayV2::Route",
+			"Properties": map[string]interface{}{
+				"ApiId":    t.APIID,
+				"RouteKey": t.Route,
+				"Target":   map[string]interface{}{"Fn::Sub": "integrations/${" + rid + "Integration}"},
+			},
+		}
+		resources[rid+"Permission"] = map[string]interface{}{
+			"Type": "AWS::Lambda::Permission",
+			"Properties": map[string]interface{}{
+				"Action":       "lambda:InvokeFunction",
+				"FunctionName": target,
+				"Principal":    "apigateway.amazonaws.com",
+				"SourceArn":    map[string]interface{}{"Fn::Sub": "arn:aws:execute-api:${AWS::Region}:${AWS::AccountId}:" + t.APIID + "/*"},
+			},
+		}
+	}
+	return resources
+}
+
+// stateMachine returns the AWS::Serverless::StateMachine resource for a
+// workflow defined in package asl.  The definition refers to the functions
+// of the named handlers with "${<handler>Arn}" substitution variables.
+func stateMachine(name string, def *asl.StateMachine, functionIDs map[string]string, handlers ...string) map[string]interface{} {
+	subs := make(map[string]interface{})
+	var policies []interface{}
+	for _, h := range handlers {
+		subs[h+"Arn"] = getAtt(functionIDs[h], "Arn")
+		policies = append(policies, map[string]interface{}{
+			"LambdaInvokePolicy": map[string]interface{}{"FunctionName": ref(functionIDs[h])},
+		})
+	}
+	return map[string]interface{}{
+		"Type": "AWS::Serverless::StateMachine",
+		"Properties": map[string]interface{}{
+			"Name":                    name,
+			"Definition":              def,
+			"DefinitionSubstitutions": subs,
+			"Policies":                policies,
+		},
+	}
+}
+
+// keyTable returns a DynamoDB table keyed by the string "key", such as the
+// table holding the task tokens of the callback handlers or the responses
+// of idempotent requests.  Items expire through the "expires" attribute.
+func keyTable(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"Type": "AWS::DynamoDB::Table",
+		"Properties": map[string]interface{}{
+			"TableName":   name,
+			"BillingMode": "PAY_PER_REQUEST",
+			"AttributeDefinitions": []interface{}{
+				map[string]interface{}{"AttributeName": "key", "AttributeType": "S"},
+			},
+			"KeySchema": []interface{}{
+				map[string]interface{}{"AttributeName": "key", "KeyType": "HASH"},
+			},
+			"TimeToLiveSpecification": map[string]interface{}{
+				"AttributeName": "expires",
+				"Enabled":       true,
+			},
+		},
+	}
+}
+
+// auditTable returns the DynamoDB table of an audit trail, holding an item
+// per target of each audit record.
+func auditTable(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"Type": "AWS::DynamoDB::Table",
+		"Properties": map[string]interface{}{
+			"TableName":   name,
+			"BillingMode": "PAY_PER_REQUEST",
+			"AttributeDefinitions": []interface{}{
+				map[string]interface{}{"AttributeName": "target", "AttributeType": "S"},
+				map[string]interface{}{"AttributeName": "time", "AttributeType": "S"},
+			},
+			"KeySchema": []interface{}{
+				map[string]interface{}{"AttributeName": "target", "KeyType": "HASH"},
+				map[string]interface{}{"AttributeName": "time", "KeyType": "RANGE"},
+			},
+		},
+	}
+}
+
+// logicalID converts a name to a CloudFormation logical-id.
+func logicalID(name string) string {
+	parts := nonAlnum.Split(name, -1)
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// ref returns a CloudFormation Ref intrinsic.
+func ref(id string) map[string]interface{} {
+	return map[string]interface{}{"Ref": id}
+}
+
+// getAtt returns a CloudFormation Fn::GetAtt intrinsic.
+func getAtt(id, attr string) map[string]interface{} {
+	return map[string]interface{}{"Fn::GetAtt": []string{id, attr}}
+}
+
+// ResourceIDs returns the sorted logical-ids of the template's resources.
+func (t Template) ResourceIDs() []string {
+	resources, _ := t["Resources"].(map[string]interface{})
+	var ids []string
+	for id := range resources {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}